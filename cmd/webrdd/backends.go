@@ -0,0 +1,6 @@
+package main
+
+// Capture backends register themselves with the capture package when they
+// are imported. Platform-specific backends are imported from the
+// build-tagged backends_*.go files.
+import _ "github.com/adamroach/webrd/pkg/capture/synthetic"
@@ -0,0 +1,5 @@
+//go:build cgo && darwin
+
+package main
+
+import _ "github.com/adamroach/webrd/pkg/capture/darwin"
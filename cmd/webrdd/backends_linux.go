@@ -0,0 +1,6 @@
+package main
+
+import (
+	_ "github.com/adamroach/webrd/pkg/capture/pulseaudio"
+	_ "github.com/adamroach/webrd/pkg/capture/x11"
+)
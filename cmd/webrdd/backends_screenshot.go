@@ -0,0 +1,5 @@
+//go:build !darwin || cgo
+
+package main
+
+import _ "github.com/adamroach/webrd/pkg/capture/screenshot"
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"log"
+
 	"github.com/adamroach/webrd/pkg/auth"
 	"github.com/adamroach/webrd/pkg/capture"
 	"github.com/adamroach/webrd/pkg/config"
@@ -19,18 +21,31 @@ func main() {
 		authenticator = auth.NewStaticAuthenticator(&config.Auth)
 	}
 
+	makeVideoCapturer, err := capture.VideoCapturers.Maker(config.Backends.Video, config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	makeAudioCapturer, err := capture.AudioCapturers.Maker(config.Backends.Audio, config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	makeKeyboard, err := hid.Keyboards.Maker(config.Backends.Keyboard, config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	makeMouse, err := hid.Mice.Maker(config.Backends.Mouse, config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Using backends: video=%s audio=%s keyboard=%s mouse=%s",
+		config.Backends.Video, config.Backends.Audio, config.Backends.Keyboard, config.Backends.Mouse)
+
 	server := server.Server{
-		MakeVideoCapturer: func() (capture.VideoCapturer, error) {
-			return capture.NewVideoCapturer(config.Video.Framerate)
-		},
-		MakeAudioCapturer: nil,
-		MakeKeyboard: func() (hid.Keyboard, error) {
-			return hid.NewKeyboard()
-		},
-		MakeMouse: func() (hid.Mouse, error) {
-			return hid.NewMouse()
-		},
-		Authenticator: authenticator,
+		MakeVideoCapturer: makeVideoCapturer,
+		MakeAudioCapturer: makeAudioCapturer,
+		MakeKeyboard:      makeKeyboard,
+		MakeMouse:         makeMouse,
+		Authenticator:     authenticator,
 	}
 	panic(server.Run(config))
 }
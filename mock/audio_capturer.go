@@ -5,6 +5,7 @@
 package mock
 
 import (
+	"github.com/adamroach/webrd/pkg/capture"
 	mock "github.com/stretchr/testify/mock"
 )
 
@@ -36,19 +37,19 @@ func (_m *AudioCapturer) EXPECT() *AudioCapturer_Expecter {
 }
 
 // FrameChannel provides a mock function for the type AudioCapturer
-func (_mock *AudioCapturer) FrameChannel() <-chan []byte {
+func (_mock *AudioCapturer) FrameChannel() <-chan *capture.Frame {
 	ret := _mock.Called()
 
 	if len(ret) == 0 {
 		panic("no return value specified for FrameChannel")
 	}
 
-	var r0 <-chan []byte
-	if returnFunc, ok := ret.Get(0).(func() <-chan []byte); ok {
+	var r0 <-chan *capture.Frame
+	if returnFunc, ok := ret.Get(0).(func() <-chan *capture.Frame); ok {
 		r0 = returnFunc()
 	} else {
 		if ret.Get(0) != nil {
-			r0 = ret.Get(0).(<-chan []byte)
+			r0 = ret.Get(0).(<-chan *capture.Frame)
 		}
 	}
 	return r0
@@ -71,12 +72,12 @@ func (_c *AudioCapturer_FrameChannel_Call) Run(run func()) *AudioCapturer_FrameC
 	return _c
 }
 
-func (_c *AudioCapturer_FrameChannel_Call) Return(bytesCh <-chan []byte) *AudioCapturer_FrameChannel_Call {
-	_c.Call.Return(bytesCh)
+func (_c *AudioCapturer_FrameChannel_Call) Return(frameCh <-chan *capture.Frame) *AudioCapturer_FrameChannel_Call {
+	_c.Call.Return(frameCh)
 	return _c
 }
 
-func (_c *AudioCapturer_FrameChannel_Call) RunAndReturn(run func() <-chan []byte) *AudioCapturer_FrameChannel_Call {
+func (_c *AudioCapturer_FrameChannel_Call) RunAndReturn(run func() <-chan *capture.Frame) *AudioCapturer_FrameChannel_Call {
 	_c.Call.Return(run)
 	return _c
 }
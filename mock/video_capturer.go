@@ -7,6 +7,7 @@ package mock
 import (
 	"image"
 
+	"github.com/adamroach/webrd/pkg/capture"
 	mock "github.com/stretchr/testify/mock"
 )
 
@@ -38,19 +39,19 @@ func (_m *VideoCapturer) EXPECT() *VideoCapturer_Expecter {
 }
 
 // FrameChannel provides a mock function for the type VideoCapturer
-func (_mock *VideoCapturer) FrameChannel() <-chan image.Image {
+func (_mock *VideoCapturer) FrameChannel() <-chan *capture.Frame {
 	ret := _mock.Called()
 
 	if len(ret) == 0 {
 		panic("no return value specified for FrameChannel")
 	}
 
-	var r0 <-chan image.Image
-	if returnFunc, ok := ret.Get(0).(func() <-chan image.Image); ok {
+	var r0 <-chan *capture.Frame
+	if returnFunc, ok := ret.Get(0).(func() <-chan *capture.Frame); ok {
 		r0 = returnFunc()
 	} else {
 		if ret.Get(0) != nil {
-			r0 = ret.Get(0).(<-chan image.Image)
+			r0 = ret.Get(0).(<-chan *capture.Frame)
 		}
 	}
 	return r0
@@ -73,12 +74,56 @@ func (_c *VideoCapturer_FrameChannel_Call) Run(run func()) *VideoCapturer_FrameC
 	return _c
 }
 
-func (_c *VideoCapturer_FrameChannel_Call) Return(imageCh <-chan image.Image) *VideoCapturer_FrameChannel_Call {
-	_c.Call.Return(imageCh)
+func (_c *VideoCapturer_FrameChannel_Call) Return(frameCh <-chan *capture.Frame) *VideoCapturer_FrameChannel_Call {
+	_c.Call.Return(frameCh)
 	return _c
 }
 
-func (_c *VideoCapturer_FrameChannel_Call) RunAndReturn(run func() <-chan image.Image) *VideoCapturer_FrameChannel_Call {
+func (_c *VideoCapturer_FrameChannel_Call) RunAndReturn(run func() <-chan *capture.Frame) *VideoCapturer_FrameChannel_Call {
+	_c.Call.Return(run)
+	return _c
+}
+
+// GetBounds provides a mock function for the type VideoCapturer
+func (_mock *VideoCapturer) GetBounds() image.Rectangle {
+	ret := _mock.Called()
+
+	if len(ret) == 0 {
+		panic("no return value specified for GetBounds")
+	}
+
+	var r0 image.Rectangle
+	if returnFunc, ok := ret.Get(0).(func() image.Rectangle); ok {
+		r0 = returnFunc()
+	} else {
+		r0 = ret.Get(0).(image.Rectangle)
+	}
+	return r0
+}
+
+// VideoCapturer_GetBounds_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'GetBounds'
+type VideoCapturer_GetBounds_Call struct {
+	*mock.Call
+}
+
+// GetBounds is a helper method to define mock.On call
+func (_e *VideoCapturer_Expecter) GetBounds() *VideoCapturer_GetBounds_Call {
+	return &VideoCapturer_GetBounds_Call{Call: _e.mock.On("GetBounds")}
+}
+
+func (_c *VideoCapturer_GetBounds_Call) Run(run func()) *VideoCapturer_GetBounds_Call {
+	_c.Call.Run(func(args mock.Arguments) {
+		run()
+	})
+	return _c
+}
+
+func (_c *VideoCapturer_GetBounds_Call) Return(rectangle image.Rectangle) *VideoCapturer_GetBounds_Call {
+	_c.Call.Return(rectangle)
+	return _c
+}
+
+func (_c *VideoCapturer_GetBounds_Call) RunAndReturn(run func() image.Rectangle) *VideoCapturer_GetBounds_Call {
 	_c.Call.Return(run)
 	return _c
 }
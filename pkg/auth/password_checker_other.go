@@ -0,0 +1,30 @@
+//go:build !darwin || !cgo
+
+package auth
+
+import (
+	"log"
+	"os/user"
+)
+
+// unsupportedPasswordChecker is used on platforms where we don't (yet) know
+// how to verify system passwords. It rejects every password, so system
+// authentication fails closed; use static users instead.
+type unsupportedPasswordChecker struct{}
+
+func NewPasswordChecker() PasswordChecker {
+	return &unsupportedPasswordChecker{}
+}
+
+func (p *unsupportedPasswordChecker) CurrentUser() string {
+	user, err := user.Current()
+	if err != nil {
+		return ""
+	}
+	return user.Username
+}
+
+func (p *unsupportedPasswordChecker) CheckPassword(username, password string) bool {
+	log.Printf("System password checks are not supported on this platform; set auth.use_system_auth to false")
+	return false
+}
@@ -0,0 +1,75 @@
+package backend
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/adamroach/webrd/pkg/config"
+)
+
+// Null is the name of the backend that is always available, and which
+// produces no device at all. Callers treat a zero-valued (nil) device as
+// "this feature is disabled".
+const Null = "null"
+
+type Factory[T any] func(config *config.Config) (T, error)
+
+// Registry holds the named implementations of a single kind of backend
+// (e.g., video capture). Backends register themselves from files that are
+// guarded by build tags, so the set of available names depends on the
+// platform and build options.
+type Registry[T any] struct {
+	kind      string
+	mu        sync.RWMutex // protects access to factories
+	factories map[string]Factory[T]
+}
+
+func NewRegistry[T any](kind string) *Registry[T] {
+	r := &Registry[T]{
+		kind:      kind,
+		factories: make(map[string]Factory[T]),
+	}
+	r.Register(Null, func(*config.Config) (T, error) {
+		var none T
+		return none, nil
+	})
+	return r
+}
+
+func (r *Registry[T]) Register(name string, factory Factory[T]) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.factories[name]; ok {
+		panic(fmt.Sprintf("%s backend %q registered twice", r.kind, name))
+	}
+	r.factories[name] = factory
+}
+
+// Names returns the sorted list of backends compiled into this binary.
+func (r *Registry[T]) Names() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	names := make([]string, 0, len(r.factories))
+	for name := range r.factories {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// Maker looks up the named backend, and returns a function that creates a
+// new instance of it using the provided configuration.
+func (r *Registry[T]) Maker(name string, config *config.Config) (func() (T, error), error) {
+	r.mu.RLock()
+	factory, ok := r.factories[name]
+	r.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%s backend %q is not compiled into this binary (available: %s)",
+			r.kind, name, strings.Join(r.Names(), ", "))
+	}
+	return func() (T, error) {
+		return factory(config)
+	}, nil
+}
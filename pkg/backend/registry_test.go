@@ -0,0 +1,60 @@
+package backend_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/adamroach/webrd/pkg/backend"
+	"github.com/adamroach/webrd/pkg/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type widget struct {
+	framerate int
+}
+
+func TestRegistry(t *testing.T) {
+	r := backend.NewRegistry[*widget]("widget")
+	r.Register("fast", func(c *config.Config) (*widget, error) {
+		return &widget{framerate: c.Video.Framerate}, nil
+	})
+	r.Register("broken", func(c *config.Config) (*widget, error) {
+		return nil, errors.New("broken")
+	})
+	assert.Equal(t, []string{"broken", "fast", backend.Null}, r.Names())
+
+	cfg := &config.Config{Video: config.Video{Framerate: 60}}
+	makeWidget, err := r.Maker("fast", cfg)
+	require.NoError(t, err)
+	w, err := makeWidget()
+	require.NoError(t, err)
+	assert.Equal(t, 60, w.framerate)
+
+	makeWidget, err = r.Maker("broken", cfg)
+	require.NoError(t, err)
+	_, err = makeWidget()
+	assert.Error(t, err)
+}
+
+func TestRegistry_Null(t *testing.T) {
+	r := backend.NewRegistry[*widget]("widget")
+	makeWidget, err := r.Maker(backend.Null, &config.Config{})
+	require.NoError(t, err)
+	w, err := makeWidget()
+	require.NoError(t, err)
+	assert.Nil(t, w)
+}
+
+func TestRegistry_Unknown(t *testing.T) {
+	r := backend.NewRegistry[*widget]("widget")
+	_, err := r.Maker("missing", &config.Config{})
+	assert.ErrorContains(t, err, `widget backend "missing" is not compiled into this binary (available: null)`)
+}
+
+func TestRegistry_Duplicate(t *testing.T) {
+	r := backend.NewRegistry[*widget]("widget")
+	assert.Panics(t, func() {
+		r.Register(backend.Null, func(c *config.Config) (*widget, error) { return nil, nil })
+	})
+}
@@ -1,7 +1,15 @@
 package capture
 
+// Audio capturers produce frames of interleaved, signed 16-bit little-endian
+// PCM, at AudioSampleRate samples per second per channel. Each frame's Time
+// is the capture time of its first sample.
+const (
+	AudioSampleRate = 48000
+	AudioChannels   = 2
+)
+
 type AudioCapturer interface {
 	Start() error
 	Stop() error
-	FrameChannel() <-chan []byte // TODO -- include timestamp information
+	FrameChannel() <-chan *Frame
 }
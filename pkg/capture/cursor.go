@@ -0,0 +1,45 @@
+package capture
+
+import (
+	"errors"
+	"image"
+)
+
+// ErrNoCursor is returned by CurrentCursor for capturers that can't report
+// the cursor separately from their frames.
+var ErrNoCursor = errors.New("cursor is not available")
+
+// Cursor describes the mouse pointer.
+type Cursor struct {
+	Visible bool
+	// Position is the location of the hotspot in the global coordinate
+	// space, like Display.Bounds.
+	Position image.Point
+	Shape    *CursorShape
+}
+
+// CursorShape is the image that is drawn for the cursor.
+type CursorShape struct {
+	// Serial changes whenever the shape does, so that it only needs to be
+	// sent to clients once.
+	Serial  uint64
+	Image   *image.NRGBA
+	Hotspot image.Point // relative to Image.Bounds().Min
+}
+
+// CursorCapturer is implemented by VideoCapturers that can report the
+// cursor, so that clients can draw it themselves instead of waiting for it
+// to show up in the video.
+type CursorCapturer interface {
+	VideoCapturer
+	Cursor() (Cursor, error)
+}
+
+// CurrentCursor returns the state of the cursor, or ErrNoCursor if capturer
+// doesn't implement CursorCapturer.
+func CurrentCursor(capturer VideoCapturer) (Cursor, error) {
+	if c, ok := capturer.(CursorCapturer); ok {
+		return c.Cursor()
+	}
+	return Cursor{}, ErrNoCursor
+}
@@ -0,0 +1,257 @@
+package capture
+
+import (
+	"bytes"
+	"image"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// DamageTracker wraps a VideoCapturer, and compares each frame to the one
+// before it in square tiles. The changed regions are reported in each frame's
+// Damage field. Frames without any changes are dropped, except that one is
+// let through every idle interval so that the stream doesn't stall entirely.
+type DamageTracker struct {
+	capturer     VideoCapturer
+	frames       chan (*Frame)
+	tileSize     int
+	idleInterval time.Duration // zero means unchanged frames are never sent
+	previous     *image.YCbCr
+	lastSent     time.Time
+	skipped      atomic.Uint64
+	refresh      atomic.Bool
+}
+
+// NewDamageTracker creates a DamageTracker that compares frames in tiles of
+// tileSize x tileSize pixels, and sends unchanged frames at no more than
+// idleFramerate frames per second.
+func NewDamageTracker(capturer VideoCapturer, tileSize int, idleFramerate int) *DamageTracker {
+	d := &DamageTracker{
+		capturer: capturer,
+		frames:   make(chan *Frame, 1),
+		tileSize: tileSize,
+	}
+	if idleFramerate > 0 {
+		d.idleInterval = time.Second / time.Duration(idleFramerate)
+	}
+	return d
+}
+
+func (d *DamageTracker) Start() error {
+	if err := d.capturer.Start(); err != nil {
+		return err
+	}
+	go d.run()
+	return nil
+}
+
+func (d *DamageTracker) Stop() error {
+	return d.capturer.Stop()
+}
+
+func (d *DamageTracker) GetBounds() image.Rectangle {
+	return d.capturer.GetBounds()
+}
+
+func (d *DamageTracker) FrameChannel() <-chan *Frame {
+	return d.frames
+}
+
+func (d *DamageTracker) Displays() ([]Display, error) {
+	return Displays(d.capturer)
+}
+
+func (d *DamageTracker) CurrentDisplay() Display {
+	return CurrentDisplay(d.capturer)
+}
+
+func (d *DamageTracker) SelectDisplay(id int) error {
+	return SelectDisplay(d.capturer, id)
+}
+
+func (d *DamageTracker) Cursor() (Cursor, error) {
+	return CurrentCursor(d.capturer)
+}
+
+func (d *DamageTracker) Dropped() uint64 {
+	return DroppedFrames(d.capturer)
+}
+
+// Refresh lets the next frame through even if it is unchanged, e.g. so that
+// a keyframe can be produced for a new viewer without waiting for the idle
+// interval to elapse.
+func (d *DamageTracker) Refresh() {
+	d.refresh.Store(true)
+}
+
+// Skipped returns the number of unchanged frames that have been dropped.
+func (d *DamageTracker) Skipped() uint64 {
+	return d.skipped.Load()
+}
+
+func (d *DamageTracker) run() {
+	defer close(d.frames)
+	idle := false
+	for frame := range d.capturer.FrameChannel() {
+		if frame.Damage == nil {
+			frame.Damage = d.compare(frame.Image)
+		} else {
+			d.update(frame.Image, frame.Damage)
+		}
+		if len(frame.Damage) == 0 {
+			idleTimeout := d.idleInterval > 0 && frame.Time.Sub(d.lastSent) >= d.idleInterval
+			if !d.refresh.Swap(false) && !idleTimeout {
+				if !idle {
+					log.Printf("Screen is idle; reducing framerate")
+					idle = true
+				}
+				d.skipped.Add(1)
+				frame.Release()
+				continue
+			}
+		} else if idle {
+			log.Printf("Screen changed; resuming full framerate (%d frames skipped so far)", d.Skipped())
+			idle = false
+		}
+		d.lastSent = frame.Time
+		d.frames <- frame
+	}
+}
+
+// compare returns the regions of img that differ from the previous image
+// and remembers img for the next comparison. Images that can't be compared
+// are reported as entirely damaged.
+func (d *DamageTracker) compare(img image.Image) []image.Rectangle {
+	current, ok := img.(*image.YCbCr)
+	if !ok {
+		d.previous = nil
+		return []image.Rectangle{img.Bounds()}
+	}
+	if !d.replace(current) {
+		return []image.Rectangle{current.Rect}
+	}
+	damage := DiffTiles(d.previous, current, d.tileSize)
+	for _, rect := range damage {
+		copyRegion(d.previous, current, rect)
+	}
+	return damage
+}
+
+// update remembers img for the next comparison, given the damage that the
+// capturer reported for it. Only the damaged regions are copied.
+func (d *DamageTracker) update(img image.Image, damage []image.Rectangle) {
+	current, ok := img.(*image.YCbCr)
+	if !ok {
+		d.previous = nil
+		return
+	}
+	if !d.replace(current) {
+		return
+	}
+	for _, rect := range damage {
+		copyRegion(d.previous, current, rect.Intersect(current.Rect))
+	}
+}
+
+// replace starts the previous image over as a copy of current if the two
+// can't be compared, and reports whether they could.
+func (d *DamageTracker) replace(current *image.YCbCr) bool {
+	if d.previous != nil && d.previous.Rect == current.Rect && d.previous.SubsampleRatio == current.SubsampleRatio {
+		return true
+	}
+	d.previous = image.NewYCbCr(current.Rect, current.SubsampleRatio)
+	copyRegion(d.previous, current, current.Rect)
+	return false
+}
+
+// DiffTiles compares two images of the same size and subsampling ratio in
+// tiles, and returns the tiles that differ. Adjacent tiles are merged into
+// larger rectangles. An empty (non-nil) result means the images are
+// identical.
+func DiffTiles(a, b *image.YCbCr, tileSize int) []image.Rectangle {
+	bounds := b.Rect
+	columns := (bounds.Dx() + tileSize - 1) / tileSize
+	rows := (bounds.Dy() + tileSize - 1) / tileSize
+	dirty := make([]bool, columns*rows)
+
+	for row := range rows {
+		tileTop := bounds.Min.Y + row*tileSize
+		tileBottom := min(tileTop+tileSize, bounds.Max.Y)
+		for column := range columns {
+			tileLeft := bounds.Min.X + column*tileSize
+			tileRight := min(tileLeft+tileSize, bounds.Max.X)
+			dirty[row*columns+column] = tileDiffers(a, b, image.Rect(tileLeft, tileTop, tileRight, tileBottom))
+		}
+	}
+	return mergeTiles(dirty, columns, rows, tileSize, bounds)
+}
+
+func tileDiffers(a, b *image.YCbCr, tile image.Rectangle) bool {
+	width := tile.Dx()
+	for y := tile.Min.Y; y < tile.Max.Y; y++ {
+		aOffset := a.YOffset(tile.Min.X, y)
+		bOffset := b.YOffset(tile.Min.X, y)
+		if !bytes.Equal(a.Y[aOffset:aOffset+width], b.Y[bOffset:bOffset+width]) {
+			return true
+		}
+		// Check chroma on the rows where a new chroma row starts
+		if y == tile.Min.Y || b.COffset(tile.Min.X, y) != b.COffset(tile.Min.X, y-1) {
+			aStart, aEnd := a.COffset(tile.Min.X, y), a.COffset(tile.Max.X-1, y)+1
+			bStart, bEnd := b.COffset(tile.Min.X, y), b.COffset(tile.Max.X-1, y)+1
+			if !bytes.Equal(a.Cb[aStart:aEnd], b.Cb[bStart:bEnd]) || !bytes.Equal(a.Cr[aStart:aEnd], b.Cr[bStart:bEnd]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// mergeTiles turns runs of dirty tiles in each row into rectangles, and then
+// merges rectangles in consecutive rows that span the same columns.
+func mergeTiles(dirty []bool, columns, rows, tileSize int, bounds image.Rectangle) []image.Rectangle {
+	damage := []image.Rectangle{}
+	open := map[[2]int]int{} // [first, last] column span -> index into damage, for the previous row
+	for row := range rows {
+		next := map[[2]int]int{}
+		for column := 0; column < columns; column++ {
+			if !dirty[row*columns+column] {
+				continue
+			}
+			first := column
+			for column+1 < columns && dirty[row*columns+column+1] {
+				column++
+			}
+			rect := image.Rect(
+				bounds.Min.X+first*tileSize, bounds.Min.Y+row*tileSize,
+				bounds.Min.X+(column+1)*tileSize, bounds.Min.Y+(row+1)*tileSize,
+			).Intersect(bounds)
+			span := [2]int{first, column}
+			if i, ok := open[span]; ok {
+				damage[i].Max.Y = rect.Max.Y
+				next[span] = i
+			} else {
+				next[span] = len(damage)
+				damage = append(damage, rect)
+			}
+		}
+		open = next
+	}
+	return damage
+}
+
+// copyRegion copies the pixels in rect from src to dst, which have the same
+// bounds and subsampling ratio. With subsampled chroma, the chroma samples
+// that rect touches are copied whole.
+func copyRegion(dst, src *image.YCbCr, rect image.Rectangle) {
+	if rect.Empty() {
+		return
+	}
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		copy(dst.Y[dst.YOffset(rect.Min.X, y):], src.Y[src.YOffset(rect.Min.X, y):src.YOffset(rect.Max.X-1, y)+1])
+		start := src.COffset(rect.Min.X, y)
+		end := src.COffset(rect.Max.X-1, y) + 1
+		copy(dst.Cb[dst.COffset(rect.Min.X, y):], src.Cb[start:end])
+		copy(dst.Cr[dst.COffset(rect.Min.X, y):], src.Cr[start:end])
+	}
+}
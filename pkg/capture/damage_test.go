@@ -0,0 +1,170 @@
+package capture_test
+
+import (
+	"image"
+	"testing"
+	"time"
+
+	"github.com/adamroach/webrd/mock"
+	"github.com/adamroach/webrd/pkg/capture"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestImage() *image.YCbCr {
+	return image.NewYCbCr(image.Rect(0, 0, 200, 100), image.YCbCrSubsampleRatio420)
+}
+
+func TestDiffTiles_Identical(t *testing.T) {
+	damage := capture.DiffTiles(newTestImage(), newTestImage(), 64)
+	assert.NotNil(t, damage)
+	assert.Empty(t, damage)
+}
+
+func TestDiffTiles_SinglePixel(t *testing.T) {
+	a, b := newTestImage(), newTestImage()
+	b.Y[b.YOffset(70, 10)] = 255
+	assert.Equal(t, []image.Rectangle{image.Rect(64, 0, 128, 64)}, capture.DiffTiles(a, b, 64))
+}
+
+func TestDiffTiles_ChromaOnly(t *testing.T) {
+	a, b := newTestImage(), newTestImage()
+	b.Cb[b.COffset(199, 99)] = 1
+	// The last tile is clipped to the image bounds
+	assert.Equal(t, []image.Rectangle{image.Rect(192, 64, 200, 100)}, capture.DiffTiles(a, b, 64))
+}
+
+func TestDiffTiles_MergesAdjacentTiles(t *testing.T) {
+	a, b := newTestImage(), newTestImage()
+	for _, pt := range []image.Point{{0, 0}, {70, 0}, {0, 70}, {70, 70}} {
+		b.Y[b.YOffset(pt.X, pt.Y)] = 255
+	}
+	assert.Equal(t, []image.Rectangle{image.Rect(0, 0, 128, 100)}, capture.DiffTiles(a, b, 64))
+}
+
+func TestDiffTiles_DifferentStrides(t *testing.T) {
+	a := newTestImage()
+	b := image.NewYCbCr(image.Rect(0, 0, 300, 100), image.YCbCrSubsampleRatio420).SubImage(a.Rect).(*image.YCbCr)
+	assert.Empty(t, capture.DiffTiles(a, b, 64))
+	b.Y[b.YOffset(150, 50)] = 255
+	assert.Equal(t, []image.Rectangle{image.Rect(128, 0, 192, 64)}, capture.DiffTiles(a, b, 64))
+}
+
+func TestDamageTracker(t *testing.T) {
+	frames := make(chan *capture.Frame)
+	capturer := mock.NewVideoCapturer(t)
+	capturer.EXPECT().Start().Return(nil)
+	capturer.EXPECT().FrameChannel().Return(frames)
+
+	// One idle frame per second
+	tracker := capture.NewDamageTracker(capturer, 64, 1)
+	require.NoError(t, tracker.Start())
+
+	start := time.Now()
+	send := func(img *image.YCbCr, offset time.Duration) {
+		frames <- &capture.Frame{Image: img, Time: start.Add(offset)}
+	}
+	receive := func() *capture.Frame {
+		select {
+		case frame := <-tracker.FrameChannel():
+			return frame
+		case <-time.After(time.Second):
+			require.FailNow(t, "timed out waiting for frame")
+			return nil
+		}
+	}
+
+	// The first frame is entirely damaged
+	img := newTestImage()
+	send(img, 0)
+	assert.Equal(t, []image.Rectangle{img.Rect}, receive().Damage)
+
+	// Unchanged frames are skipped until the idle interval has passed
+	send(newTestImage(), 100*time.Millisecond)
+	send(newTestImage(), 200*time.Millisecond)
+	send(newTestImage(), time.Second)
+	frame := receive()
+	assert.Equal(t, start.Add(time.Second), frame.Time)
+	assert.Empty(t, frame.Damage)
+	assert.Equal(t, uint64(2), tracker.Skipped())
+
+	// Changes are sent immediately
+	changed := newTestImage()
+	changed.Y[changed.YOffset(0, 0)] = 255
+	send(changed, 1100*time.Millisecond)
+	assert.Equal(t, []image.Rectangle{image.Rect(0, 0, 64, 64)}, receive().Damage)
+
+	// Damage reported by the capturer is passed through untouched
+	reported := []image.Rectangle{image.Rect(10, 10, 20, 20)}
+	frames <- &capture.Frame{Image: changed, Time: start.Add(1200 * time.Millisecond), Damage: reported}
+	assert.Equal(t, reported, receive().Damage)
+
+	close(frames)
+	_, ok := <-tracker.FrameChannel()
+	assert.False(t, ok)
+}
+
+func TestDamageTracker_Refresh(t *testing.T) {
+	frames := make(chan *capture.Frame)
+	capturer := mock.NewVideoCapturer(t)
+	capturer.EXPECT().Start().Return(nil)
+	capturer.EXPECT().FrameChannel().Return(frames)
+
+	// Unchanged frames are never sent unless a refresh is requested
+	tracker := capture.NewDamageTracker(capturer, 64, 0)
+	require.NoError(t, tracker.Start())
+
+	start := time.Now()
+	frames <- &capture.Frame{Image: newTestImage(), Time: start}
+	<-tracker.FrameChannel()
+
+	// The second send only completes once the first frame has been handled
+	frames <- &capture.Frame{Image: newTestImage(), Time: start.Add(time.Hour)}
+	frames <- &capture.Frame{Image: newTestImage(), Time: start.Add(2 * time.Hour)}
+	tracker.Refresh()
+	frames <- &capture.Frame{Image: newTestImage(), Time: start.Add(3 * time.Hour)}
+	frame := <-tracker.FrameChannel()
+	assert.Equal(t, start.Add(3*time.Hour), frame.Time)
+	assert.Equal(t, uint64(2), tracker.Skipped())
+	close(frames)
+}
+
+func TestDamageTracker_ReportedDamage(t *testing.T) {
+	frames := make(chan *capture.Frame)
+	capturer := mock.NewVideoCapturer(t)
+	capturer.EXPECT().Start().Return(nil)
+	capturer.EXPECT().FrameChannel().Return(frames)
+	tracker := capture.NewDamageTracker(capturer, 64, 0)
+	require.NoError(t, tracker.Start())
+	defer close(frames)
+
+	start := time.Now()
+	send := func(frame *capture.Frame) []image.Rectangle {
+		frame.Time = start
+		frames <- frame
+		select {
+		case frame := <-tracker.FrameChannel():
+			return frame.Damage
+		case <-time.After(time.Second):
+			require.FailNow(t, "timed out waiting for frame")
+			return nil
+		}
+	}
+	send(&capture.Frame{Image: newTestImage()})
+
+	// A change that the capturer reports itself is remembered, so that the
+	// next comparison only finds what changed after it
+	first := newTestImage()
+	first.Y[first.YOffset(10, 10)] = 255
+	reported := []image.Rectangle{image.Rect(8, 8, 16, 16)}
+	assert.Equal(t, reported, send(&capture.Frame{Image: first, Damage: reported}))
+	second := newTestImage()
+	second.Y[second.YOffset(10, 10)] = 255
+	second.Y[second.YOffset(150, 80)] = 255
+	assert.Equal(t, []image.Rectangle{image.Rect(128, 64, 192, 100)}, send(&capture.Frame{Image: second}))
+
+	// Undoing a change is a change too
+	third := newTestImage()
+	third.Y[third.YOffset(10, 10)] = 255
+	assert.Equal(t, []image.Rectangle{image.Rect(128, 64, 192, 100)}, send(&capture.Frame{Image: third}))
+}
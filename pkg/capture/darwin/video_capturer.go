@@ -4,8 +4,9 @@ package darwin
 
 /*
 #cgo CFLAGS: -x objective-c
-#cgo LDFLAGS: -framework CoreGraphics -framework CoreFoundation -framework AVFoundation -framework Foundation -framework CoreMedia -framework CoreVideo
+#cgo LDFLAGS: -framework CoreGraphics -framework CoreFoundation -framework AVFoundation -framework Foundation -framework CoreMedia -framework CoreVideo -framework AppKit
 
+#include <stdlib.h>
 #import "video_capturer.h"
 
 static void* newVideoCapturer(){
@@ -20,9 +21,18 @@ static void releaseVideoCapturer(void *capturer){
 	[(VideoCapturer *)capturer release];
 }
 
-static void startVideoCapture(void *capturer, int fps, uint64 opaque) {
-	NSLog(@"Starting capture with capturer %p @ %d fps", capturer, fps);
-	[(VideoCapturer *)capturer start:(void *)opaque fps:fps];
+static void startVideoCapture(void *capturer, int fps, CGDirectDisplayID displayId, int fullRange, int cursor, uint64 opaque) {
+	NSLog(@"Starting capture of display %u with capturer %p @ %d fps", displayId, capturer, fps);
+	[(VideoCapturer *)capturer start:(void *)opaque fps:fps displayId:displayId fullRange:fullRange != 0 cursor:cursor != 0];
+}
+
+// Returns the position of the cursor, in the same global coordinates as
+// CGDisplayBounds
+static CGPoint getCursorLocation() {
+	CGEventRef event = CGEventCreate(NULL);
+	CGPoint location = CGEventGetLocation(event);
+	CFRelease(event);
+	return location;
 }
 
 static void stopVideoCapture(void *capturer) {
@@ -30,30 +40,95 @@ static void stopVideoCapture(void *capturer) {
 	[(VideoCapturer *)capturer stop];
 }
 
+static int getActiveDisplays(CGDirectDisplayID *ids, int max) {
+	uint32_t count = 0;
+	if (CGGetActiveDisplayList(max, ids, &count) != kCGErrorSuccess) {
+		return 0;
+	}
+	return count;
+}
+
+// Returns the number of pixels per point for the given display
+static double getDisplayScale(CGDirectDisplayID displayId) {
+	CGDisplayModeRef mode = CGDisplayCopyDisplayMode(displayId);
+	if (!mode) {
+		return 1;
+	}
+	double scale = (double)CGDisplayModeGetPixelWidth(mode) / (double)CGDisplayModeGetWidth(mode);
+	CGDisplayModeRelease(mode);
+	return scale;
+}
+
 */
 import "C"
 import (
+	"fmt"
+	"hash/fnv"
 	"image"
 	"runtime"
 	"sync"
+	"time"
 	"unsafe"
+
+	"github.com/adamroach/webrd/pkg/capture"
+	"github.com/adamroach/webrd/pkg/imageconvert"
 )
 
 type VideoCapturer struct {
-	capturer  unsafe.Pointer // Can't use C.VideoCapturer because objective-C objects aren't handled completely by Go
-	frames    chan (image.Image)
-	framerate int
-	bounds    image.Rectangle
-	mu        sync.RWMutex // protects access to coordinates
+	capturer   unsafe.Pointer // Can't use C.VideoCapturer because objective-C objects aren't handled completely by Go
+	frames     *capture.FrameSlot
+	pool       *capture.FramePool
+	framerate  int
+	fullRange  bool
+	drawCursor bool
+	sequence   uint64
+	bounds     image.Rectangle
+	selected   capture.Display
+	running    bool
+	shape      *capture.CursorShape
+	mu         sync.RWMutex // protects access to coordinates, selected, running and shape
+}
+
+// WithFormat sets the range of the captured frames. AVFoundation decides
+// the color matrix itself.
+func WithFormat(format capture.VideoFormat) func(*VideoCapturer) error {
+	return func(c *VideoCapturer) error {
+		c.fullRange = format.ColorSpace.FullRange
+		return nil
+	}
+}
+
+// WithDrawCursor controls whether the cursor is drawn into the captured
+// frames. By default, it is only reported through Cursor.
+func WithDrawCursor(draw bool) func(*VideoCapturer) error {
+	return func(c *VideoCapturer) error {
+		c.drawCursor = draw
+		return nil
+	}
 }
 
-func NewVideoCapturer(framerate int) (*VideoCapturer, error) {
+func NewVideoCapturer(framerate int, opts ...func(*VideoCapturer) error) (*VideoCapturer, error) {
 	c := &VideoCapturer{
 		capturer:  C.newVideoCapturer(),
-		frames:    make(chan image.Image, 4),
+		frames:    capture.NewFrameSlot(),
+		pool:      capture.NewFramePool(),
 		framerate: framerate,
 	}
+	for _, opt := range opts {
+		if err := opt(c); err != nil {
+			C.releaseVideoCapturer(c.capturer)
+			return nil, err
+		}
+	}
 	runtime.SetFinalizer(c, func(c *VideoCapturer) { C.releaseVideoCapturer(c.capturer) })
+	displays, err := c.Displays()
+	if err != nil {
+		return nil, err
+	}
+	c.selected, err = capture.PrimaryDisplay(displays)
+	if err != nil {
+		return nil, err
+	}
 	return c, nil
 }
 
@@ -70,30 +145,153 @@ func (c *VideoCapturer) Start() error {
 	// on the VideoCapturer.
 
 	// TODO: error handling
-	C.startVideoCapture(c.capturer, C.int(c.framerate), C.uint64(uintptr(unsafe.Pointer(c))))
+	c.mu.Lock()
+	c.running = true
+	c.mu.Unlock()
+	c.start()
 	return nil
 }
 
+// start begins capturing the selected display. It must not be called with
+// c.mu held, since stopping a running session waits for any frame that is
+// being processed.
+func (c *VideoCapturer) start() {
+	displayId := C.CGDirectDisplayID(c.CurrentDisplay().ID)
+	fullRange, drawCursor := 0, 0
+	if c.fullRange {
+		fullRange = 1
+	}
+	if c.drawCursor {
+		drawCursor = 1
+	}
+	C.startVideoCapture(c.capturer, C.int(c.framerate), displayId, C.int(fullRange), C.int(drawCursor), C.uint64(uintptr(unsafe.Pointer(c))))
+}
+
 func (c *VideoCapturer) Stop() error {
+	c.mu.Lock()
+	c.running = false
+	c.mu.Unlock()
 	C.stopVideoCapture(c.capturer)
 	return nil
 }
 
+func (c *VideoCapturer) Displays() ([]capture.Display, error) {
+	var ids [32]C.CGDirectDisplayID
+	count := int(C.getActiveDisplays(&ids[0], C.int(len(ids))))
+	if count == 0 {
+		return nil, fmt.Errorf("no active displays")
+	}
+	displays := make([]capture.Display, count)
+	for i, id := range ids[:count] {
+		// CGDisplayBounds is in points, which is what mouse events use
+		rect := C.CGDisplayBounds(id)
+		x, y := int(rect.origin.x), int(rect.origin.y)
+		displays[i] = capture.Display{
+			ID:      int(id),
+			Name:    fmt.Sprintf("Display %d", i+1),
+			Primary: C.CGDisplayIsMain(id) != 0,
+			Bounds:  image.Rect(x, y, x+int(rect.size.width), y+int(rect.size.height)),
+			Scale:   float64(C.getDisplayScale(id)),
+		}
+	}
+	return displays, nil
+}
+
+func (c *VideoCapturer) CurrentDisplay() capture.Display {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.selected
+}
+
+// SelectDisplay switches to another display. AVCaptureScreenInput is bound
+// to a single display, so a running capture session is restarted.
+func (c *VideoCapturer) SelectDisplay(id int) error {
+	displays, err := c.Displays()
+	if err != nil {
+		return err
+	}
+	display, err := capture.FindDisplay(displays, id)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.selected = display
+	running := c.running
+	c.mu.Unlock()
+	if running {
+		c.start()
+	}
+	return nil
+}
+
 func (c *VideoCapturer) GetBounds() image.Rectangle {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
 	return c.bounds
 }
 
-func (c *VideoCapturer) processFrame(img image.Image) {
+func (c *VideoCapturer) processFrame(frame *capture.Frame, colorSpace imageconvert.ColorSpace, captureTime time.Time) {
 	c.mu.Lock()
-	c.bounds = img.Bounds()
+	c.bounds = frame.Image.Bounds()
 	c.mu.Unlock()
-	c.frames <- img
+	c.sequence++
+	frame.Time = captureTime
+	frame.Sequence = c.sequence
+	frame.ColorSpace = colorSpace
+	c.frames.Put(frame)
+}
+
+// Cursor returns the cursor's position and shape. macOS doesn't number
+// cursor shapes, so the serial is a hash of the image.
+func (c *VideoCapturer) Cursor() (capture.Cursor, error) {
+	location := C.getCursorLocation()
+	cursor := capture.Cursor{
+		Visible:  true,
+		Position: image.Pt(int(location.x), int(location.y)),
+	}
+
+	var pixels *C.uint8_t
+	var width, height, hotX, hotY C.int
+	if C.copy_cursor_image(&pixels, &width, &height, &hotX, &hotY) == 0 {
+		cursor.Visible = false
+		return cursor, nil
+	}
+	premultiplied := C.GoBytes(unsafe.Pointer(pixels), width*height*4)
+	C.free(unsafe.Pointer(pixels))
+	hotspot := image.Pt(int(hotX), int(hotY))
+	hash := fnv.New64a()
+	hash.Write(premultiplied)
+	fmt.Fprint(hash, hotspot)
+	serial := hash.Sum64()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.shape == nil || c.shape.Serial != serial {
+		img := image.NewNRGBA(image.Rect(0, 0, int(width), int(height)))
+		for i := 0; i < len(premultiplied); i += 4 {
+			a := uint32(premultiplied[i+3])
+			if a == 0 {
+				continue
+			}
+			for j := range 3 {
+				img.Pix[i+j] = uint8(min(uint32(premultiplied[i+j])*255/a, 255))
+			}
+			img.Pix[i+3] = uint8(a)
+		}
+		c.shape = &capture.CursorShape{Serial: serial, Image: img, Hotspot: hotspot}
+	}
+	cursor.Shape = c.shape
+	return cursor, nil
 }
 
-func (c *VideoCapturer) FrameChannel() <-chan image.Image {
-	return c.frames
+func (c *VideoCapturer) FrameChannel() <-chan *capture.Frame {
+	return c.frames.FrameChannel()
+}
+
+// Dropped returns the number of frames that were replaced by newer ones
+// before they were consumed.
+func (c *VideoCapturer) Dropped() uint64 {
+	return c.frames.Dropped()
 }
 
 //export process_yuv_frame
@@ -106,19 +304,35 @@ func process_yuv_frame(
 	cStride C.int,
 	width C.int,
 	height C.int,
+	matrix C.int,
+	fullRange C.int,
 ) {
+	captureTime := time.Now()
 	c := (*VideoCapturer)(opaque)
-	img := &image.YCbCr{
-		Y:              C.GoBytes(y, yStride*height),
-		Cb:             C.GoBytes(cb, cStride*height/2),
-		Cr:             C.GoBytes(cr, cStride*height/2),
-		YStride:        int(yStride),
-		CStride:        int(cStride),
-		SubsampleRatio: image.YCbCrSubsampleRatio420,
-		Rect: image.Rectangle{
-			Min: image.Point{0, 0},
-			Max: image.Point{int(width), int(height)},
-		},
-	}
-	c.processFrame(img)
+	// The planes belong to the sample buffer, which is only valid until we
+	// return, so they are copied into a pooled image
+	frame := c.pool.Get(image.Rect(0, 0, int(width), int(height)), image.YCbCrSubsampleRatio420)
+	img := frame.Image.(*image.YCbCr)
+	chromaWidth, chromaHeight := (int(width)+1)/2, (int(height)+1)/2
+	copyPlane(img.Y, img.YStride, y, int(yStride), int(width), int(height))
+	copyPlane(img.Cb, img.CStride, cb, int(cStride), chromaWidth, chromaHeight)
+	copyPlane(img.Cr, img.CStride, cr, int(cStride), chromaWidth, chromaHeight)
+	// The matrix comes from the frame's attachments, and matches the values
+	// of imageconvert.Matrix
+	colorSpace := imageconvert.ColorSpace{
+		Matrix:    imageconvert.Matrix(matrix),
+		FullRange: fullRange != 0,
+	}
+	c.processFrame(frame, colorSpace, captureTime)
+}
+
+// copyPlane copies width x height samples from a C image plane.
+func copyPlane(dst []byte, dstStride int, src unsafe.Pointer, srcStride, width, height int) {
+	if height == 0 {
+		return
+	}
+	data := unsafe.Slice((*byte)(src), srcStride*(height-1)+width)
+	for row := range height {
+		copy(dst[row*dstStride:row*dstStride+width], data[row*srcStride:])
+	}
 }
@@ -1,6 +1,7 @@
 #import <AVFoundation/AVFoundation.h>
 #import <CoreMedia/CoreMedia.h>
 #import <CoreVideo/CoreVideo.h>
+#import <AppKit/AppKit.h>
 #import <Foundation/Foundation.h>
 
 @interface VideoCapturer
@@ -10,9 +11,20 @@
     AVCaptureVideoDataOutput *mVideoDataOutput;
     dispatch_queue_t mVideoDataOutputQueue;
     void *mCallbackOpaque;
+    BOOL mFullRange;
 }
 
-- (void)start:(void *)opaque fps:(int)fps;
+- (void)start:(void *)opaque
+          fps:(int)fps
+    displayId:(CGDirectDisplayID)displayId
+    fullRange:(BOOL)fullRange
+       cursor:(BOOL)cursor;
 - (void)stop;
 
-@end
\ No newline at end of file
+@end
+
+// Copies the current cursor image as premultiplied RGBA, with the hotspot
+// in pixels. Returns 0 if there is no cursor; otherwise, the caller must
+// free *pixels.
+int copy_cursor_image(uint8_t **pixels, int *width, int *height, int *hotX,
+                      int *hotY);
@@ -4,14 +4,39 @@
 #include <CoreVideo/CVPixelBuffer.h>
 
 extern void process_yuv_frame(void *opaque, void *y, void *cb, void *cr,
-                              int yStride, int cStride, int width, int height);
+                              int yStride, int cStride, int width, int height,
+                              int matrix, int fullRange);
+
+// Matrix values understood by process_yuv_frame; these match
+// imageconvert.Matrix
+enum { MatrixUnspecified = 0, MatrixBT601 = 1, MatrixBT709 = 2 };
+
+static int getMatrix(CVImageBufferRef img) {
+    CFTypeRef matrix =
+        CVBufferGetAttachment(img, kCVImageBufferYCbCrMatrixKey, NULL);
+    if (!matrix) {
+        return MatrixUnspecified;
+    }
+    if (CFEqual(matrix, kCVImageBufferYCbCrMatrix_ITU_R_709_2)) {
+        return MatrixBT709;
+    }
+    if (CFEqual(matrix, kCVImageBufferYCbCrMatrix_ITU_R_601_4)) {
+        return MatrixBT601;
+    }
+    return MatrixUnspecified;
+}
 
 @implementation VideoCapturer
-- (void)start:(void *)opaque fps:(int)fps {
+- (void)start:(void *)opaque
+          fps:(int)fps
+    displayId:(CGDirectDisplayID)displayId
+    fullRange:(BOOL)fullRange
+       cursor:(BOOL)cursor {
     if (mSession) {
         [self stop];
     }
     mCallbackOpaque = opaque;
+    mFullRange = fullRange;
 
     // Create a capture session
     mSession = [[AVCaptureSession alloc] init];
@@ -19,11 +44,6 @@ extern void process_yuv_frame(void *opaque, void *y, void *cb, void *cr,
     // Set the session preset as you wish
     mSession.sessionPreset = AVCaptureSessionPresetHigh;
 
-    // If you're on a multi-display system and you want to capture a secondary
-    // display, you can call CGGetActiveDisplayList() to get the list of all
-    // active displays.
-    CGDirectDisplayID displayId = kCGDirectMainDisplay;
-
     // Create a ScreenInput with the display and add it to the session
     AVCaptureScreenInput *input = [[[AVCaptureScreenInput alloc]
         initWithDisplayID:displayId] autorelease];
@@ -33,6 +53,7 @@ extern void process_yuv_frame(void *opaque, void *y, void *cb, void *cr,
         return;
     }
     input.minFrameDuration = CMTimeMake(1, fps);
+    input.capturesCursor = cursor;
     if ([mSession canAddInput:input])
         [mSession addInput:input];
 
@@ -41,7 +62,10 @@ extern void process_yuv_frame(void *opaque, void *y, void *cb, void *cr,
     // Set up the video capture delegate
     NSDictionary *outputSettings = [NSDictionary
         dictionaryWithObject:
-            [NSNumber numberWithInt:kCVPixelFormatType_420YpCbCr8Planar]
+            [NSNumber
+                numberWithInt:fullRange
+                                  ? kCVPixelFormatType_420YpCbCr8PlanarFullRange
+                                  : kCVPixelFormatType_420YpCbCr8Planar]
                       forKey:(id)kCVPixelBufferPixelFormatTypeKey];
     [mVideoDataOutput setVideoSettings:outputSettings];
     [mVideoDataOutput setAlwaysDiscardsLateVideoFrames:YES];
@@ -113,7 +137,7 @@ extern void process_yuv_frame(void *opaque, void *y, void *cb, void *cr,
     int Height = CVPixelBufferGetHeight(img);
 
     process_yuv_frame(mCallbackOpaque, Y, Cb, Cr, YStride, CStride, Width,
-                      Height);
+                      Height, getMatrix(img), mFullRange);
 
     CVPixelBufferUnlockBaseAddress(img, 0);
 }
@@ -123,4 +147,46 @@ extern void process_yuv_frame(void *opaque, void *y, void *cb, void *cr,
                fromConnection:(AVCaptureConnection *)connection {
     NSLog(@"dropped capture");
 }
-@end
\ No newline at end of file
+@end
+
+int copy_cursor_image(uint8_t **pixels, int *width, int *height, int *hotX,
+                      int *hotY) {
+    @autoreleasepool {
+        NSCursor *cursor = [NSCursor currentSystemCursor];
+        if (!cursor) {
+            return 0;
+        }
+        NSImage *image = [cursor image];
+        CGImageRef cgImage = [image CGImageForProposedRect:NULL
+                                                   context:nil
+                                                     hints:nil];
+        if (!cgImage) {
+            return 0;
+        }
+        size_t w = CGImageGetWidth(cgImage);
+        size_t h = CGImageGetHeight(cgImage);
+        uint8_t *buffer = calloc(w * h, 4);
+        CGColorSpaceRef colorSpace = CGColorSpaceCreateDeviceRGB();
+        CGContextRef context = CGBitmapContextCreate(
+            buffer, w, h, 8, w * 4, colorSpace,
+            kCGImageAlphaPremultipliedLast | kCGBitmapByteOrder32Big);
+        CGColorSpaceRelease(colorSpace);
+        if (!context) {
+            free(buffer);
+            return 0;
+        }
+        CGContextDrawImage(context, CGRectMake(0, 0, w, h), cgImage);
+        CGContextRelease(context);
+
+        // The hotspot is in points, and the image may have more pixels
+        // than that on Retina displays
+        NSSize size = [image size];
+        NSPoint hotSpot = [cursor hotSpot];
+        *pixels = buffer;
+        *width = (int)w;
+        *height = (int)h;
+        *hotX = size.width > 0 ? (int)(hotSpot.x * w / size.width) : 0;
+        *hotY = size.height > 0 ? (int)(hotSpot.y * h / size.height) : 0;
+        return 1;
+    }
+}
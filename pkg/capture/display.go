@@ -0,0 +1,86 @@
+package capture
+
+import (
+	"fmt"
+	"image"
+)
+
+// Display describes one of the screens that a VideoCapturer can capture.
+type Display struct {
+	ID      int
+	Name    string
+	Primary bool
+	// Bounds is the position and size of the display in the global desktop
+	// coordinate space, which is the space that mouse events are injected in.
+	Bounds image.Rectangle
+	// Scale is the number of captured pixels per unit of Bounds; e.g., 2 for
+	// a Retina display on macOS, and 1 nearly everywhere else.
+	Scale float64
+}
+
+// DisplayCapturer is implemented by VideoCapturers that can enumerate the
+// displays attached to the system, and switch between them while running.
+type DisplayCapturer interface {
+	VideoCapturer
+	Displays() ([]Display, error)
+	CurrentDisplay() Display
+	SelectDisplay(id int) error
+}
+
+// Displays returns the displays available to capturer. Capturers that don't
+// implement DisplayCapturer are treated as having a single display.
+func Displays(capturer VideoCapturer) ([]Display, error) {
+	if d, ok := capturer.(DisplayCapturer); ok {
+		return d.Displays()
+	}
+	return []Display{CurrentDisplay(capturer)}, nil
+}
+
+// CurrentDisplay returns the display that capturer is currently capturing.
+func CurrentDisplay(capturer VideoCapturer) Display {
+	if d, ok := capturer.(DisplayCapturer); ok {
+		return d.CurrentDisplay()
+	}
+	bounds := capturer.GetBounds()
+	return Display{
+		Name:    "Screen",
+		Primary: true,
+		Bounds:  bounds.Sub(bounds.Min),
+		Scale:   1,
+	}
+}
+
+// SelectDisplay switches capturer to the display with the given ID.
+func SelectDisplay(capturer VideoCapturer, id int) error {
+	if d, ok := capturer.(DisplayCapturer); ok {
+		return d.SelectDisplay(id)
+	}
+	if id != CurrentDisplay(capturer).ID {
+		return fmt.Errorf("display %d does not exist", id)
+	}
+	return nil
+}
+
+// FindDisplay returns the display with the given ID.
+func FindDisplay(displays []Display, id int) (Display, error) {
+	for _, display := range displays {
+		if display.ID == id {
+			return display, nil
+		}
+	}
+	return Display{}, fmt.Errorf("display %d does not exist", id)
+}
+
+// PrimaryDisplay returns the primary display, or the first display if none
+// is marked as primary.
+func PrimaryDisplay(displays []Display) (Display, error) {
+	if len(displays) == 0 {
+		return Display{}, fmt.Errorf("no displays found")
+	}
+	for _, display := range displays {
+		if display.Primary {
+			return display, nil
+		}
+	}
+	return displays[0], nil
+}
@@ -0,0 +1,43 @@
+package capture_test
+
+import (
+	"image"
+	"testing"
+
+	"github.com/adamroach/webrd/mock"
+	"github.com/adamroach/webrd/pkg/capture"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDisplays_SingleDisplayFallback(t *testing.T) {
+	capturer := mock.NewVideoCapturer(t)
+	capturer.EXPECT().GetBounds().Return(image.Rect(0, 0, 1920, 1080))
+
+	displays, err := capture.Displays(capturer)
+	require.NoError(t, err)
+	require.Len(t, displays, 1)
+	assert.Equal(t, image.Rect(0, 0, 1920, 1080), displays[0].Bounds)
+	assert.True(t, displays[0].Primary)
+	assert.Equal(t, 1.0, displays[0].Scale)
+
+	assert.NoError(t, capture.SelectDisplay(capturer, 0))
+	assert.Error(t, capture.SelectDisplay(capturer, 1))
+}
+
+func TestPrimaryDisplay(t *testing.T) {
+	displays := []capture.Display{{ID: 3}, {ID: 7, Primary: true}}
+	primary, err := capture.PrimaryDisplay(displays)
+	require.NoError(t, err)
+	assert.Equal(t, 7, primary.ID)
+
+	primary, err = capture.PrimaryDisplay(displays[:1])
+	require.NoError(t, err)
+	assert.Equal(t, 3, primary.ID)
+
+	_, err = capture.PrimaryDisplay(nil)
+	assert.Error(t, err)
+
+	_, err = capture.FindDisplay(displays, 5)
+	assert.Error(t, err)
+}
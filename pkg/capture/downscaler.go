@@ -0,0 +1,150 @@
+package capture
+
+import (
+	"image"
+	"log"
+
+	"github.com/adamroach/webrd/pkg/imageconvert"
+)
+
+// Downscaler wraps a VideoCapturer, and shrinks frames that are larger than
+// a maximum size to fit within it, keeping their aspect ratio. Smaller
+// frames are passed through untouched. Input coordinates don't need to be
+// adjusted, since clients report positions as fractions of the video size.
+type Downscaler struct {
+	capturer VideoCapturer
+	frames   chan (*Frame)
+	maxSize  image.Point
+	filter   imageconvert.Filter
+	pool     *FramePool
+}
+
+// NewDownscaler creates a Downscaler that fits frames within maxWidth x
+// maxHeight pixels. A limit of zero leaves that dimension unconstrained.
+func NewDownscaler(capturer VideoCapturer, maxWidth, maxHeight int, filter imageconvert.Filter) *Downscaler {
+	return &Downscaler{
+		capturer: capturer,
+		frames:   make(chan *Frame, 1),
+		maxSize:  image.Pt(maxWidth, maxHeight),
+		filter:   filter,
+		pool:     NewFramePool(),
+	}
+}
+
+// FitSize returns the largest size with the same aspect ratio as size that
+// fits within maxSize, or size itself if it already fits. A zero component
+// of maxSize is unconstrained. Since 4:2:0 video needs whole chroma samples,
+// a scaled size is rounded down to even dimensions.
+func FitSize(size, maxSize image.Point) image.Point {
+	scale := 1.0
+	if maxSize.X > 0 && size.X > maxSize.X {
+		scale = float64(maxSize.X) / float64(size.X)
+	}
+	if maxSize.Y > 0 && size.Y > maxSize.Y {
+		scale = min(scale, float64(maxSize.Y)/float64(size.Y))
+	}
+	if scale == 1 {
+		return size
+	}
+	return image.Pt(
+		max(2, int(float64(size.X)*scale)&^1),
+		max(2, int(float64(size.Y)*scale)&^1),
+	)
+}
+
+func (d *Downscaler) Start() error {
+	if err := d.capturer.Start(); err != nil {
+		return err
+	}
+	go d.run()
+	return nil
+}
+
+func (d *Downscaler) Stop() error {
+	return d.capturer.Stop()
+}
+
+// GetBounds returns the size of the frames after scaling.
+func (d *Downscaler) GetBounds() image.Rectangle {
+	bounds := d.capturer.GetBounds()
+	return image.Rectangle{Max: FitSize(bounds.Size(), d.maxSize)}
+}
+
+func (d *Downscaler) FrameChannel() <-chan *Frame {
+	return d.frames
+}
+
+func (d *Downscaler) Displays() ([]Display, error) {
+	return Displays(d.capturer)
+}
+
+func (d *Downscaler) CurrentDisplay() Display {
+	return CurrentDisplay(d.capturer)
+}
+
+func (d *Downscaler) SelectDisplay(id int) error {
+	return SelectDisplay(d.capturer, id)
+}
+
+func (d *Downscaler) Cursor() (Cursor, error) {
+	return CurrentCursor(d.capturer)
+}
+
+func (d *Downscaler) Dropped() uint64 {
+	return DroppedFrames(d.capturer)
+}
+
+func (d *Downscaler) run() {
+	defer close(d.frames)
+	var size image.Point
+	for frame := range d.capturer.FrameChannel() {
+		src, ok := frame.Image.(*image.YCbCr)
+		if !ok || src.SubsampleRatio != image.YCbCrSubsampleRatio420 {
+			d.frames <- frame
+			continue
+		}
+		nativeSize := src.Rect.Size()
+		scaledSize := FitSize(nativeSize, d.maxSize)
+		if scaledSize != size {
+			if scaledSize != nativeSize {
+				log.Printf("Scaling video from %d x %d to %d x %d", nativeSize.X, nativeSize.Y, scaledSize.X, scaledSize.Y)
+			}
+			size = scaledSize
+		}
+		if scaledSize == nativeSize {
+			d.frames <- frame
+			continue
+		}
+		scaled := d.pool.Get(image.Rectangle{Max: scaledSize}, src.SubsampleRatio)
+		dst := scaled.Image.(*image.YCbCr)
+		err := imageconvert.Scale(dst, src, d.filter)
+		frame.Release()
+		if err != nil {
+			log.Printf("could not scale frame: %v", err)
+			scaled.Release()
+			continue
+		}
+		scaled.Time = frame.Time
+		scaled.Sequence = frame.Sequence
+		scaled.Damage = scaleDamage(frame.Damage, src.Rect, dst.Rect)
+		scaled.ColorSpace = frame.ColorSpace
+		d.frames <- scaled
+	}
+}
+
+// scaleDamage maps damaged regions from the native frame into the scaled
+// one, rounding outwards so that no changed pixels are lost.
+func scaleDamage(damage []image.Rectangle, from, to image.Rectangle) []image.Rectangle {
+	if damage == nil {
+		return nil
+	}
+	scaled := make([]image.Rectangle, len(damage))
+	for i, r := range damage {
+		r = r.Sub(from.Min)
+		scaled[i] = image.Rect(
+			r.Min.X*to.Dx()/from.Dx(), r.Min.Y*to.Dy()/from.Dy(),
+			(r.Max.X*to.Dx()+from.Dx()-1)/from.Dx(), (r.Max.Y*to.Dy()+from.Dy()-1)/from.Dy(),
+		).Add(to.Min).Intersect(to)
+	}
+	return scaled
+}
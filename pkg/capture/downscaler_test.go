@@ -0,0 +1,69 @@
+package capture_test
+
+import (
+	"image"
+	"testing"
+
+	"github.com/adamroach/webrd/mock"
+	"github.com/adamroach/webrd/pkg/capture"
+	"github.com/adamroach/webrd/pkg/imageconvert"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFitSize(t *testing.T) {
+	for _, test := range []struct {
+		size, maxSize, expected image.Point
+	}{
+		{image.Pt(3840, 2160), image.Pt(1920, 1080), image.Pt(1920, 1080)},
+		{image.Pt(1280, 720), image.Pt(1920, 1080), image.Pt(1280, 720)},
+		{image.Pt(1281, 721), image.Pt(0, 0), image.Pt(1281, 721)},
+		// The tighter constraint wins, and the aspect ratio is kept
+		{image.Pt(2560, 1600), image.Pt(1920, 1080), image.Pt(1728, 1080)},
+		{image.Pt(5120, 1440), image.Pt(1920, 1080), image.Pt(1920, 540)},
+		{image.Pt(3000, 2000), image.Pt(0, 1000), image.Pt(1500, 1000)},
+		// Scaled sizes are even
+		{image.Pt(1001, 1001), image.Pt(501, 0), image.Pt(500, 500)},
+	} {
+		assert.Equal(t, test.expected, capture.FitSize(test.size, test.maxSize), "%v in %v", test.size, test.maxSize)
+	}
+}
+
+func TestDownscaler(t *testing.T) {
+	frames := make(chan *capture.Frame)
+	capturer := mock.NewVideoCapturer(t)
+	capturer.EXPECT().Start().Return(nil)
+	capturer.EXPECT().FrameChannel().Return(frames)
+	capturer.EXPECT().GetBounds().Return(image.Rect(0, 0, 400, 200))
+
+	scaler := capture.NewDownscaler(capturer, 200, 200, imageconvert.FilterArea)
+	require.NoError(t, scaler.Start())
+	assert.Equal(t, image.Rect(0, 0, 200, 100), scaler.GetBounds())
+
+	// Oversized frames are scaled down, along with their damage
+	pool := capture.NewFramePool()
+	native := pool.Get(image.Rect(0, 0, 400, 200), image.YCbCrSubsampleRatio420)
+	native.Sequence = 1
+	native.Damage = []image.Rectangle{image.Rect(11, 21, 101, 199)}
+	nativeImage := native.Image
+	frames <- native
+	frame := <-scaler.FrameChannel()
+	assert.Equal(t, uint64(1), frame.Sequence)
+	assert.Equal(t, image.Rect(0, 0, 200, 100), frame.Image.Bounds())
+	assert.Equal(t, []image.Rectangle{image.Rect(5, 10, 51, 100)}, frame.Damage)
+
+	// The native frame has been released, and the scaled one can be
+	assert.Same(t, nativeImage, pool.Get(image.Rect(0, 0, 400, 200), image.YCbCrSubsampleRatio420).Image)
+	frame.Release()
+
+	// Frames that already fit are passed through
+	small := newTestImage()
+	frames <- &capture.Frame{Image: small}
+	frame = <-scaler.FrameChannel()
+	assert.Same(t, small, frame.Image)
+	assert.Nil(t, frame.Damage)
+
+	close(frames)
+	_, ok := <-scaler.FrameChannel()
+	assert.False(t, ok)
+}
@@ -0,0 +1,33 @@
+package capture
+
+import (
+	"image"
+
+	"github.com/adamroach/webrd/pkg/config"
+	"github.com/adamroach/webrd/pkg/imageconvert"
+)
+
+// VideoFormat describes the YCbCr frames that video capturers produce.
+// Chroma is always subsampled to 4:2:0, the only format the encoders take.
+type VideoFormat struct {
+	ColorSpace imageconvert.ColorSpace
+}
+
+// DefaultVideoFormat is what HD video normally uses: limited range BT.709.
+var DefaultVideoFormat = VideoFormat{
+	ColorSpace: imageconvert.ColorSpace{Matrix: imageconvert.BT709},
+}
+
+// ParseVideoFormat reads the color settings from the video configuration.
+func ParseVideoFormat(video config.Video) (VideoFormat, error) {
+	colorSpace, err := imageconvert.ParseColorSpace(video.ColorMatrix, video.ColorRange)
+	if err != nil {
+		return VideoFormat{}, err
+	}
+	return VideoFormat{ColorSpace: colorSpace}, nil
+}
+
+// NewImage allocates a 4:2:0 image.
+func (f VideoFormat) NewImage(r image.Rectangle) *image.YCbCr {
+	return image.NewYCbCr(r, image.YCbCrSubsampleRatio420)
+}
@@ -0,0 +1,29 @@
+package capture_test
+
+import (
+	"testing"
+
+	"github.com/adamroach/webrd/pkg/capture"
+	"github.com/adamroach/webrd/pkg/config"
+	"github.com/adamroach/webrd/pkg/imageconvert"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseVideoFormat(t *testing.T) {
+	format, err := capture.ParseVideoFormat(config.Video{ColorMatrix: "bt709", ColorRange: "limited"})
+	require.NoError(t, err)
+	assert.Equal(t, capture.DefaultVideoFormat, format)
+
+	format, err = capture.ParseVideoFormat(config.Video{ColorMatrix: "bt601", ColorRange: "full"})
+	require.NoError(t, err)
+	assert.Equal(t, imageconvert.ColorSpace{Matrix: imageconvert.BT601, FullRange: true}, format.ColorSpace)
+
+	for _, video := range []config.Video{
+		{ColorMatrix: "bt2020", ColorRange: "limited"},
+		{ColorMatrix: "bt709", ColorRange: "studio"},
+	} {
+		_, err := capture.ParseVideoFormat(video)
+		assert.Error(t, err, "%+v", video)
+	}
+}
@@ -0,0 +1,33 @@
+package capture
+
+import (
+	"image"
+	"time"
+
+	"github.com/adamroach/webrd/pkg/imageconvert"
+)
+
+// Frame is a single unit of captured media, along with the information
+// needed to time it correctly downstream. Whoever consumes a frame last
+// must call Release once it is done with the frame's Image or Samples.
+type Frame struct {
+	Image    image.Image       // Captured video; nil for audio frames
+	Samples  []byte            // Captured audio, as interleaved PCM; nil for video frames
+	Time     time.Time         // When the frame was captured
+	Sequence uint64            // Increases by one for each frame produced by a capturer
+	Damage   []image.Rectangle // Regions that changed since the previous frame; nil means unknown
+
+	ColorSpace imageconvert.ColorSpace // How Image's YCbCr samples were derived; zero means unknown
+
+	release func()
+}
+
+// Release hands the frame's buffers back to the FramePool they came from,
+// if any. The frame must not be used afterwards. Releasing a frame more
+// than once has no further effect.
+func (f *Frame) Release() {
+	if f.release != nil {
+		f.release()
+		f.release = nil
+	}
+}
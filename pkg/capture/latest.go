@@ -0,0 +1,153 @@
+package capture
+
+import (
+	"image"
+	"sync/atomic"
+)
+
+// FrameSlot passes frames from a producer to a consumer, holding at most
+// one that hasn't been taken yet. Put never blocks: a frame that is still
+// waiting when the next one arrives is released and counted as dropped, so
+// the consumer always gets the newest frame, and never one that has been
+// queueing behind others. A FrameSlot supports a single producer.
+type FrameSlot struct {
+	frames  chan *Frame
+	dropped atomic.Uint64
+}
+
+func NewFrameSlot() *FrameSlot {
+	return &FrameSlot{frames: make(chan *Frame, 1)}
+}
+
+// Put replaces any waiting frame with frame. The regions damaged in a
+// dropped frame are added to frame's, so that no change goes unreported.
+func (s *FrameSlot) Put(frame *Frame) {
+	for {
+		select {
+		case s.frames <- frame:
+			return
+		default:
+		}
+		select {
+		case stale := <-s.frames:
+			frame.Damage = mergeDamage(stale.Damage, frame.Damage)
+			stale.Release()
+			s.dropped.Add(1)
+		default:
+			// The consumer took it in the meantime
+		}
+	}
+}
+
+// Close tells the consumer that no more frames are coming. Put must not be
+// called afterwards.
+func (s *FrameSlot) Close() {
+	close(s.frames)
+}
+
+func (s *FrameSlot) FrameChannel() <-chan *Frame {
+	return s.frames
+}
+
+// Dropped returns the number of frames that were replaced before the
+// consumer took them.
+func (s *FrameSlot) Dropped() uint64 {
+	return s.dropped.Load()
+}
+
+func mergeDamage(a, b []image.Rectangle) []image.Rectangle {
+	if a == nil || b == nil {
+		// One of them changed in unknown ways
+		return nil
+	}
+	return append(append([]image.Rectangle{}, a...), b...)
+}
+
+// FrameDropper is implemented by VideoCapturers that drop stale frames
+// rather than let them queue up.
+type FrameDropper interface {
+	VideoCapturer
+	Dropped() uint64
+}
+
+// DroppedFrames returns the number of frames that capturer has dropped, or
+// zero if it doesn't implement FrameDropper.
+func DroppedFrames(capturer VideoCapturer) uint64 {
+	if d, ok := capturer.(FrameDropper); ok {
+		return d.Dropped()
+	}
+	return 0
+}
+
+// LatestFrames wraps a VideoCapturer, and reads its frames as fast as they
+// arrive, keeping only the newest one for the consumer. Placed in front of
+// an encoder, it keeps the stages before it from stalling while a frame is
+// being encoded, and makes sure that the encoder always works on the most
+// recent picture.
+type LatestFrames struct {
+	capturer VideoCapturer
+	slot     *FrameSlot
+}
+
+func NewLatestFrames(capturer VideoCapturer) *LatestFrames {
+	return &LatestFrames{
+		capturer: capturer,
+		slot:     NewFrameSlot(),
+	}
+}
+
+func (l *LatestFrames) Start() error {
+	if err := l.capturer.Start(); err != nil {
+		return err
+	}
+	go l.run()
+	return nil
+}
+
+func (l *LatestFrames) Stop() error {
+	return l.capturer.Stop()
+}
+
+func (l *LatestFrames) GetBounds() image.Rectangle {
+	return l.capturer.GetBounds()
+}
+
+func (l *LatestFrames) FrameChannel() <-chan *Frame {
+	return l.slot.FrameChannel()
+}
+
+// Dropped returns the number of frames dropped here and by the wrapped
+// capturer.
+func (l *LatestFrames) Dropped() uint64 {
+	return l.slot.Dropped() + DroppedFrames(l.capturer)
+}
+
+func (l *LatestFrames) Displays() ([]Display, error) {
+	return Displays(l.capturer)
+}
+
+func (l *LatestFrames) CurrentDisplay() Display {
+	return CurrentDisplay(l.capturer)
+}
+
+func (l *LatestFrames) SelectDisplay(id int) error {
+	return SelectDisplay(l.capturer, id)
+}
+
+func (l *LatestFrames) Cursor() (Cursor, error) {
+	return CurrentCursor(l.capturer)
+}
+
+// Refresh is passed on to the wrapped capturer, if it is a DamageTracker.
+func (l *LatestFrames) Refresh() {
+	if tracker, ok := l.capturer.(interface{ Refresh() }); ok {
+		tracker.Refresh()
+	}
+}
+
+func (l *LatestFrames) run() {
+	defer l.slot.Close()
+	for frame := range l.capturer.FrameChannel() {
+		l.slot.Put(frame)
+	}
+}
@@ -0,0 +1,71 @@
+package capture_test
+
+import (
+	"image"
+	"testing"
+
+	"github.com/adamroach/webrd/mock"
+	"github.com/adamroach/webrd/pkg/capture"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFrameSlot(t *testing.T) {
+	slot := capture.NewFrameSlot()
+	pool := capture.NewFramePool()
+	bounds := image.Rect(0, 0, 64, 64)
+
+	// Put never blocks, and only the newest frame is kept
+	first := pool.Get(bounds, image.YCbCrSubsampleRatio420)
+	first.Sequence = 1
+	first.Damage = []image.Rectangle{image.Rect(0, 0, 16, 16)}
+	firstImage := first.Image
+	slot.Put(first)
+	slot.Put(&capture.Frame{Sequence: 2, Damage: []image.Rectangle{image.Rect(16, 16, 32, 32)}})
+	slot.Put(&capture.Frame{Sequence: 3, Damage: []image.Rectangle{}})
+	assert.Equal(t, uint64(2), slot.Dropped())
+
+	// The newest frame carries the damage of the ones it replaced
+	frame := <-slot.FrameChannel()
+	assert.Equal(t, uint64(3), frame.Sequence)
+	assert.Equal(t, []image.Rectangle{image.Rect(0, 0, 16, 16), image.Rect(16, 16, 32, 32)}, frame.Damage)
+
+	// Dropped frames are released
+	assert.Same(t, firstImage, pool.Get(bounds, image.YCbCrSubsampleRatio420).Image)
+
+	// Unknown damage stays unknown
+	slot.Put(&capture.Frame{Sequence: 4})
+	slot.Put(&capture.Frame{Sequence: 5, Damage: []image.Rectangle{image.Rect(0, 0, 1, 1)}})
+	assert.Nil(t, (<-slot.FrameChannel()).Damage)
+
+	slot.Close()
+	_, ok := <-slot.FrameChannel()
+	assert.False(t, ok)
+}
+
+func TestLatestFrames(t *testing.T) {
+	frames := make(chan *capture.Frame)
+	capturer := mock.NewVideoCapturer(t)
+	capturer.EXPECT().Start().Return(nil)
+	capturer.EXPECT().FrameChannel().Return(frames)
+
+	latest := capture.NewLatestFrames(capturer)
+	require.NoError(t, latest.Start())
+
+	// The wrapped capturer never waits for the consumer
+	for i := range 10 {
+		frames <- &capture.Frame{Sequence: uint64(i + 1)}
+	}
+	close(frames)
+
+	// Everything but the newest frame was dropped, unless it was taken
+	// before the next one arrived
+	var received []uint64
+	for frame := range latest.FrameChannel() {
+		received = append(received, frame.Sequence)
+	}
+	require.NotEmpty(t, received)
+	assert.Equal(t, uint64(10), received[len(received)-1])
+	assert.Equal(t, uint64(10-len(received)), latest.Dropped())
+	assert.Equal(t, latest.Dropped(), capture.DroppedFrames(latest))
+}
@@ -0,0 +1,60 @@
+package capture
+
+import (
+	"image"
+	"sync"
+)
+
+// maxPooledImages is the most released images a FramePool holds on to. A
+// pipeline only has a few frames in flight at once, so more than this would
+// just be waiting for the garbage collector.
+const maxPooledImages = 8
+
+// FramePool recycles the images of video frames, so that capturing at a
+// high framerate doesn't allocate a new image for every frame. Frames from
+// a pool must be released once they have been consumed; frames that aren't
+// are simply left to the garbage collector.
+type FramePool struct {
+	mu    sync.Mutex // protects access to the fields below
+	rect  image.Rectangle
+	ratio image.YCbCrSubsampleRatio
+	free  []*image.YCbCr
+}
+
+func NewFramePool() *FramePool {
+	return &FramePool{}
+}
+
+// Get returns a frame whose Image is a *image.YCbCr with the given bounds
+// and subsampling, reusing the image of a released frame if there is one.
+// The image's pixels are left over from whichever frame used it last.
+func (p *FramePool) Get(r image.Rectangle, ratio image.YCbCrSubsampleRatio) *Frame {
+	p.mu.Lock()
+	if r != p.rect || ratio != p.ratio {
+		// Images of the old size are of no further use
+		p.rect = r
+		p.ratio = ratio
+		p.free = nil
+	}
+	var img *image.YCbCr
+	if n := len(p.free); n > 0 {
+		img = p.free[n-1]
+		p.free = p.free[:n-1]
+	}
+	p.mu.Unlock()
+	if img == nil {
+		img = image.NewYCbCr(r, ratio)
+	}
+	return &Frame{
+		Image:   img,
+		release: func() { p.put(img) },
+	}
+}
+
+func (p *FramePool) put(img *image.YCbCr) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if img.Rect == p.rect && img.SubsampleRatio == p.ratio && len(p.free) < maxPooledImages {
+		p.free = append(p.free, img)
+	}
+}
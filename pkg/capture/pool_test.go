@@ -0,0 +1,42 @@
+package capture_test
+
+import (
+	"image"
+	"testing"
+
+	"github.com/adamroach/webrd/pkg/capture"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFramePool(t *testing.T) {
+	pool := capture.NewFramePool()
+	bounds := image.Rect(0, 0, 64, 32)
+
+	first := pool.Get(bounds, image.YCbCrSubsampleRatio420)
+	img, ok := first.Image.(*image.YCbCr)
+	require.True(t, ok)
+	assert.Equal(t, bounds, img.Rect)
+	assert.Equal(t, image.YCbCrSubsampleRatio420, img.SubsampleRatio)
+
+	// Frames that are still in use never share an image
+	second := pool.Get(bounds, image.YCbCrSubsampleRatio420)
+	assert.NotSame(t, img, second.Image)
+
+	// Released images are reused, but only once
+	first.Release()
+	first.Release()
+	assert.Same(t, img, pool.Get(bounds, image.YCbCrSubsampleRatio420).Image)
+	assert.NotSame(t, img, pool.Get(bounds, image.YCbCrSubsampleRatio420).Image)
+
+	// Images of another size or subsampling are not
+	second.Release()
+	assert.Equal(t, image.YCbCrSubsampleRatio444, pool.Get(bounds, image.YCbCrSubsampleRatio444).Image.(*image.YCbCr).SubsampleRatio)
+	larger := pool.Get(image.Rect(0, 0, 128, 64), image.YCbCrSubsampleRatio420)
+	assert.Equal(t, image.Rect(0, 0, 128, 64), larger.Image.Bounds())
+}
+
+func TestFrame_ReleaseUnpooled(t *testing.T) {
+	frame := &capture.Frame{Image: newTestImage()}
+	frame.Release()
+}
@@ -0,0 +1,196 @@
+//go:build linux
+
+package pulseaudio
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/adamroach/webrd/pkg/capture"
+	"github.com/jfreymuth/pulse"
+	"github.com/jfreymuth/pulse/proto"
+)
+
+const (
+	// audioChunk is how much audio each frame holds.
+	audioChunk = 10 * time.Millisecond
+	// bytesPerSample is the size of one sample on every channel
+	bytesPerSample = capture.AudioChannels * 2
+	// chunkBytes is the size of a frame's Samples
+	chunkBytes = int(capture.AudioSampleRate*audioChunk/time.Second) * bytesPerSample
+	// resyncThreshold is how far the sample count may fall behind the wall
+	// clock before frame times are realigned, e.g. after the server stopped
+	// delivering audio for a while.
+	resyncThreshold = 100 * time.Millisecond
+)
+
+// AudioCapturer records from a PulseAudio source over the native protocol,
+// which pipewire-pulse also speaks. By default it records the monitor of
+// the default sink, i.e. whatever the machine is playing.
+type AudioCapturer struct {
+	server string
+	device string
+	client *pulse.Client
+	stream *pulse.RecordStream
+
+	mu       sync.Mutex // protects everything below
+	frames   chan (*capture.Frame)
+	stopped  bool
+	pending  []byte
+	start    time.Time // capture time of the first sample
+	position uint64    // samples per channel since start
+	sequence uint64
+}
+
+// WithServer connects to the given PulseAudio server string instead of the
+// default one (from $PULSE_SERVER, or the user's runtime directory).
+func WithServer(server string) func(*AudioCapturer) error {
+	return func(c *AudioCapturer) error {
+		c.server = server
+		return nil
+	}
+}
+
+// WithDevice records from the named device. A sink name records what is
+// played on it, and a source name (including a ".monitor" source) records
+// that source directly. Empty means the monitor of the default sink.
+func WithDevice(device string) func(*AudioCapturer) error {
+	return func(c *AudioCapturer) error {
+		c.device = device
+		return nil
+	}
+}
+
+func NewAudioCapturer(opts ...func(*AudioCapturer) error) (*AudioCapturer, error) {
+	c := &AudioCapturer{
+		frames: make(chan *capture.Frame, 4),
+	}
+	for _, opt := range opts {
+		if err := opt(c); err != nil {
+			return nil, err
+		}
+	}
+
+	clientOptions := []pulse.ClientOption{pulse.ClientApplicationName("webrdd")}
+	if c.server != "" {
+		clientOptions = append(clientOptions, pulse.ClientServerString(c.server))
+	}
+	client, err := pulse.NewClient(clientOptions...)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to PulseAudio server: %v", err)
+	}
+
+	device, err := c.findDevice(client)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	stream, err := client.NewRecord(
+		pulse.NewWriter(c, proto.FormatInt16LE),
+		device,
+		pulse.RecordStereo,
+		pulse.RecordSampleRate(capture.AudioSampleRate),
+		pulse.RecordLatency(audioChunk.Seconds()),
+		pulse.RecordMediaName("Remote desktop audio"),
+	)
+	if err != nil {
+		client.Close()
+		return nil, fmt.Errorf("could not create record stream: %v", err)
+	}
+	c.client = client
+	c.stream = stream
+	return c, nil
+}
+
+// findDevice returns the option that selects the configured device
+func (c *AudioCapturer) findDevice(client *pulse.Client) (pulse.RecordOption, error) {
+	if c.device == "" {
+		sink, err := client.DefaultSink()
+		if err != nil {
+			return nil, fmt.Errorf("could not find default sink: %v", err)
+		}
+		log.Printf("Recording from monitor of default sink %s", sink.ID())
+		return pulse.RecordMonitor(sink), nil
+	}
+	if sink, err := client.SinkByID(c.device); err == nil {
+		log.Printf("Recording from monitor of sink %s", sink.ID())
+		return pulse.RecordMonitor(sink), nil
+	}
+	source, err := client.SourceByID(c.device)
+	if err != nil {
+		return nil, fmt.Errorf("no sink or source named %q: %v", c.device, err)
+	}
+	log.Printf("Recording from source %s", source.ID())
+	return pulse.RecordSource(source), nil
+}
+
+func (c *AudioCapturer) Start() error {
+	c.stream.Start()
+	return nil
+}
+
+func (c *AudioCapturer) Stop() error {
+	// Closing the stream waits for the server, whose replies arrive on the
+	// goroutine that calls Write, so it must happen without holding mu
+	c.stream.Close()
+	c.mu.Lock()
+	if !c.stopped {
+		c.stopped = true
+		close(c.frames)
+		log.Printf("Stopped PulseAudio capture")
+	}
+	c.mu.Unlock()
+	c.client.Close()
+	return nil
+}
+
+func (c *AudioCapturer) FrameChannel() <-chan *capture.Frame {
+	return c.frames
+}
+
+// Write receives recorded PCM from the stream, and splits it into frames.
+func (c *AudioCapturer) Write(data []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.stopped {
+		return len(data), nil
+	}
+
+	// The data just arrived, so its first sample was captured its duration
+	// ago, give or take the server's buffering
+	now := time.Now()
+	samples := uint64((len(c.pending) + len(data)) / bytesPerSample)
+	first := now.Add(-time.Duration(samples) * time.Second / capture.AudioSampleRate)
+	if c.start.IsZero() || first.Sub(c.timeAt(c.position)) > resyncThreshold {
+		c.start = first
+		c.position = 0
+	}
+
+	c.pending = append(c.pending, data...)
+	for len(c.pending) >= chunkBytes {
+		c.sequence++
+		frame := &capture.Frame{
+			Samples:  c.pending[:chunkBytes:chunkBytes],
+			Time:     c.timeAt(c.position),
+			Sequence: c.sequence,
+		}
+		c.pending = c.pending[chunkBytes:]
+		c.position += uint64(chunkBytes / bytesPerSample)
+		if len(c.frames) == cap(c.frames) {
+			// Nobody is keeping up, so this chunk is lost; the gap shows up
+			// in the time of the next one
+			continue
+		}
+		c.frames <- frame
+	}
+	// Don't let the frames share memory with data that is still to come
+	c.pending = append([]byte(nil), c.pending...)
+	return len(data), nil
+}
+
+// timeAt returns the capture time of the sample at position
+func (c *AudioCapturer) timeAt(position uint64) time.Time {
+	return c.start.Add(time.Duration(position) * time.Second / capture.AudioSampleRate)
+}
@@ -0,0 +1,155 @@
+//go:build linux
+
+package pulseaudio_test
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/adamroach/webrd/pkg/capture"
+	"github.com/adamroach/webrd/pkg/capture/pulseaudio"
+	"github.com/adamroach/webrd/pkg/capture/synthetic"
+	"github.com/jfreymuth/pulse"
+	"github.com/jfreymuth/pulse/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startPulseAudio launches a private PulseAudio daemon with a single null
+// sink named "test" for the duration of the test, and returns its server
+// string. The test is skipped if PulseAudio isn't installed.
+func startPulseAudio(t *testing.T) string {
+	path, err := exec.LookPath("pulseaudio")
+	if err != nil {
+		t.Skip("pulseaudio not installed")
+	}
+	dir := t.TempDir()
+	socket := filepath.Join(dir, "native")
+	cmd := exec.Command(path,
+		"-n", "--daemonize=no", "--exit-idle-time=-1", "--disallow-exit",
+		"--load=module-native-protocol-unix auth-anonymous=1 socket="+socket,
+		"--load=module-null-sink sink_name=test",
+		"--load=module-null-sink sink_name=other",
+	)
+	cmd.Env = append(os.Environ(), "HOME="+dir, "XDG_RUNTIME_DIR="+dir, "XDG_CONFIG_HOME="+dir)
+	require.NoError(t, cmd.Start())
+	t.Cleanup(func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	})
+
+	// Wait for the server to come up
+	server := "unix:" + socket
+	for range 50 {
+		client, err := pulse.NewClient(pulse.ClientServerString(server))
+		if err == nil {
+			client.Close()
+			return server
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatalf("pulseaudio did not start on %s", socket)
+	return ""
+}
+
+// playTone plays a sine tone on the named sink until the test ends
+func playTone(t *testing.T, server, sinkName string) {
+	client, err := pulse.NewClient(pulse.ClientServerString(server))
+	require.NoError(t, err)
+	t.Cleanup(client.Close)
+	sink, err := client.SinkByID(sinkName)
+	require.NoError(t, err)
+
+	tone, err := synthetic.NewAudioCapturer(440)
+	require.NoError(t, err)
+	var position uint64
+	reader := pulse.Uint8Reader(func(buf []byte) (int, error) {
+		samples := len(buf) / 4
+		n := copy(buf, tone.Render(position, samples))
+		position += uint64(samples)
+		return n, nil
+	})
+	stream, err := client.NewPlayback(
+		pulse.NewReader(reader, proto.FormatInt16LE),
+		pulse.PlaybackStereo,
+		pulse.PlaybackSampleRate(capture.AudioSampleRate),
+		pulse.PlaybackSink(sink),
+	)
+	require.NoError(t, err)
+	stream.Start()
+	t.Cleanup(stream.Close)
+}
+
+func readFrames(t *testing.T, c *pulseaudio.AudioCapturer, count int) []*capture.Frame {
+	t.Helper()
+	var frames []*capture.Frame
+	timeout := time.After(5 * time.Second)
+	for len(frames) < count {
+		select {
+		case frame := <-c.FrameChannel():
+			require.NotNil(t, frame)
+			frames = append(frames, frame)
+		case <-timeout:
+			t.Fatal("timed out waiting for frames")
+		}
+	}
+	return frames
+}
+
+func loud(frame *capture.Frame) bool {
+	for _, b := range frame.Samples {
+		if b != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func TestAudioCapturer(t *testing.T) {
+	server := startPulseAudio(t)
+	playTone(t, server, "test")
+
+	c, err := pulseaudio.NewAudioCapturer(pulseaudio.WithServer(server), pulseaudio.WithDevice("test"))
+	require.NoError(t, err)
+	require.NoError(t, c.Start())
+
+	// Frames hold 10ms of 48kHz stereo, and their times follow the samples
+	frames := readFrames(t, c, 50)
+	for i, frame := range frames {
+		assert.Len(t, frame.Samples, 480*capture.AudioChannels*2)
+		if i > 0 && frame.Sequence == frames[i-1].Sequence+1 {
+			assert.Equal(t, 10*time.Millisecond, frame.Time.Sub(frames[i-1].Time))
+		}
+	}
+	assert.True(t, loud(frames[len(frames)-1]))
+
+	require.NoError(t, c.Stop())
+	// The frame channel is closed once capture stops
+	for range c.FrameChannel() {
+	}
+}
+
+func TestAudioCapturer_Device(t *testing.T) {
+	server := startPulseAudio(t)
+	playTone(t, server, "test")
+
+	// Another sink's monitor doesn't hear the tone
+	c, err := pulseaudio.NewAudioCapturer(pulseaudio.WithServer(server), pulseaudio.WithDevice("other.monitor"))
+	require.NoError(t, err)
+	require.NoError(t, c.Start())
+	defer c.Stop()
+	for _, frame := range readFrames(t, c, 20) {
+		assert.False(t, loud(frame))
+	}
+
+	_, err = pulseaudio.NewAudioCapturer(pulseaudio.WithServer(server), pulseaudio.WithDevice("missing"))
+	assert.Error(t, err)
+}
+
+func TestAudioCapturer_NoServer(t *testing.T) {
+	_, err := pulseaudio.NewAudioCapturer(pulseaudio.WithServer("unix:" + filepath.Join(t.TempDir(), "missing")))
+	assert.Error(t, err)
+}
@@ -0,0 +1,17 @@
+//go:build linux
+
+package pulseaudio
+
+import (
+	"github.com/adamroach/webrd/pkg/capture"
+	"github.com/adamroach/webrd/pkg/config"
+)
+
+func init() {
+	capture.AudioCapturers.Register("pulseaudio", func(config *config.Config) (capture.AudioCapturer, error) {
+		return NewAudioCapturer(
+			WithServer(config.PulseAudio.Server),
+			WithDevice(config.PulseAudio.Device),
+		)
+	})
+}
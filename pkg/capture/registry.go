@@ -0,0 +1,8 @@
+package capture
+
+import "github.com/adamroach/webrd/pkg/backend"
+
+var (
+	VideoCapturers = backend.NewRegistry[VideoCapturer]("video capture")
+	AudioCapturers = backend.NewRegistry[AudioCapturer]("audio capture")
+)
@@ -0,0 +1,16 @@
+package screenshot
+
+import (
+	"github.com/adamroach/webrd/pkg/capture"
+	"github.com/adamroach/webrd/pkg/config"
+)
+
+func init() {
+	capture.VideoCapturers.Register("screenshot", func(config *config.Config) (capture.VideoCapturer, error) {
+		format, err := capture.ParseVideoFormat(config.Video)
+		if err != nil {
+			return nil, err
+		}
+		return NewVideoCapturer(config.Video.Framerate, WithFormat(format))
+	})
+}
@@ -1,35 +1,58 @@
 package screenshot
 
 import (
+	"fmt"
 	"image"
 	"log"
+	"sync"
 	"time"
 
-	"github.com/adamroach/webrd/pkg/imageconvert"
+	"github.com/adamroach/webrd/pkg/capture"
 	"github.com/kbinani/screenshot"
 )
 
 type VideoCapturer struct {
-	frames       chan (image.Image)
+	frames       *capture.FrameSlot
 	stop         chan (struct{})
 	screenNumber int
 	framerate    int
+	format       capture.VideoFormat
+	pool         *capture.FramePool
+	bounds       image.Rectangle // global coordinates of the display being captured
+	mu           sync.RWMutex    // protects access to screenNumber and bounds
 }
 
-func NewVideoCapturer(framerate int) (*VideoCapturer, error) {
+// WithFormat sets the color space of the captured frames. The default is
+// capture.DefaultVideoFormat.
+func WithFormat(format capture.VideoFormat) func(*VideoCapturer) error {
+	return func(c *VideoCapturer) error {
+		c.format = format
+		return nil
+	}
+}
+
+func NewVideoCapturer(framerate int, opts ...func(*VideoCapturer) error) (*VideoCapturer, error) {
 	c := &VideoCapturer{
-		frames:    make(chan image.Image, 4),
+		frames:    capture.NewFrameSlot(),
+		stop:      make(chan struct{}),
 		framerate: framerate,
+		format:    capture.DefaultVideoFormat,
+		pool:      capture.NewFramePool(),
 	}
+	for _, opt := range opts {
+		if err := opt(c); err != nil {
+			return nil, err
+		}
+	}
+	c.bounds = screenshot.GetDisplayBounds(c.screenNumber)
 	return c, nil
 }
 
 func (c *VideoCapturer) Start() error {
 	duration := time.Duration(float64(1*time.Second) / float64(c.framerate))
 	lastFrame := time.Now()
-	bounds := screenshot.GetDisplayBounds(c.screenNumber)
-	yuvImage := image.NewYCbCr(bounds, image.YCbCrSubsampleRatio420)
 	go func() {
+		var sequence uint64
 		for {
 			timeToNextFrame := max(time.Until(lastFrame.Add(duration)), time.Nanosecond)
 			lastFrame = time.Now()
@@ -39,17 +62,24 @@ func (c *VideoCapturer) Start() error {
 				log.Printf("Stopping video capture loop")
 				return
 			case <-timer.C:
-				if len(c.frames) == cap(c.frames) {
-					// If the queue is full, we're producing faster than
-					// frames can be consumed, so we drop this frame
-					continue
-				}
+				captureTime := time.Now()
+				c.mu.RLock()
+				bounds := c.bounds
+				c.mu.RUnlock()
 				rgbImage, err := screenshot.CaptureRect(bounds)
 				if err != nil {
 					log.Printf("Error grabbing screenshot; exiting video capture loop: %v", err)
+					return
 				}
-				imageconvert.ToYCbCr(yuvImage, rgbImage)
-				c.frames <- yuvImage
+				// Each frame gets its own image, since earlier ones may
+				// still be waiting to be encoded
+				frame := c.pool.Get(image.Rectangle{Max: rgbImage.Bounds().Size()}, image.YCbCrSubsampleRatio420)
+				c.format.ColorSpace.ToYCbCr(frame.Image.(*image.YCbCr), rgbImage)
+				sequence++
+				frame.Time = captureTime
+				frame.Sequence = sequence
+				frame.ColorSpace = c.format.ColorSpace
+				c.frames.Put(frame)
 			}
 		}
 	}()
@@ -61,6 +91,59 @@ func (c *VideoCapturer) Stop() error {
 	return nil
 }
 
-func (c *VideoCapturer) FrameChannel() <-chan image.Image {
-	return c.frames
+func (c *VideoCapturer) GetBounds() image.Rectangle {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.bounds.Sub(c.bounds.Min)
+}
+
+func (c *VideoCapturer) Displays() ([]capture.Display, error) {
+	count := screenshot.NumActiveDisplays()
+	if count == 0 {
+		return nil, fmt.Errorf("no active displays")
+	}
+	displays := make([]capture.Display, count)
+	for i := range displays {
+		displays[i] = capture.Display{
+			ID:      i,
+			Name:    fmt.Sprintf("Display %d", i+1),
+			Primary: i == 0,
+			Bounds:  screenshot.GetDisplayBounds(i),
+			Scale:   1,
+		}
+	}
+	return displays, nil
+}
+
+func (c *VideoCapturer) CurrentDisplay() capture.Display {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return capture.Display{
+		ID:      c.screenNumber,
+		Name:    fmt.Sprintf("Display %d", c.screenNumber+1),
+		Primary: c.screenNumber == 0,
+		Bounds:  c.bounds,
+		Scale:   1,
+	}
+}
+
+func (c *VideoCapturer) SelectDisplay(id int) error {
+	if id < 0 || id >= screenshot.NumActiveDisplays() {
+		return fmt.Errorf("display %d does not exist", id)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.screenNumber = id
+	c.bounds = screenshot.GetDisplayBounds(id)
+	return nil
+}
+
+func (c *VideoCapturer) FrameChannel() <-chan *capture.Frame {
+	return c.frames.FrameChannel()
+}
+
+// Dropped returns the number of frames that were replaced by newer ones
+// before they were consumed.
+func (c *VideoCapturer) Dropped() uint64 {
+	return c.frames.Dropped()
 }
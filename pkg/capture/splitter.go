@@ -0,0 +1,186 @@
+package capture
+
+import (
+	"errors"
+	"image"
+	"sync"
+	"sync/atomic"
+)
+
+// Splitter shares a single VideoCapturer among several consumers, so that
+// a display is only captured once however many pipelines read from it. Each
+// consumer gets a Branch, which behaves like a capturer of its own. The
+// shared capturer is started by the first branch to start, and stopped
+// along with the last branch; it can't be started again afterwards.
+type Splitter struct {
+	capturer VideoCapturer
+
+	mu       sync.Mutex // protects access to the fields below
+	branches map[*Branch]struct{}
+	started  bool
+	stopped  bool
+}
+
+func NewSplitter(capturer VideoCapturer) *Splitter {
+	return &Splitter{
+		capturer: capturer,
+		branches: make(map[*Branch]struct{}),
+	}
+}
+
+// Branch returns a new consumer of the shared capturer's frames.
+func (s *Splitter) Branch() *Branch {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b := &Branch{splitter: s, slot: NewFrameSlot()}
+	if s.stopped {
+		b.slot.Close()
+		return b
+	}
+	s.branches[b] = struct{}{}
+	return b
+}
+
+// Stopped reports whether the shared capturer has stopped, either because
+// its last branch was stopped or because it ran out of frames.
+func (s *Splitter) Stopped() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stopped
+}
+
+// Cursor reports the cursor of the shared capturer.
+func (s *Splitter) Cursor() (Cursor, error) {
+	return CurrentCursor(s.capturer)
+}
+
+func (s *Splitter) start() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopped {
+		return errors.New("capturer has stopped")
+	}
+	if s.started {
+		return nil
+	}
+	if err := s.capturer.Start(); err != nil {
+		return err
+	}
+	s.started = true
+	go s.run()
+	return nil
+}
+
+// remove stops a branch, and the shared capturer if that was the last one.
+func (s *Splitter) remove(b *Branch) error {
+	s.mu.Lock()
+	if _, ok := s.branches[b]; !ok {
+		s.mu.Unlock()
+		return nil
+	}
+	delete(s.branches, b)
+	b.slot.Close()
+	last := len(s.branches) == 0 && !s.stopped
+	if last {
+		s.stopped = true
+	}
+	s.mu.Unlock()
+	if last {
+		return s.capturer.Stop()
+	}
+	return nil
+}
+
+func (s *Splitter) run() {
+	for frame := range s.capturer.FrameChannel() {
+		s.mu.Lock()
+		shares := frame.share(len(s.branches))
+		for b := range s.branches {
+			b.slot.Put(shares[len(shares)-1])
+			shares = shares[:len(shares)-1]
+		}
+		s.mu.Unlock()
+	}
+
+	// The capturer stopped on its own, so the branches get no more frames
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stopped = true
+	for b := range s.branches {
+		b.slot.Close()
+		delete(s.branches, b)
+	}
+}
+
+// share returns n frames that refer to f's image, for n consumers to
+// release independently. f's buffers are released along with the last of
+// them.
+func (f *Frame) share(n int) []*Frame {
+	if n == 0 {
+		f.Release()
+		return nil
+	}
+	release := f.release
+	var remaining atomic.Int32
+	remaining.Store(int32(n))
+	shares := make([]*Frame, n)
+	for i := range shares {
+		shared := *f
+		shared.release = func() {
+			if remaining.Add(-1) == 0 && release != nil {
+				release()
+			}
+		}
+		shares[i] = &shared
+	}
+	return shares
+}
+
+// Branch is one consumer's view of a Splitter. Frames that it doesn't take
+// in time are dropped, as by LatestFrames, so a slow consumer never holds
+// up the others.
+type Branch struct {
+	splitter *Splitter
+	slot     *FrameSlot
+}
+
+func (b *Branch) Start() error {
+	return b.splitter.start()
+}
+
+func (b *Branch) Stop() error {
+	return b.splitter.remove(b)
+}
+
+func (b *Branch) GetBounds() image.Rectangle {
+	return b.splitter.capturer.GetBounds()
+}
+
+func (b *Branch) FrameChannel() <-chan *Frame {
+	return b.slot.FrameChannel()
+}
+
+func (b *Branch) Dropped() uint64 {
+	return b.slot.Dropped()
+}
+
+func (b *Branch) Displays() ([]Display, error) {
+	return Displays(b.splitter.capturer)
+}
+
+func (b *Branch) CurrentDisplay() Display {
+	return CurrentDisplay(b.splitter.capturer)
+}
+
+// SelectDisplay only accepts the current display, since switching would
+// switch every other branch too.
+func (b *Branch) SelectDisplay(id int) error {
+	if current := b.CurrentDisplay().ID; id != current {
+		return errors.New("a shared capturer can't switch displays")
+	}
+	return nil
+}
+
+func (b *Branch) Cursor() (Cursor, error) {
+	return b.splitter.Cursor()
+}
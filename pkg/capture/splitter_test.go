@@ -0,0 +1,85 @@
+package capture_test
+
+import (
+	"image"
+	"testing"
+
+	"github.com/adamroach/webrd/mock"
+	"github.com/adamroach/webrd/pkg/capture"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSplitter(t *testing.T) {
+	frames := make(chan *capture.Frame)
+	capturer := mock.NewVideoCapturer(t)
+	capturer.EXPECT().Start().Return(nil).Once()
+	capturer.EXPECT().FrameChannel().Return(frames)
+	capturer.EXPECT().Stop().Run(func() { close(frames) }).Return(nil).Once()
+
+	splitter := capture.NewSplitter(capturer)
+	first, second := splitter.Branch(), splitter.Branch()
+	require.NoError(t, first.Start())
+	require.NoError(t, second.Start())
+
+	// Every branch gets each frame, which is only released once all of
+	// them are done with it
+	pool := capture.NewFramePool()
+	bounds := image.Rect(0, 0, 64, 64)
+	frame := pool.Get(bounds, image.YCbCrSubsampleRatio420)
+	frame.Sequence = 1
+	frames <- frame
+	a, b := <-first.FrameChannel(), <-second.FrameChannel()
+	assert.Equal(t, uint64(1), a.Sequence)
+	assert.Same(t, frame.Image, a.Image)
+	assert.Same(t, frame.Image, b.Image)
+	a.Release()
+	assert.NotSame(t, frame.Image, pool.Get(bounds, image.YCbCrSubsampleRatio420).Image)
+	b.Release()
+	assert.Same(t, frame.Image, pool.Get(bounds, image.YCbCrSubsampleRatio420).Image)
+
+	// A branch that doesn't keep up only gets the newest frame. Each send
+	// returns once the frame before it has been passed on.
+	for i := range 3 {
+		frames <- &capture.Frame{Sequence: uint64(i + 2)}
+	}
+	assert.Positive(t, first.Dropped())
+	assert.Positive(t, second.Dropped())
+	for (<-first.FrameChannel()).Sequence != 4 {
+	}
+
+	// Stopping one branch leaves the others running
+	require.NoError(t, first.Stop())
+	_, ok := <-first.FrameChannel()
+	assert.False(t, ok)
+	frames <- &capture.Frame{Sequence: 5}
+	for (<-second.FrameChannel()).Sequence != 5 {
+	}
+	assert.False(t, splitter.Stopped())
+
+	// The last one stops the capturer, for good
+	require.NoError(t, second.Stop())
+	assert.True(t, splitter.Stopped())
+	late := splitter.Branch()
+	assert.Error(t, late.Start())
+	_, ok = <-late.FrameChannel()
+	assert.False(t, ok)
+}
+
+func TestSplitter_CapturerStops(t *testing.T) {
+	frames := make(chan *capture.Frame)
+	capturer := mock.NewVideoCapturer(t)
+	capturer.EXPECT().Start().Return(nil)
+	capturer.EXPECT().FrameChannel().Return(frames)
+
+	splitter := capture.NewSplitter(capturer)
+	branch := splitter.Branch()
+	require.NoError(t, branch.Start())
+
+	// The branches end along with the capturer's frames
+	close(frames)
+	_, ok := <-branch.FrameChannel()
+	assert.False(t, ok)
+	assert.True(t, splitter.Stopped())
+	require.NoError(t, branch.Stop())
+}
@@ -0,0 +1,114 @@
+package synthetic
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"math"
+	"time"
+
+	"github.com/adamroach/webrd/pkg/capture"
+)
+
+// audioChunk is how much audio each frame holds.
+const audioChunk = 10 * time.Millisecond
+
+// AudioCapturer generates a continuous sine tone, identical on every
+// channel. Frame times advance by exactly the duration of each frame, so the
+// output is sample-accurate no matter how the capture loop is scheduled.
+type AudioCapturer struct {
+	frames    chan (*capture.Frame)
+	stop      chan (struct{})
+	frequency float64
+	amplitude float64
+}
+
+// WithAmplitude sets the peak level of the tone, as a fraction of full
+// scale. The default is 0.25.
+func WithAmplitude(amplitude float64) func(*AudioCapturer) error {
+	return func(c *AudioCapturer) error {
+		if amplitude < 0 || amplitude > 1 {
+			return fmt.Errorf("invalid amplitude %v", amplitude)
+		}
+		c.amplitude = amplitude
+		return nil
+	}
+}
+
+func NewAudioCapturer(frequency float64, opts ...func(*AudioCapturer) error) (*AudioCapturer, error) {
+	if frequency <= 0 || frequency >= capture.AudioSampleRate/2 {
+		return nil, fmt.Errorf("invalid tone frequency %v", frequency)
+	}
+	c := &AudioCapturer{
+		frames:    make(chan *capture.Frame, 4),
+		stop:      make(chan struct{}),
+		frequency: frequency,
+		amplitude: 0.25,
+	}
+	for _, opt := range opts {
+		if err := opt(c); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func (c *AudioCapturer) Start() error {
+	go func() {
+		defer close(c.frames)
+		ticker := time.NewTicker(audioChunk)
+		defer ticker.Stop()
+		samplesPerChunk := int(capture.AudioSampleRate * audioChunk / time.Second)
+		start := time.Now()
+		var sequence, position uint64
+		for {
+			select {
+			case <-c.stop:
+				log.Printf("Stopping synthetic audio capture loop")
+				return
+			case <-ticker.C:
+				sequence++
+				frame := &capture.Frame{
+					Samples:  c.Render(position, samplesPerChunk),
+					Time:     start.Add(time.Duration(position) * time.Second / capture.AudioSampleRate),
+					Sequence: sequence,
+				}
+				position += uint64(samplesPerChunk)
+				if len(c.frames) == cap(c.frames) {
+					// Nobody is keeping up, so this chunk is lost; the gap
+					// shows up in the time of the next one
+					continue
+				}
+				c.frames <- frame
+			}
+		}
+	}()
+	return nil
+}
+
+func (c *AudioCapturer) Stop() error {
+	select {
+	case <-c.stop:
+	default:
+		close(c.stop)
+	}
+	return nil
+}
+
+func (c *AudioCapturer) FrameChannel() <-chan *capture.Frame {
+	return c.frames
+}
+
+// Render generates count samples per channel, starting at the given sample
+// position.
+func (c *AudioCapturer) Render(position uint64, count int) []byte {
+	pcm := make([]byte, 0, count*capture.AudioChannels*2)
+	for i := range count {
+		t := float64(position+uint64(i)) / capture.AudioSampleRate
+		sample := int16(math.Round(c.amplitude * math.MaxInt16 * math.Sin(2*math.Pi*c.frequency*t)))
+		for range capture.AudioChannels {
+			pcm = binary.LittleEndian.AppendUint16(pcm, uint16(sample))
+		}
+	}
+	return pcm
+}
@@ -0,0 +1,69 @@
+package synthetic_test
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/adamroach/webrd/pkg/capture"
+	"github.com/adamroach/webrd/pkg/capture/synthetic"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAudioCapturer_Render(t *testing.T) {
+	c, err := synthetic.NewAudioCapturer(1000, synthetic.WithAmplitude(0.5))
+	require.NoError(t, err)
+
+	// One period of a 1kHz tone is 48 samples: a quarter of the way in is
+	// the peak, and both channels are the same
+	pcm := c.Render(0, 48)
+	require.Len(t, pcm, 48*capture.AudioChannels*2)
+	sample := func(i, channel int) int16 {
+		return int16(binary.LittleEndian.Uint16(pcm[(i*capture.AudioChannels+channel)*2:]))
+	}
+	assert.Equal(t, int16(0), sample(0, 0))
+	assert.Equal(t, int16(16384), sample(12, 0))
+	assert.Equal(t, int16(-16384), sample(36, 1))
+	assert.Equal(t, sample(12, 0), sample(12, 1))
+
+	// Rendering is continuous from one chunk to the next
+	assert.Equal(t, c.Render(0, 96)[len(pcm):], c.Render(48, 48))
+}
+
+func TestAudioCapturer_Frames(t *testing.T) {
+	c, err := synthetic.NewAudioCapturer(440)
+	require.NoError(t, err)
+	require.NoError(t, c.Start())
+
+	var frames []*capture.Frame
+	for len(frames) < 3 {
+		select {
+		case frame := <-c.FrameChannel():
+			frames = append(frames, frame)
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for audio")
+		}
+	}
+	require.NoError(t, c.Stop())
+	for range c.FrameChannel() {
+	}
+
+	// Each frame is 10ms, and its time is exactly that much after the last
+	for i, frame := range frames {
+		assert.Equal(t, uint64(i+1), frame.Sequence)
+		assert.Equal(t, c.Render(uint64(i*480), 480), frame.Samples)
+		if i > 0 {
+			assert.Equal(t, 10*time.Millisecond, frame.Time.Sub(frames[i-1].Time))
+		}
+	}
+}
+
+func TestAudioCapturer_Invalid(t *testing.T) {
+	_, err := synthetic.NewAudioCapturer(0)
+	assert.Error(t, err)
+	_, err = synthetic.NewAudioCapturer(30000)
+	assert.Error(t, err)
+	_, err = synthetic.NewAudioCapturer(440, synthetic.WithAmplitude(2))
+	assert.Error(t, err)
+}
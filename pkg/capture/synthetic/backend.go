@@ -0,0 +1,28 @@
+package synthetic
+
+import (
+	"github.com/adamroach/webrd/pkg/capture"
+	"github.com/adamroach/webrd/pkg/config"
+	"github.com/adamroach/webrd/pkg/hid"
+)
+
+func init() {
+	capture.VideoCapturers.Register("synthetic", func(config *config.Config) (capture.VideoCapturer, error) {
+		format, err := capture.ParseVideoFormat(config.Video)
+		if err != nil {
+			return nil, err
+		}
+		return NewVideoCapturer(
+			config.Video.Framerate,
+			config.Synthetic.Width,
+			config.Synthetic.Height,
+			WithInput(hid.SyntheticInput),
+			WithDisplays(config.Synthetic.Displays),
+			WithFormat(format),
+			WithDrawCursor(config.Video.Cursor == "video"),
+		)
+	})
+	capture.AudioCapturers.Register("synthetic", func(config *config.Config) (capture.AudioCapturer, error) {
+		return NewAudioCapturer(config.Synthetic.ToneFrequency)
+	})
+}
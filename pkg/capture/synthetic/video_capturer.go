@@ -0,0 +1,336 @@
+package synthetic
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/adamroach/webrd/pkg/capture"
+	"github.com/adamroach/webrd/pkg/hid"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+// VideoCapturer generates a deterministic test pattern instead of capturing
+// a real screen: color bars, a clock and frame counter derived from the frame
+// number, a moving marker, and (optionally) an echo of recorded input. This
+// allows the whole pipeline to be exercised on machines without a display.
+// The recorded pointer is reported as a crosshair cursor, which can also be
+// drawn into the frames.
+//
+// Several identical displays can be simulated; they are laid out left to
+// right in the global coordinate space.
+type VideoCapturer struct {
+	frames     *capture.FrameSlot
+	stop       chan (struct{})
+	framerate  int
+	bounds     image.Rectangle
+	input      *hid.Recorder
+	drawCursor bool
+	displays   int
+	format     capture.VideoFormat
+	pool       *capture.FramePool
+	selected   int
+	mu         sync.RWMutex // protects access to selected
+}
+
+// WithInput echoes the state of the given recorder (typically the one used
+// by the synthetic keyboard and mouse) onto each frame.
+func WithInput(recorder *hid.Recorder) func(*VideoCapturer) error {
+	return func(c *VideoCapturer) error {
+		c.input = recorder
+		return nil
+	}
+}
+
+// WithDrawCursor draws the cursor into each frame. By default, it is only
+// reported through Cursor.
+func WithDrawCursor(draw bool) func(*VideoCapturer) error {
+	return func(c *VideoCapturer) error {
+		c.drawCursor = draw
+		return nil
+	}
+}
+
+// WithDisplays simulates the given number of displays.
+func WithDisplays(count int) func(*VideoCapturer) error {
+	return func(c *VideoCapturer) error {
+		if count < 1 {
+			return fmt.Errorf("invalid number of displays %d", count)
+		}
+		c.displays = count
+		return nil
+	}
+}
+
+// WithFormat sets the color space of the generated frames. The default is
+// capture.DefaultVideoFormat.
+func WithFormat(format capture.VideoFormat) func(*VideoCapturer) error {
+	return func(c *VideoCapturer) error {
+		c.format = format
+		return nil
+	}
+}
+
+func NewVideoCapturer(framerate, width, height int, opts ...func(*VideoCapturer) error) (*VideoCapturer, error) {
+	if framerate <= 0 {
+		return nil, fmt.Errorf("invalid framerate %d", framerate)
+	}
+	if width < 64 || height < 64 {
+		return nil, fmt.Errorf("invalid resolution %d x %d", width, height)
+	}
+	c := &VideoCapturer{
+		frames:    capture.NewFrameSlot(),
+		stop:      make(chan struct{}),
+		framerate: framerate,
+		bounds:    image.Rect(0, 0, width, height),
+		displays:  1,
+		format:    capture.DefaultVideoFormat,
+		pool:      capture.NewFramePool(),
+	}
+	for _, opt := range opts {
+		if err := opt(c); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func (c *VideoCapturer) Start() error {
+	go func() {
+		defer c.frames.Close()
+		ticker := time.NewTicker(time.Duration(float64(1*time.Second) / float64(c.framerate)))
+		defer ticker.Stop()
+		var frameNumber uint64
+		for {
+			select {
+			case <-c.stop:
+				log.Printf("Stopping synthetic video capture loop")
+				return
+			case now := <-ticker.C:
+				frameNumber++
+				frame := c.pool.Get(c.bounds, image.YCbCrSubsampleRatio420)
+				c.draw(frame.Image.(*image.YCbCr), frameNumber)
+				frame.Time = now
+				frame.Sequence = frameNumber
+				frame.ColorSpace = c.format.ColorSpace
+				c.frames.Put(frame)
+			}
+		}
+	}()
+	return nil
+}
+
+func (c *VideoCapturer) Stop() error {
+	select {
+	case <-c.stop:
+	default:
+		close(c.stop)
+	}
+	return nil
+}
+
+func (c *VideoCapturer) GetBounds() image.Rectangle {
+	return c.bounds
+}
+
+func (c *VideoCapturer) FrameChannel() <-chan *capture.Frame {
+	return c.frames.FrameChannel()
+}
+
+// Dropped returns the number of frames that were replaced by newer ones
+// before they were consumed.
+func (c *VideoCapturer) Dropped() uint64 {
+	return c.frames.Dropped()
+}
+
+func (c *VideoCapturer) Displays() ([]capture.Display, error) {
+	displays := make([]capture.Display, c.displays)
+	for i := range displays {
+		displays[i] = c.display(i)
+	}
+	return displays, nil
+}
+
+func (c *VideoCapturer) CurrentDisplay() capture.Display {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.display(c.selected)
+}
+
+// Cursor reports the pointer position from the input recorder, as a white
+// crosshair that turns red while a button is held down.
+func (c *VideoCapturer) Cursor() (capture.Cursor, error) {
+	if c.input == nil {
+		return capture.Cursor{}, capture.ErrNoCursor
+	}
+	state := c.input.State()
+	shape := cursorShapes[0]
+	if state.Buttons != 0 {
+		shape = cursorShapes[1]
+	}
+	return capture.Cursor{
+		Visible:  true,
+		Position: image.Pt(state.PointerX, state.PointerY),
+		Shape:    shape,
+	}, nil
+}
+
+func (c *VideoCapturer) SelectDisplay(id int) error {
+	if id < 0 || id >= c.displays {
+		return fmt.Errorf("display %d does not exist", id)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.selected = id
+	return nil
+}
+
+func (c *VideoCapturer) display(id int) capture.Display {
+	return capture.Display{
+		ID:      id,
+		Name:    fmt.Sprintf("Synthetic %d", id+1),
+		Primary: id == 0,
+		Bounds:  c.bounds.Add(image.Pt(id*c.bounds.Dx(), 0)),
+		Scale:   1,
+	}
+}
+
+var bars = []color.RGBA{
+	{255, 255, 255, 255}, // white
+	{255, 255, 0, 255},   // yellow
+	{0, 255, 255, 255},   // cyan
+	{0, 255, 0, 255},     // green
+	{255, 0, 255, 255},   // magenta
+	{255, 0, 0, 255},     // red
+	{0, 0, 255, 255},     // blue
+	{0, 0, 0, 255},       // black
+}
+
+// Render draws the given frame. The output depends only on the frame
+// number, the selected display and the recorded input state, so identical
+// inputs produce identical frames.
+func (c *VideoCapturer) Render(frameNumber uint64) *image.YCbCr {
+	img := c.format.NewImage(c.bounds)
+	c.draw(img, frameNumber)
+	return img
+}
+
+// draw renders the given frame into img, overwriting all of it.
+func (c *VideoCapturer) draw(img *image.YCbCr, frameNumber uint64) {
+	display := c.CurrentDisplay()
+	toYCbCr := func(rgb color.RGBA) color.YCbCr {
+		return c.format.ColorSpace.Color(rgb.R, rgb.G, rgb.B)
+	}
+	white := toYCbCr(color.RGBA{255, 255, 255, 255})
+	black := toYCbCr(color.RGBA{0, 0, 0, 255})
+	red := toYCbCr(color.RGBA{255, 0, 0, 255})
+	width := c.bounds.Dx()
+	height := c.bounds.Dy()
+	barsHeight := height * 2 / 3
+	scale := max(1, height/240)
+
+	for i, bar := range bars {
+		fillRect(img, image.Rect(i*width/len(bars), 0, (i+1)*width/len(bars), barsHeight), toYCbCr(bar))
+	}
+	fillRect(img, image.Rect(0, barsHeight, width, height), black)
+
+	// A marker that sweeps across the screen every two seconds
+	markerWidth := 4 * scale
+	markerX := int(frameNumber*uint64(width)/uint64(2*c.framerate)) % width
+	fillRect(img, image.Rect(markerX, barsHeight, markerX+markerWidth, barsHeight+markerWidth), white)
+
+	elapsed := time.Duration(frameNumber) * time.Second / time.Duration(c.framerate)
+	lines := []string{
+		fmt.Sprintf("webrd synthetic %dx%d @ %d fps", width, height, c.framerate),
+		fmt.Sprintf("display %d of %d at %d,%d", display.ID+1, c.displays, display.Bounds.Min.X, display.Bounds.Min.Y),
+		fmt.Sprintf("frame %08d  %02d:%02d:%02d.%03d", frameNumber,
+			int(elapsed.Hours()), int(elapsed.Minutes())%60, int(elapsed.Seconds())%60, elapsed.Milliseconds()%1000),
+	}
+
+	var state hid.InputState
+	if c.input != nil {
+		state = c.input.State()
+		lines = append(lines,
+			fmt.Sprintf("pointer %d,%d  buttons %03b  events %d", state.PointerX, state.PointerY, state.Buttons, state.Events),
+			"keys "+strings.Join(state.RecentKeys, " "),
+		)
+	}
+
+	lineHeight := basicfont.Face7x13.Height * scale
+	y := barsHeight + markerWidth + lineHeight/2
+	for _, line := range lines {
+		drawText(img, image.Pt(lineHeight/2, y), scale, line, white)
+		y += lineHeight
+	}
+
+	if c.input != nil && c.drawCursor {
+		cursorColor := white
+		if state.Buttons != 0 {
+			cursorColor = red
+		}
+		size := 8 * scale
+		// The pointer position is in global coordinates
+		x, y := state.PointerX-display.Bounds.Min.X, state.PointerY-display.Bounds.Min.Y
+		fillRect(img, image.Rect(x-size, y-scale, x+size, y+scale), cursorColor)
+		fillRect(img, image.Rect(x-scale, y-size, x+scale, y+size), cursorColor)
+	}
+}
+
+// cursorShapes are the crosshairs reported by Cursor: white, and red for
+// when a button is pressed.
+var cursorShapes = []*capture.CursorShape{
+	crosshair(1, color.NRGBA{255, 255, 255, 255}),
+	crosshair(2, color.NRGBA{255, 0, 0, 255}),
+}
+
+func crosshair(serial uint64, c color.NRGBA) *capture.CursorShape {
+	const size = 8
+	img := image.NewNRGBA(image.Rect(0, 0, 2*size, 2*size))
+	for i := range 2 * size {
+		for _, j := range []int{size - 1, size} {
+			img.SetNRGBA(i, j, c)
+			img.SetNRGBA(j, i, c)
+		}
+	}
+	return &capture.CursorShape{Serial: serial, Image: img, Hotspot: image.Pt(size, size)}
+}
+
+func fillRect(img *image.YCbCr, r image.Rectangle, c color.YCbCr) {
+	r = r.Intersect(img.Rect)
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			img.Y[img.YOffset(x, y)] = c.Y
+			offset := img.COffset(x, y)
+			img.Cb[offset] = c.Cb
+			img.Cr[offset] = c.Cr
+		}
+	}
+}
+
+// drawText renders text with basicfont, scaled up by an integer factor,
+// with its top left corner at the given point.
+func drawText(img *image.YCbCr, at image.Point, scale int, text string, c color.YCbCr) {
+	face := basicfont.Face7x13
+	mask := image.NewAlpha(image.Rect(0, 0, face.Advance*len(text), face.Height))
+	drawer := font.Drawer{
+		Dst:  mask,
+		Src:  image.Opaque,
+		Face: face,
+		Dot:  fixed.P(0, face.Ascent),
+	}
+	drawer.DrawString(text)
+	for y := 0; y < mask.Rect.Dy(); y++ {
+		for x := 0; x < mask.Rect.Dx(); x++ {
+			if mask.AlphaAt(x, y).A >= 0x80 {
+				pixel := image.Rect(0, 0, scale, scale).Add(at.Add(image.Pt(x*scale, y*scale)))
+				fillRect(img, pixel, c)
+			}
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package synthetic_test
+
+import (
+	"image"
+	"image/color"
+	"testing"
+	"time"
+
+	"github.com/adamroach/webrd/pkg/capture"
+	"github.com/adamroach/webrd/pkg/capture/synthetic"
+	"github.com/adamroach/webrd/pkg/hid"
+	"github.com/adamroach/webrd/pkg/hid/key"
+	"github.com/adamroach/webrd/pkg/imageconvert"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRender_Deterministic(t *testing.T) {
+	c, err := synthetic.NewVideoCapturer(30, 320, 240)
+	require.NoError(t, err)
+
+	first := c.Render(42)
+	second := c.Render(42)
+	assert.Equal(t, first, second)
+	assert.NotEqual(t, first, c.Render(43))
+}
+
+func TestRender_ColorBars(t *testing.T) {
+	c, err := synthetic.NewVideoCapturer(30, 320, 240)
+	require.NoError(t, err)
+	img := c.Render(0)
+
+	// Center of the first bar is white, and the center of the sixth is red
+	colorSpace := capture.DefaultVideoFormat.ColorSpace
+	assert.Equal(t, image.YCbCrSubsampleRatio420, img.SubsampleRatio)
+	assert.Equal(t, colorSpace.Color(255, 255, 255), img.YCbCrAt(20, 80))
+	assert.Equal(t, colorSpace.Color(255, 0, 0), img.YCbCrAt(220, 80))
+}
+
+func TestRender_Format(t *testing.T) {
+	format := capture.VideoFormat{
+		ColorSpace: imageconvert.ColorSpace{Matrix: imageconvert.BT601, FullRange: true},
+	}
+	c, err := synthetic.NewVideoCapturer(30, 320, 240, synthetic.WithFormat(format))
+	require.NoError(t, err)
+	img := c.Render(0)
+
+	y, cb, cr := color.RGBToYCbCr(255, 0, 0)
+	assert.Equal(t, color.YCbCr{Y: y, Cb: cb, Cr: cr}, img.YCbCrAt(220, 80))
+}
+
+func TestRender_EchoesInput(t *testing.T) {
+	recorder := hid.NewRecorder(4)
+	c, err := synthetic.NewVideoCapturer(30, 320, 240, synthetic.WithInput(recorder))
+	require.NoError(t, err)
+	before := c.Render(1)
+
+	mouse := hid.NewSyntheticMouse(recorder)
+	keyboard := hid.NewSyntheticKeyboard(recorder)
+	require.NoError(t, mouse.Move(100, 50))
+	require.NoError(t, keyboard.Key(key.Event{Key: "a", Code: key.CodeKeyA, KeyDown: true}))
+	require.NoError(t, keyboard.Key(key.Event{Key: "a", Code: key.CodeKeyA, KeyDown: false}))
+
+	state := recorder.State()
+	assert.Equal(t, 100, state.PointerX)
+	assert.Equal(t, 50, state.PointerY)
+	assert.Equal(t, []string{"a"}, state.RecentKeys)
+	assert.Equal(t, uint64(3), state.Events)
+
+	after := c.Render(1)
+	assert.NotEqual(t, before, after)
+}
+
+func TestVideoCapturer_Frames(t *testing.T) {
+	c, err := synthetic.NewVideoCapturer(60, 128, 96)
+	require.NoError(t, err)
+	assert.Equal(t, image.Rect(0, 0, 128, 96), c.GetBounds())
+
+	require.NoError(t, c.Start())
+	select {
+	case frame := <-c.FrameChannel():
+		assert.Equal(t, image.Rect(0, 0, 128, 96), frame.Image.Bounds())
+		assert.Equal(t, uint64(1), frame.Sequence)
+		assert.False(t, frame.Time.IsZero())
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for frame")
+	}
+	require.NoError(t, c.Stop())
+	for range c.FrameChannel() {
+	}
+}
+
+func TestVideoCapturer_Displays(t *testing.T) {
+	recorder := hid.NewRecorder(8)
+	c, err := synthetic.NewVideoCapturer(30, 320, 240, synthetic.WithDisplays(2), synthetic.WithInput(recorder), synthetic.WithDrawCursor(true))
+	require.NoError(t, err)
+
+	displays, err := c.Displays()
+	require.NoError(t, err)
+	require.Len(t, displays, 2)
+	assert.Equal(t, image.Rect(0, 0, 320, 240), displays[0].Bounds)
+	assert.True(t, displays[0].Primary)
+	assert.Equal(t, image.Rect(320, 0, 640, 240), displays[1].Bounds)
+	assert.False(t, displays[1].Primary)
+	assert.Equal(t, displays[0], c.CurrentDisplay())
+
+	first := c.Render(1)
+	require.NoError(t, c.SelectDisplay(1))
+	assert.Equal(t, displays[1], c.CurrentDisplay())
+	second := c.Render(1)
+	assert.NotEqual(t, first, second)
+	assert.Equal(t, image.Rect(0, 0, 320, 240), second.Bounds())
+
+	// The pointer is drawn relative to the selected display
+	require.NoError(t, hid.NewSyntheticMouse(recorder).Move(400, 20))
+	img := c.Render(1)
+	assert.Equal(t, capture.DefaultVideoFormat.ColorSpace.Color(255, 255, 255), img.At(80, 20))
+
+	assert.Error(t, c.SelectDisplay(2))
+}
+
+func TestVideoCapturer_Cursor(t *testing.T) {
+	c, err := synthetic.NewVideoCapturer(30, 320, 240)
+	require.NoError(t, err)
+	_, err = c.Cursor()
+	assert.Equal(t, capture.ErrNoCursor, err)
+
+	recorder := hid.NewRecorder(4)
+	c, err = synthetic.NewVideoCapturer(30, 320, 240, synthetic.WithInput(recorder))
+	require.NoError(t, err)
+	mouse := hid.NewSyntheticMouse(recorder)
+	require.NoError(t, mouse.Move(100, 50))
+	cursor, err := c.Cursor()
+	require.NoError(t, err)
+	assert.True(t, cursor.Visible)
+	assert.Equal(t, image.Pt(100, 50), cursor.Position)
+	require.NotNil(t, cursor.Shape)
+	hotspot := cursor.Shape.Hotspot
+	assert.Equal(t, color.NRGBA{255, 255, 255, 255}, cursor.Shape.Image.NRGBAAt(hotspot.X, hotspot.Y))
+
+	// The cursor isn't drawn into the frames unless asked for; the center
+	// of the sixth bar is red
+	colorSpace := capture.DefaultVideoFormat.ColorSpace
+	require.NoError(t, mouse.Move(220, 80))
+	assert.Equal(t, colorSpace.Color(255, 0, 0), c.Render(1).YCbCrAt(220, 80))
+	drawn, err := synthetic.NewVideoCapturer(30, 320, 240, synthetic.WithInput(recorder), synthetic.WithDrawCursor(true))
+	require.NoError(t, err)
+	assert.Equal(t, colorSpace.Color(255, 255, 255), drawn.Render(1).YCbCrAt(220, 80))
+
+	require.NoError(t, mouse.Button(0, 220, 80, true))
+	pressed, err := c.Cursor()
+	require.NoError(t, err)
+	assert.NotEqual(t, cursor.Shape.Serial, pressed.Shape.Serial)
+}
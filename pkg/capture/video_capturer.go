@@ -6,5 +6,5 @@ type VideoCapturer interface {
 	Start() error
 	Stop() error
 	GetBounds() image.Rectangle
-	FrameChannel() <-chan image.Image // TODO -- include timestamp information
+	FrameChannel() <-chan *Frame
 }
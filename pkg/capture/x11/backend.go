@@ -0,0 +1,24 @@
+//go:build linux
+
+package x11
+
+import (
+	"github.com/adamroach/webrd/pkg/capture"
+	"github.com/adamroach/webrd/pkg/config"
+)
+
+func init() {
+	capture.VideoCapturers.Register("x11", func(config *config.Config) (capture.VideoCapturer, error) {
+		format, err := capture.ParseVideoFormat(config.Video)
+		if err != nil {
+			return nil, err
+		}
+		return NewVideoCapturer(
+			config.Video.Framerate,
+			WithDisplay(config.X11.Display),
+			WithScreen(config.X11.Screen),
+			WithFormat(format),
+			WithDrawCursor(config.Video.Cursor == "video"),
+		)
+	})
+}
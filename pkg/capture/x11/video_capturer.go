@@ -0,0 +1,527 @@
+//go:build linux
+
+package x11
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/adamroach/webrd/pkg/capture"
+	"github.com/gen2brain/shm"
+	"github.com/jezek/xgb"
+	"github.com/jezek/xgb/randr"
+	xshm "github.com/jezek/xgb/shm"
+	"github.com/jezek/xgb/xfixes"
+	"github.com/jezek/xgb/xproto"
+)
+
+// VideoCapturer grabs the contents of an X11 root window. When the X server
+// supports the MIT-SHM extension, pixels are transferred through a shared
+// memory segment rather than over the X connection. When it supports RandR
+// 1.5, each monitor is offered as a separate display; otherwise, the whole
+// root window is treated as a single display.
+type VideoCapturer struct {
+	frames       *capture.FrameSlot
+	stop         chan (struct{})
+	framerate    int
+	sequence     uint64
+	display      string // X display name; empty means use $DISPLAY
+	screenNumber int
+	format       capture.VideoFormat
+	pool         *capture.FramePool
+	drawCursor   bool
+
+	conn       *xgb.Conn
+	root       xproto.Window
+	useShm     bool
+	useRandr   bool
+	useXfixes  bool
+	seg        xshm.Seg
+	shmId      int
+	shmBuf     []byte
+	screenSize image.Point
+
+	bounds   image.Rectangle // size of the captured frames
+	selected capture.Display
+	shape    *capture.CursorShape // the most recent cursor shape, reused while its serial is unchanged
+	running  bool                 // the capture loop owns the connection, and closes it when it stops
+	mu       sync.RWMutex         // protects access to screenSize, bounds, selected, shape and running
+}
+
+// WithDisplay selects the X display to capture from (e.g. ":1"). By
+// default, the display named by the DISPLAY environment variable is used.
+func WithDisplay(display string) func(*VideoCapturer) error {
+	return func(c *VideoCapturer) error {
+		c.display = display
+		return nil
+	}
+}
+
+// WithScreen selects which X screen (i.e., which root window) to capture.
+func WithScreen(screenNumber int) func(*VideoCapturer) error {
+	return func(c *VideoCapturer) error {
+		if screenNumber < 0 {
+			return fmt.Errorf("invalid screen number %d", screenNumber)
+		}
+		c.screenNumber = screenNumber
+		return nil
+	}
+}
+
+// WithFormat sets the color space of the captured frames. The default is
+// capture.DefaultVideoFormat.
+func WithFormat(format capture.VideoFormat) func(*VideoCapturer) error {
+	return func(c *VideoCapturer) error {
+		c.format = format
+		return nil
+	}
+}
+
+// WithDrawCursor draws the cursor into the captured frames. X never
+// includes the cursor in screen grabs, so by default it is only reported
+// through Cursor.
+func WithDrawCursor(draw bool) func(*VideoCapturer) error {
+	return func(c *VideoCapturer) error {
+		c.drawCursor = draw
+		return nil
+	}
+}
+
+func NewVideoCapturer(framerate int, opts ...func(*VideoCapturer) error) (*VideoCapturer, error) {
+	if framerate <= 0 {
+		return nil, fmt.Errorf("invalid framerate %d", framerate)
+	}
+	c := &VideoCapturer{
+		frames:    capture.NewFrameSlot(),
+		stop:      make(chan struct{}),
+		framerate: framerate,
+		format:    capture.DefaultVideoFormat,
+		pool:      capture.NewFramePool(),
+		shmId:     -1,
+	}
+	for _, opt := range opts {
+		if err := opt(c); err != nil {
+			return nil, err
+		}
+	}
+
+	var err error
+	c.conn, err = xgb.NewConnDisplay(c.display)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to X server: %v", err)
+	}
+
+	setup := xproto.Setup(c.conn)
+	if c.screenNumber >= len(setup.Roots) {
+		c.conn.Close()
+		return nil, fmt.Errorf("screen %d does not exist (X server has %d screens)", c.screenNumber, len(setup.Roots))
+	}
+	screen := setup.Roots[c.screenNumber]
+	if err = checkPixmapFormat(setup, screen.RootDepth); err != nil {
+		c.conn.Close()
+		return nil, err
+	}
+	c.root = screen.Root
+	c.screenSize = image.Pt(int(screen.WidthInPixels), int(screen.HeightInPixels))
+
+	if err = xshm.Init(c.conn); err != nil {
+		log.Printf("MIT-SHM extension not available, falling back to GetImage: %v", err)
+	} else {
+		c.useShm = true
+	}
+
+	if err = randr.Init(c.conn); err == nil {
+		var version *randr.QueryVersionReply
+		version, err = randr.QueryVersion(c.conn, 1, 5).Reply()
+		if err == nil && (version.MajorVersion > 1 || version.MinorVersion >= 5) {
+			c.useRandr = true
+		}
+	}
+	if !c.useRandr {
+		log.Printf("RandR 1.5 not available, capturing the whole X screen as one display")
+	}
+
+	// GetCursorImage needs XFIXES 2.0 or later
+	if err = xfixes.Init(c.conn); err == nil {
+		var version *xfixes.QueryVersionReply
+		version, err = xfixes.QueryVersion(c.conn, 2, 0).Reply()
+		c.useXfixes = err == nil && version.MajorVersion >= 2
+	}
+	if !c.useXfixes {
+		log.Printf("XFIXES 2.0 not available, the cursor can't be captured")
+	}
+
+	displays, err := c.Displays()
+	if err != nil {
+		c.conn.Close()
+		return nil, err
+	}
+	c.selected, err = capture.PrimaryDisplay(displays)
+	if err != nil {
+		c.conn.Close()
+		return nil, err
+	}
+	c.bounds = image.Rectangle{Max: c.selected.Bounds.Size()}
+	return c, nil
+}
+
+// checkPixmapFormat verifies that the root window uses 32-bit pixels, which
+// is what the conversion in captureFrame assumes.
+func checkPixmapFormat(setup *xproto.SetupInfo, depth byte) error {
+	if setup.ImageByteOrder != xproto.ImageOrderLSBFirst {
+		return errors.New("only little-endian X servers are supported")
+	}
+	for _, format := range setup.PixmapFormats {
+		if format.Depth == depth {
+			if format.BitsPerPixel != 32 {
+				return fmt.Errorf("unsupported pixel format: %d bits per pixel", format.BitsPerPixel)
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("no pixmap format for root depth %d", depth)
+}
+
+func (c *VideoCapturer) Start() error {
+	if err := c.allocate(c.GetBounds()); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.running = true
+	c.mu.Unlock()
+	go func() {
+		defer c.conn.Close()
+		defer c.release()
+		defer c.frames.Close()
+		ticker := time.NewTicker(time.Duration(float64(1*time.Second) / float64(c.framerate)))
+		defer ticker.Stop()
+		for {
+			select {
+			case <-c.stop:
+				log.Printf("Stopping X11 video capture loop")
+				return
+			case <-ticker.C:
+				frame, err := c.captureFrame()
+				if err != nil {
+					log.Printf("Error capturing X11 frame; exiting video capture loop: %v", err)
+					return
+				}
+				c.frames.Put(frame)
+			}
+		}
+	}()
+	return nil
+}
+
+// Stop ends capturing and disconnects from the X server. A capturer that
+// was never started, or failed to start, is closed at once.
+func (c *VideoCapturer) Stop() error {
+	select {
+	case <-c.stop:
+		return nil
+	default:
+		close(c.stop)
+	}
+	c.mu.RLock()
+	running := c.running
+	c.mu.RUnlock()
+	if !running {
+		c.release()
+		c.conn.Close()
+	}
+	return nil
+}
+
+func (c *VideoCapturer) GetBounds() image.Rectangle {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.bounds
+}
+
+func (c *VideoCapturer) FrameChannel() <-chan *capture.Frame {
+	return c.frames.FrameChannel()
+}
+
+// Dropped returns the number of frames that were replaced by newer ones
+// before they were consumed.
+func (c *VideoCapturer) Dropped() uint64 {
+	return c.frames.Dropped()
+}
+
+func (c *VideoCapturer) Displays() ([]capture.Display, error) {
+	c.mu.RLock()
+	screenSize := c.screenSize
+	c.mu.RUnlock()
+	whole := []capture.Display{{
+		ID:      0,
+		Name:    fmt.Sprintf("Screen %d", c.screenNumber),
+		Primary: true,
+		Bounds:  image.Rectangle{Max: screenSize},
+		Scale:   1,
+	}}
+	if !c.useRandr {
+		return whole, nil
+	}
+	reply, err := randr.GetMonitors(c.conn, c.root, true).Reply()
+	if err != nil {
+		return nil, fmt.Errorf("could not get monitors: %v", err)
+	}
+	if len(reply.Monitors) == 0 {
+		return whole, nil
+	}
+	displays := make([]capture.Display, len(reply.Monitors))
+	for i, monitor := range reply.Monitors {
+		name := fmt.Sprintf("Monitor %d", i+1)
+		if atom, err := xproto.GetAtomName(c.conn, monitor.Name).Reply(); err == nil {
+			name = atom.Name
+		}
+		displays[i] = capture.Display{
+			ID:      i,
+			Name:    name,
+			Primary: monitor.Primary,
+			Bounds: image.Rect(int(monitor.X), int(monitor.Y),
+				int(monitor.X)+int(monitor.Width), int(monitor.Y)+int(monitor.Height)),
+			Scale: 1,
+		}
+	}
+	return displays, nil
+}
+
+func (c *VideoCapturer) CurrentDisplay() capture.Display {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.selected
+}
+
+func (c *VideoCapturer) SelectDisplay(id int) error {
+	displays, err := c.Displays()
+	if err != nil {
+		return err
+	}
+	display, err := capture.FindDisplay(displays, id)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.selected = display
+	return nil
+}
+
+// refreshDisplay looks up the selected display again after the screen
+// layout changes, falling back to the primary display if it has gone away.
+func (c *VideoCapturer) refreshDisplay() error {
+	displays, err := c.Displays()
+	if err != nil {
+		return err
+	}
+	display, err := capture.FindDisplay(displays, c.CurrentDisplay().ID)
+	if err != nil {
+		if display, err = capture.PrimaryDisplay(displays); err != nil {
+			return err
+		}
+		log.Printf("Selected X11 display has gone away; switching to %s", display.Name)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.selected = display
+	return nil
+}
+
+func (c *VideoCapturer) captureFrame() (*capture.Frame, error) {
+	captureTime := time.Now()
+	geometry, err := xproto.GetGeometry(c.conn, xproto.Drawable(c.root)).Reply()
+	if err != nil {
+		return nil, fmt.Errorf("could not get root window geometry: %v", err)
+	}
+	screenSize := image.Pt(int(geometry.Width), int(geometry.Height))
+	c.mu.RLock()
+	resized := screenSize != c.screenSize
+	c.mu.RUnlock()
+	if resized {
+		log.Printf("X11 screen size changed to %d x %d", screenSize.X, screenSize.Y)
+		c.mu.Lock()
+		c.screenSize = screenSize
+		c.mu.Unlock()
+		if err := c.refreshDisplay(); err != nil {
+			return nil, err
+		}
+	}
+
+	region := c.CurrentDisplay().Bounds.Intersect(image.Rectangle{Max: screenSize})
+	if region.Empty() {
+		return nil, errors.New("selected display is outside of the X screen")
+	}
+	bounds := image.Rectangle{Max: region.Size()}
+	if bounds != c.GetBounds() {
+		log.Printf("X11 capture size changed to %d x %d", bounds.Dx(), bounds.Dy())
+		c.release()
+		if err := c.allocate(bounds); err != nil {
+			return nil, err
+		}
+		c.mu.Lock()
+		c.bounds = bounds
+		c.mu.Unlock()
+	}
+
+	var data []byte
+	if c.useShm {
+		_, err = xshm.GetImage(c.conn, xproto.Drawable(c.root), int16(region.Min.X), int16(region.Min.Y),
+			uint16(bounds.Dx()), uint16(bounds.Dy()), 0xffffffff,
+			xproto.ImageFormatZPixmap, c.seg, 0).Reply()
+		data = c.shmBuf
+	} else {
+		var reply *xproto.GetImageReply
+		reply, err = xproto.GetImage(c.conn, xproto.ImageFormatZPixmap, xproto.Drawable(c.root), int16(region.Min.X), int16(region.Min.Y),
+			uint16(bounds.Dx()), uint16(bounds.Dy()), 0xffffffff).Reply()
+		if reply != nil {
+			data = reply.Data
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not get image: %v", err)
+	}
+
+	if c.drawCursor && c.useXfixes {
+		if err := c.compositeCursor(data, region); err != nil {
+			return nil, err
+		}
+	}
+
+	// X11 hands us BGRX pixels, with no padding between rows
+	frame := c.pool.Get(bounds, image.YCbCrSubsampleRatio420)
+	if err := c.format.ColorSpace.BGRAToYCbCr(frame.Image.(*image.YCbCr), data, bounds.Dx()*4); err != nil {
+		frame.Release()
+		return nil, err
+	}
+	c.sequence++
+	frame.Time = captureTime
+	frame.Sequence = c.sequence
+	frame.ColorSpace = c.format.ColorSpace
+	return frame, nil
+}
+
+func (c *VideoCapturer) allocate(bounds image.Rectangle) error {
+	if !c.useShm {
+		return nil
+	}
+	size := bounds.Dx() * bounds.Dy() * 4
+	shmId, err := shm.Get(shm.IPC_PRIVATE, size, shm.IPC_CREAT|0600)
+	if err != nil {
+		return fmt.Errorf("could not create shared memory segment: %v", err)
+	}
+	c.shmId = shmId
+	c.shmBuf, err = shm.At(shmId, 0, 0)
+	if err != nil {
+		c.release()
+		return fmt.Errorf("could not attach shared memory segment: %v", err)
+	}
+	c.seg, err = xshm.NewSegId(c.conn)
+	if err != nil {
+		c.release()
+		return fmt.Errorf("could not allocate shared memory segment id: %v", err)
+	}
+	err = xshm.AttachChecked(c.conn, c.seg, uint32(shmId), false).Check()
+	if err != nil {
+		c.seg = 0
+		c.release()
+		return fmt.Errorf("X server could not attach shared memory segment: %v", err)
+	}
+	return nil
+}
+
+func (c *VideoCapturer) release() {
+	if c.seg != 0 {
+		xshm.Detach(c.conn, c.seg)
+		c.seg = 0
+	}
+	if c.shmBuf != nil {
+		_ = shm.Dt(c.shmBuf)
+		c.shmBuf = nil
+	}
+	if c.shmId >= 0 {
+		_ = shm.Rm(c.shmId)
+		c.shmId = -1
+	}
+}
+
+// Cursor returns the cursor's position and shape. The shape's pixels are
+// only fetched again when XFIXES reports a new cursor serial.
+func (c *VideoCapturer) Cursor() (capture.Cursor, error) {
+	if !c.useXfixes {
+		return capture.Cursor{}, capture.ErrNoCursor
+	}
+	reply, err := xfixes.GetCursorImage(c.conn).Reply()
+	if err != nil {
+		return capture.Cursor{}, fmt.Errorf("could not get cursor image: %v", err)
+	}
+	cursor := capture.Cursor{
+		Visible:  reply.Width > 0 && reply.Height > 0,
+		Position: image.Pt(int(reply.X), int(reply.Y)),
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.shape == nil || c.shape.Serial != uint64(reply.CursorSerial) {
+		c.shape = cursorShape(reply)
+	}
+	cursor.Shape = c.shape
+	return cursor, nil
+}
+
+// cursorShape converts an XFIXES cursor image, which is premultiplied ARGB.
+func cursorShape(reply *xfixes.GetCursorImageReply) *capture.CursorShape {
+	width, height := int(reply.Width), int(reply.Height)
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for i, pixel := range reply.CursorImage[:width*height] {
+		a := pixel >> 24
+		if a == 0 {
+			continue
+		}
+		unpremultiply := func(v uint32) uint8 {
+			return uint8(min((v&0xff)*255/a, 255))
+		}
+		img.Pix[i*4] = unpremultiply(pixel >> 16)
+		img.Pix[i*4+1] = unpremultiply(pixel >> 8)
+		img.Pix[i*4+2] = unpremultiply(pixel)
+		img.Pix[i*4+3] = uint8(a)
+	}
+	return &capture.CursorShape{
+		Serial:  uint64(reply.CursorSerial),
+		Image:   img,
+		Hotspot: image.Pt(int(reply.Xhot), int(reply.Yhot)),
+	}
+}
+
+// compositeCursor blends the cursor into a buffer of BGRX pixels that was
+// captured from the given region of the screen.
+func (c *VideoCapturer) compositeCursor(data []byte, region image.Rectangle) error {
+	reply, err := xfixes.GetCursorImage(c.conn).Reply()
+	if err != nil {
+		return fmt.Errorf("could not get cursor image: %v", err)
+	}
+	width, height := int(reply.Width), int(reply.Height)
+	origin := image.Pt(int(reply.X)-int(reply.Xhot), int(reply.Y)-int(reply.Yhot))
+	area := image.Rect(0, 0, width, height).Add(origin).Intersect(region)
+	stride := region.Dx() * 4
+	for y := area.Min.Y; y < area.Max.Y; y++ {
+		for x := area.Min.X; x < area.Max.X; x++ {
+			pixel := reply.CursorImage[(y-origin.Y)*width+x-origin.X]
+			a := pixel >> 24
+			if a == 0 {
+				continue
+			}
+			// Both are premultiplied, so this is a plain "over" blend
+			offset := (y-region.Min.Y)*stride + (x-region.Min.X)*4
+			for i, shift := range []int{0, 8, 16} {
+				src := (pixel >> shift) & 0xff
+				dst := uint32(data[offset+i])
+				data[offset+i] = uint8(min(src+dst*(255-a)/255, 255))
+			}
+		}
+	}
+	return nil
+}
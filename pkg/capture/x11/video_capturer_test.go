@@ -0,0 +1,142 @@
+//go:build linux
+
+package x11_test
+
+import (
+	"fmt"
+	"image"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/adamroach/webrd/pkg/capture/x11"
+	"github.com/jezek/xgb"
+	"github.com/jezek/xgb/xproto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var nextDisplay = 90 + os.Getpid()%100
+
+// startXvfb launches a virtual X server for the duration of the test, and
+// returns its display name. The test is skipped if Xvfb isn't installed.
+func startXvfb(t *testing.T, width, height int) string {
+	path, err := exec.LookPath("Xvfb")
+	if err != nil {
+		t.Skip("Xvfb not installed")
+	}
+	display := fmt.Sprintf(":%d", nextDisplay)
+	nextDisplay++
+	cmd := exec.Command(path, display, "-screen", "0", fmt.Sprintf("%dx%dx24", width, height), "-nolisten", "tcp")
+	require.NoError(t, cmd.Start())
+	t.Cleanup(func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	})
+
+	// Wait for the server to come up
+	for range 50 {
+		conn, err := xgb.NewConnDisplay(display)
+		if err == nil {
+			conn.Close()
+			return display
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatalf("Xvfb did not start on display %s", display)
+	return ""
+}
+
+func TestVideoCapturer(t *testing.T) {
+	display := startXvfb(t, 640, 480)
+
+	c, err := x11.NewVideoCapturer(30, x11.WithDisplay(display))
+	require.NoError(t, err)
+	assert.Equal(t, image.Rect(0, 0, 640, 480), c.GetBounds())
+
+	require.NoError(t, c.Start())
+	select {
+	case frame := <-c.FrameChannel():
+		require.NotNil(t, frame)
+		assert.False(t, frame.Time.IsZero())
+		yuv, ok := frame.Image.(*image.YCbCr)
+		require.True(t, ok)
+		assert.Equal(t, image.YCbCrSubsampleRatio420, yuv.SubsampleRatio)
+		assert.Equal(t, image.Rect(0, 0, 640, 480), yuv.Bounds())
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for frame")
+	}
+	require.NoError(t, c.Stop())
+
+	// The frame channel is closed once the capture loop exits
+	for range c.FrameChannel() {
+	}
+}
+
+func TestVideoCapturer_InvalidScreen(t *testing.T) {
+	display := startXvfb(t, 320, 240)
+
+	_, err := x11.NewVideoCapturer(30, x11.WithDisplay(display), x11.WithScreen(3))
+	assert.Error(t, err)
+}
+
+func TestVideoCapturer_StopWithoutStart(t *testing.T) {
+	display := startXvfb(t, 320, 240)
+
+	// A capturer that never ran lets go of its connection when stopped,
+	// and stopping it again does nothing
+	c, err := x11.NewVideoCapturer(30, x11.WithDisplay(display))
+	require.NoError(t, err)
+	require.NoError(t, c.Stop())
+	require.NoError(t, c.Stop())
+}
+
+func TestVideoCapturer_InvalidFramerate(t *testing.T) {
+	// Rejected before connecting, so no X server is needed
+	_, err := x11.NewVideoCapturer(0)
+	assert.Error(t, err)
+	_, err = x11.NewVideoCapturer(-1)
+	assert.Error(t, err)
+}
+
+func TestVideoCapturer_Displays(t *testing.T) {
+	display := startXvfb(t, 640, 480)
+
+	c, err := x11.NewVideoCapturer(30, x11.WithDisplay(display))
+	require.NoError(t, err)
+
+	displays, err := c.Displays()
+	require.NoError(t, err)
+	require.NotEmpty(t, displays)
+	assert.Equal(t, image.Rect(0, 0, 640, 480), displays[0].Bounds)
+	assert.Equal(t, displays[0].ID, c.CurrentDisplay().ID)
+
+	require.NoError(t, c.SelectDisplay(displays[0].ID))
+	assert.Error(t, c.SelectDisplay(len(displays)))
+}
+
+func TestVideoCapturer_Cursor(t *testing.T) {
+	display := startXvfb(t, 640, 480)
+
+	c, err := x11.NewVideoCapturer(30, x11.WithDisplay(display))
+	require.NoError(t, err)
+
+	// Move the pointer with a separate connection, as another client would
+	conn, err := xgb.NewConnDisplay(display)
+	require.NoError(t, err)
+	defer conn.Close()
+	root := xproto.Setup(conn).DefaultScreen(conn).Root
+	require.NoError(t, xproto.WarpPointerChecked(conn, 0, root, 0, 0, 0, 0, 100, 50).Check())
+
+	cursor, err := c.Cursor()
+	require.NoError(t, err)
+	assert.Equal(t, image.Pt(100, 50), cursor.Position)
+	require.NotNil(t, cursor.Shape)
+	assert.False(t, cursor.Shape.Image.Bounds().Empty())
+
+	// The shape is only converted again when it changes
+	again, err := c.Cursor()
+	require.NoError(t, err)
+	assert.Same(t, cursor.Shape, again.Shape)
+}
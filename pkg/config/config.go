@@ -3,6 +3,7 @@ package config
 import (
 	"fmt"
 	"log"
+	"runtime"
 	"strings"
 
 	"github.com/spf13/viper"
@@ -13,8 +14,14 @@ type Config struct {
 	viper *viper.Viper
 
 	BindAddresses []string    `mapstructure:"bind_addresses" yaml:"bind_addresses"`
+	Backends      Backends    `mapstructure:"backends" yaml:"backends"`
 	Video         Video       `mapstructure:"video" yaml:"video"`
+	Audio         Audio       `mapstructure:"audio" yaml:"audio"`
+	X11           X11         `mapstructure:"x11" yaml:"x11"`
+	PulseAudio    PulseAudio  `mapstructure:"pulseaudio" yaml:"pulseaudio"`
+	Synthetic     Synthetic   `mapstructure:"synthetic" yaml:"synthetic"`
 	IceServers    []IceServer `mapstructure:"ice_servers" yaml:"ice_servers"`
+	Turn          Turn        `mapstructure:"turn" yaml:"turn"`
 	Tls           Tls         `mapstructure:"tls" yaml:"tls"`
 	Security      Security    `mapstructure:"security" yaml:"security"`
 	Auth          Auth        `mapstructure:"auth" yaml:"auth"`
@@ -24,6 +31,7 @@ type Auth struct {
 	UseSystemAuth      bool   `mapstructure:"use_system_auth" yaml:"use_system_auth"`
 	HmacKey            string `mapstructure:"hmac_key" yaml:"hmac_key"`
 	TokenValidityHours int    `mapstructure:"token_validity_hours" yaml:"token_validity_hours"`
+	ResumeGraceSeconds int    `mapstructure:"resume_grace_seconds" yaml:"resume_grace_seconds"` // How long a session waits for its client to reconnect; 0 ends it at once
 	Users              []User `mapstructure:"users" yaml:"users"`
 }
 
@@ -32,9 +40,58 @@ type User struct {
 	Password string `mapstructure:"password" yaml:"password"`
 }
 
+// Backends names the implementation used for each kind of device. The
+// available names depend on the platform and build tags; "null" is always
+// available, and disables the corresponding device.
+type Backends struct {
+	Video    string `mapstructure:"video" yaml:"video"`
+	Audio    string `mapstructure:"audio" yaml:"audio"`
+	Keyboard string `mapstructure:"keyboard" yaml:"keyboard"`
+	Mouse    string `mapstructure:"mouse" yaml:"mouse"`
+}
+
+type X11 struct {
+	Display string `mapstructure:"display" yaml:"display"` // Empty means use $DISPLAY
+	Screen  int    `mapstructure:"screen" yaml:"screen"`
+}
+
+type PulseAudio struct {
+	Server string `mapstructure:"server" yaml:"server"` // Empty means use $PULSE_SERVER or the local server
+	Device string `mapstructure:"device" yaml:"device"` // Sink or source name; empty means the default sink's monitor
+}
+
+// Synthetic configures the test-pattern video backend and the sine-tone
+// audio backend
+type Synthetic struct {
+	Width         int     `mapstructure:"width" yaml:"width"`
+	Height        int     `mapstructure:"height" yaml:"height"`
+	Displays      int     `mapstructure:"displays" yaml:"displays"`
+	ToneFrequency float64 `mapstructure:"tone_frequency" yaml:"tone_frequency"` // in Hz
+}
+
 type Video struct {
-	Bitrate   int `mapstructure:"bitrate" yaml:"bitrate"`
-	Framerate int `mapstructure:"framerate" yaml:"framerate"`
+	Bitrate        int      `mapstructure:"bitrate" yaml:"bitrate"`                   // The starting and highest bitrate
+	Framerate      int      `mapstructure:"framerate" yaml:"framerate"`               // The highest framerate
+	MinBitrate     int      `mapstructure:"min_bitrate" yaml:"min_bitrate"`           // Congestion control never goes lower
+	MinFramerate   int      `mapstructure:"min_framerate" yaml:"min_framerate"`       // Lowest framerate when bandwidth is short
+	MinScale       float64  `mapstructure:"min_scale" yaml:"min_scale"`               // Smallest fraction of the size to scale down to when bandwidth is short
+	DamageTileSize int      `mapstructure:"damage_tile_size" yaml:"damage_tile_size"` // 0 disables change detection
+	IdleFramerate  int      `mapstructure:"idle_framerate" yaml:"idle_framerate"`     // Framerate while the screen is unchanged
+	MaxWidth       int      `mapstructure:"max_width" yaml:"max_width"`               // Larger screens are scaled down; 0 means no limit
+	MaxHeight      int      `mapstructure:"max_height" yaml:"max_height"`             // Larger screens are scaled down; 0 means no limit
+	Scaler         string   `mapstructure:"scaler" yaml:"scaler"`                     // "area" or "bilinear"
+	ColorMatrix    string   `mapstructure:"color_matrix" yaml:"color_matrix"`         // "bt709" or "bt601"
+	ColorRange     string   `mapstructure:"color_range" yaml:"color_range"`           // "limited" or "full"
+	Cursor         string   `mapstructure:"cursor" yaml:"cursor"`                     // "client" draws the cursor in the browser; "video" draws it into the frames
+	Codecs         []string `mapstructure:"codecs" yaml:"codecs"`                     // In order of preference; the browser picks from these
+
+	KeyframeMinIntervalMs   int  `mapstructure:"keyframe_min_interval_ms" yaml:"keyframe_min_interval_ms"`   // Keyframe requests from the browser are held back until this long after the last keyframe
+	KeyframeIntervalSeconds int  `mapstructure:"keyframe_interval_seconds" yaml:"keyframe_interval_seconds"` // Send a keyframe at least this often; 0 means only on request
+	IntraRefresh            bool `mapstructure:"intra_refresh" yaml:"intra_refresh"`                         // Recover from loss gradually rather than with keyframes, where the codec can
+}
+
+type Audio struct {
+	Bitrate int `mapstructure:"bitrate" yaml:"bitrate"`
 }
 
 type IceServer struct {
@@ -43,6 +100,18 @@ type IceServer struct {
 	Urls       []string `mapstructure:"urls" yaml:"urls" json:"urls"`
 }
 
+// Turn configures the TURN server that webrdd can run itself, for clients
+// that can't reach it directly, e.g. from behind a symmetric NAT
+type Turn struct {
+	Enabled      bool   `mapstructure:"enabled" yaml:"enabled"`
+	Port         int    `mapstructure:"port" yaml:"port"`           // UDP and TCP port to listen on
+	PublicIP     string `mapstructure:"public_ip" yaml:"public_ip"` // Address that clients reach the server at; empty means the first non-loopback interface's
+	Realm        string `mapstructure:"realm" yaml:"realm"`
+	RelayMinPort int    `mapstructure:"relay_min_port" yaml:"relay_min_port"` // Range of ports to relay from; 0 means any
+	RelayMaxPort int    `mapstructure:"relay_max_port" yaml:"relay_max_port"`
+	RelayOnly    bool   `mapstructure:"relay_only" yaml:"relay_only"` // Clients only use the relay, for networks where nothing else gets through
+}
+
 type Tls struct {
 	Enabled  bool   `mapstructure:"enabled" yaml:"enabled"`
 	CertFile string `mapstructure:"cert_file" yaml:"cert_file"`
@@ -77,11 +146,40 @@ func NewConfig() *Config {
 
 	// Setup default values
 	c.viper.SetDefault("bind_addresses", []string{":8080"})
+	c.viper.SetDefault("backends.video", defaultVideoBackend())
+	c.viper.SetDefault("backends.audio", "null")
+	c.viper.SetDefault("backends.keyboard", defaultInputBackend())
+	c.viper.SetDefault("backends.mouse", defaultInputBackend())
 	c.viper.SetDefault("video.bitrate", 8_000_000)
 	c.viper.SetDefault("video.framerate", 30)
+	c.viper.SetDefault("video.min_bitrate", 300_000)
+	c.viper.SetDefault("video.min_framerate", 10)
+	c.viper.SetDefault("video.min_scale", 0.5)
+	c.viper.SetDefault("video.damage_tile_size", 64)
+	c.viper.SetDefault("video.idle_framerate", 1)
+	c.viper.SetDefault("video.max_width", 0)
+	c.viper.SetDefault("video.max_height", 0)
+	c.viper.SetDefault("video.scaler", "area")
+	c.viper.SetDefault("video.color_matrix", "bt709")
+	c.viper.SetDefault("video.color_range", "limited")
+	c.viper.SetDefault("video.cursor", "client")
+	c.viper.SetDefault("video.codecs", []string{"h264"})
+	c.viper.SetDefault("video.keyframe_min_interval_ms", 500)
+	c.viper.SetDefault("video.keyframe_interval_seconds", 0)
+	c.viper.SetDefault("video.intra_refresh", false)
+	c.viper.SetDefault("synthetic.width", 1280)
+	c.viper.SetDefault("synthetic.height", 720)
+	c.viper.SetDefault("synthetic.displays", 1)
+	c.viper.SetDefault("synthetic.tone_frequency", 440)
+	c.viper.SetDefault("audio.bitrate", 64_000)
+	c.viper.SetDefault("turn.enabled", false)
+	c.viper.SetDefault("turn.port", 3478)
+	c.viper.SetDefault("turn.realm", "webrd")
+	c.viper.SetDefault("turn.relay_only", false)
 	c.viper.SetDefault("tls.cert_file", "./cert.pem")
 	c.viper.SetDefault("tls.key_file", "./key.pem")
 	c.viper.SetDefault("security.check_origin", true)
+	c.viper.SetDefault("auth.resume_grace_seconds", 30)
 
 	err = c.viper.Unmarshal(c)
 	if err != nil {
@@ -90,6 +188,28 @@ func NewConfig() *Config {
 	return c
 }
 
+func defaultVideoBackend() string {
+	switch runtime.GOOS {
+	case "darwin":
+		return "darwin"
+	case "linux":
+		return "x11"
+	default:
+		return "screenshot"
+	}
+}
+
+func defaultInputBackend() string {
+	switch runtime.GOOS {
+	case "darwin":
+		return "darwin"
+	case "linux":
+		return "x11"
+	default:
+		return "null"
+	}
+}
+
 func (c *Config) String() string {
 	yaml, err := yaml.Marshal(c)
 	if err != nil {
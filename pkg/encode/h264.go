@@ -0,0 +1,116 @@
+package encode
+
+import (
+	"fmt"
+	"image"
+
+	"github.com/adamroach/webrd/pkg/config"
+	"github.com/adamroach/webrd/pkg/h264"
+	"github.com/adamroach/webrd/pkg/imageconvert"
+	"github.com/pion/mediadevices/pkg/codec"
+	"github.com/pion/mediadevices/pkg/codec/openh264"
+	"github.com/pion/mediadevices/pkg/io/video"
+	"github.com/pion/mediadevices/pkg/prop"
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v4"
+)
+
+func init() {
+	RegisterVideoCodec("h264", NewH264)
+}
+
+// H264 encodes Constrained Baseline profile with openh264, which is always
+// compiled in.
+type H264 struct {
+	Framerate int
+	Bitrate   int
+}
+
+// NewH264 creates an H.264 codec for the configured framerate and bitrate.
+func NewH264(video *config.Video) (VideoCodec, error) {
+	return H264{
+		Framerate: video.Framerate,
+		Bitrate:   video.Bitrate,
+	}, nil
+}
+
+func (H264) Name() string {
+	return "h264"
+}
+
+func (H264) MimeType() string {
+	return webrtc.MimeTypeH264
+}
+
+// Parameters advertises the lowest level that allows video of the given
+// size at the configured framerate and bitrate. Describe writes the same
+// level into the stream.
+func (c H264) Parameters(size image.Point) []webrtc.RTPCodecParameters {
+	fmtp := "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=" + h264.ProfileLevelID(h264.ProfileConstrainedBaseline, c.level(size))
+	return videoParameters(c.MimeType(), fmtp, 102, 121)
+}
+
+func (c H264) Level(size image.Point) int {
+	return int(c.level(size))
+}
+
+func (c H264) level(size image.Point) h264.Level {
+	return h264.LevelFor(size.X, size.Y, c.Framerate, c.Bitrate)
+}
+
+func (H264) NewPayloader() rtp.Payloader {
+	return &codecs.H264Payloader{}
+}
+
+func (H264) NewEncoder(r video.Reader, media prop.Media, bitrate int) (codec.ReadCloser, error) {
+	params, err := openh264.NewParams()
+	if err != nil {
+		return nil, err
+	}
+	params.BitRate = bitrate
+	params.EnableFrameSkip = false
+	// Suppress automatic keyframe generation
+	params.IntraPeriod = 0
+	return params.BuildVideoEncoder(r, media)
+}
+
+func (H264) IsKeyFrame(data []byte) bool {
+	return h264.IsKeyFrame(data)
+}
+
+// Describe rewrites the SPS, since openh264 doesn't describe the colors in
+// it, and otherwise browsers assume limited range BT.601. It also replaces
+// the level that openh264 picked with the one advertised by Parameters.
+func (c H264) Describe(data []byte, size image.Point, colorSpace imageconvert.ColorSpace) ([]byte, error) {
+	var signal *h264.VideoSignal
+	if s, ok := videoSignal(colorSpace); ok {
+		signal = &s
+	}
+	rewritten, err := h264.RewriteSPS(data, c.level(size), signal)
+	if err != nil {
+		return nil, fmt.Errorf("could not rewrite SPS: %v", err)
+	}
+	return rewritten, nil
+}
+
+// videoSignal returns the VUI description of a color space. Screen content
+// is sRGB, which shares its primaries with BT.709, so only the matrix and
+// range vary. Frames with an unknown matrix are left for the decoder to
+// guess.
+func videoSignal(colorSpace imageconvert.ColorSpace) (h264.VideoSignal, bool) {
+	signal := h264.VideoSignal{
+		FullRange:      colorSpace.FullRange,
+		ColorPrimaries: h264.ColorPrimariesBT709,
+		Transfer:       h264.TransferBT709,
+	}
+	switch colorSpace.Matrix {
+	case imageconvert.BT601:
+		signal.Matrix = h264.MatrixBT601
+	case imageconvert.BT709:
+		signal.Matrix = h264.MatrixBT709
+	default:
+		return h264.VideoSignal{}, false
+	}
+	return signal, true
+}
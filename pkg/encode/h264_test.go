@@ -0,0 +1,43 @@
+package encode_test
+
+import (
+	"image"
+	"testing"
+
+	"github.com/adamroach/webrd/pkg/config"
+	"github.com/adamroach/webrd/pkg/encode"
+	"github.com/adamroach/webrd/pkg/imageconvert"
+	"github.com/pion/webrtc/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestH264_DescribeNoSPS(t *testing.T) {
+	// Data without an SPS is left alone, even if it isn't H.264
+	data := []byte{0, 0, 0, 1, 0x09, 0xf0}
+	signalled, err := encode.H264{}.Describe(data, image.Pt(320, 240), imageconvert.ColorSpace{})
+	require.NoError(t, err)
+	assert.Equal(t, data, signalled)
+}
+
+func TestH264_Parameters(t *testing.T) {
+	video := &config.Video{Framerate: 30, Bitrate: 1_000_000}
+	c, err := encode.NewH264(video)
+	require.NoError(t, err)
+
+	// The level follows the size of the video
+	parameters := c.Parameters(image.Pt(1280, 720))
+	require.Len(t, parameters, 2)
+	assert.Equal(t, "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f", parameters[0].SDPFmtpLine)
+	assert.Equal(t, webrtc.PayloadType(102), parameters[0].PayloadType)
+	assert.Equal(t, "apt=102", parameters[1].SDPFmtpLine)
+	assert.Contains(t, c.Parameters(image.Pt(2560, 1600))[0].SDPFmtpLine, "profile-level-id=42e032")
+}
+
+func TestH264_RegisterParameters(t *testing.T) {
+	// Every size gives parameters that a MediaEngine accepts
+	me := &webrtc.MediaEngine{}
+	for _, parameters := range (encode.H264{}).Parameters(image.Point{}) {
+		require.NoError(t, me.RegisterCodec(parameters, webrtc.RTPCodecTypeVideo))
+	}
+}
@@ -0,0 +1,30 @@
+package encode
+
+// isVP8KeyFrame checks the frame tag at the start of a VP8 frame (RFC 6386
+// section 9.1), whose lowest bit is zero for keyframes.
+func isVP8KeyFrame(data []byte) bool {
+	return len(data) >= 3 && data[0]&0x01 == 0
+}
+
+// isVP9KeyFrame checks the start of a VP9 frame's uncompressed header
+// (section 6.2 of the bitstream specification).
+func isVP9KeyFrame(data []byte) bool {
+	if len(data) == 0 {
+		return false
+	}
+	// Bits are numbered from the most significant end
+	bit := func(n int) bool {
+		return data[0]&(0x80>>n) != 0
+	}
+	if data[0]>>6 != 2 { // frame_marker
+		return false
+	}
+	next := 4
+	if bit(2) && bit(3) { // profile 3 has a reserved bit
+		next++
+	}
+	if bit(next) { // show_existing_frame
+		return false
+	}
+	return !bit(next + 1) // frame_type is 0 for keyframes
+}
@@ -0,0 +1,33 @@
+package encode
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsVP8KeyFrame(t *testing.T) {
+	// Frame tags for a keyframe and an interframe, each followed by the
+	// start of a header
+	assert.True(t, isVP8KeyFrame([]byte{0x50, 0x42, 0x00, 0x9d, 0x01, 0x2a}))
+	assert.False(t, isVP8KeyFrame([]byte{0x51, 0x42, 0x00}))
+	assert.False(t, isVP8KeyFrame([]byte{0x50}))
+}
+
+func TestIsVP9KeyFrame(t *testing.T) {
+	for _, test := range []struct {
+		header   byte
+		keyFrame bool
+	}{
+		{0x82, true},  // profile 0 keyframe
+		{0x86, false}, // profile 0 interframe
+		{0x92, true},  // profile 2 keyframe
+		{0xb1, true},  // profile 3 keyframe, after its reserved bit
+		{0xb3, false}, // profile 3 interframe
+		{0x88, false}, // show_existing_frame
+		{0x02, false}, // bad frame_marker
+	} {
+		assert.Equal(t, test.keyFrame, isVP9KeyFrame([]byte{test.header}), "%#02x", test.header)
+	}
+	assert.False(t, isVP9KeyFrame(nil))
+}
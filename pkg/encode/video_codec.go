@@ -0,0 +1,166 @@
+// Package encode provides the video codecs that webrdd can send, each with
+// an encoder and the parameters needed to negotiate it over WebRTC. Codecs
+// register themselves when their package is compiled in, so the set of
+// available names depends on the build tags.
+package encode
+
+import (
+	"fmt"
+	"image"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/adamroach/webrd/pkg/config"
+	"github.com/adamroach/webrd/pkg/imageconvert"
+	"github.com/pion/mediadevices/pkg/codec"
+	"github.com/pion/mediadevices/pkg/io/video"
+	"github.com/pion/mediadevices/pkg/prop"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+// DefaultVideoCodec is used when no codec is configured.
+const DefaultVideoCodec = "h264"
+
+// VideoCodec is a video compression format, along with everything needed to
+// encode it and send it to a browser.
+type VideoCodec interface {
+	// Name identifies the codec in the configuration.
+	Name() string
+	MimeType() string
+	// Parameters returns the codec's RTP formats for video of the given
+	// size, followed by the one for retransmissions.
+	Parameters(size image.Point) []webrtc.RTPCodecParameters
+	NewPayloader() rtp.Payloader
+	// NewEncoder creates an encoder that reads its frames from r.
+	NewEncoder(r video.Reader, media prop.Media, bitrate int) (codec.ReadCloser, error)
+	// IsKeyFrame reports whether an encoded frame can be decoded without
+	// earlier frames.
+	IsKeyFrame(data []byte) bool
+	// Describe adds what the encoder leaves out of the encoded data for a
+	// frame of the given size, where the format has room for it: a
+	// description of the frame's colors, and anything needed to match the
+	// parameters from Parameters.
+	Describe(data []byte, size image.Point, colorSpace imageconvert.ColorSpace) ([]byte, error)
+}
+
+// IntraRefresher is implemented by codecs whose encoders can recover from
+// loss gradually, by intra-coding a band of the picture in each frame, so
+// that there are no keyframes to burst over the network after the first.
+type IntraRefresher interface {
+	VideoCodec
+	// NewIntraRefreshEncoder is like NewEncoder, but the encoder refreshes
+	// the whole picture every period frames.
+	NewIntraRefreshEncoder(r video.Reader, media prop.Media, bitrate, period int) (codec.ReadCloser, error)
+}
+
+// FixedColorSpace is implemented by codecs whose streams don't say how their
+// colors were derived, so that browsers always decode them with the same
+// color space. Frames for them have to be converted with that one.
+type FixedColorSpace interface {
+	VideoCodec
+	ColorSpace() imageconvert.ColorSpace
+}
+
+// Leveled is implemented by codecs whose parameters carry a level, which
+// caps the size of video that the browser has to be ready for. Video that
+// needs no higher level than the negotiated one can be sent without
+// negotiating again.
+type Leveled interface {
+	VideoCodec
+	// Level returns the lowest level that allows video of the given size.
+	// Higher levels allow everything that lower ones do.
+	Level(size image.Point) int
+}
+
+// Factory creates a codec that is set up according to the configuration.
+type Factory func(video *config.Video) (VideoCodec, error)
+
+var (
+	mu        sync.RWMutex // protects access to factories
+	factories = map[string]Factory{}
+)
+
+// RegisterVideoCodec makes a codec available by name.
+func RegisterVideoCodec(name string, factory Factory) {
+	mu.Lock()
+	defer mu.Unlock()
+	if _, ok := factories[name]; ok {
+		panic(fmt.Sprintf("video codec %q registered twice", name))
+	}
+	factories[name] = factory
+}
+
+// VideoCodecNames returns the sorted list of codecs compiled into this
+// binary.
+func VideoCodecNames() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+	names := make([]string, 0, len(factories))
+	for name := range factories {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// NewVideoCodec creates the named codec.
+func NewVideoCodec(name string, video *config.Video) (VideoCodec, error) {
+	mu.RLock()
+	factory, ok := factories[name]
+	mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("video codec %q is not compiled into this binary (available: %s)",
+			name, strings.Join(VideoCodecNames(), ", "))
+	}
+	return factory(video)
+}
+
+// NewVideoCodecs creates the configured codecs, in order of preference.
+func NewVideoCodecs(video *config.Video) ([]VideoCodec, error) {
+	codecs := make([]VideoCodec, 0, len(video.Codecs))
+	for _, name := range video.Codecs {
+		c, err := NewVideoCodec(name, video)
+		if err != nil {
+			return nil, err
+		}
+		codecs = append(codecs, c)
+	}
+	return codecs, nil
+}
+
+// videoClockRate is the RTP clock rate of every video format.
+const videoClockRate = 90000
+
+// videoFeedback is the RTCP feedback that every video codec supports.
+var videoFeedback = []webrtc.RTCPFeedback{
+	{Type: "goog-remb", Parameter: ""},
+	{Type: "ccm", Parameter: "fir"},
+	{Type: "nack", Parameter: ""},
+	{Type: webrtc.TypeRTCPFBTransportCC, Parameter: ""},
+}
+
+// videoParameters returns the parameters for a codec with the given payload
+// type, and for retransmissions of it with rtxPayloadType.
+func videoParameters(mimeType, fmtp string, payloadType, rtxPayloadType webrtc.PayloadType) []webrtc.RTPCodecParameters {
+	return []webrtc.RTPCodecParameters{
+		{
+			RTPCodecCapability: webrtc.RTPCodecCapability{
+				MimeType:     mimeType,
+				ClockRate:    videoClockRate,
+				SDPFmtpLine:  fmtp,
+				RTCPFeedback: videoFeedback,
+			},
+			PayloadType: payloadType,
+		},
+		{
+			RTPCodecCapability: webrtc.RTPCodecCapability{
+				MimeType:    webrtc.MimeTypeRTX,
+				ClockRate:   videoClockRate,
+				SDPFmtpLine: fmt.Sprintf("apt=%d", payloadType),
+			},
+			PayloadType: rtxPayloadType,
+		},
+	}
+}
@@ -0,0 +1,27 @@
+package encode_test
+
+import (
+	"testing"
+
+	"github.com/adamroach/webrd/pkg/config"
+	"github.com/adamroach/webrd/pkg/encode"
+	"github.com/pion/webrtc/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewVideoCodecs(t *testing.T) {
+	assert.Contains(t, encode.VideoCodecNames(), encode.DefaultVideoCodec)
+
+	codecs, err := encode.NewVideoCodecs(&config.Video{Codecs: []string{"h264"}})
+	require.NoError(t, err)
+	require.Len(t, codecs, 1)
+	assert.Equal(t, webrtc.MimeTypeH264, codecs[0].MimeType())
+
+	_, err = encode.NewVideoCodecs(&config.Video{Codecs: []string{"h264", "theora"}})
+	assert.ErrorContains(t, err, "theora")
+}
+
+func TestRegisterVideoCodec(t *testing.T) {
+	assert.Panics(t, func() { encode.RegisterVideoCodec("h264", encode.NewH264) })
+}
@@ -0,0 +1,126 @@
+//go:build vpx
+
+package encode
+
+import (
+	"image"
+
+	"github.com/adamroach/webrd/pkg/config"
+	"github.com/adamroach/webrd/pkg/imageconvert"
+	"github.com/pion/mediadevices/pkg/codec"
+	"github.com/pion/mediadevices/pkg/codec/vpx"
+	"github.com/pion/mediadevices/pkg/io/video"
+	"github.com/pion/mediadevices/pkg/prop"
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v4"
+)
+
+// The VP8 and VP9 encoders need libvpx, so they are only compiled in with
+// the vpx build tag.
+func init() {
+	RegisterVideoCodec("vp8", func(*config.Video) (VideoCodec, error) {
+		return VP8{}, nil
+	})
+	RegisterVideoCodec("vp9", func(*config.Video) (VideoCodec, error) {
+		return VP9{}, nil
+	})
+}
+
+// configureVPX sets up libvpx for low latency.
+func configureVPX(params *vpx.Params, bitrate int) {
+	params.BitRate = bitrate
+	params.RateControlEndUsage = vpx.RateControlCBR
+	params.LagInFrames = 0
+	// Suppress automatic keyframe generation
+	params.KeyFrameInterval = 1 << 30
+}
+
+// VP8 encodes with libvpx.
+type VP8 struct{}
+
+// vpxColorSpace is how browsers decode VP8, and VP9 from libvpx, which
+// doesn't let us set the color space it writes into keyframes.
+var vpxColorSpace = imageconvert.ColorSpace{Matrix: imageconvert.BT601}
+
+func (VP8) Name() string {
+	return "vp8"
+}
+
+func (VP8) MimeType() string {
+	return webrtc.MimeTypeVP8
+}
+
+func (c VP8) Parameters(image.Point) []webrtc.RTPCodecParameters {
+	return videoParameters(c.MimeType(), "", 96, 97)
+}
+
+func (VP8) NewPayloader() rtp.Payloader {
+	return &codecs.VP8Payloader{EnablePictureID: true}
+}
+
+func (VP8) NewEncoder(r video.Reader, media prop.Media, bitrate int) (codec.ReadCloser, error) {
+	params, err := vpx.NewVP8Params()
+	if err != nil {
+		return nil, err
+	}
+	configureVPX(&params.Params, bitrate)
+	return params.BuildVideoEncoder(r, media)
+}
+
+func (VP8) IsKeyFrame(data []byte) bool {
+	return isVP8KeyFrame(data)
+}
+
+// ColorSpace is always limited range BT.601 for VP8.
+func (VP8) ColorSpace() imageconvert.ColorSpace {
+	return vpxColorSpace
+}
+
+// Describe leaves the data alone: VP8 is always limited range BT.601.
+func (VP8) Describe(data []byte, size image.Point, colorSpace imageconvert.ColorSpace) ([]byte, error) {
+	return data, nil
+}
+
+// VP9 encodes profile 0 (4:2:0, 8 bit) with libvpx.
+type VP9 struct{}
+
+func (VP9) Name() string {
+	return "vp9"
+}
+
+func (VP9) MimeType() string {
+	return webrtc.MimeTypeVP9
+}
+
+func (c VP9) Parameters(image.Point) []webrtc.RTPCodecParameters {
+	return videoParameters(c.MimeType(), "profile-id=0", 98, 99)
+}
+
+func (VP9) NewPayloader() rtp.Payloader {
+	return &codecs.VP9Payloader{}
+}
+
+func (VP9) NewEncoder(r video.Reader, media prop.Media, bitrate int) (codec.ReadCloser, error) {
+	params, err := vpx.NewVP9Params()
+	if err != nil {
+		return nil, err
+	}
+	configureVPX(&params.Params, bitrate)
+	return params.BuildVideoEncoder(r, media)
+}
+
+func (VP9) IsKeyFrame(data []byte) bool {
+	return isVP9KeyFrame(data)
+}
+
+// ColorSpace is the limited range BT.601 that libvpx writes into keyframes.
+func (VP9) ColorSpace() imageconvert.ColorSpace {
+	return vpxColorSpace
+}
+
+// Describe leaves the data alone; libvpx doesn't let us set the color space
+// it writes into keyframes.
+func (VP9) Describe(data []byte, size image.Point, colorSpace imageconvert.ColorSpace) ([]byte, error) {
+	return data, nil
+}
@@ -0,0 +1,190 @@
+package h264
+
+import "errors"
+
+var errTruncated = errors.New("truncated bitstream")
+
+// bitReader reads bits, most significant first, from an RBSP (a NAL unit
+// payload with its emulation prevention bytes removed).
+type bitReader struct {
+	data []byte
+	pos  int // in bits
+}
+
+func (r *bitReader) bit() (uint32, error) {
+	if r.pos >= len(r.data)*8 {
+		return 0, errTruncated
+	}
+	bit := uint32(r.data[r.pos/8]>>(7-r.pos%8)) & 1
+	r.pos++
+	return bit, nil
+}
+
+func (r *bitReader) bits(n int) (uint32, error) {
+	var value uint32
+	for range n {
+		bit, err := r.bit()
+		if err != nil {
+			return 0, err
+		}
+		value = value<<1 | bit
+	}
+	return value, nil
+}
+
+// ue reads an unsigned Exp-Golomb code.
+func (r *bitReader) ue() (uint32, error) {
+	zeros := 0
+	for {
+		bit, err := r.bit()
+		if err != nil {
+			return 0, err
+		}
+		if bit == 1 {
+			break
+		}
+		zeros++
+		if zeros > 31 {
+			return 0, errors.New("invalid Exp-Golomb code")
+		}
+	}
+	suffix, err := r.bits(zeros)
+	if err != nil {
+		return 0, err
+	}
+	return 1<<zeros - 1 + suffix, nil
+}
+
+// se reads a signed Exp-Golomb code.
+func (r *bitReader) se() (int32, error) {
+	code, err := r.ue()
+	if err != nil {
+		return 0, err
+	}
+	if code&1 == 1 {
+		return int32(code+1) / 2, nil
+	}
+	return -int32(code / 2), nil
+}
+
+// bitWriter writes bits, most significant first.
+type bitWriter struct {
+	data []byte
+	pos  int // in bits
+}
+
+func (w *bitWriter) bit(bit uint32) {
+	if w.pos%8 == 0 {
+		w.data = append(w.data, 0)
+	}
+	w.data[len(w.data)-1] |= byte(bit&1) << (7 - w.pos%8)
+	w.pos++
+}
+
+func (w *bitWriter) bits(value uint32, n int) {
+	for i := n - 1; i >= 0; i-- {
+		w.bit(value >> i)
+	}
+}
+
+func (w *bitWriter) ue(value uint32) {
+	value++
+	length := 0
+	for v := value; v > 1; v >>= 1 {
+		length++
+	}
+	w.bits(0, length)
+	w.bits(value, length+1)
+}
+
+func (w *bitWriter) se(value int32) {
+	if value > 0 {
+		w.ue(uint32(2*value - 1))
+	} else {
+		w.ue(uint32(-2 * value))
+	}
+}
+
+// trailingBits writes rbsp_trailing_bits: a one, then zeros up to the next
+// byte boundary.
+func (w *bitWriter) trailingBits() {
+	w.bit(1)
+	for w.pos%8 != 0 {
+		w.bit(0)
+	}
+}
+
+// copier reads syntax elements and writes them back out unchanged, so that
+// a NAL unit can be rewritten from a given point onwards.
+type copier struct {
+	r *bitReader
+	w *bitWriter
+}
+
+func (c *copier) bits(n int) (uint32, error) {
+	value, err := c.r.bits(n)
+	if err == nil {
+		c.w.bits(value, n)
+	}
+	return value, err
+}
+
+func (c *copier) flag() (bool, error) {
+	value, err := c.bits(1)
+	return value == 1, err
+}
+
+func (c *copier) ue() (uint32, error) {
+	value, err := c.r.ue()
+	if err == nil {
+		c.w.ue(value)
+	}
+	return value, err
+}
+
+func (c *copier) se() (int32, error) {
+	value, err := c.r.se()
+	if err == nil {
+		c.w.se(value)
+	}
+	return value, err
+}
+
+// unescape removes emulation prevention bytes (the 0x03 in 0x000003).
+func unescape(ebsp []byte) []byte {
+	rbsp := make([]byte, 0, len(ebsp))
+	zeros := 0
+	for _, b := range ebsp {
+		if zeros >= 2 && b == 3 {
+			zeros = 0
+			continue
+		}
+		rbsp = append(rbsp, b)
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+	}
+	return rbsp
+}
+
+// escape inserts emulation prevention bytes, so that the payload can't be
+// mistaken for a start code.
+func escape(rbsp []byte) []byte {
+	ebsp := make([]byte, 0, len(rbsp)+len(rbsp)/64)
+	zeros := 0
+	for _, b := range rbsp {
+		if zeros >= 2 && b <= 3 {
+			ebsp = append(ebsp, 3)
+			zeros = 0
+		}
+		ebsp = append(ebsp, b)
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+	}
+	return ebsp
+}
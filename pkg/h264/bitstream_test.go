@@ -0,0 +1,129 @@
+package h264
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExpGolomb(t *testing.T) {
+	w := &bitWriter{}
+	unsigned := []uint32{0, 1, 2, 3, 7, 8, 255, 1 << 20}
+	signed := []int32{0, 1, -1, 2, -2, 1000, -1000}
+	for _, v := range unsigned {
+		w.ue(v)
+	}
+	for _, v := range signed {
+		w.se(v)
+	}
+	w.trailingBits()
+
+	r := &bitReader{data: w.data}
+	for _, v := range unsigned {
+		read, err := r.ue()
+		require.NoError(t, err)
+		assert.Equal(t, v, read)
+	}
+	for _, v := range signed {
+		read, err := r.se()
+		require.NoError(t, err)
+		assert.Equal(t, v, read)
+	}
+	assert.Equal(t, r.pos, stopBit(w.data))
+}
+
+func TestEscape(t *testing.T) {
+	rbsp := []byte{0x67, 0, 0, 0, 0, 0, 1, 0, 0, 2, 0, 0, 3, 0, 0, 4}
+	ebsp := escape(rbsp)
+	assert.Equal(t, []byte{0x67, 0, 0, 3, 0, 0, 3, 0, 1, 0, 0, 3, 2, 0, 0, 3, 3, 0, 0, 4}, ebsp)
+	assert.Equal(t, rbsp, unescape(ebsp))
+}
+
+// testSPS builds a baseline SPS whose VUI has an aspect ratio before the
+// video signal, and timing info and bitstream restrictions after it. The
+// video signal is included if signal is non-nil.
+func testSPS(signal *VideoSignal) []byte {
+	w := &bitWriter{}
+	w.bits(0x67, 8)
+	w.bits(66, 8)   // profile_idc
+	w.bits(0xc0, 8) // constraint flags
+	w.bits(20, 8)   // level_idc
+	w.ue(0)         // seq_parameter_set_id
+	w.ue(0)         // log2_max_frame_num_minus4
+	w.ue(2)         // pic_order_cnt_type
+	w.ue(1)         // max_num_ref_frames
+	w.bit(0)        // gaps_in_frame_num_value_allowed_flag
+	w.ue(19)        // pic_width_in_mbs_minus1
+	w.ue(14)        // pic_height_in_map_units_minus1
+	w.bit(1)        // frame_mbs_only_flag
+	w.bit(1)        // direct_8x8_inference_flag
+	w.bit(0)        // frame_cropping_flag
+	w.bit(1)        // vui_parameters_present_flag
+
+	w.bit(1)       // aspect_ratio_info_present_flag
+	w.bits(255, 8) // Extended_SAR
+	w.bits(1, 16)  // sar_width
+	w.bits(1, 16)  // sar_height
+	w.bit(0)       // overscan_info_present_flag
+	if signal != nil {
+		writeVideoSignal(w, *signal)
+	} else {
+		w.bit(0)
+	}
+	w.bit(0)       // chroma_loc_info_present_flag
+	w.bit(1)       // timing_info_present_flag
+	w.bits(1, 32)  // num_units_in_tick
+	w.bits(60, 32) // time_scale
+	w.bit(1)       // fixed_frame_rate_flag
+	w.bits(0, 3)   // nal_hrd, vcl_hrd, pic_struct
+	w.bit(1)       // bitstream_restriction_flag
+	w.bit(1)       // motion_vectors_over_pic_boundaries_flag
+	w.ue(0)        // max_bytes_per_pic_denom
+	w.ue(0)        // max_bits_per_mb_denom
+	w.ue(16)       // log2_max_mv_length_horizontal
+	w.ue(16)       // log2_max_mv_length_vertical
+	w.ue(0)        // max_num_reorder_frames
+	w.ue(1)        // max_dec_frame_buffering
+	w.trailingBits()
+	return append([]byte{0, 0, 0, 1}, escape(w.data)...)
+}
+
+func TestRewriteSPS_KeepsOtherVUIFields(t *testing.T) {
+	signal := VideoSignal{ColorPrimaries: 1, Transfer: 1, Matrix: 1}
+	rewritten, err := RewriteSPS(testSPS(nil), 0, &signal)
+	require.NoError(t, err)
+	assert.Equal(t, testSPS(&signal), rewritten)
+
+	read, found, err := ReadVideoSignal(rewritten)
+	require.NoError(t, err)
+	require.True(t, found)
+	assert.Equal(t, signal, read)
+}
+
+func TestRewriteSPS_AddsVUI(t *testing.T) {
+	w := &bitWriter{}
+	w.bits(0x67, 8)
+	w.bits(66, 8)
+	w.bits(0xc0, 8)
+	w.bits(20, 8)
+	w.ue(0)
+	w.ue(0)
+	w.ue(2)
+	w.ue(1)
+	w.bit(0)
+	w.ue(19)
+	w.ue(14)
+	w.bits(0b110, 3) // frame_mbs_only, direct_8x8_inference, frame_cropping
+	w.bit(0)         // vui_parameters_present_flag
+	w.trailingBits()
+	sps := append([]byte{0, 0, 0, 1}, escape(w.data)...)
+
+	signal := VideoSignal{FullRange: true, ColorPrimaries: 1, Transfer: 1, Matrix: 6}
+	rewritten, err := RewriteSPS(sps, 0, &signal)
+	require.NoError(t, err)
+	read, found, err := ReadVideoSignal(rewritten)
+	require.NoError(t, err)
+	require.True(t, found)
+	assert.Equal(t, signal, read)
+}
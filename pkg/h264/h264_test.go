@@ -0,0 +1,119 @@
+package h264_test
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/adamroach/webrd/pkg/h264"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// The start of a keyframe from openh264 (320x240, constrained baseline):
+// an SPS whose VUI has no video signal description, a PPS, and the
+// beginning of an IDR slice
+var openh264KeyFrame, _ = hex.DecodeString(
+	"000000016742c0148c8d40a0f900f08846a0" +
+		"0000000168ce3c80" +
+		"0000000165b8000400001788c500011798e00021571c00042ae23fe4e4e4")
+
+func TestNALUnits(t *testing.T) {
+	units := h264.NALUnits(openh264KeyFrame)
+	require.Len(t, units, 3)
+	assert.Equal(t, h264.NALTypeSPS, h264.NALType(units[0]))
+	assert.Equal(t, h264.NALTypePPS, h264.NALType(units[1]))
+	assert.Equal(t, h264.NALTypeIDR, h264.NALType(units[2]))
+	assert.Equal(t, []byte{0x68, 0xce, 0x3c, 0x80}, units[1])
+
+	// 3-byte start codes work too
+	units = h264.NALUnits([]byte{0, 0, 1, 0x41, 0x9a, 0, 0, 1, 0x41, 0x9b})
+	assert.Equal(t, [][]byte{{0x41, 0x9a}, {0x41, 0x9b}}, units)
+}
+
+func TestIsKeyFrame(t *testing.T) {
+	assert.True(t, h264.IsKeyFrame(openh264KeyFrame))
+	assert.True(t, h264.IsKeyFrame([]byte{0, 0, 1, 0x65, 0x88}))
+	assert.False(t, h264.IsKeyFrame([]byte{0, 0, 0, 1, 0x41, 0x9a, 0, 0, 1, 0x41, 0x65}))
+	assert.False(t, h264.IsKeyFrame(nil))
+}
+
+func TestRewriteSPS_VideoSignal(t *testing.T) {
+	_, found, err := h264.ReadVideoSignal(openh264KeyFrame)
+	require.NoError(t, err)
+	assert.False(t, found)
+
+	signal := h264.VideoSignal{
+		ColorPrimaries: h264.ColorPrimariesBT709,
+		Transfer:       h264.TransferBT709,
+		Matrix:         h264.MatrixBT709,
+	}
+	rewritten, err := h264.RewriteSPS(openh264KeyFrame, 0, &signal)
+	require.NoError(t, err)
+	read, found, err := h264.ReadVideoSignal(rewritten)
+	require.NoError(t, err)
+	require.True(t, found)
+	assert.Equal(t, signal, read)
+
+	// Only the SPS changes
+	before, after := h264.NALUnits(openh264KeyFrame), h264.NALUnits(rewritten)
+	require.Len(t, after, 3)
+	assert.Equal(t, before[0][:9], after[0][:9])
+	assert.Equal(t, before[1:], after[1:])
+
+	// Rewriting an SPS that already has a VUI replaces the signal, and
+	// keeps the rest of the VUI
+	signal = h264.VideoSignal{
+		FullRange:      true,
+		ColorPrimaries: h264.ColorPrimariesBT601,
+		Transfer:       h264.TransferBT601,
+		Matrix:         h264.MatrixBT601,
+	}
+	again, err := h264.RewriteSPS(rewritten, 0, &signal)
+	require.NoError(t, err)
+	read, found, err = h264.ReadVideoSignal(again)
+	require.NoError(t, err)
+	require.True(t, found)
+	assert.Equal(t, signal, read)
+	assert.Len(t, h264.NALUnits(again)[0], len(after[0]))
+}
+
+func TestRewriteSPS_Level(t *testing.T) {
+	level, found, err := h264.ReadLevel(openh264KeyFrame)
+	require.NoError(t, err)
+	require.True(t, found)
+	assert.Equal(t, h264.Level(20), level)
+
+	// Only level_idc changes, and nothing else in the access unit
+	rewritten, err := h264.RewriteSPS(openh264KeyFrame, 31, nil)
+	require.NoError(t, err)
+	level, _, err = h264.ReadLevel(rewritten)
+	require.NoError(t, err)
+	assert.Equal(t, h264.Level(31), level)
+	expected := append([]byte{}, openh264KeyFrame...)
+	expected[7] = 31
+	assert.Equal(t, expected, rewritten)
+
+	// Both at once
+	signal := h264.VideoSignal{ColorPrimaries: 1, Transfer: 1, Matrix: 1}
+	rewritten, err = h264.RewriteSPS(openh264KeyFrame, 50, &signal)
+	require.NoError(t, err)
+	level, _, err = h264.ReadLevel(rewritten)
+	require.NoError(t, err)
+	assert.Equal(t, h264.Level(50), level)
+	read, found, err := h264.ReadVideoSignal(rewritten)
+	require.NoError(t, err)
+	require.True(t, found)
+	assert.Equal(t, signal, read)
+}
+
+func TestRewriteSPS_NoSPS(t *testing.T) {
+	slice := []byte{0, 0, 0, 1, 0x41, 0x9a, 0x00, 0x03}
+	rewritten, err := h264.RewriteSPS(slice, 0, &h264.VideoSignal{})
+	require.NoError(t, err)
+	assert.Equal(t, slice, rewritten)
+}
+
+func TestRewriteSPS_Truncated(t *testing.T) {
+	_, err := h264.RewriteSPS([]byte{0, 0, 0, 1, 0x67, 0x42}, 0, &h264.VideoSignal{})
+	assert.Error(t, err)
+}
@@ -0,0 +1,80 @@
+package h264
+
+import "fmt"
+
+// Profile identifies an H.264 profile by its profile_idc and constraint
+// flags, as they appear in the SPS and in the profile-level-id SDP
+// parameter.
+type Profile struct {
+	IDC         uint8
+	Constraints uint8
+}
+
+// ProfileConstrainedBaseline is what openh264 produces, and what every
+// browser can decode.
+var ProfileConstrainedBaseline = Profile{IDC: 66, Constraints: 0xe0}
+
+// Level is an H.264 level, as its level_idc: ten times the level number.
+type Level uint8
+
+func (l Level) String() string {
+	return fmt.Sprintf("%d.%d", l/10, l%10)
+}
+
+// levelLimits are the limits from table A-1 of the H.264 specification
+// that depend on the size, framerate and bitrate of a stream.
+type levelLimits struct {
+	level   Level
+	maxMBPS int // macroblocks per second
+	maxFS   int // macroblocks per frame
+	maxBR   int // kbit/s, for Baseline profile
+}
+
+var levels = []levelLimits{
+	{10, 1485, 99, 64},
+	{11, 3000, 396, 192},
+	{12, 6000, 396, 384},
+	{13, 11880, 396, 768},
+	{20, 11880, 396, 2000},
+	{21, 19800, 792, 4000},
+	{22, 20250, 1620, 4000},
+	{30, 40500, 1620, 10000},
+	{31, 108000, 3600, 14000},
+	{32, 216000, 5120, 20000},
+	{40, 245760, 8192, 20000},
+	{41, 245760, 8192, 50000},
+	{42, 522240, 8704, 50000},
+	{50, 589824, 22080, 135000},
+	{51, 983040, 36864, 240000},
+	{52, 2073600, 36864, 240000},
+	{60, 4177920, 139264, 240000},
+	{61, 8355840, 139264, 480000},
+	{62, 16711680, 139264, 800000},
+}
+
+// LevelFor returns the lowest Constrained Baseline level that allows a
+// stream of the given size, framerate and bitrate (in bits per second).
+// Streams beyond every level get the highest one.
+func LevelFor(width, height, framerate, bitrate int) Level {
+	widthMBs := (width + 15) / 16
+	heightMBs := (height + 15) / 16
+	frameSize := widthMBs * heightMBs
+	bitrateFactor := 1000 // cpbBrVclFactor, in bits per kbit of maxBR
+	for _, limits := range levels {
+		// Neither dimension may exceed sqrt(8 * MaxFS)
+		maxDimension := 8 * limits.maxFS
+		if frameSize <= limits.maxFS &&
+			widthMBs*widthMBs <= maxDimension && heightMBs*heightMBs <= maxDimension &&
+			frameSize*framerate <= limits.maxMBPS &&
+			bitrate <= limits.maxBR*bitrateFactor {
+			return limits.level
+		}
+	}
+	return levels[len(levels)-1].level
+}
+
+// ProfileLevelID formats the profile-level-id parameter that describes a
+// stream in SDP (RFC 6184 section 8.1).
+func ProfileLevelID(profile Profile, level Level) string {
+	return fmt.Sprintf("%02x%02x%02x", profile.IDC, profile.Constraints, uint8(level))
+}
@@ -0,0 +1,37 @@
+package h264_test
+
+import (
+	"testing"
+
+	"github.com/adamroach/webrd/pkg/h264"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLevelFor(t *testing.T) {
+	for _, test := range []struct {
+		width, height, framerate, bitrate int
+		expected                          h264.Level
+	}{
+		// The levels openh264 picks for itself at 1Mbit/s
+		{320, 240, 30, 1_000_000, 20},
+		{1280, 720, 30, 1_000_000, 31},
+		{1920, 1080, 30, 1_000_000, 40},
+		{2560, 1600, 30, 1_000_000, 50},
+		// Framerate and bitrate count too
+		{1280, 720, 60, 1_000_000, 32},
+		{1920, 1080, 30, 30_000_000, 41},
+		// A frame may have plenty of macroblocks, but not be too narrow
+		{4096, 16, 1, 0, 40},
+		// Nothing is larger than the highest level
+		{16384, 16384, 120, 0, 62},
+	} {
+		assert.Equal(t, test.expected, h264.LevelFor(test.width, test.height, test.framerate, test.bitrate),
+			"%dx%d@%d %d", test.width, test.height, test.framerate, test.bitrate)
+	}
+}
+
+func TestProfileLevelID(t *testing.T) {
+	assert.Equal(t, "42e01f", h264.ProfileLevelID(h264.ProfileConstrainedBaseline, 31))
+	assert.Equal(t, "42e032", h264.ProfileLevelID(h264.ProfileConstrainedBaseline, 50))
+	assert.Equal(t, "5.1", h264.Level(51).String())
+}
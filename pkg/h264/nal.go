@@ -0,0 +1,74 @@
+// Package h264 inspects and rewrites H.264 bitstreams in Annex B format, as
+// produced by the encoder.
+package h264
+
+// NAL unit types
+const (
+	NALTypeIDR = 5
+	NALTypeSPS = 7
+	NALTypePPS = 8
+)
+
+// NALUnits splits an Annex B access unit into its NAL units, without their
+// start codes.
+func NALUnits(data []byte) [][]byte {
+	var units [][]byte
+	start := -1
+	for i := 0; i+2 < len(data); i++ {
+		if data[i] != 0 || data[i+1] != 0 || data[i+2] != 1 {
+			continue
+		}
+		if start >= 0 {
+			units = append(units, trimZeros(data[start:i]))
+		}
+		i += 2
+		start = i + 1
+	}
+	if start >= 0 && start < len(data) {
+		units = append(units, data[start:])
+	}
+	return units
+}
+
+// trimZeros removes the leading zero of a 4-byte start code (and any other
+// trailing zeros) from the end of a NAL unit.
+func trimZeros(unit []byte) []byte {
+	for len(unit) > 0 && unit[len(unit)-1] == 0 {
+		unit = unit[:len(unit)-1]
+	}
+	return unit
+}
+
+// NALType returns the type of a NAL unit.
+func NALType(unit []byte) int {
+	if len(unit) == 0 {
+		return 0
+	}
+	return int(unit[0] & 0x1f)
+}
+
+// IsKeyFrame reports whether an access unit contains an IDR slice.
+func IsKeyFrame(data []byte) bool {
+	for _, unit := range NALUnits(data) {
+		if NALType(unit) == NALTypeIDR {
+			return true
+		}
+	}
+	return false
+}
+
+// rewrite replaces each NAL unit in an access unit with the result of
+// calling fn on it, with 4-byte start codes.
+func rewrite(data []byte, fn func(unit []byte) ([]byte, error)) ([]byte, error) {
+	units := NALUnits(data)
+	out := make([]byte, 0, len(data)+16)
+	for _, unit := range units {
+		rewritten, err := fn(unit)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, 0, 0, 0, 1)
+		out = append(out, rewritten...)
+	}
+	return out, nil
+}
@@ -0,0 +1,401 @@
+package h264
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Color description codes from H.273, as used in the VUI
+const (
+	ColorPrimariesBT709 = 1
+	ColorPrimariesBT601 = 6 // SMPTE 170M
+
+	TransferBT709 = 1
+	TransferBT601 = 6 // SMPTE 170M
+
+	MatrixBT709 = 1
+	MatrixBT601 = 6 // SMPTE 170M
+)
+
+// VideoSignal describes how decoders should interpret the samples in a
+// stream. Without one, browsers have to guess the color matrix and range.
+type VideoSignal struct {
+	FullRange      bool
+	ColorPrimaries uint8
+	Transfer       uint8
+	Matrix         uint8
+}
+
+// The profiles whose SPS includes chroma format and bit depth information
+var highProfiles = map[uint32]bool{
+	100: true, 110: true, 122: true, 244: true, 44: true, 83: true,
+	86: true, 118: true, 128: true, 138: true, 139: true, 134: true, 135: true,
+}
+
+// RewriteSPS rewrites each SPS in an access unit. A non-zero level replaces
+// level_idc, since openh264 picks a level of its own rather than the one
+// advertised in SDP. A non-nil signal is written into the VUI, adding one if
+// needed. Everything else in the SPS, including any other VUI fields, is
+// kept as it was. Access units without an SPS are returned as they are.
+func RewriteSPS(data []byte, level Level, signal *VideoSignal) ([]byte, error) {
+	found := false
+	for _, unit := range NALUnits(data) {
+		if NALType(unit) == NALTypeSPS {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return data, nil
+	}
+	return rewrite(data, func(unit []byte) ([]byte, error) {
+		if NALType(unit) != NALTypeSPS {
+			return unit, nil
+		}
+		rbsp, err := rewriteSPS(unescape(unit), level, signal)
+		if err != nil {
+			return nil, fmt.Errorf("could not rewrite SPS: %v", err)
+		}
+		return escape(rbsp), nil
+	})
+}
+
+// ReadLevel returns the level_idc of the first SPS in an access unit. The
+// second result is false if there is no SPS.
+func ReadLevel(data []byte) (Level, bool, error) {
+	for _, unit := range NALUnits(data) {
+		if NALType(unit) != NALTypeSPS {
+			continue
+		}
+		rbsp := unescape(unit)
+		if len(rbsp) < 4 {
+			return 0, false, errors.New("SPS too short")
+		}
+		return Level(rbsp[3]), true, nil
+	}
+	return 0, false, nil
+}
+
+// ReadVideoSignal returns the video signal description from the first SPS
+// in an access unit. The second result is false if there is no SPS, or its
+// VUI has no video signal description.
+func ReadVideoSignal(data []byte) (VideoSignal, bool, error) {
+	for _, unit := range NALUnits(data) {
+		if NALType(unit) != NALTypeSPS {
+			continue
+		}
+		c := &copier{r: &bitReader{data: unescape(unit)}, w: &bitWriter{}}
+		if _, err := c.bits(8); err != nil {
+			return VideoSignal{}, false, err
+		}
+		present, err := skipToVUI(c, 0)
+		if err != nil || !present {
+			return VideoSignal{}, false, err
+		}
+		if err := skipToVideoSignal(c); err != nil {
+			return VideoSignal{}, false, err
+		}
+		return readVideoSignal(c.r)
+	}
+	return VideoSignal{}, false, nil
+}
+
+// rewriteSPS rewrites an SPS RBSP, including its NAL header byte.
+func rewriteSPS(rbsp []byte, level Level, signal *VideoSignal) ([]byte, error) {
+	r := &bitReader{data: rbsp}
+	w := &bitWriter{}
+	c := &copier{r: r, w: w}
+	if _, err := c.bits(8); err != nil { // NAL header
+		return nil, err
+	}
+
+	present, err := skipToVUI(c, level)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case signal == nil:
+		// The VUI, if any, is copied as it is
+		if present {
+			w.bit(1)
+		} else {
+			w.bit(0)
+		}
+	case !present:
+		// A VUI that only has a video signal description
+		w.bit(1)     // vui_parameters_present_flag
+		w.bits(0, 2) // aspect_ratio_info_present_flag, overscan_info_present_flag
+		writeVideoSignal(w, *signal)
+		w.bits(0, 6) // chroma_loc, timing_info, nal_hrd, vcl_hrd, pic_struct, bitstream_restriction
+		w.trailingBits()
+		return w.data, nil
+	default:
+		w.bit(1) // vui_parameters_present_flag
+		if err := skipToVideoSignal(c); err != nil {
+			return nil, err
+		}
+		if _, _, err := readVideoSignal(r); err != nil {
+			return nil, err
+		}
+		writeVideoSignal(w, *signal)
+	}
+
+	// The rest is copied as it is, up to the stop bit
+	end := stopBit(rbsp)
+	if end < r.pos {
+		return nil, errors.New("missing stop bit")
+	}
+	for r.pos < end {
+		bit, _ := r.bit()
+		w.bit(bit)
+	}
+	w.trailingBits()
+	return w.data, nil
+}
+
+// skipToVUI copies the SPS fields that come before the VUI, with level in
+// place of level_idc unless it is zero, and reads (but doesn't copy)
+// vui_parameters_present_flag.
+func skipToVUI(c *copier, level Level) (bool, error) {
+	profile, err := c.bits(8)
+	if err != nil {
+		return false, err
+	}
+	if _, err := c.bits(8); err != nil { // constraint flags
+		return false, err
+	}
+	levelIDC, err := c.r.bits(8)
+	if err != nil {
+		return false, err
+	}
+	if level != 0 {
+		levelIDC = uint32(level)
+	}
+	c.w.bits(levelIDC, 8)
+	if _, err := c.ue(); err != nil { // seq_parameter_set_id
+		return false, err
+	}
+	if highProfiles[profile] {
+		chromaFormat, err := c.ue()
+		if err != nil {
+			return false, err
+		}
+		if chromaFormat == 3 {
+			if _, err := c.flag(); err != nil { // separate_colour_plane_flag
+				return false, err
+			}
+		}
+		for range 2 { // bit_depth_luma_minus8, bit_depth_chroma_minus8
+			if _, err := c.ue(); err != nil {
+				return false, err
+			}
+		}
+		if _, err := c.flag(); err != nil { // qpprime_y_zero_transform_bypass_flag
+			return false, err
+		}
+		scalingMatrix, err := c.flag()
+		if err != nil {
+			return false, err
+		}
+		if scalingMatrix {
+			lists := 8
+			if chromaFormat == 3 {
+				lists = 12
+			}
+			for i := range lists {
+				present, err := c.flag()
+				if err != nil {
+					return false, err
+				}
+				if !present {
+					continue
+				}
+				size := 16
+				if i >= 6 {
+					size = 64
+				}
+				if err := copyScalingList(c, size); err != nil {
+					return false, err
+				}
+			}
+		}
+	}
+	if _, err := c.ue(); err != nil { // log2_max_frame_num_minus4
+		return false, err
+	}
+	pocType, err := c.ue()
+	if err != nil {
+		return false, err
+	}
+	switch pocType {
+	case 0:
+		if _, err := c.ue(); err != nil { // log2_max_pic_order_cnt_lsb_minus4
+			return false, err
+		}
+	case 1:
+		if _, err := c.flag(); err != nil { // delta_pic_order_always_zero_flag
+			return false, err
+		}
+		for range 2 { // offset_for_non_ref_pic, offset_for_top_to_bottom_field
+			if _, err := c.se(); err != nil {
+				return false, err
+			}
+		}
+		cycle, err := c.ue()
+		if err != nil {
+			return false, err
+		}
+		for range cycle {
+			if _, err := c.se(); err != nil {
+				return false, err
+			}
+		}
+	}
+	if _, err := c.ue(); err != nil { // max_num_ref_frames
+		return false, err
+	}
+	if _, err := c.flag(); err != nil { // gaps_in_frame_num_value_allowed_flag
+		return false, err
+	}
+	for range 2 { // pic_width_in_mbs_minus1, pic_height_in_map_units_minus1
+		if _, err := c.ue(); err != nil {
+			return false, err
+		}
+	}
+	frameMbsOnly, err := c.flag()
+	if err != nil {
+		return false, err
+	}
+	if !frameMbsOnly {
+		if _, err := c.flag(); err != nil { // mb_adaptive_frame_field_flag
+			return false, err
+		}
+	}
+	if _, err := c.flag(); err != nil { // direct_8x8_inference_flag
+		return false, err
+	}
+	cropping, err := c.flag()
+	if err != nil {
+		return false, err
+	}
+	if cropping {
+		for range 4 {
+			if _, err := c.ue(); err != nil {
+				return false, err
+			}
+		}
+	}
+	present, err := c.r.bits(1)
+	return present == 1, err
+}
+
+func copyScalingList(c *copier, size int) error {
+	last, next := int32(8), int32(8)
+	for range size {
+		if next != 0 {
+			delta, err := c.se()
+			if err != nil {
+				return err
+			}
+			next = (last + delta + 256) % 256
+		}
+		if next != 0 {
+			last = next
+		}
+	}
+	return nil
+}
+
+// skipToVideoSignal copies the VUI fields that come before
+// video_signal_type_present_flag.
+func skipToVideoSignal(c *copier) error {
+	const extendedSAR = 255
+	aspectRatio, err := c.flag()
+	if err != nil {
+		return err
+	}
+	if aspectRatio {
+		idc, err := c.bits(8)
+		if err != nil {
+			return err
+		}
+		if idc == extendedSAR {
+			if _, err := c.bits(32); err != nil { // sar_width, sar_height
+				return err
+			}
+		}
+	}
+	overscan, err := c.flag()
+	if err != nil {
+		return err
+	}
+	if overscan {
+		if _, err := c.flag(); err != nil { // overscan_appropriate_flag
+			return err
+		}
+	}
+	return nil
+}
+
+// readVideoSignal reads the video signal fields of a VUI, starting at
+// video_signal_type_present_flag.
+func readVideoSignal(r *bitReader) (VideoSignal, bool, error) {
+	present, err := r.bits(1)
+	if err != nil || present == 0 {
+		return VideoSignal{}, false, err
+	}
+	var signal VideoSignal
+	if _, err := r.bits(3); err != nil { // video_format
+		return VideoSignal{}, false, err
+	}
+	fullRange, err := r.bits(1)
+	if err != nil {
+		return VideoSignal{}, false, err
+	}
+	signal.FullRange = fullRange == 1
+	colorDescription, err := r.bits(1)
+	if err != nil {
+		return VideoSignal{}, false, err
+	}
+	if colorDescription == 1 {
+		fields, err := r.bits(24)
+		if err != nil {
+			return VideoSignal{}, false, err
+		}
+		signal.ColorPrimaries = uint8(fields >> 16)
+		signal.Transfer = uint8(fields >> 8)
+		signal.Matrix = uint8(fields)
+	}
+	return signal, true, nil
+}
+
+func writeVideoSignal(w *bitWriter, signal VideoSignal) {
+	const videoFormatUnspecified = 5
+	w.bit(1) // video_signal_type_present_flag
+	w.bits(videoFormatUnspecified, 3)
+	if signal.FullRange {
+		w.bit(1)
+	} else {
+		w.bit(0)
+	}
+	w.bit(1) // colour_description_present_flag
+	w.bits(uint32(signal.ColorPrimaries), 8)
+	w.bits(uint32(signal.Transfer), 8)
+	w.bits(uint32(signal.Matrix), 8)
+}
+
+// stopBit returns the bit position of rbsp_stop_one_bit: the last one bit
+// in the RBSP.
+func stopBit(rbsp []byte) int {
+	for i := len(rbsp) - 1; i >= 0; i-- {
+		if rbsp[i] == 0 {
+			continue
+		}
+		for bit := 0; bit < 8; bit++ {
+			if rbsp[i]&(1<<bit) != 0 {
+				return i*8 + 7 - bit
+			}
+		}
+	}
+	return -1
+}
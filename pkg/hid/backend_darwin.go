@@ -0,0 +1,14 @@
+//go:build cgo && darwin
+
+package hid
+
+import "github.com/adamroach/webrd/pkg/config"
+
+func init() {
+	Keyboards.Register("darwin", func(*config.Config) (Keyboard, error) {
+		return NewKeyboard()
+	})
+	Mice.Register("darwin", func(*config.Config) (Mouse, error) {
+		return NewMouse()
+	})
+}
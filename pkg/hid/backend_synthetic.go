@@ -0,0 +1,12 @@
+package hid
+
+import "github.com/adamroach/webrd/pkg/config"
+
+func init() {
+	Keyboards.Register("synthetic", func(*config.Config) (Keyboard, error) {
+		return NewSyntheticKeyboard(SyntheticInput), nil
+	})
+	Mice.Register("synthetic", func(*config.Config) (Mouse, error) {
+		return NewSyntheticMouse(SyntheticInput), nil
+	})
+}
@@ -0,0 +1,14 @@
+//go:build linux
+
+package hid
+
+import "github.com/adamroach/webrd/pkg/config"
+
+func init() {
+	Keyboards.Register("x11", func(config *config.Config) (Keyboard, error) {
+		return NewX11Keyboard(config.X11.Display)
+	})
+	Mice.Register("x11", func(config *config.Config) (Mouse, error) {
+		return NewX11Mouse(config.X11.Display)
+	})
+}
@@ -0,0 +1,269 @@
+//go:build linux
+
+package hid
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/adamroach/webrd/pkg/hid/key"
+	"github.com/jezek/xgb"
+	"github.com/jezek/xgb/xproto"
+	"github.com/jezek/xgb/xtest"
+)
+
+type x11Keyboard struct {
+	conn     *xgb.Conn
+	root     xproto.Window
+	keycodes map[key.Code]xproto.Keycode
+}
+
+func NewX11Keyboard(display string) (Keyboard, error) {
+	conn, root, err := newX11Connection(display)
+	if err != nil {
+		return nil, err
+	}
+	keycodes, err := resolveKeycodes(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &x11Keyboard{
+		conn:     conn,
+		root:     root,
+		keycodes: keycodes,
+	}, nil
+}
+
+func (k *x11Keyboard) Key(event key.Event) error {
+	keyCode, ok := k.keycodes[event.Code]
+	if !ok {
+		return fmt.Errorf("no X keycode for %s", event.Code)
+	}
+	log.Printf("Sending key event: %+v (%d)", event, keyCode)
+	eventType := byte(xproto.KeyRelease)
+	if event.KeyDown {
+		eventType = xproto.KeyPress
+	}
+	return xtest.FakeInputChecked(k.conn, eventType, byte(keyCode), 0, k.root, 0, 0, 0).Check()
+}
+
+// Close disconnects from the X server.
+func (k *x11Keyboard) Close() error {
+	k.conn.Close()
+	return nil
+}
+
+// resolveKeycodes determines which X keycode to send for each key.Code.
+// Since key.Code identifies a physical key, we prefer the evdev keycode for
+// that key, which is what virtually every modern X server uses. If the
+// server's keyboard mapping has nothing at that keycode, we fall back to
+// looking for a keycode that produces the expected keysym.
+func resolveKeycodes(conn *xgb.Conn) (map[key.Code]xproto.Keycode, error) {
+	setup := xproto.Setup(conn)
+	minKeycode := setup.MinKeycode
+	maxKeycode := setup.MaxKeycode
+	mapping, err := xproto.GetKeyboardMapping(conn, minKeycode, byte(maxKeycode-minKeycode+1)).Reply()
+	if err != nil {
+		return nil, fmt.Errorf("could not get keyboard mapping: %v", err)
+	}
+	return mapKeycodes(minKeycode, maxKeycode, int(mapping.KeysymsPerKeycode), mapping.Keysyms), nil
+}
+
+// mapKeycodes does the work of resolveKeycodes, given the server's keyboard
+// mapping: perKeycode keysyms for each keycode from minKeycode on.
+func mapKeycodes(minKeycode, maxKeycode xproto.Keycode, perKeycode int, keysyms []xproto.Keysym) map[key.Code]xproto.Keycode {
+	keycodes := make(map[key.Code]xproto.Keycode)
+	if perKeycode <= 0 {
+		return keycodes
+	}
+	mapped := make(map[xproto.Keycode]bool)
+	keysymToKeycode := make(map[xproto.Keysym]xproto.Keycode)
+	for i := 0; (i+1)*perKeycode <= len(keysyms); i++ {
+		keycode := minKeycode + xproto.Keycode(i)
+		for _, keysym := range keysyms[i*perKeycode : (i+1)*perKeycode] {
+			if keysym == 0 {
+				continue
+			}
+			mapped[keycode] = true
+			if _, ok := keysymToKeycode[keysym]; !ok {
+				keysymToKeycode[keysym] = keycode
+			}
+		}
+	}
+
+	for code, x := range x11Keymap {
+		if x.keycode >= minKeycode && x.keycode <= maxKeycode && mapped[x.keycode] {
+			keycodes[code] = x.keycode
+		} else if keycode, ok := keysymToKeycode[x.keysym]; ok && x.keysym != 0 {
+			keycodes[code] = keycode
+		}
+	}
+	return keycodes
+}
+
+type x11Key struct {
+	keycode xproto.Keycode // evdev scancode + 8
+	keysym  xproto.Keysym  // unshifted keysym, from X11/keysymdef.h and X11/XF86keysym.h
+}
+
+var x11Keymap = map[key.Code]x11Key{
+	key.CodeEscape:             {9, 0xff1b},       // Escape
+	key.CodeDigit1:             {10, 0x0031},      // 1
+	key.CodeDigit2:             {11, 0x0032},      // 2
+	key.CodeDigit3:             {12, 0x0033},      // 3
+	key.CodeDigit4:             {13, 0x0034},      // 4
+	key.CodeDigit5:             {14, 0x0035},      // 5
+	key.CodeDigit6:             {15, 0x0036},      // 6
+	key.CodeDigit7:             {16, 0x0037},      // 7
+	key.CodeDigit8:             {17, 0x0038},      // 8
+	key.CodeDigit9:             {18, 0x0039},      // 9
+	key.CodeDigit0:             {19, 0x0030},      // 0
+	key.CodeMinus:              {20, 0x002d},      // minus
+	key.CodeEqual:              {21, 0x003d},      // equal
+	key.CodeBackspace:          {22, 0xff08},      // BackSpace
+	key.CodeTab:                {23, 0xff09},      // Tab
+	key.CodeKeyQ:               {24, 0x0071},      // q
+	key.CodeKeyW:               {25, 0x0077},      // w
+	key.CodeKeyE:               {26, 0x0065},      // e
+	key.CodeKeyR:               {27, 0x0072},      // r
+	key.CodeKeyT:               {28, 0x0074},      // t
+	key.CodeKeyY:               {29, 0x0079},      // y
+	key.CodeKeyU:               {30, 0x0075},      // u
+	key.CodeKeyI:               {31, 0x0069},      // i
+	key.CodeKeyO:               {32, 0x006f},      // o
+	key.CodeKeyP:               {33, 0x0070},      // p
+	key.CodeBracketLeft:        {34, 0x005b},      // bracketleft
+	key.CodeBracketRight:       {35, 0x005d},      // bracketright
+	key.CodeEnter:              {36, 0xff0d},      // Return
+	key.CodeControlLeft:        {37, 0xffe3},      // Control_L
+	key.CodeKeyA:               {38, 0x0061},      // a
+	key.CodeKeyS:               {39, 0x0073},      // s
+	key.CodeKeyD:               {40, 0x0064},      // d
+	key.CodeKeyF:               {41, 0x0066},      // f
+	key.CodeKeyG:               {42, 0x0067},      // g
+	key.CodeKeyH:               {43, 0x0068},      // h
+	key.CodeKeyJ:               {44, 0x006a},      // j
+	key.CodeKeyK:               {45, 0x006b},      // k
+	key.CodeKeyL:               {46, 0x006c},      // l
+	key.CodeSemicolon:          {47, 0x003b},      // semicolon
+	key.CodeQuote:              {48, 0x0027},      // apostrophe
+	key.CodeBackquote:          {49, 0x0060},      // grave
+	key.CodeShiftLeft:          {50, 0xffe1},      // Shift_L
+	key.CodeBackslash:          {51, 0x005c},      // backslash
+	key.CodeKeyZ:               {52, 0x007a},      // z
+	key.CodeKeyX:               {53, 0x0078},      // x
+	key.CodeKeyC:               {54, 0x0063},      // c
+	key.CodeKeyV:               {55, 0x0076},      // v
+	key.CodeKeyB:               {56, 0x0062},      // b
+	key.CodeKeyN:               {57, 0x006e},      // n
+	key.CodeKeyM:               {58, 0x006d},      // m
+	key.CodeComma:              {59, 0x002c},      // comma
+	key.CodePeriod:             {60, 0x002e},      // period
+	key.CodeSlash:              {61, 0x002f},      // slash
+	key.CodeShiftRight:         {62, 0xffe2},      // Shift_R
+	key.CodeNumpadMultiply:     {63, 0xffaa},      // KP_Multiply
+	key.CodeAltLeft:            {64, 0xffe9},      // Alt_L
+	key.CodeSpace:              {65, 0x0020},      // space
+	key.CodeCapsLock:           {66, 0xffe5},      // Caps_Lock
+	key.CodeF1:                 {67, 0xffbe},      // F1
+	key.CodeF2:                 {68, 0xffbf},      // F2
+	key.CodeF3:                 {69, 0xffc0},      // F3
+	key.CodeF4:                 {70, 0xffc1},      // F4
+	key.CodeF5:                 {71, 0xffc2},      // F5
+	key.CodeF6:                 {72, 0xffc3},      // F6
+	key.CodeF7:                 {73, 0xffc4},      // F7
+	key.CodeF8:                 {74, 0xffc5},      // F8
+	key.CodeF9:                 {75, 0xffc6},      // F9
+	key.CodeF10:                {76, 0xffc7},      // F10
+	key.CodeNumLock:            {77, 0xff7f},      // Num_Lock
+	key.CodeScrollLock:         {78, 0xff14},      // Scroll_Lock
+	key.CodeNumpad7:            {79, 0xffb7},      // KP_7
+	key.CodeNumpad8:            {80, 0xffb8},      // KP_8
+	key.CodeNumpad9:            {81, 0xffb9},      // KP_9
+	key.CodeNumpadSubtract:     {82, 0xffad},      // KP_Subtract
+	key.CodeNumpad4:            {83, 0xffb4},      // KP_4
+	key.CodeNumpad5:            {84, 0xffb5},      // KP_5
+	key.CodeNumpad6:            {85, 0xffb6},      // KP_6
+	key.CodeNumpadAdd:          {86, 0xffab},      // KP_Add
+	key.CodeNumpad1:            {87, 0xffb1},      // KP_1
+	key.CodeNumpad2:            {88, 0xffb2},      // KP_2
+	key.CodeNumpad3:            {89, 0xffb3},      // KP_3
+	key.CodeNumpad0:            {90, 0xffb0},      // KP_0
+	key.CodeNumpadDecimal:      {91, 0xffae},      // KP_Decimal
+	key.CodeIntlBackslash:      {94, 0x003c},      // less
+	key.CodeF11:                {95, 0xffc8},      // F11
+	key.CodeF12:                {96, 0xffc9},      // F12
+	key.CodeIntlRo:             {97, 0x005f},      // underscore
+	key.CodeLang3:              {98, 0xff26},      // Katakana
+	key.CodeLang4:              {99, 0xff25},      // Hiragana
+	key.CodeConvert:            {100, 0xff23},     // Henkan_Mode
+	key.CodeKanaMode:           {101, 0xff27},     // Hiragana_Katakana
+	key.CodeNonConvert:         {102, 0xff22},     // Muhenkan
+	key.CodeNumpadEnter:        {104, 0xff8d},     // KP_Enter
+	key.CodeControlRight:       {105, 0xffe4},     // Control_R
+	key.CodeNumpadDivide:       {106, 0xffaf},     // KP_Divide
+	key.CodePrintScreen:        {107, 0xff61},     // Print
+	key.CodeAltRight:           {108, 0xffea},     // Alt_R
+	key.CodeHome:               {110, 0xff50},     // Home
+	key.CodeArrowUp:            {111, 0xff52},     // Up
+	key.CodePageUp:             {112, 0xff55},     // Prior
+	key.CodeArrowLeft:          {113, 0xff51},     // Left
+	key.CodeArrowRight:         {114, 0xff53},     // Right
+	key.CodeEnd:                {115, 0xff57},     // End
+	key.CodeArrowDown:          {116, 0xff54},     // Down
+	key.CodePageDown:           {117, 0xff56},     // Next
+	key.CodeInsert:             {118, 0xff63},     // Insert
+	key.CodeDelete:             {119, 0xffff},     // Delete
+	key.CodeAudioVolumeMute:    {121, 0x1008ff12}, // XF86AudioMute
+	key.CodeVolumeMute:         {121, 0x1008ff12}, // XF86AudioMute
+	key.CodeAudioVolumeDown:    {122, 0x1008ff11}, // XF86AudioLowerVolume
+	key.CodeVolumeDown:         {122, 0x1008ff11}, // XF86AudioLowerVolume
+	key.CodeAudioVolumeUp:      {123, 0x1008ff13}, // XF86AudioRaiseVolume
+	key.CodeVolumeUp:           {123, 0x1008ff13}, // XF86AudioRaiseVolume
+	key.CodePower:              {124, 0x1008ff2a}, // XF86PowerOff
+	key.CodeNumpadEqual:        {125, 0xffbd},     // KP_Equal
+	key.CodePause:              {127, 0xff13},     // Pause
+	key.CodeNumpadComma:        {129, 0xffac},     // KP_Separator
+	key.CodeLang1:              {130, 0xff31},     // Hangul
+	key.CodeLang2:              {131, 0xff34},     // Hangul_Hanja
+	key.CodeIntlYen:            {132, 0x00a5},     // yen
+	key.CodeMetaLeft:           {133, 0xffeb},     // Super_L
+	key.CodeMetaRight:          {134, 0xffec},     // Super_R
+	key.CodeContextMenu:        {135, 0xff67},     // Menu
+	key.CodeBrowserStop:        {136, 0x1008ff28}, // XF86Stop
+	key.CodeUndo:               {139, 0xff65},     // Undo
+	key.CodeCopy:               {141, 0x1008ff57}, // XF86Copy
+	key.CodePaste:              {143, 0x1008ff6d}, // XF86Paste
+	key.CodeCut:                {145, 0x1008ff58}, // XF86Cut
+	key.CodeHelp:               {146, 0xff6a},     // Help
+	key.CodeLaunchApp2:         {148, 0x1008ff1d}, // XF86Calculator
+	key.CodeSleep:              {150, 0x1008ff2f}, // XF86Sleep
+	key.CodeWakeUp:             {151, 0x1008ff2b}, // XF86WakeUp
+	key.CodeLaunchMail:         {163, 0x1008ff19}, // XF86Mail
+	key.CodeBrowserFavorites:   {164, 0x1008ff30}, // XF86Favorites
+	key.CodeLaunchApp1:         {165, 0x1008ff33}, // XF86MyComputer
+	key.CodeBrowserBack:        {166, 0x1008ff26}, // XF86Back
+	key.CodeBrowserForward:     {167, 0x1008ff27}, // XF86Forward
+	key.CodeEject:              {169, 0x1008ff2c}, // XF86Eject
+	key.CodeMediaTrackNext:     {171, 0x1008ff17}, // XF86AudioNext
+	key.CodeMediaPlayPause:     {172, 0x1008ff14}, // XF86AudioPlay
+	key.CodeMediaTrackPrevious: {173, 0x1008ff16}, // XF86AudioPrev
+	key.CodeMediaStop:          {174, 0x1008ff15}, // XF86AudioStop
+	key.CodeBrowserHome:        {180, 0x1008ff18}, // XF86HomePage
+	key.CodeBrowserRefresh:     {181, 0x1008ff29}, // XF86Refresh
+	key.CodeF13:                {191, 0xffca},     // F13
+	key.CodeF14:                {192, 0xffcb},     // F14
+	key.CodeF15:                {193, 0xffcc},     // F15
+	key.CodeF16:                {194, 0xffcd},     // F16
+	key.CodeF17:                {195, 0xffce},     // F17
+	key.CodeF18:                {196, 0xffcf},     // F18
+	key.CodeF19:                {197, 0xffd0},     // F19
+	key.CodeF20:                {198, 0xffd1},     // F20
+	key.CodeF21:                {199, 0xffd2},     // F21
+	key.CodeF22:                {200, 0xffd3},     // F22
+	key.CodeF23:                {201, 0xffd4},     // F23
+	key.CodeF24:                {202, 0xffd5},     // F24
+	key.CodeBrowserSearch:      {225, 0x1008ff1b}, // XF86Search
+	key.CodeMediaSelect:        {234, 0x1008ff32}, // XF86AudioMedia
+}
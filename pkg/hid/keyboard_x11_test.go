@@ -0,0 +1,92 @@
+//go:build linux
+
+package hid
+
+import (
+	"testing"
+
+	"github.com/adamroach/webrd/pkg/hid/key"
+	"github.com/jezek/xgb/xproto"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestX11Keymap(t *testing.T) {
+	tests := []struct {
+		code    key.Code
+		keycode xproto.Keycode
+		keysym  xproto.Keysym
+	}{
+		{key.CodeEscape, 9, 0xff1b},
+		{key.CodeKeyA, 38, 0x0061},
+		{key.CodeDigit0, 19, 0x0030},
+		{key.CodeEnter, 36, 0xff0d},
+		{key.CodeShiftLeft, 50, 0xffe1},
+		{key.CodeShiftRight, 62, 0xffe2},
+		{key.CodeSpace, 65, 0x0020},
+		{key.CodeF1, 67, 0xffbe},
+		{key.CodeF12, 96, 0xffc9},
+		{key.CodeArrowUp, 111, 0xff52},
+		{key.CodeDelete, 119, 0xffff},
+		{key.CodeMetaLeft, 133, 0xffeb},
+		{key.CodeNumpadEnter, 104, 0xff8d},
+		{key.CodeAudioVolumeMute, 121, 0x1008ff12},
+		{key.CodeF24, 202, 0xffd5},
+	}
+	for _, test := range tests {
+		t.Run(string(test.code), func(t *testing.T) {
+			x, ok := x11Keymap[test.code]
+			assert.True(t, ok)
+			assert.Equal(t, test.keycode, x.keycode)
+			assert.Equal(t, test.keysym, x.keysym)
+		})
+	}
+}
+
+func TestX11Keymap_Keycodes(t *testing.T) {
+	// X keycodes are evdev scancodes offset by 8, and fit in a byte
+	used := map[xproto.Keycode]key.Code{}
+	for code, x := range x11Keymap {
+		assert.GreaterOrEqual(t, x.keycode, xproto.Keycode(8), code)
+		if other, ok := used[x.keycode]; ok {
+			// Only the old and new names for the volume keys share a keycode
+			assert.Equal(t, x11Keymap[other].keysym, x.keysym, "%s and %s", code, other)
+		}
+		used[x.keycode] = code
+	}
+}
+
+func TestMapKeycodes(t *testing.T) {
+	// A server with two keysyms per keycode, from keycode 8 up to 70
+	minKeycode, maxKeycode := xproto.Keycode(8), xproto.Keycode(70)
+	keysyms := make([]xproto.Keysym, 2*int(maxKeycode-minKeycode+1))
+	set := func(keycode xproto.Keycode, keysym xproto.Keysym) {
+		keysyms[2*int(keycode-minKeycode)] = keysym
+	}
+	set(38, 0x0061) // a, at its evdev keycode
+	set(66, 0x0071) // q, where Caps Lock would be
+	set(9, 0xff1b)  // Escape
+	set(70, 0xffbe) // F1, away from its evdev keycode (67)
+
+	keycodes := mapKeycodes(minKeycode, maxKeycode, 2, keysyms)
+	tests := []struct {
+		name    string
+		code    key.Code
+		keycode xproto.Keycode
+		ok      bool
+	}{
+		{"evdev keycode", key.CodeKeyA, 38, true},
+		{"evdev keycode with another keysym", key.CodeCapsLock, 66, true},
+		{"keysym fallback", key.CodeF1, 70, true},
+		{"keysym fallback to a keycode with another key", key.CodeKeyQ, 66, true},
+		{"unmapped", key.CodeKeyZ, 0, false},
+		{"beyond the server's keycodes", key.CodeF12, 0, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			keycode, ok := keycodes[test.code]
+			assert.Equal(t, test.ok, ok)
+			assert.Equal(t, test.keycode, keycode)
+		})
+	}
+	assert.Empty(t, mapKeycodes(minKeycode, maxKeycode, 0, nil))
+}
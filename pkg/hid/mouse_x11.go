@@ -0,0 +1,133 @@
+//go:build linux
+
+package hid
+
+import (
+	"log"
+
+	"github.com/jezek/xgb"
+	"github.com/jezek/xgb/xproto"
+	"github.com/jezek/xgb/xtest"
+)
+
+// X11 reports scrolling as presses of buttons 4-7. Browsers report wheel
+// movement in pixels, so we accumulate deltas and emit one button press for
+// every wheelStep pixels of travel.
+const wheelStep = 50
+
+const (
+	x11ButtonLeft       = 1
+	x11ButtonMiddle     = 2
+	x11ButtonRight      = 3
+	x11ButtonWheelUp    = 4
+	x11ButtonWheelDown  = 5
+	x11ButtonWheelLeft  = 6
+	x11ButtonWheelRight = 7
+	x11ButtonBack       = 8
+	x11ButtonForward    = 9
+)
+
+// Maps DOM MouseEvent.button values onto X11 button numbers
+var x11Buttons = map[int]byte{
+	0: x11ButtonLeft,
+	1: x11ButtonMiddle,
+	2: x11ButtonRight,
+	3: x11ButtonBack,
+	4: x11ButtonForward,
+}
+
+type x11Mouse struct {
+	conn   *xgb.Conn
+	root   xproto.Window
+	click  func(button byte) error // presses and releases a button, for the wheel
+	wheelX int
+	wheelY int
+}
+
+func NewX11Mouse(display string) (Mouse, error) {
+	conn, root, err := newX11Connection(display)
+	if err != nil {
+		return nil, err
+	}
+	m := &x11Mouse{
+		conn: conn,
+		root: root,
+	}
+	m.click = m.fakeClick
+	return m, nil
+}
+
+// x11Button maps a DOM MouseEvent.button value onto an X11 button number.
+func x11Button(button int) byte {
+	if xButton, ok := x11Buttons[button]; ok {
+		return xButton
+	}
+	return byte(button + 1)
+}
+
+// Close disconnects from the X server.
+func (m *x11Mouse) Close() error {
+	m.conn.Close()
+	return nil
+}
+
+func (m *x11Mouse) Move(x, y int) error {
+	return xtest.FakeInputChecked(m.conn, xproto.MotionNotify, 0, 0, m.root, int16(x), int16(y), 0).Check()
+}
+
+func (m *x11Mouse) Button(button int, x int, y int, down bool) error {
+	log.Printf("Button: %d, x: %d, y: %d, down: %v", button, x, y, down)
+	xButton := x11Button(button)
+	if err := m.Move(x, y); err != nil {
+		return err
+	}
+	eventType := byte(xproto.ButtonRelease)
+	if down {
+		eventType = xproto.ButtonPress
+	}
+	return xtest.FakeInputChecked(m.conn, eventType, xButton, 0, m.root, 0, 0, 0).Check()
+}
+
+func (m *x11Mouse) Wheel(deltaX, deltaY, deltaZ int) error {
+	// X11 has no notion of a Z axis, so deltaZ is ignored
+	var err error
+	m.wheelX, err = m.scroll(m.wheelX+deltaX, x11ButtonWheelLeft, x11ButtonWheelRight)
+	if err != nil {
+		return err
+	}
+	m.wheelY, err = m.scroll(m.wheelY+deltaY, x11ButtonWheelUp, x11ButtonWheelDown)
+	return err
+}
+
+// scroll emits a click of the negative or positive wheel button for each
+// wheelStep in delta, and returns whatever is left over.
+func (m *x11Mouse) scroll(delta int, negative, positive byte) (int, error) {
+	for delta >= wheelStep || delta <= -wheelStep {
+		button := positive
+		if delta < 0 {
+			button = negative
+			delta += wheelStep
+		} else {
+			delta -= wheelStep
+		}
+		if err := m.click(button); err != nil {
+			return 0, err
+		}
+	}
+	return delta, nil
+}
+
+func (m *x11Mouse) fakeClick(button byte) error {
+	for _, eventType := range []byte{xproto.ButtonPress, xproto.ButtonRelease} {
+		err := xtest.FakeInputChecked(m.conn, eventType, button, 0, m.root, 0, 0, 0).Check()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *x11Mouse) Touch(touches []Touch, event TouchEvent) error {
+	// TODO -- touch injection requires XInput 2.2
+	return nil
+}
@@ -0,0 +1,64 @@
+//go:build linux
+
+package hid
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestX11Button(t *testing.T) {
+	tests := []struct {
+		dom  int
+		x11  byte
+		name string
+	}{
+		{0, x11ButtonLeft, "left"},
+		{1, x11ButtonMiddle, "middle"},
+		{2, x11ButtonRight, "right"},
+		{3, x11ButtonBack, "back"},
+		{4, x11ButtonForward, "forward"},
+		{5, 6, "unknown"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.x11, x11Button(test.dom))
+		})
+	}
+}
+
+func TestX11Mouse_Wheel(t *testing.T) {
+	tests := []struct {
+		name    string
+		deltas  [][2]int // x and y for each call to Wheel
+		clicks  []byte
+		remainX int
+		remainY int
+	}{
+		{"less than a step", [][2]int{{0, 30}}, nil, 0, 30},
+		{"steps add up", [][2]int{{0, 30}, {0, 30}}, []byte{x11ButtonWheelDown}, 0, 10},
+		{"several steps at once", [][2]int{{0, 120}}, []byte{x11ButtonWheelDown, x11ButtonWheelDown}, 0, 20},
+		{"up", [][2]int{{0, -120}}, []byte{x11ButtonWheelUp, x11ButtonWheelUp}, 0, -20},
+		{"up cancels down", [][2]int{{0, 40}, {0, -70}}, nil, 0, -30},
+		{"right", [][2]int{{75, 0}}, []byte{x11ButtonWheelRight}, 25, 0},
+		{"left", [][2]int{{-60, 0}, {-45, 0}}, []byte{x11ButtonWheelLeft, x11ButtonWheelLeft}, -5, 0},
+		{"both axes", [][2]int{{-50, 50}}, []byte{x11ButtonWheelLeft, x11ButtonWheelDown}, 0, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var clicks []byte
+			m := &x11Mouse{click: func(button byte) error {
+				clicks = append(clicks, button)
+				return nil
+			}}
+			for _, delta := range test.deltas {
+				require.NoError(t, m.Wheel(delta[0], delta[1], 0))
+			}
+			assert.Equal(t, test.clicks, clicks)
+			assert.Equal(t, test.remainX, m.wheelX)
+			assert.Equal(t, test.remainY, m.wheelY)
+		})
+	}
+}
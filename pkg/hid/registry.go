@@ -0,0 +1,21 @@
+package hid
+
+import (
+	"io"
+
+	"github.com/adamroach/webrd/pkg/backend"
+)
+
+var (
+	Keyboards = backend.NewRegistry[Keyboard]("keyboard")
+	Mice      = backend.NewRegistry[Mouse]("mouse")
+)
+
+// Close releases whatever a keyboard or mouse holds on to, such as a
+// connection to the X server. Devices that hold nothing are left alone.
+func Close(device any) error {
+	if closer, ok := device.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
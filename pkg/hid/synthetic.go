@@ -0,0 +1,121 @@
+package hid
+
+import (
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/adamroach/webrd/pkg/hid/key"
+)
+
+// SyntheticInput is shared by the synthetic keyboard and mouse backends and
+// the synthetic video capturer, which echoes the recorded input onto the
+// frames it generates.
+var SyntheticInput = NewRecorder(8)
+
+// Recorder keeps track of input events without delivering them anywhere,
+// which is useful for running headless and for testing.
+type Recorder struct {
+	mu         sync.RWMutex // protects access to all fields
+	state      InputState
+	recentKeys int
+}
+
+// InputState is a snapshot of the input seen so far by a Recorder.
+type InputState struct {
+	PointerX   int
+	PointerY   int
+	Buttons    uint32   // Bitmask of buttons that are currently down
+	RecentKeys []string // Most recent key presses, oldest first
+	Events     uint64   // Total number of events recorded
+}
+
+func NewRecorder(recentKeys int) *Recorder {
+	return &Recorder{recentKeys: recentKeys}
+}
+
+func (r *Recorder) State() InputState {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	state := r.state
+	state.RecentKeys = append([]string(nil), r.state.RecentKeys...)
+	return state
+}
+
+func (r *Recorder) record(update func(state *InputState)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	update(&r.state)
+	r.state.Events++
+}
+
+type syntheticKeyboard struct {
+	recorder *Recorder
+}
+
+func NewSyntheticKeyboard(recorder *Recorder) Keyboard {
+	return &syntheticKeyboard{recorder: recorder}
+}
+
+func (k *syntheticKeyboard) Key(event key.Event) error {
+	log.Printf("Synthetic key event: %+v", event)
+	k.recorder.record(func(state *InputState) {
+		if !event.KeyDown {
+			return
+		}
+		name := event.Key
+		if name == "" || name == " " {
+			name = string(event.Code)
+		}
+		state.RecentKeys = append(state.RecentKeys, name)
+		if len(state.RecentKeys) > k.recorder.recentKeys {
+			state.RecentKeys = state.RecentKeys[len(state.RecentKeys)-k.recorder.recentKeys:]
+		}
+	})
+	return nil
+}
+
+type syntheticMouse struct {
+	recorder *Recorder
+}
+
+func NewSyntheticMouse(recorder *Recorder) Mouse {
+	return &syntheticMouse{recorder: recorder}
+}
+
+func (m *syntheticMouse) Move(x, y int) error {
+	m.recorder.record(func(state *InputState) {
+		state.PointerX = x
+		state.PointerY = y
+	})
+	return nil
+}
+
+func (m *syntheticMouse) Button(button int, x int, y int, down bool) error {
+	log.Printf("Synthetic button: %d, x: %d, y: %d, down: %v", button, x, y, down)
+	if button < 0 || button >= 32 {
+		return fmt.Errorf("invalid button %d", button)
+	}
+	m.recorder.record(func(state *InputState) {
+		state.PointerX = x
+		state.PointerY = y
+		if down {
+			state.Buttons |= 1 << button
+		} else {
+			state.Buttons &^= 1 << button
+		}
+	})
+	return nil
+}
+
+func (m *syntheticMouse) Wheel(deltaX, deltaY, deltaZ int) error {
+	log.Printf("Synthetic wheel: %d, %d, %d", deltaX, deltaY, deltaZ)
+	m.recorder.record(func(state *InputState) {})
+	return nil
+}
+
+func (m *syntheticMouse) Touch(touches []Touch, event TouchEvent) error {
+	log.Printf("Synthetic touch: %s %+v", event, touches)
+	m.recorder.record(func(state *InputState) {})
+	return nil
+}
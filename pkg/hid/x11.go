@@ -0,0 +1,27 @@
+//go:build linux
+
+package hid
+
+import (
+	"fmt"
+
+	"github.com/jezek/xgb"
+	"github.com/jezek/xgb/xproto"
+	"github.com/jezek/xgb/xtest"
+)
+
+// newX11Connection connects to the named X server (or the one named by
+// $DISPLAY, if display is empty) and makes sure that it supports the XTEST
+// extension, which we use to inject input events.
+func newX11Connection(display string) (*xgb.Conn, xproto.Window, error) {
+	conn, err := xgb.NewConnDisplay(display)
+	if err != nil {
+		return nil, 0, fmt.Errorf("could not connect to X server: %v", err)
+	}
+	if err = xtest.Init(conn); err != nil {
+		conn.Close()
+		return nil, 0, fmt.Errorf("XTEST extension not available: %v", err)
+	}
+	root := xproto.Setup(conn).DefaultScreen(conn).Root
+	return conn, root, nil
+}
@@ -0,0 +1,180 @@
+package imageconvert
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+)
+
+// Matrix selects the coefficients used to derive luma and chroma from RGB.
+type Matrix int
+
+const (
+	// MatrixUnspecified means the matrix isn't known; it is converted as
+	// BT.601, and not signaled to decoders.
+	MatrixUnspecified Matrix = iota
+	// BT601 is the standard definition matrix, which JPEG also uses.
+	BT601
+	// BT709 is the high definition matrix, which browsers assume for HD
+	// video that doesn't say otherwise.
+	BT709
+)
+
+func ParseMatrix(name string) (Matrix, error) {
+	switch name {
+	case "bt601":
+		return BT601, nil
+	case "bt709":
+		return BT709, nil
+	}
+	return MatrixUnspecified, fmt.Errorf("unknown color matrix %q", name)
+}
+
+func (m Matrix) String() string {
+	switch m {
+	case MatrixUnspecified:
+		return "unspecified"
+	case BT601:
+		return "bt601"
+	case BT709:
+		return "bt709"
+	}
+	return fmt.Sprintf("Matrix(%d)", int(m))
+}
+
+// ColorSpace describes how RGB pixels are turned into YCbCr samples. Full
+// range samples use all of [0, 255]; limited ("video") range samples keep
+// luma within [16, 235] and chroma within [16, 240], which is what video
+// decoders assume unless told otherwise.
+type ColorSpace struct {
+	Matrix    Matrix
+	FullRange bool
+}
+
+// JFIF is the color space used by the image/color package and by JPEG:
+// full range BT.601.
+var JFIF = ColorSpace{Matrix: BT601, FullRange: true}
+
+// ParseColorSpace parses a matrix name ("bt601" or "bt709") and a range
+// name ("limited" or "full").
+func ParseColorSpace(matrix, colorRange string) (ColorSpace, error) {
+	m, err := ParseMatrix(matrix)
+	if err != nil {
+		return ColorSpace{}, err
+	}
+	switch colorRange {
+	case "limited":
+		return ColorSpace{Matrix: m}, nil
+	case "full":
+		return ColorSpace{Matrix: m, FullRange: true}, nil
+	}
+	return ColorSpace{}, fmt.Errorf("unknown color range %q", colorRange)
+}
+
+func (c ColorSpace) String() string {
+	if c.FullRange {
+		return c.Matrix.String() + " full range"
+	}
+	return c.Matrix.String() + " limited range"
+}
+
+// ToYCbCr converts src into dst, which must have the same bounds and use 4:2:0
+// subsampling. *image.RGBA and *image.NRGBA sources are converted directly
+// from their pixel buffers; anything else goes through the (much slower)
+// image.Image interface. Alpha is ignored, since screens are opaque.
+func (c ColorSpace) ToYCbCr(dst *image.YCbCr, src image.Image) error {
+	return toYCbCr(dst, src, c.coefficients())
+}
+
+// BGRAToYCbCr converts a buffer of 32-bit BGRA (or BGRX) pixels, as produced
+// by X11 and most other native screen capture APIs, into dst. The buffer
+// holds one row every stride bytes, and must cover dst's bounds.
+func (c ColorSpace) BGRAToYCbCr(dst *image.YCbCr, pix []byte, stride int) error {
+	return bgraToYCbCr(dst, pix, stride, c.coefficients())
+}
+
+// Color converts a single RGB color.
+func (c ColorSpace) Color(r, g, b uint8) color.YCbCr {
+	k := c.coefficients()
+	cb, cr := k.chroma1(int32(r), int32(g), int32(b))
+	return color.YCbCr{Y: k.luma(int32(r), int32(g), int32(b)), Cb: cb, Cr: cr}
+}
+
+// coefficients holds a color space's conversion in 16-bit fixed point.
+type coefficients struct {
+	yr, yg, yb, yOffset int32 // yOffset includes rounding
+	cbr, cbg, cbb       int32
+	crr, crg, crb       int32
+}
+
+var (
+	coefficientsBT601Full    = newCoefficients(0.299, 0.114, true)
+	coefficientsBT601Limited = newCoefficients(0.299, 0.114, false)
+	coefficientsBT709Full    = newCoefficients(0.2126, 0.0722, true)
+	coefficientsBT709Limited = newCoefficients(0.2126, 0.0722, false)
+)
+
+func (c ColorSpace) coefficients() *coefficients {
+	switch {
+	case c.Matrix == BT709 && c.FullRange:
+		return coefficientsBT709Full
+	case c.Matrix == BT709:
+		return coefficientsBT709Limited
+	case c.FullRange:
+		return coefficientsBT601Full
+	}
+	return coefficientsBT601Limited
+}
+
+// newCoefficients derives the conversion from the red and blue luma
+// weights. The coefficients for green are whatever is left over, so that
+// grays always have neutral chroma and white has the maximum luma.
+func newCoefficients(kr, kb float64, fullRange bool) *coefficients {
+	lumaScale, chromaScale, lumaOffset := 219.0/255, 224.0/255, int32(16)
+	if fullRange {
+		lumaScale, chromaScale, lumaOffset = 1, 1, 0
+	}
+	fixed := func(v float64) int32 {
+		return int32(math.Round(v * (1 << 16)))
+	}
+	k := &coefficients{
+		yr:      fixed(kr * lumaScale),
+		yb:      fixed(kb * lumaScale),
+		yOffset: lumaOffset<<16 + 1<<15,
+		cbr:     fixed(-kr / (2 * (1 - kb)) * chromaScale),
+		cbb:     fixed(0.5 * chromaScale),
+		crr:     fixed(0.5 * chromaScale),
+		crb:     fixed(-kb / (2 * (1 - kr)) * chromaScale),
+	}
+	k.yg = fixed(lumaScale) - k.yr - k.yb
+	k.cbg = -k.cbr - k.cbb
+	k.crg = -k.crr - k.crb
+	return k
+}
+
+func (k *coefficients) luma(r, g, b int32) uint8 {
+	return uint8((k.yr*r + k.yg*g + k.yb*b + k.yOffset) >> 16)
+}
+
+// chroma4 computes a chroma sample from the sums of four pixels.
+func (k *coefficients) chroma4(r, g, b int32) (uint8, uint8) {
+	cb := k.cbr*r + k.cbg*g + k.cbb*b + 257<<17
+	cr := k.crr*r + k.crg*g + k.crb*b + 257<<17
+	return clamp(cb, 18), clamp(cr, 18)
+}
+
+// chroma1 computes a chroma sample from a single pixel.
+func (k *coefficients) chroma1(r, g, b int32) (uint8, uint8) {
+	cb := k.cbr*r + k.cbg*g + k.cbb*b + 257<<15
+	cr := k.crr*r + k.crg*g + k.crb*b + 257<<15
+	return clamp(cb, 16), clamp(cr, 16)
+}
+
+// chroma computes a chroma sample from the sums of count pixels.
+func (k *coefficients) chroma(r, g, b int32, count int) (uint8, uint8) {
+	n := int32(count)
+	cb := (k.cbr*r+k.cbg*g+k.cbb*b)/n + 257<<15
+	cr := (k.crr*r+k.crg*g+k.crb*b)/n + 257<<15
+	return clamp(cb, 16), clamp(cr, 16)
+}
@@ -0,0 +1,111 @@
+package imageconvert_test
+
+import (
+	"image"
+	"math"
+	"testing"
+
+	"github.com/adamroach/webrd/pkg/imageconvert"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// referenceColor converts one pixel in floating point, straight from the
+// definitions in BT.601 and BT.709.
+func referenceColor(cs imageconvert.ColorSpace, r, g, b float64) (y, cb, cr float64) {
+	kr, kb := 0.299, 0.114
+	if cs.Matrix == imageconvert.BT709 {
+		kr, kb = 0.2126, 0.0722
+	}
+	luma := kr*r + (1-kr-kb)*g + kb*b
+	cb, cr = (b-luma)/(2*(1-kb)), (r-luma)/(2*(1-kr))
+	if cs.FullRange {
+		return luma, cb + 128, cr + 128
+	}
+	return 16 + luma*219/255, 128 + cb*224/255, 128 + cr*224/255
+}
+
+var colorSpaces = []imageconvert.ColorSpace{
+	{Matrix: imageconvert.BT601},
+	{Matrix: imageconvert.BT601, FullRange: true},
+	{Matrix: imageconvert.BT709},
+	{Matrix: imageconvert.BT709, FullRange: true},
+}
+
+func TestColorSpace_Color(t *testing.T) {
+	for _, cs := range colorSpaces {
+		for _, rgb := range [][3]uint8{{0, 0, 0}, {255, 255, 255}, {255, 0, 0}, {0, 255, 0}, {0, 0, 255}, {12, 200, 99}} {
+			y, cb, cr := referenceColor(cs, float64(rgb[0]), float64(rgb[1]), float64(rgb[2]))
+			c := cs.Color(rgb[0], rgb[1], rgb[2])
+			assert.InDelta(t, y, float64(c.Y), 0.51, "%v %v", cs, rgb)
+			assert.InDelta(t, cb, float64(c.Cb), 0.51, "%v %v", cs, rgb)
+			assert.InDelta(t, cr, float64(c.Cr), 0.51, "%v %v", cs, rgb)
+		}
+		// Grays have neutral chroma
+		gray := cs.Color(77, 77, 77)
+		assert.Equal(t, uint8(128), gray.Cb)
+		assert.Equal(t, uint8(128), gray.Cr)
+	}
+	limited := imageconvert.ColorSpace{Matrix: imageconvert.BT709}
+	assert.Equal(t, uint8(16), limited.Color(0, 0, 0).Y)
+	assert.Equal(t, uint8(235), limited.Color(255, 255, 255).Y)
+}
+
+// referenceYCbCr converts src with Color, averaging the chroma of the
+// pixels that share each sample.
+func referenceYCbCr(cs imageconvert.ColorSpace, src *image.RGBA) *image.YCbCr {
+	dst := image.NewYCbCr(src.Rect, image.YCbCrSubsampleRatio420)
+	sums := make(map[int][3]int)
+	for y := src.Rect.Min.Y; y < src.Rect.Max.Y; y++ {
+		for x := src.Rect.Min.X; x < src.Rect.Max.X; x++ {
+			i := src.PixOffset(x, y)
+			c := cs.Color(src.Pix[i], src.Pix[i+1], src.Pix[i+2])
+			dst.Y[dst.YOffset(x, y)] = c.Y
+			offset := dst.COffset(x, y)
+			sum := sums[offset]
+			sums[offset] = [3]int{sum[0] + int(c.Cb), sum[1] + int(c.Cr), sum[2] + 1}
+		}
+	}
+	for offset, sum := range sums {
+		dst.Cb[offset] = uint8(math.Round(float64(sum[0]) / float64(sum[2])))
+		dst.Cr[offset] = uint8(math.Round(float64(sum[1]) / float64(sum[2])))
+	}
+	return dst
+}
+
+func TestColorSpace_ToYCbCr(t *testing.T) {
+	src := randomRGBA(67, 35)
+	for _, cs := range colorSpaces {
+		expected := referenceYCbCr(cs, src)
+
+		dst := image.NewYCbCr(src.Rect, image.YCbCrSubsampleRatio420)
+		require.NoError(t, cs.ToYCbCr(dst, src))
+		assertClose(t, expected, dst)
+
+		dst = image.NewYCbCr(src.Rect, image.YCbCrSubsampleRatio420)
+		require.NoError(t, cs.ToYCbCr(dst, struct{ image.Image }{src}))
+		assertClose(t, expected, dst)
+
+		bgra := make([]byte, len(src.Pix))
+		for i := 0; i < len(bgra); i += 4 {
+			bgra[i], bgra[i+1], bgra[i+2] = src.Pix[i+2], src.Pix[i+1], src.Pix[i]
+		}
+		dst = image.NewYCbCr(src.Rect, image.YCbCrSubsampleRatio420)
+		require.NoError(t, cs.BGRAToYCbCr(dst, bgra, src.Stride))
+		assertClose(t, expected, dst)
+	}
+}
+
+func TestParseColorSpace(t *testing.T) {
+	cs, err := imageconvert.ParseColorSpace("bt709", "limited")
+	require.NoError(t, err)
+	assert.Equal(t, imageconvert.ColorSpace{Matrix: imageconvert.BT709}, cs)
+	cs, err = imageconvert.ParseColorSpace("bt601", "full")
+	require.NoError(t, err)
+	assert.Equal(t, imageconvert.JFIF, cs)
+
+	_, err = imageconvert.ParseColorSpace("bt2020", "full")
+	assert.Error(t, err)
+	_, err = imageconvert.ParseColorSpace("bt709", "partial")
+	assert.Error(t, err)
+}
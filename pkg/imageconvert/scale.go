@@ -0,0 +1,263 @@
+package imageconvert
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"math"
+)
+
+// Filter selects the resampling algorithm used by Scale.
+type Filter int
+
+const (
+	// FilterArea averages all of the source pixels that each destination
+	// pixel covers. It is the best choice for downscaling.
+	FilterArea Filter = iota
+	// FilterBilinear interpolates between the two nearest source pixels in
+	// each direction. It is cheaper, but aliases when shrinking by more than
+	// a factor of two.
+	FilterBilinear
+)
+
+func ParseFilter(name string) (Filter, error) {
+	switch name {
+	case "area", "":
+		return FilterArea, nil
+	case "bilinear":
+		return FilterBilinear, nil
+	}
+	return 0, fmt.Errorf("unknown scaling filter %q", name)
+}
+
+func (f Filter) String() string {
+	switch f {
+	case FilterArea:
+		return "area"
+	case FilterBilinear:
+		return "bilinear"
+	}
+	return fmt.Sprintf("Filter(%d)", int(f))
+}
+
+// Weights are fixed point, with this many fractional bits
+const weightBits = 14
+
+// Horizontally resampled rows keep this many fractional bits, so that the
+// vertical pass fits in 32 bits
+const rowBits = 7
+
+// taps holds the weights of the source samples that make up each destination
+// sample along one axis. Every destination sample has the same number of
+// weights (padded with zeros), so destination sample i is made up of count
+// source samples starting at first[i], weighted by
+// weights[i*count:(i+1)*count]. The weights for each destination sample add
+// up to 1<<weightBits.
+type taps struct {
+	count   int
+	first   []int
+	weights []int32
+}
+
+// newTaps calls weigh for each destination sample, which returns the first
+// source sample it covers and the (unnormalized) weights of the source
+// samples from there on.
+func newTaps(srcSize, dstSize int, weigh func(i int) (int, []float64)) taps {
+	firsts := make([]int, dstSize)
+	all := make([][]int32, dstSize)
+	var t taps
+	for i := range dstSize {
+		var weights []float64
+		firsts[i], weights = weigh(i)
+		all[i] = normalize(weights)
+		t.count = max(t.count, len(all[i]))
+	}
+	t.first = make([]int, dstSize)
+	t.weights = make([]int32, dstSize*t.count)
+	for i, weights := range all {
+		// Move the window back if necessary, so that it stays within the
+		// source; the padding then goes before the real weights
+		first := min(firsts[i], srcSize-t.count)
+		copy(t.weights[i*t.count+firsts[i]-first:], weights)
+		t.first[i] = first
+	}
+	return t
+}
+
+// Scale resamples src into dst. Both images must use 4:2:0 subsampling;
+// they may be of any size.
+func Scale(dst, src *image.YCbCr, filter Filter) error {
+	if dst.SubsampleRatio != image.YCbCrSubsampleRatio420 || src.SubsampleRatio != image.YCbCrSubsampleRatio420 {
+		return errors.New("only 4:2:0 subsampling is supported")
+	}
+	if dst.Rect.Empty() || src.Rect.Empty() {
+		return errors.New("images must not be empty")
+	}
+	scalePlane(
+		dst.Y[dst.YOffset(dst.Rect.Min.X, dst.Rect.Min.Y):], dst.YStride, dst.Rect.Size(),
+		src.Y[src.YOffset(src.Rect.Min.X, src.Rect.Min.Y):], src.YStride, src.Rect.Size(),
+		filter,
+	)
+	dstChroma := chromaSize(dst.Rect)
+	srcChroma := chromaSize(src.Rect)
+	for _, planes := range [][2][]byte{{dst.Cb, src.Cb}, {dst.Cr, src.Cr}} {
+		scalePlane(
+			planes[0][dst.COffset(dst.Rect.Min.X, dst.Rect.Min.Y):], dst.CStride, dstChroma,
+			planes[1][src.COffset(src.Rect.Min.X, src.Rect.Min.Y):], src.CStride, srcChroma,
+			filter,
+		)
+	}
+	return nil
+}
+
+// chromaSize returns the size of the chroma planes of a 4:2:0 image.
+func chromaSize(r image.Rectangle) image.Point {
+	return image.Pt((r.Max.X+1)/2-r.Min.X/2, (r.Max.Y+1)/2-r.Min.Y/2)
+}
+
+func scalePlane(dst []byte, dstStride int, dstSize image.Point, src []byte, srcStride int, srcSize image.Point, filter Filter) {
+	if srcSize == dstSize.Mul(2) {
+		// Both filters average 2x2 blocks at exactly half size
+		halvePlane(dst, dstStride, dstSize, src, srcStride)
+		return
+	}
+	weights := areaWeights
+	if filter == FilterBilinear {
+		weights = bilinearWeights
+	}
+	columns := weights(srcSize.X, dstSize.X)
+	rows := weights(srcSize.Y, dstSize.Y)
+
+	forEachBand(dstSize.Y, func(y0, y1 int) {
+		// Source rows are resampled horizontally once, and kept around for
+		// as long as they might be needed by the next destination row
+		cached := make([][]int32, rows.count+1)
+		cachedRow := make([]int, len(cached))
+		for i := range cached {
+			cached[i] = make([]int32, dstSize.X)
+			cachedRow[i] = -1
+		}
+		sums := make([]int32, dstSize.X)
+		for y := y0; y < y1; y++ {
+			clear(sums)
+			first := rows.first[y]
+			for i, weight := range rows.weights[y*rows.count : (y+1)*rows.count] {
+				if weight == 0 {
+					continue
+				}
+				srcY := first + i
+				slot := srcY % len(cached)
+				row := cached[slot]
+				if cachedRow[slot] != srcY {
+					resampleRow(row, src[srcY*srcStride:srcY*srcStride+srcSize.X], &columns)
+					cachedRow[slot] = srcY
+				}
+				row = row[:len(sums)]
+				for x, value := range row {
+					sums[x] += value * weight
+				}
+			}
+			dstRow := dst[y*dstStride : y*dstStride+dstSize.X]
+			for x, sum := range sums {
+				dstRow[x] = uint8(min(255, max(0, (sum+1<<(weightBits+rowBits-1))>>(weightBits+rowBits))))
+			}
+		}
+	})
+}
+
+func halvePlane(dst []byte, dstStride int, dstSize image.Point, src []byte, srcStride int) {
+	width := dstSize.X
+	forEachBand(dstSize.Y, func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			top := src[2*y*srcStride : 2*y*srcStride+2*width]
+			bottom := src[(2*y+1)*srcStride : (2*y+1)*srcStride+2*width]
+			dstRow := dst[y*dstStride : y*dstStride+width]
+			for x := range dstRow {
+				sum := uint(top[2*x]) + uint(top[2*x+1]) + uint(bottom[2*x]) + uint(bottom[2*x+1])
+				dstRow[x] = uint8((sum + 2) >> 2)
+			}
+		}
+	})
+}
+
+// resampleRow resamples one row of source samples horizontally, leaving the
+// results with rowBits fractional bits.
+func resampleRow(dst []int32, src []byte, columns *taps) {
+	count := columns.count
+	if count == 2 {
+		// By far the most common case: bilinear, or area at exactly half size
+		for x := range dst {
+			first := columns.first[x]
+			samples := src[first : first+2 : first+2]
+			weights := columns.weights[2*x : 2*x+2 : 2*x+2]
+			sum := int32(samples[0])*weights[0] + int32(samples[1])*weights[1]
+			dst[x] = (sum + 1<<(weightBits-rowBits-1)) >> (weightBits - rowBits)
+		}
+		return
+	}
+	for x := range dst {
+		first := columns.first[x]
+		samples := src[first : first+count : first+count]
+		var sum int32
+		for i, weight := range columns.weights[x*count : (x+1)*count] {
+			sum += int32(samples[i]) * weight
+		}
+		dst[x] = (sum + 1<<(weightBits-rowBits-1)) >> (weightBits - rowBits)
+	}
+}
+
+// areaWeights gives each source sample a weight proportional to how much of
+// the destination sample it covers.
+func areaWeights(srcSize, dstSize int) taps {
+	scale := float64(srcSize) / float64(dstSize)
+	return newTaps(srcSize, dstSize, func(i int) (int, []float64) {
+		start := float64(i) * scale
+		end := float64(i+1) * scale
+		first := int(math.Floor(start))
+		last := min(int(math.Ceil(end)), srcSize) - 1
+		coverage := make([]float64, last-first+1)
+		for j := range coverage {
+			coverage[j] = min(end, float64(first+j+1)) - max(start, float64(first+j))
+		}
+		return first, coverage
+	})
+}
+
+// bilinearWeights interpolates between the two source samples closest to
+// the center of each destination sample.
+func bilinearWeights(srcSize, dstSize int) taps {
+	scale := float64(srcSize) / float64(dstSize)
+	return newTaps(srcSize, dstSize, func(i int) (int, []float64) {
+		center := (float64(i)+0.5)*scale - 0.5
+		first := int(math.Floor(center))
+		fraction := center - float64(first)
+		switch {
+		case first < 0:
+			return 0, []float64{1}
+		case first >= srcSize-1:
+			return srcSize - 1, []float64{1}
+		}
+		return first, []float64{1 - fraction, fraction}
+	})
+}
+
+// normalize converts weights to fixed point, making sure that they add up
+// to exactly 1<<weightBits so that flat areas stay flat.
+func normalize(weights []float64) []int32 {
+	var total float64
+	for _, w := range weights {
+		total += w
+	}
+	fixed := make([]int32, len(weights))
+	var sum int32
+	largest := 0
+	for i, w := range weights {
+		fixed[i] = int32(math.Round(w / total * (1 << weightBits)))
+		sum += fixed[i]
+		if fixed[i] > fixed[largest] {
+			largest = i
+		}
+	}
+	fixed[largest] += 1<<weightBits - sum
+	return fixed
+}
@@ -0,0 +1,144 @@
+package imageconvert_test
+
+import (
+	"image"
+	"testing"
+
+	"github.com/adamroach/webrd/pkg/imageconvert"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func randomYCbCr(t testing.TB, width, height int) *image.YCbCr {
+	src := randomRGBA(width, height)
+	dst := image.NewYCbCr(src.Rect, image.YCbCrSubsampleRatio420)
+	require.NoError(t, imageconvert.ToYCbCr(dst, src))
+	return dst
+}
+
+func fill(img *image.YCbCr, y, cb, cr uint8) {
+	for i := range img.Y {
+		img.Y[i] = y
+	}
+	for i := range img.Cb {
+		img.Cb[i], img.Cr[i] = cb, cr
+	}
+}
+
+func TestScale_Flat(t *testing.T) {
+	// Every filter must leave a flat image flat, at any ratio
+	src := image.NewYCbCr(image.Rect(0, 0, 1001, 777), image.YCbCrSubsampleRatio420)
+	fill(src, 200, 30, 240)
+	for _, filter := range []imageconvert.Filter{imageconvert.FilterArea, imageconvert.FilterBilinear} {
+		for _, size := range []image.Point{{640, 480}, {333, 17}, {1, 1}, {1001, 777}, {2000, 1000}} {
+			dst := image.NewYCbCr(image.Rectangle{Max: size}, image.YCbCrSubsampleRatio420)
+			require.NoError(t, imageconvert.Scale(dst, src, filter))
+			expected := image.NewYCbCr(dst.Rect, image.YCbCrSubsampleRatio420)
+			fill(expected, 200, 30, 240)
+			assert.Equal(t, expected, dst, "%v to %v", filter, size)
+		}
+	}
+}
+
+func TestScale_AreaHalf(t *testing.T) {
+	// Halving each dimension averages each 2x2 block
+	src := randomYCbCr(t, 64, 48)
+	dst := image.NewYCbCr(image.Rect(0, 0, 32, 24), image.YCbCrSubsampleRatio420)
+	require.NoError(t, imageconvert.Scale(dst, src, imageconvert.FilterArea))
+	for y := 0; y < 24; y++ {
+		for x := 0; x < 32; x++ {
+			sum := int(src.Y[src.YOffset(2*x, 2*y)]) + int(src.Y[src.YOffset(2*x+1, 2*y)]) +
+				int(src.Y[src.YOffset(2*x, 2*y+1)]) + int(src.Y[src.YOffset(2*x+1, 2*y+1)])
+			assert.InDelta(t, float64(sum)/4, float64(dst.Y[dst.YOffset(x, y)]), 0.5)
+		}
+	}
+}
+
+func TestScale_AreaThird(t *testing.T) {
+	src := randomYCbCr(t, 96, 72)
+	dst := image.NewYCbCr(image.Rect(0, 0, 32, 24), image.YCbCrSubsampleRatio420)
+	require.NoError(t, imageconvert.Scale(dst, src, imageconvert.FilterArea))
+	for y := 0; y < 24; y++ {
+		for x := 0; x < 32; x++ {
+			sum := 0
+			for i := range 9 {
+				sum += int(src.Y[src.YOffset(3*x+i%3, 3*y+i/3)])
+			}
+			assert.InDelta(t, float64(sum)/9, float64(dst.Y[dst.YOffset(x, y)]), 1)
+		}
+	}
+}
+
+func TestScale_Identity(t *testing.T) {
+	src := randomYCbCr(t, 65, 33)
+	for _, filter := range []imageconvert.Filter{imageconvert.FilterArea, imageconvert.FilterBilinear} {
+		dst := image.NewYCbCr(src.Rect, image.YCbCrSubsampleRatio420)
+		require.NoError(t, imageconvert.Scale(dst, src, filter))
+		assert.Equal(t, src, dst, "%v", filter)
+	}
+}
+
+func TestScale_SubImage(t *testing.T) {
+	// Only the pixels within the sub-image are used
+	full := image.NewYCbCr(image.Rect(0, 0, 100, 100), image.YCbCrSubsampleRatio420)
+	fill(full, 0, 0, 0)
+	src := full.SubImage(image.Rect(20, 40, 60, 80)).(*image.YCbCr)
+	fill(src, 0, 0, 0)
+	for y := 40; y < 80; y++ {
+		for x := 20; x < 60; x++ {
+			src.Y[src.YOffset(x, y)] = 100
+			src.Cb[src.COffset(x, y)] = 50
+			src.Cr[src.COffset(x, y)] = 150
+		}
+	}
+	dst := image.NewYCbCr(image.Rect(0, 0, 10, 10), image.YCbCrSubsampleRatio420)
+	require.NoError(t, imageconvert.Scale(dst, src, imageconvert.FilterArea))
+	expected := image.NewYCbCr(dst.Rect, image.YCbCrSubsampleRatio420)
+	fill(expected, 100, 50, 150)
+	assert.Equal(t, expected, dst)
+}
+
+func TestScale_Errors(t *testing.T) {
+	src := randomYCbCr(t, 4, 4)
+	assert.Error(t, imageconvert.Scale(image.NewYCbCr(image.Rect(0, 0, 2, 2), image.YCbCrSubsampleRatio444), src, imageconvert.FilterArea))
+	assert.Error(t, imageconvert.Scale(image.NewYCbCr(image.Rect(0, 0, 2, 2), image.YCbCrSubsampleRatio422), image.NewYCbCr(src.Rect, image.YCbCrSubsampleRatio422), imageconvert.FilterArea))
+	assert.Error(t, imageconvert.Scale(image.NewYCbCr(image.Rect(0, 0, 0, 2), image.YCbCrSubsampleRatio420), src, imageconvert.FilterArea))
+}
+
+func TestParseFilter(t *testing.T) {
+	for _, filter := range []imageconvert.Filter{imageconvert.FilterArea, imageconvert.FilterBilinear} {
+		parsed, err := imageconvert.ParseFilter(filter.String())
+		require.NoError(t, err)
+		assert.Equal(t, filter, parsed)
+	}
+	_, err := imageconvert.ParseFilter("lanczos")
+	assert.Error(t, err)
+}
+
+func benchmarkScale(b *testing.B, from, to image.Point, filter imageconvert.Filter) {
+	src := randomYCbCr(b, from.X, from.Y)
+	dst := image.NewYCbCr(image.Rectangle{Max: to}, image.YCbCrSubsampleRatio420)
+	b.SetBytes(int64(len(src.Y) + len(src.Cb) + len(src.Cr)))
+	b.ResetTimer()
+	for range b.N {
+		if err := imageconvert.Scale(dst, src, filter); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkScale_Area_4KTo1080p(b *testing.B) {
+	benchmarkScale(b, image.Pt(3840, 2160), image.Pt(1920, 1080), imageconvert.FilterArea)
+}
+
+func BenchmarkScale_Area_1440pTo1080p(b *testing.B) {
+	benchmarkScale(b, image.Pt(2560, 1440), image.Pt(1920, 1080), imageconvert.FilterArea)
+}
+
+func BenchmarkScale_Bilinear_4KTo1080p(b *testing.B) {
+	benchmarkScale(b, image.Pt(3840, 2160), image.Pt(1920, 1080), imageconvert.FilterBilinear)
+}
+
+func BenchmarkScale_Bilinear_1440pTo1080p(b *testing.B) {
+	benchmarkScale(b, image.Pt(2560, 1440), image.Pt(1920, 1080), imageconvert.FilterBilinear)
+}
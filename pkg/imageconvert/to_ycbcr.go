@@ -4,43 +4,194 @@ import (
 	"errors"
 	"image"
 	"image/color"
+	"runtime"
+	"sync"
 )
 
+// Images with fewer rows than this are converted on a single goroutine,
+// since splitting them up costs more than it saves.
+const minRowsPerBand = 64
+
+// Byte offsets of the color channels within a 4-byte pixel
+type layout struct {
+	r, g, b int
+}
+
+var (
+	layoutRGBA = layout{r: 0, g: 1, b: 2}
+	layoutBGRA = layout{r: 2, g: 1, b: 0}
+)
+
+// ToYCbCr converts src into dst using the JFIF color space, as the
+// image/color package does. See ColorSpace.ToYCbCr.
 func ToYCbCr(dst *image.YCbCr, src image.Image) error {
+	return JFIF.ToYCbCr(dst, src)
+}
+
+// BGRAToYCbCr converts BGRA pixels into dst using the JFIF color space. See
+// ColorSpace.BGRAToYCbCr.
+func BGRAToYCbCr(dst *image.YCbCr, pix []byte, stride int) error {
+	return JFIF.BGRAToYCbCr(dst, pix, stride)
+}
+
+func toYCbCr(dst *image.YCbCr, src image.Image, k *coefficients) error {
 	if dst.Bounds() != src.Bounds() {
 		return errors.New("images must be the same size")
 	}
+	if err := checkDestination(dst); err != nil {
+		return err
+	}
+	switch src := src.(type) {
+	case *image.RGBA:
+		convertPacked(dst, src.Pix[src.PixOffset(src.Rect.Min.X, src.Rect.Min.Y):], src.Stride, layoutRGBA, k)
+	case *image.NRGBA:
+		convertPacked(dst, src.Pix[src.PixOffset(src.Rect.Min.X, src.Rect.Min.Y):], src.Stride, layoutRGBA, k)
+	default:
+		convertGeneric(dst, src, k)
+	}
+	return nil
+}
+
+func bgraToYCbCr(dst *image.YCbCr, pix []byte, stride int, k *coefficients) error {
+	if err := checkDestination(dst); err != nil {
+		return err
+	}
+	width, height := dst.Rect.Dx(), dst.Rect.Dy()
+	if height > 0 && (stride < width*4 || len(pix) < (height-1)*stride+width*4) {
+		return errors.New("pixel buffer is too small")
+	}
+	convertPacked(dst, pix, stride, layoutBGRA, k)
+	return nil
+}
+
+func checkDestination(dst *image.YCbCr) error {
 	if dst.SubsampleRatio != image.YCbCrSubsampleRatio420 {
-		return errors.New("only 4:2:0 subsampling is currently supported")
-	}
-
-	// Currently, we don't handle the final pixel for images that are an odd number
-	// of pixels wide and/or high
-	width := src.Bounds().Dx() & (^1)
-	height := src.Bounds().Dy() & (^1)
-	for y := 0; y < height; y += 2 {
-		for x := 0; x < width; x += 2 {
-			r, g, b, _ := src.At(x, y).RGBA()
-			yy, cb1, cr1 := color.RGBToYCbCr(uint8(r>>8), uint8(g>>8), uint8(b>>8))
-			dst.Y[x+y*dst.YStride] = yy
-
-			r, g, b, _ = src.At(x+1, y).RGBA()
-			yy, cb2, cr2 := color.RGBToYCbCr(uint8(r>>8), uint8(g>>8), uint8(b>>8))
-			dst.Y[(x+1)+y*dst.YStride] = yy
-
-			r, g, b, _ = src.At(x, y+1).RGBA()
-			yy, cb3, cr3 := color.RGBToYCbCr(uint8(r>>8), uint8(g>>8), uint8(b>>8))
-			dst.Y[x+(y+1)*dst.YStride] = yy
-
-			r, g, b, _ = src.At(x+1, y+1).RGBA()
-			yy, cb4, cr4 := color.RGBToYCbCr(uint8(r>>8), uint8(g>>8), uint8(b>>8))
-			dst.Y[(x+1)+(y+1)*dst.YStride] = yy
-
-			cb := uint8((int(cb1) + int(cb2) + int(cb3) + int(cb4)) / 4)
-			cr := uint8((int(cr1) + int(cr2) + int(cr3) + int(cr4)) / 4)
-			dst.Cb[x/2+(y/2)*dst.CStride] = cb
-			dst.Cr[x/2+(y/2)*dst.CStride] = cr
-		}
+		return errors.New("only 4:2:0 subsampling is supported")
+	}
+	if dst.Rect.Min.X&1 != 0 || dst.Rect.Min.Y&1 != 0 {
+		return errors.New("destination must start on an even pixel")
 	}
 	return nil
 }
+
+// forEachBand splits the rows of an image into bands with an even number of
+// rows (so that each band has whole rows of chroma samples) and calls convert
+// for each band in parallel.
+func forEachBand(height int, convert func(y0, y1 int)) {
+	bands := min(runtime.GOMAXPROCS(0), height/minRowsPerBand)
+	if bands <= 1 {
+		convert(0, height)
+		return
+	}
+	rowsPerBand := (height/bands + 1) &^ 1
+	var wg sync.WaitGroup
+	for y0 := 0; y0 < height; y0 += rowsPerBand {
+		wg.Add(1)
+		go func(y0, y1 int) {
+			defer wg.Done()
+			convert(y0, y1)
+		}(y0, min(y0+rowsPerBand, height))
+	}
+	wg.Wait()
+}
+
+// convertPacked converts 4-byte pixels, starting at the top left corner of
+// pix, into dst.
+func convertPacked(dst *image.YCbCr, pix []byte, stride int, l layout, k *coefficients) {
+	width, height := dst.Rect.Dx(), dst.Rect.Dy()
+	evenWidth := width &^ 1
+	forEachBand(height, func(y0, y1 int) {
+		for y := y0; y < y1; y += 2 {
+			row0 := pix[y*stride:]
+			lumaRow0 := dst.Y[dst.YOffset(dst.Rect.Min.X, dst.Rect.Min.Y+y):]
+			cb := dst.Cb[dst.COffset(dst.Rect.Min.X, dst.Rect.Min.Y+y):]
+			cr := dst.Cr[dst.COffset(dst.Rect.Min.X, dst.Rect.Min.Y+y):]
+
+			if y+1 == height {
+				// The last row of an image with an odd height
+				for x := 0; x < width; x += 2 {
+					columns := min(2, width-x)
+					var sumR, sumG, sumB int32
+					for i := 0; i < columns; i++ {
+						r, g, b := pixel(row0, (x+i)*4, l)
+						lumaRow0[x+i] = k.luma(r, g, b)
+						sumR, sumG, sumB = sumR+r, sumG+g, sumB+b
+					}
+					cb[x/2], cr[x/2] = k.chroma(sumR, sumG, sumB, columns)
+				}
+				continue
+			}
+
+			row1 := pix[(y+1)*stride:]
+			lumaRow1 := dst.Y[dst.YOffset(dst.Rect.Min.X, dst.Rect.Min.Y+y+1):]
+			for x := 0; x < evenWidth; x += 2 {
+				// Slicing up front lets the compiler skip most bounds checks
+				top := row0[x*4 : x*4+8 : x*4+8]
+				bottom := row1[x*4 : x*4+8 : x*4+8]
+				r0, g0, b0 := int32(top[l.r]), int32(top[l.g]), int32(top[l.b])
+				r1, g1, b1 := int32(top[4+l.r]), int32(top[4+l.g]), int32(top[4+l.b])
+				r2, g2, b2 := int32(bottom[l.r]), int32(bottom[l.g]), int32(bottom[l.b])
+				r3, g3, b3 := int32(bottom[4+l.r]), int32(bottom[4+l.g]), int32(bottom[4+l.b])
+				luma0 := lumaRow0[x : x+2 : x+2]
+				luma1 := lumaRow1[x : x+2 : x+2]
+				luma0[0] = k.luma(r0, g0, b0)
+				luma0[1] = k.luma(r1, g1, b1)
+				luma1[0] = k.luma(r2, g2, b2)
+				luma1[1] = k.luma(r3, g3, b3)
+				cb[x/2], cr[x/2] = k.chroma4(r0+r1+r2+r3, g0+g1+g2+g3, b0+b1+b2+b3)
+			}
+			if evenWidth < width {
+				// The last column of an image with an odd width
+				x := evenWidth
+				r0, g0, b0 := pixel(row0, x*4, l)
+				r1, g1, b1 := pixel(row1, x*4, l)
+				lumaRow0[x] = k.luma(r0, g0, b0)
+				lumaRow1[x] = k.luma(r1, g1, b1)
+				cb[x/2], cr[x/2] = k.chroma(r0+r1, g0+g1, b0+b1, 2)
+			}
+		}
+	})
+}
+
+func convertGeneric(dst *image.YCbCr, src image.Image, k *coefficients) {
+	bounds := src.Bounds()
+	// Pixels are visited in blocks that share a chroma sample
+	block := []image.Point{{0, 0}, {1, 0}, {0, 1}, {1, 1}}
+	forEachBand(bounds.Dy(), func(y0, y1 int) {
+		for y := bounds.Min.Y + y0; y < bounds.Min.Y+y1; y += 2 {
+			for x := bounds.Min.X; x < bounds.Max.X; x += 2 {
+				var sumR, sumG, sumB int32
+				count := 0
+				for _, offset := range block {
+					p := image.Pt(x+offset.X, y+offset.Y)
+					if !p.In(bounds) {
+						continue
+					}
+					c := color.RGBAModel.Convert(src.At(p.X, p.Y)).(color.RGBA)
+					r, g, b := int32(c.R), int32(c.G), int32(c.B)
+					dst.Y[dst.YOffset(p.X, p.Y)] = k.luma(r, g, b)
+					sumR, sumG, sumB = sumR+r, sumG+g, sumB+b
+					count++
+				}
+				offset := dst.COffset(x, y)
+				dst.Cb[offset], dst.Cr[offset] = k.chroma(sumR, sumG, sumB, count)
+			}
+		}
+	})
+}
+
+func pixel(row []byte, i int, l layout) (r, g, b int32) {
+	return int32(row[i+l.r]), int32(row[i+l.g]), int32(row[i+l.b])
+}
+
+// Chroma is computed from the sum of the pixels that share a sample, rather
+// than averaging per-pixel chroma values; see coefficients.chroma.
+
+// clamp shifts a fixed-point value down by shift bits, clamping the result
+// to [0, 255].
+func clamp(value int32, shift uint) uint8 {
+	if uint32(value)>>(shift+8) == 0 {
+		return uint8(value >> shift)
+	}
+	return uint8(^(value >> 31))
+}
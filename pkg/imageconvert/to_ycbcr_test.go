@@ -0,0 +1,159 @@
+package imageconvert_test
+
+import (
+	"image"
+	"image/color"
+	"math/rand/v2"
+	"testing"
+
+	"github.com/adamroach/webrd/pkg/imageconvert"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func randomRGBA(width, height int) *image.RGBA {
+	rng := rand.New(rand.NewPCG(1, 2))
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(rng.IntN(256))
+	}
+	for i := 3; i < len(img.Pix); i += 4 {
+		img.Pix[i] = 0xff
+	}
+	return img
+}
+
+// reference converts src one pixel at a time with the standard library,
+// averaging the chroma of the pixels that share each sample.
+func reference(src image.Image) *image.YCbCr {
+	bounds := src.Bounds()
+	dst := image.NewYCbCr(bounds, image.YCbCrSubsampleRatio420)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y += 2 {
+		for x := bounds.Min.X; x < bounds.Max.X; x += 2 {
+			var sumCb, sumCr, count int
+			for _, p := range []image.Point{{x, y}, {x + 1, y}, {x, y + 1}, {x + 1, y + 1}} {
+				if !p.In(bounds) {
+					continue
+				}
+				c := color.RGBAModel.Convert(src.At(p.X, p.Y)).(color.RGBA)
+				yy, cb, cr := color.RGBToYCbCr(c.R, c.G, c.B)
+				dst.Y[dst.YOffset(p.X, p.Y)] = yy
+				sumCb, sumCr, count = sumCb+int(cb), sumCr+int(cr), count+1
+			}
+			dst.Cb[dst.COffset(x, y)] = uint8((sumCb + count/2) / count)
+			dst.Cr[dst.COffset(x, y)] = uint8((sumCr + count/2) / count)
+		}
+	}
+	return dst
+}
+
+// assertClose checks that two images differ by no more than one step in any
+// sample, which allows for rounding differences.
+func assertClose(t *testing.T, expected, actual *image.YCbCr) {
+	t.Helper()
+	require.Equal(t, expected.Rect, actual.Rect)
+	for _, planes := range [][2][]byte{{expected.Y, actual.Y}, {expected.Cb, actual.Cb}, {expected.Cr, actual.Cr}} {
+		require.Equal(t, len(planes[0]), len(planes[1]))
+		for i := range planes[0] {
+			diff := int(planes[0][i]) - int(planes[1][i])
+			if diff < -1 || diff > 1 {
+				t.Fatalf("sample %d differs: expected %d, got %d", i, planes[0][i], planes[1][i])
+			}
+		}
+	}
+}
+
+func TestToYCbCr(t *testing.T) {
+	for _, size := range []image.Point{{2, 2}, {3, 3}, {1, 1}, {64, 48}, {33, 17}, {641, 361}} {
+		src := randomRGBA(size.X, size.Y)
+		expected := reference(src)
+
+		dst := image.NewYCbCr(src.Rect, image.YCbCrSubsampleRatio420)
+		require.NoError(t, imageconvert.ToYCbCr(dst, src))
+		assertClose(t, expected, dst)
+
+		nrgba := &image.NRGBA{Pix: src.Pix, Stride: src.Stride, Rect: src.Rect}
+		dst = image.NewYCbCr(src.Rect, image.YCbCrSubsampleRatio420)
+		require.NoError(t, imageconvert.ToYCbCr(dst, nrgba))
+		assertClose(t, expected, dst)
+
+		// Anything else goes through image.Image
+		generic := struct{ image.Image }{src}
+		dst = image.NewYCbCr(src.Rect, image.YCbCrSubsampleRatio420)
+		require.NoError(t, imageconvert.ToYCbCr(dst, generic))
+		assertClose(t, expected, dst)
+	}
+}
+
+func TestToYCbCr_SubImage(t *testing.T) {
+	// Pixels outside of a sub-image's bounds must not be read
+	full := randomRGBA(100, 100)
+	src := full.SubImage(image.Rect(10, 20, 61, 71)).(*image.RGBA)
+	dst := image.NewYCbCr(src.Rect, image.YCbCrSubsampleRatio420)
+	require.NoError(t, imageconvert.ToYCbCr(dst, src))
+	assertClose(t, reference(src), dst)
+}
+
+func TestBGRAToYCbCr(t *testing.T) {
+	src := randomRGBA(101, 75)
+	stride := src.Rect.Dx()*4 + 12
+	bgra := make([]byte, stride*src.Rect.Dy())
+	for y := 0; y < src.Rect.Dy(); y++ {
+		for x := 0; x < src.Rect.Dx(); x++ {
+			i := src.PixOffset(x, y)
+			j := y*stride + x*4
+			bgra[j], bgra[j+1], bgra[j+2], bgra[j+3] = src.Pix[i+2], src.Pix[i+1], src.Pix[i], 0
+		}
+	}
+	dst := image.NewYCbCr(src.Rect, image.YCbCrSubsampleRatio420)
+	require.NoError(t, imageconvert.BGRAToYCbCr(dst, bgra, stride))
+	assertClose(t, reference(src), dst)
+
+	// The padding at the end of the last row is optional
+	last := (src.Rect.Dy()-1)*stride + src.Rect.Dx()*4
+	assert.NoError(t, imageconvert.BGRAToYCbCr(dst, bgra[:last], stride))
+	assert.Error(t, imageconvert.BGRAToYCbCr(dst, bgra[:last-1], stride))
+	assert.Error(t, imageconvert.BGRAToYCbCr(dst, bgra, 100))
+}
+
+func TestToYCbCr_Errors(t *testing.T) {
+	src := randomRGBA(4, 4)
+	assert.Error(t, imageconvert.ToYCbCr(image.NewYCbCr(image.Rect(0, 0, 2, 2), image.YCbCrSubsampleRatio420), src))
+	assert.Error(t, imageconvert.ToYCbCr(image.NewYCbCr(src.Rect, image.YCbCrSubsampleRatio422), src))
+}
+
+func benchmarkToYCbCr(b *testing.B, src image.Image) {
+	dst := image.NewYCbCr(src.Bounds(), image.YCbCrSubsampleRatio420)
+	b.SetBytes(int64(src.Bounds().Dx() * src.Bounds().Dy() * 4))
+	b.ResetTimer()
+	for range b.N {
+		if err := imageconvert.ToYCbCr(dst, src); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkToYCbCr_RGBA_4K(b *testing.B) {
+	benchmarkToYCbCr(b, randomRGBA(3840, 2160))
+}
+
+func BenchmarkToYCbCr_NRGBA_4K(b *testing.B) {
+	src := randomRGBA(3840, 2160)
+	benchmarkToYCbCr(b, &image.NRGBA{Pix: src.Pix, Stride: src.Stride, Rect: src.Rect})
+}
+
+func BenchmarkToYCbCr_Generic_1080p(b *testing.B) {
+	benchmarkToYCbCr(b, struct{ image.Image }{randomRGBA(1920, 1080)})
+}
+
+func BenchmarkBGRAToYCbCr_4K(b *testing.B) {
+	src := randomRGBA(3840, 2160)
+	dst := image.NewYCbCr(src.Rect, image.YCbCrSubsampleRatio420)
+	b.SetBytes(int64(len(src.Pix)))
+	b.ResetTimer()
+	for range b.N {
+		if err := imageconvert.BGRAToYCbCr(dst, src.Pix, src.Stride); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
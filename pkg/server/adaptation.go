@@ -0,0 +1,90 @@
+package server
+
+import (
+	"image"
+	"time"
+
+	"github.com/adamroach/webrd/pkg/config"
+)
+
+const (
+	// lowBitsPerPixel is the bitrate per pixel per frame below which the
+	// picture falls apart, so the next lower quality is better.
+	lowBitsPerPixel = 0.02
+	// highBitsPerPixel is how much there must be to spare at the next higher
+	// quality before stepping up, so that quality doesn't flap.
+	highBitsPerPixel = 0.04
+	// adaptInterval is the least time between quality changes, each of
+	// which costs a keyframe.
+	adaptInterval = 5 * time.Second
+)
+
+// quality is the framerate and size at which a subscriber gets video.
+type quality struct {
+	framerate int
+	scale     float64 // fraction of the full size in each dimension
+}
+
+// adapter trades framerate and then resolution for picture quality when a
+// subscriber's bandwidth is short, and restores them when it recovers.
+type adapter struct {
+	ladder     []quality // from best to worst
+	step       int
+	lastChange time.Time
+}
+
+// newAdapter creates an adapter whose ladder steps the framerate down from
+// the configured one to the minimum, and then the scale down to the
+// minimum.
+func newAdapter(video *config.Video) *adapter {
+	maxFramerate := max(video.Framerate, 1)
+	minFramerate := min(max(video.MinFramerate, 1), maxFramerate)
+	minScale := min(max(video.MinScale, 0.1), 1)
+	ladder := []quality{{framerate: maxFramerate, scale: 1}}
+	for framerate := maxFramerate * 2 / 3; ; framerate = framerate * 2 / 3 {
+		framerate = max(framerate, minFramerate)
+		if framerate >= ladder[len(ladder)-1].framerate {
+			break
+		}
+		ladder = append(ladder, quality{framerate: framerate, scale: 1})
+	}
+	for scale := 0.75; ; scale *= 0.75 {
+		scale = max(scale, minScale)
+		if scale >= ladder[len(ladder)-1].scale {
+			break
+		}
+		ladder = append(ladder, quality{framerate: minFramerate, scale: scale})
+	}
+	return &adapter{ladder: ladder}
+}
+
+func (a *adapter) quality() quality {
+	return a.ladder[a.step]
+}
+
+// update takes a new bitrate, and the size of the video at the current
+// quality, and returns the quality to use from now on, and whether that is
+// a change.
+func (a *adapter) update(bitrate int, size image.Point, now time.Time) (quality, bool) {
+	current := a.quality()
+	if size.X <= 0 || size.Y <= 0 || now.Sub(a.lastChange) < adaptInterval {
+		return current, false
+	}
+	bitsPerPixel := func(q quality) float64 {
+		ratio := q.scale / current.scale
+		pixels := float64(size.X*size.Y) * ratio * ratio
+		return float64(bitrate) / (pixels * float64(q.framerate))
+	}
+	step := a.step
+	if bitsPerPixel(current) < lowBitsPerPixel && step < len(a.ladder)-1 {
+		step++
+	} else if step > 0 && bitsPerPixel(a.ladder[step-1]) >= highBitsPerPixel {
+		step--
+	}
+	if step == a.step {
+		return current, false
+	}
+	a.step = step
+	a.lastChange = now
+	return a.quality(), true
+}
@@ -0,0 +1,66 @@
+package server
+
+import (
+	"image"
+	"testing"
+	"time"
+
+	"github.com/adamroach/webrd/pkg/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdapter_Ladder(t *testing.T) {
+	a := newAdapter(&config.Video{Framerate: 30, MinFramerate: 10, MinScale: 0.5})
+	assert.Equal(t, []quality{
+		{30, 1}, {20, 1}, {13, 1}, {10, 1},
+		{10, 0.75}, {10, 0.5625}, {10, 0.5},
+	}, a.ladder)
+
+	// Without room to step down, the ladder has a single step
+	a = newAdapter(&config.Video{Framerate: 10, MinFramerate: 15, MinScale: 1})
+	assert.Equal(t, []quality{{10, 1}}, a.ladder)
+}
+
+func TestAdapter_Update(t *testing.T) {
+	a := newAdapter(&config.Video{Framerate: 30, MinFramerate: 10, MinScale: 0.5})
+	size := image.Pt(1920, 1080)
+	now := time.Now()
+
+	// Plenty of bandwidth
+	_, changed := a.update(8_000_000, size, now)
+	assert.False(t, changed)
+
+	// Too little steps the framerate down, but not too often
+	q, changed := a.update(1_000_000, size, now)
+	assert.True(t, changed)
+	assert.Equal(t, quality{20, 1}, q)
+	_, changed = a.update(300_000, size, now.Add(time.Second))
+	assert.False(t, changed)
+	now = now.Add(adaptInterval)
+	q, _ = a.update(300_000, size, now)
+	assert.Equal(t, quality{13, 1}, q)
+	now = now.Add(adaptInterval)
+	q, _ = a.update(300_000, size, now)
+	assert.Equal(t, quality{10, 1}, q)
+
+	// and then the size
+	now = now.Add(adaptInterval)
+	q, _ = a.update(300_000, size, now)
+	assert.Equal(t, quality{10, 0.75}, q)
+	size = image.Pt(1440, 810)
+
+	// A little more bandwidth isn't enough to step back up
+	now = now.Add(adaptInterval)
+	_, changed = a.update(600_000, size, now)
+	assert.False(t, changed)
+
+	// but twice the threshold is
+	q, changed = a.update(1_000_000, size, now)
+	assert.True(t, changed)
+	assert.Equal(t, quality{10, 1}, q)
+
+	// Frames of unknown size change nothing
+	now = now.Add(adaptInterval)
+	_, changed = a.update(100_000, image.Point{}, now)
+	assert.False(t, changed)
+}
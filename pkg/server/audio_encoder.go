@@ -0,0 +1,111 @@
+package server
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"github.com/adamroach/webrd/pkg/capture"
+	"github.com/pion/mediadevices/pkg/codec"
+	"github.com/pion/mediadevices/pkg/codec/opus"
+	"github.com/pion/mediadevices/pkg/prop"
+	"github.com/pion/mediadevices/pkg/wave"
+)
+
+// AudioReader turns captured PCM frames into chunks for the Opus encoder,
+// and keeps track of when they were captured.
+type AudioReader struct {
+	capturer capture.AudioCapturer
+	// The capture time and position (in samples since the start of the
+	// stream) of the most recent frame
+	time     time.Time
+	position int64
+	read     int64 // samples read so far
+}
+
+func (r *AudioReader) Read() (wave.Audio, func(), error) {
+	frame := <-r.capturer.FrameChannel()
+	if frame == nil {
+		return nil, nil, io.EOF
+	}
+	samples := len(frame.Samples) / 2 / capture.AudioChannels
+	chunk := wave.NewInt16Interleaved(wave.ChunkInfo{
+		Len:          samples,
+		Channels:     capture.AudioChannels,
+		SamplingRate: capture.AudioSampleRate,
+	})
+	for i := range chunk.Data {
+		chunk.Data[i] = int16(binary.LittleEndian.Uint16(frame.Samples[i*2:]))
+	}
+	r.time = frame.Time
+	r.position = r.read
+	r.read += int64(samples)
+	return chunk, func() {}, nil
+}
+
+// captureTime estimates when the sample at the given position was captured,
+// from the time of the most recent frame.
+func (r *AudioReader) captureTime(position int64) time.Time {
+	return r.time.Add(time.Duration(position-r.position) * time.Second / capture.AudioSampleRate)
+}
+
+// AudioEncoder encodes captured audio as Opus, in 20ms frames.
+type AudioEncoder struct {
+	reader   *AudioReader
+	encoder  codec.ReadCloser
+	samples  uint32 // per encoded frame
+	position int64  // of the next encoded frame, in samples
+}
+
+func NewAudioEncoder(capturer capture.AudioCapturer, bitrate int) (*AudioEncoder, error) {
+	params, err := opus.NewParams()
+	if err != nil {
+		return nil, err
+	}
+	params.BitRate = bitrate
+	params.Latency = opus.Latency20ms
+	reader := &AudioReader{capturer: capturer}
+	encoder, err := params.BuildAudioEncoder(reader, prop.Media{
+		Audio: prop.Audio{
+			SampleRate:   capture.AudioSampleRate,
+			ChannelCount: capture.AudioChannels,
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not create Opus encoder: %v", err)
+	}
+	log.Printf("Initialized Opus encoder: %d kbps", bitrate/1000)
+	return &AudioEncoder{
+		reader:  reader,
+		encoder: encoder,
+		samples: uint32(params.Latency.Duration() * capture.AudioSampleRate / time.Second),
+	}, nil
+}
+
+// ReadFrame returns the next Opus frame. Its Samples field gives its length,
+// so that RTP timestamps can advance by exactly that much.
+func (e *AudioEncoder) ReadFrame() (*EncodedFrame, error) {
+	data, release, err := e.encoder.Read()
+	if err != nil {
+		return nil, err
+	}
+	frame := &EncodedFrame{
+		Data:        data,
+		CaptureTime: e.reader.captureTime(e.position),
+		KeyFrame:    true,
+		Samples:     e.samples,
+		release:     release,
+	}
+	e.position += int64(e.samples)
+	return frame, nil
+}
+
+func (e *AudioEncoder) Controller() codec.EncoderController {
+	return e.encoder.Controller()
+}
+
+func (e *AudioEncoder) Close() error {
+	return e.encoder.Close()
+}
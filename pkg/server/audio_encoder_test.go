@@ -0,0 +1,40 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/adamroach/webrd/pkg/capture/synthetic"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAudioEncoder(t *testing.T) {
+	capturer, err := synthetic.NewAudioCapturer(440)
+	require.NoError(t, err)
+	encoder, err := NewAudioEncoder(capturer, 64_000)
+	require.NoError(t, err)
+	require.NoError(t, capturer.Start())
+
+	var previous *EncodedFrame
+	for range 5 {
+		frame, err := encoder.ReadFrame()
+		require.NoError(t, err)
+		assert.NotEmpty(t, frame.Data)
+		assert.Equal(t, uint32(960), frame.Samples)
+		if previous != nil {
+			assert.Equal(t, 20*time.Millisecond, frame.CaptureTime.Sub(previous.CaptureTime))
+		}
+		frame.Release()
+		previous = frame
+	}
+
+	// Stopping the capturer ends the stream
+	require.NoError(t, capturer.Stop())
+	for {
+		if _, err := encoder.ReadFrame(); err != nil {
+			break
+		}
+	}
+	require.NoError(t, encoder.Close())
+}
@@ -3,9 +3,7 @@ package server
 import (
 	"log"
 	"math/rand/v2"
-	"time"
 
-	"github.com/pion/mediadevices/pkg/codec"
 	"github.com/pion/rtcp"
 	"github.com/pion/rtp"
 	"github.com/pion/rtp/codecs"
@@ -13,13 +11,19 @@ import (
 )
 
 type AudioSender struct {
-	encoder         codec.ReadCloser
+	encoder         Encoder
 	track           *webrtc.TrackLocalStaticRTP
 	sender          *webrtc.RTPSender
 	packetizer      rtp.Packetizer
 	codecCapability webrtc.RTPCodecCapability
 }
 
+func NewAudioSender(encoder Encoder) *AudioSender {
+	return &AudioSender{
+		encoder: encoder,
+	}
+}
+
 func (s *AudioSender) RegisterCodecs(me *webrtc.MediaEngine) error {
 	s.codecCapability = webrtc.RTPCodecCapability{
 		MimeType:    webrtc.MimeTypeOpus,
@@ -86,20 +90,18 @@ func (s *AudioSender) Close() error {
 }
 
 func (s *AudioSender) sendMedia() {
-	lastFrameTime := time.Now()
+	// Timestamps advance by exactly the number of samples in each frame;
+	// capture times are subject to scheduling jitter, so they are only used
+	// to skip over gaps
+	clock := newSampleClock(s.codecCapability.ClockRate)
 	for {
-		f, release, err := s.encoder.Read()
+		frame, err := s.encoder.ReadFrame()
 		if err != nil {
 			log.Printf("Error reading audio: %v", err)
 			return
 		}
-		// TODO This logic isn't correct for audio -- the timestamps should be
-		// precisely calculated based on the audio frame size and sample rate
-		delta := time.Since(lastFrameTime)
-		lastFrameTime = time.Now()
-		samples := int(90000 * delta.Seconds())
-
-		rtpPackets := s.packetizer.Packetize(f, uint32(samples))
+		s.packetizer.SkipSamples(clock.skip(frame.CaptureTime, frame.Samples))
+		rtpPackets := s.packetizer.Packetize(frame.Data, frame.Samples)
 		for _, pkt := range rtpPackets {
 			buffer, err := pkt.Marshal()
 			if err != nil {
@@ -112,7 +114,7 @@ func (s *AudioSender) sendMedia() {
 				return
 			}
 		}
-		release()
+		frame.Release()
 	}
 }
 
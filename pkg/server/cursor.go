@@ -0,0 +1,267 @@
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"image/png"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/adamroach/webrd/pkg/capture"
+)
+
+// cursorInterval is how often the cursor is checked for changes.
+const cursorInterval = time.Second / 60
+
+// cursorPoller polls the cursor of one display on behalf of every session
+// viewing it, so that the capturer is asked once per interval however many
+// sessions there are, just as they share its frames. The trackers watching
+// it are woken whenever the cursor changes.
+type cursorPoller struct {
+	display int
+	source  *capture.Splitter
+	stop    chan struct{}
+	done    chan struct{}
+
+	mu       sync.Mutex // protects access to the fields below
+	cursor   capture.Cursor
+	polled   bool // cursor has been set
+	trackers map[*cursorTracker]struct{}
+}
+
+func newCursorPoller(display int, source *capture.Splitter) *cursorPoller {
+	return &cursorPoller{
+		display:  display,
+		source:   source,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+		trackers: make(map[*cursorTracker]struct{}),
+	}
+}
+
+func (p *cursorPoller) run() {
+	defer close(p.done)
+	ticker := time.NewTicker(cursorInterval)
+	defer ticker.Stop()
+	failing := false
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+		}
+		if p.source.Stopped() {
+			continue
+		}
+		err := p.poll()
+		if err == capture.ErrNoCursor {
+			log.Printf("Video capturer doesn't report the cursor; it won't be sent to the client")
+			return
+		}
+		// Errors are only logged when they start, rather than at every
+		// interval until they stop
+		if err != nil && !failing {
+			log.Printf("could not get cursor for display %d: %v", p.display, err)
+		}
+		failing = err != nil
+	}
+}
+
+// poll checks the cursor once, and wakes the trackers if it has changed.
+func (p *cursorPoller) poll() error {
+	cursor, err := p.source.Cursor()
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.polled && cursor == p.cursor {
+		return nil
+	}
+	p.cursor = cursor
+	p.polled = true
+	for t := range p.trackers {
+		t.wake()
+	}
+	return nil
+}
+
+// current returns the cursor as of the last poll, and whether there has
+// been one.
+func (p *cursorPoller) current() (capture.Cursor, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.cursor, p.polled
+}
+
+func (p *cursorPoller) add(t *cursorTracker) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.trackers[t] = struct{}{}
+}
+
+// remove returns the number of remaining trackers.
+func (p *cursorPoller) remove(t *cursorTracker) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.trackers, t)
+	return len(p.trackers)
+}
+
+// Stop waits for the poller to finish, so that the capturer isn't asked
+// for the cursor afterwards.
+func (p *cursorPoller) Stop() {
+	close(p.stop)
+	<-p.done
+}
+
+// cursorTracker sends the position and shape of the cursor on the display
+// that a session is viewing to its client, whenever they change.
+type cursorTracker struct {
+	video    *VideoSubscription
+	sender   messageSender
+	resend   atomic.Bool   // the client has lost track, and needs everything again
+	wakeup   chan struct{} // something may have changed
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+
+	// The poller for the display being viewed; only used by run
+	poller  *cursorPoller
+	display int
+
+	// What the client has been sent so far
+	position *CursorMessage
+	serial   uint64
+	shape    bool
+}
+
+func newCursorTracker(video *VideoSubscription, sender messageSender) *cursorTracker {
+	return &cursorTracker{
+		video:  video,
+		sender: sender,
+		wakeup: make(chan struct{}, 1),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+}
+
+func (t *cursorTracker) Start() {
+	go t.run()
+}
+
+// Stop waits for the tracker to finish, so that nothing more is sent on
+// the message channel.
+func (t *cursorTracker) Stop() {
+	t.stopOnce.Do(func() { close(t.stop) })
+	<-t.done
+}
+
+// Resend makes the tracker send the shape and position again, even if they
+// haven't changed. The session also calls it after switching displays, so
+// that the tracker follows.
+func (t *cursorTracker) Resend() {
+	t.resend.Store(true)
+	t.wake()
+}
+
+func (t *cursorTracker) wake() {
+	select {
+	case t.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+// run sends updates until the session is closed. Updates that can't be
+// sent are logged, and left for the next change.
+func (t *cursorTracker) run() {
+	defer close(t.done)
+	defer func() {
+		if t.poller != nil {
+			t.video.pipelines.unwatchCursor(t.poller, t)
+		}
+	}()
+	for {
+		t.follow()
+		if err := t.update(); err != nil {
+			log.Printf("could not send cursor: %v", err)
+		}
+		select {
+		case <-t.stop:
+			return
+		case <-t.wakeup:
+		}
+	}
+}
+
+// follow watches the poller for the display that the session is viewing.
+func (t *cursorTracker) follow() {
+	display := t.video.currentPipeline().key.display
+	if t.poller != nil && display == t.display {
+		return
+	}
+	t.poller = t.video.pipelines.watchCursor(display, t, t.poller)
+	t.display = display
+}
+
+// update sends whatever has changed since the last call.
+func (t *cursorTracker) update() error {
+	if t.poller == nil {
+		return nil
+	}
+	cursor, ok := t.poller.current()
+	if !ok {
+		return nil
+	}
+	if t.resend.Swap(false) {
+		t.shape = false
+		t.position = nil
+	}
+	if cursor.Shape != nil && (!t.shape || cursor.Shape.Serial != t.serial) {
+		message, err := cursorShapeMessage(cursor.Shape)
+		if err != nil {
+			return err
+		}
+		if err := t.sender.Send(message); err != nil {
+			return err
+		}
+		t.serial = cursor.Shape.Serial
+		t.shape = true
+	}
+
+	// The position is relative to the display being viewed, like the
+	// positions of mouse events
+	bounds := t.video.CurrentDisplay().Bounds
+	position := &CursorMessage{
+		Type:    TypeCursor,
+		Visible: cursor.Visible && cursor.Position.In(bounds),
+	}
+	if position.Visible {
+		position.X = float64(cursor.Position.X-bounds.Min.X) / float64(bounds.Dx())
+		position.Y = float64(cursor.Position.Y-bounds.Min.Y) / float64(bounds.Dy())
+	}
+	if t.position != nil && *t.position == *position {
+		return nil
+	}
+	if err := t.sender.Send(*position); err != nil {
+		return err
+	}
+	t.position = position
+	return nil
+}
+
+func cursorShapeMessage(shape *capture.CursorShape) (CursorShapeMessage, error) {
+	var encoded bytes.Buffer
+	if err := png.Encode(&encoded, shape.Image); err != nil {
+		return CursorShapeMessage{}, fmt.Errorf("could not encode cursor: %v", err)
+	}
+	return CursorShapeMessage{
+		Type:     TypeCursorShape,
+		Image:    "data:image/png;base64," + base64.StdEncoding.EncodeToString(encoded.Bytes()),
+		HotspotX: shape.Hotspot.X,
+		HotspotY: shape.Hotspot.Y,
+	}, nil
+}
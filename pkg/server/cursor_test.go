@@ -0,0 +1,164 @@
+package server
+
+import (
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/adamroach/webrd/pkg/capture"
+	"github.com/adamroach/webrd/pkg/capture/synthetic"
+	"github.com/adamroach/webrd/pkg/config"
+	"github.com/adamroach/webrd/pkg/hid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCursorTracker(t *testing.T) {
+	recorder := hid.NewRecorder(4)
+	pipelines := NewVideoPipelines(func() (capture.VideoCapturer, error) {
+		return synthetic.NewVideoCapturer(30, 400, 300, synthetic.WithDisplays(2), synthetic.WithInput(recorder))
+	}, &config.Config{
+		Video: config.Video{Bitrate: 1_000_000, Framerate: 30, DamageTileSize: 64},
+	})
+	video, err := pipelines.Subscribe(1)
+	require.NoError(t, err)
+	defer video.Close()
+	mouse := hid.NewSyntheticMouse(recorder)
+	require.NoError(t, mouse.Move(500, 150))
+
+	channel := &recordingChannel{}
+	tracker := newCursorTracker(video, channel)
+	tracker.follow()
+	defer pipelines.unwatchCursor(tracker.poller, tracker)
+	require.NoError(t, tracker.poller.poll())
+	require.NoError(t, tracker.update())
+	require.Len(t, channel.sent, 2)
+	shape, ok := channel.sent[0].(CursorShapeMessage)
+	require.True(t, ok)
+	assert.True(t, strings.HasPrefix(shape.Image, "data:image/png;base64,"))
+	assert.Equal(t, 8, shape.HotspotX)
+	assert.Equal(t, CursorMessage{Type: TypeCursor, Visible: true, X: 0.25, Y: 0.5}, channel.sent[1])
+
+	// Nothing is sent while the cursor stays put
+	require.NoError(t, tracker.poller.poll())
+	require.NoError(t, tracker.update())
+	assert.Len(t, channel.sent, 2)
+
+	// The shape is only sent again when it changes
+	require.NoError(t, mouse.Button(0, 500, 150, true))
+	require.NoError(t, tracker.poller.poll())
+	require.NoError(t, tracker.update())
+	require.Len(t, channel.sent, 3)
+	assert.IsType(t, CursorShapeMessage{}, channel.sent[2])
+
+	// A cursor on another display is hidden
+	require.NoError(t, mouse.Move(100, 150))
+	require.NoError(t, tracker.poller.poll())
+	require.NoError(t, tracker.update())
+	require.Len(t, channel.sent, 4)
+	assert.Equal(t, CursorMessage{Type: TypeCursor}, channel.sent[3])
+}
+
+func TestCursorTracker_Shared(t *testing.T) {
+	recorder := hid.NewRecorder(4)
+	pipelines := NewVideoPipelines(func() (capture.VideoCapturer, error) {
+		return synthetic.NewVideoCapturer(30, 400, 300, synthetic.WithDisplays(2), synthetic.WithInput(recorder))
+	}, &config.Config{
+		Video: config.Video{Bitrate: 1_000_000, Framerate: 30},
+	})
+	first, err := pipelines.Subscribe(1)
+	require.NoError(t, err)
+	defer first.Close()
+	second, err := pipelines.Subscribe(1)
+	require.NoError(t, err)
+	defer second.Close()
+
+	// Sessions viewing the same display share a poller
+	a := newCursorTracker(first, &recordingChannel{})
+	b := newCursorTracker(second, &recordingChannel{})
+	a.follow()
+	b.follow()
+	require.NotNil(t, a.poller)
+	assert.Same(t, a.poller, b.poller)
+	assert.Len(t, pipelines.cursors, 1)
+
+	// A session that switches displays follows with its own
+	require.NoError(t, second.SelectDisplay(0))
+	b.follow()
+	assert.NotSame(t, a.poller, b.poller)
+	assert.Len(t, pipelines.cursors, 2)
+
+	// Pollers stop along with their last tracker
+	pipelines.unwatchCursor(a.poller, a)
+	pipelines.unwatchCursor(b.poller, b)
+	assert.Empty(t, pipelines.cursors)
+}
+
+// flakyCursorCapturer fails to report the cursor a number of times
+type flakyCursorCapturer struct {
+	*synthetic.VideoCapturer
+	failures atomic.Int32
+}
+
+func (c *flakyCursorCapturer) Cursor() (capture.Cursor, error) {
+	if c.failures.Add(-1) >= 0 {
+		return capture.Cursor{}, errors.New("connection lost")
+	}
+	return c.VideoCapturer.Cursor()
+}
+
+// channelSender passes sent messages on to a channel
+type channelSender chan any
+
+func (c channelSender) Send(message any) error {
+	c <- message
+	return nil
+}
+
+func TestCursorTracker_KeepsPolling(t *testing.T) {
+	pipelines := NewVideoPipelines(func() (capture.VideoCapturer, error) {
+		synth, err := synthetic.NewVideoCapturer(30, 320, 240, synthetic.WithInput(hid.NewRecorder(4)))
+		if err != nil {
+			return nil, err
+		}
+		capturer := &flakyCursorCapturer{VideoCapturer: synth}
+		capturer.failures.Store(5)
+		return capturer, nil
+	}, &config.Config{
+		Video: config.Video{Bitrate: 1_000_000, Framerate: 30},
+	})
+	video, err := pipelines.Subscribe(DefaultDisplay)
+	require.NoError(t, err)
+	defer video.Close()
+
+	// The cursor is sent once the capturer recovers
+	sent := make(channelSender, 4)
+	tracker := newCursorTracker(video, sent)
+	tracker.Start()
+	defer tracker.Stop()
+	select {
+	case message := <-sent:
+		assert.IsType(t, CursorShapeMessage{}, message)
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "timed out waiting for cursor")
+	}
+}
+
+func TestCursorTracker_NoCursor(t *testing.T) {
+	pipelines := newTestPipelines(320, 240, 1)
+	video, err := pipelines.Subscribe(DefaultDisplay)
+	require.NoError(t, err)
+	defer video.Close()
+
+	channel := &recordingChannel{}
+	tracker := newCursorTracker(video, channel)
+	tracker.follow()
+	assert.Equal(t, capture.ErrNoCursor, tracker.poller.poll())
+
+	tracker.Start()
+	tracker.Stop()
+	assert.Empty(t, channel.sent)
+	assert.Empty(t, pipelines.cursors)
+}
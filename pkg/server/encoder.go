@@ -0,0 +1,33 @@
+package server
+
+import (
+	"image"
+	"time"
+
+	"github.com/pion/mediadevices/pkg/codec"
+)
+
+// Encoder produces compressed frames for a Sender to packetize.
+type Encoder interface {
+	ReadFrame() (*EncodedFrame, error)
+	Controller() codec.EncoderController
+	Close() error
+}
+
+// EncodedFrame is a compressed frame, along with the time at which the media
+// it was encoded from was captured. Release must be called once the frame's
+// data is no longer needed.
+type EncodedFrame struct {
+	Data        []byte
+	CaptureTime time.Time
+	KeyFrame    bool        // true if the frame can be decoded without earlier frames
+	Samples     uint32      // for audio, the number of samples (per channel) in the frame
+	Size        image.Point // for video, the width and height of the frame
+	release     func()
+}
+
+func (f *EncodedFrame) Release() {
+	if f.release != nil {
+		f.release()
+	}
+}
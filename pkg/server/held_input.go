@@ -0,0 +1,77 @@
+package server
+
+import (
+	"log"
+	"sync"
+
+	"github.com/adamroach/webrd/pkg/hid"
+	"github.com/adamroach/webrd/pkg/hid/key"
+)
+
+// heldInput keeps track of the keys and mouse buttons that the client is
+// holding down, so that they can be let go of if the session ends first.
+// Otherwise, a key that was down when the connection dropped would stay
+// down on the remote machine.
+type heldInput struct {
+	mu      sync.Mutex // protects access to the fields below
+	keys    map[key.Code]key.Event
+	buttons map[int]bool
+	x, y    int // where the pointer was last put
+}
+
+func newHeldInput() *heldInput {
+	return &heldInput{
+		keys:    make(map[key.Code]key.Event),
+		buttons: make(map[int]bool),
+	}
+}
+
+func (h *heldInput) key(event key.Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if event.KeyDown {
+		h.keys[event.Code] = event
+	} else {
+		delete(h.keys, event.Code)
+	}
+}
+
+func (h *heldInput) button(button, x, y int, down bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.x, h.y = x, y
+	if down {
+		h.buttons[button] = true
+	} else {
+		delete(h.buttons, button)
+	}
+}
+
+func (h *heldInput) move(x, y int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.x, h.y = x, y
+}
+
+// release lets go of everything that is still held down.
+func (h *heldInput) release(keyboard hid.Keyboard, mouse hid.Mouse) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if keyboard != nil {
+		for code, event := range h.keys {
+			event.KeyDown = false
+			if err := keyboard.Key(event); err != nil {
+				log.Printf("could not release key %s: %v", code, err)
+			}
+		}
+	}
+	if mouse != nil {
+		for button := range h.buttons {
+			if err := mouse.Button(button, h.x, h.y, false); err != nil {
+				log.Printf("could not release mouse button %d: %v", button, err)
+			}
+		}
+	}
+	clear(h.keys)
+	clear(h.buttons)
+}
@@ -1,10 +1,48 @@
+// A client whose websocket drops tries this many times to resume its
+// session, waiting a little longer each time
+const maxReconnectAttempts = 5;
+const reconnectDelay = 1000; // milliseconds
+
 class Client {
     constructor() {
         this.auth = new Auth();
-        this.websocket = new WebSocket("/ws");
+        this.websocket = null;
         this.videoElement = document.getElementById("video");
+        this.audioElement = document.getElementById("audio");
+        this.cursorElement = document.getElementById("cursor");
+        this.cursor = {
+            visible: false,
+            x: 0,
+            y: 0,
+            hotspotX: 0,
+            hotspotY: 0,
+        };
+        this.pointerInside = false;
+        this.displaySelect = document.getElementById("displays");
+        this.displaySelect.addEventListener("change", () => {
+            this.websocket.send(
+                JSON.stringify({
+                    type: "select_display",
+                    id: Number(this.displaySelect.value),
+                }),
+            );
+        });
         this.peerConnection = null;
+        // Settles once the latest offer has been applied, so that the ICE
+        // candidates that follow it aren't added too soon
+        this.offerApplied = Promise.resolve();
         this.authed = false;
+        this.resizeTimer = null;
+        this.inputCaptured = false;
+        this.trackingVideoSize = false;
+        // Input goes over the data channels that the server opens, once
+        // they are open, and over the websocket until then
+        this.inputChannels = {};
+        this.moveSeq = 0;
+        // Lets a new websocket take over the session if this one drops
+        this.resumeToken = null;
+        this.resuming = false;
+        this.ended = false;
     }
 
     async start() {
@@ -24,6 +62,7 @@ class Client {
                     JSON.stringify({
                         type: "auth",
                         token: e.token,
+                        trickleIce: true,
                     }),
                 );
                 this.authed = true;
@@ -43,28 +82,95 @@ class Client {
     }
 
     async startWebsocket() {
+        const websocket = new WebSocket("/ws");
         return new Promise((accept, reject) => {
-            this.websocket.addEventListener("open", accept);
-            this.websocket.addEventListener("error", reject);
-            this.websocket.addEventListener(
+            websocket.addEventListener("open", () => {
+                this.websocket = websocket;
+                accept();
+            });
+            websocket.addEventListener("error", reject);
+            websocket.addEventListener(
                 "message",
                 this.handleMessage.bind(this),
             );
+            websocket.addEventListener("close", () =>
+                this.websocketClosed(websocket),
+            );
         });
     }
 
+    // The session carries on at the server for a while after the websocket
+    // drops, so the media keeps flowing while a new one resumes it
+    websocketClosed(websocket) {
+        if (websocket !== this.websocket || this.ended) {
+            return;
+        }
+        if (!this.resumeToken) {
+            console.log("websocket closed, and the session can't be resumed");
+            return;
+        }
+        this.reconnect();
+    }
+
+    async reconnect() {
+        for (let attempt = 1; attempt <= maxReconnectAttempts; attempt++) {
+            await new Promise((r) => setTimeout(r, reconnectDelay * attempt));
+            try {
+                await this.startWebsocket();
+            } catch (e) {
+                console.log(`could not reconnect (attempt ${attempt}):`, e);
+                continue;
+            }
+            this.resuming = true;
+            this.websocket.send(
+                JSON.stringify({
+                    type: "resume",
+                    token: this.resumeToken,
+                }),
+            );
+            return;
+        }
+        this.endSession("could not reconnect to the server");
+    }
+
+    // A session that can't be resumed is replaced by a new one, after
+    // logging in again
+    resumeFailed() {
+        this.resuming = false;
+        this.resumeToken = null;
+        if (this.peerConnection) {
+            this.peerConnection.close();
+            this.peerConnection = null;
+        }
+        this.offerApplied = Promise.resolve();
+        this.inputChannels = {};
+        this.authed = false;
+    }
+
     async setupPeerConnection(offer) {
         this.peerConnection = new RTCPeerConnection({
             iceServers: offer.iceServers,
+            // "relay" when the server only lets clients in through its
+            // TURN server
+            iceTransportPolicy: offer.iceTransportPolicy || "all",
         });
 
         this.peerConnection.ontrack = (event) => {
+            if (event.track.kind === "audio") {
+                this.audioElement.srcObject = event.streams[0];
+                this.audioElement.play();
+                return;
+            }
             this.videoElement.srcObject = event.streams[0];
             this.videoElement.muted = true;
             this.videoElement.autoplay = true;
             this.videoElement.play();
         };
 
+        this.peerConnection.ondatachannel = (event) => {
+            this.inputChannels[event.channel.label] = event.channel;
+        };
+
         this.peerConnection.onicecandidate = (event) => {
             if (event.candidate) {
                 console.log("Sending ICE Candidate:", event.candidate);
@@ -84,6 +190,12 @@ class Client {
             );
         };
 
+        return this.answerOffer(offer);
+    }
+
+    // The server sends further offers on the same connection when it needs
+    // to change the video parameters, e.g. after the screen size changes
+    async answerOffer(offer) {
         await this.peerConnection.setRemoteDescription(
             new RTCSessionDescription({
                 type: "offer",
@@ -99,6 +211,46 @@ class Client {
         };
     }
 
+    // The server ends the session when the connection is lost for good
+    endSession(reason) {
+        this.ended = true;
+        this.resumeToken = null;
+        this.inputChannels = {};
+        if (this.peerConnection) {
+            this.peerConnection.close();
+            this.peerConnection = null;
+        }
+        alert(`The session has ended: ${reason}. Reload the page to reconnect.`);
+    }
+
+    // The server sends its ICE candidates after the offer; an empty one
+    // marks the end of them
+    async addCandidate(candidate) {
+        try {
+            await this.offerApplied;
+            if (candidate.candidate === "") {
+                await this.peerConnection.addIceCandidate();
+            } else {
+                await this.peerConnection.addIceCandidate(candidate);
+            }
+        } catch (e) {
+            console.log("could not add ICE candidate:", e);
+        }
+    }
+
+    // Pointer motion goes on the unordered "pointer" channel, where a lost
+    // move isn't worth waiting for, and everything else on the reliable
+    // "input" channel
+    sendInput(message, label) {
+        const channel = this.inputChannels[label];
+        const data = JSON.stringify(message);
+        if (channel && channel.readyState === "open") {
+            channel.send(data);
+        } else {
+            this.websocket.send(data);
+        }
+    }
+
     coordinates(event) {
         const x =
             event.offsetX /
@@ -111,23 +263,72 @@ class Client {
         return { x, y };
     }
 
+    // The remote cursor is drawn by the browser: as the CSS cursor while the
+    // local pointer is over the video, so that it moves without any lag, and
+    // as an overlay otherwise, so that remote movement still shows up.
+    updateCursorShape(message) {
+        this.cursor.hotspotX = message.hotspotX;
+        this.cursor.hotspotY = message.hotspotY;
+        this.cursorElement.src = message.image;
+        const { image, hotspotX, hotspotY } = message;
+        this.videoElement.style.cursor = `url(${image}) ${hotspotX} ${hotspotY}, auto`;
+        this.drawCursor();
+    }
+
+    updateCursor(message) {
+        this.cursor.visible = message.visible;
+        this.cursor.x = message.x;
+        this.cursor.y = message.y;
+        this.drawCursor();
+    }
+
+    drawCursor() {
+        const show = this.cursor.visible && !this.pointerInside;
+        this.cursorElement.hidden = !show;
+        if (!show) {
+            return;
+        }
+        const rect = this.videoElement.getBoundingClientRect();
+        const left =
+            rect.left + this.cursor.x * rect.width - this.cursor.hotspotX;
+        const top =
+            rect.top + this.cursor.y * rect.height - this.cursor.hotspotY;
+        this.cursorElement.style.left = `${left}px`;
+        this.cursorElement.style.top = `${top}px`;
+    }
+
     captureInput() {
+        if (this.inputCaptured) {
+            return;
+        }
+        this.inputCaptured = true;
+        this.videoElement.addEventListener("pointerenter", () => {
+            this.pointerInside = true;
+            this.drawCursor();
+        });
+        this.videoElement.addEventListener("pointerleave", () => {
+            this.pointerInside = false;
+            this.drawCursor();
+        });
+
         this.videoElement.addEventListener("pointermove", (event) => {
             const { x, y } = this.coordinates(event);
 
-            this.websocket.send(
-                JSON.stringify({
+            this.sendInput(
+                {
                     type: "mouse_move",
                     x,
                     y,
-                }),
+                    seq: ++this.moveSeq,
+                },
+                "pointer",
             );
         });
 
         const sendKeyEvent = (event) => {
             console.log("Key event", event);
-            this.websocket.send(
-                JSON.stringify({
+            this.sendInput(
+                {
                     type: "keyboard",
                     event: {
                         key: event.key,
@@ -135,7 +336,8 @@ class Client {
                         location: event.location,
                         keyDown: event.type === "keydown",
                     },
-                }),
+                },
+                "input",
             );
             event.preventDefault();
         };
@@ -145,14 +347,15 @@ class Client {
         const sendMouseButtonEvent = (event) => {
             console.log("Mouse button event", event);
             const { x, y } = this.coordinates(event);
-            this.websocket.send(
-                JSON.stringify({
+            this.sendInput(
+                {
                     type: "mouse_button",
                     button: event.button,
                     x,
                     y,
                     down: event.type === "mousedown",
-                }),
+                },
+                "input",
             );
             event.preventDefault();
         };
@@ -161,32 +364,112 @@ class Client {
         this.videoElement.addEventListener("mouseup", sendMouseButtonEvent);
 
         this.videoElement.addEventListener("wheel", (event) => {
-            this.websocket.send(
-                JSON.stringify({
+            this.sendInput(
+                {
                     type: "mouse_wheel",
                     deltaX: event.deltaX,
                     deltaY: event.deltaY,
                     deltaZ: event.deltaZ,
-                }),
+                },
+                "input",
             );
             event.preventDefault();
         });
     }
 
+    // Ask the server not to send more pixels than the video element can
+    // show. Resizing the window is debounced, since each change of size
+    // may restart the video stream.
+    sendVideoSize() {
+        this.websocket.send(
+            JSON.stringify({
+                type: "video_size",
+                width: Math.round(
+                    this.videoElement.clientWidth * window.devicePixelRatio,
+                ),
+                height: Math.round(
+                    this.videoElement.clientHeight * window.devicePixelRatio,
+                ),
+            }),
+        );
+    }
+
+    trackVideoSize() {
+        this.sendVideoSize();
+        if (this.trackingVideoSize) {
+            return;
+        }
+        this.trackingVideoSize = true;
+        window.addEventListener("resize", () => {
+            clearTimeout(this.resizeTimer);
+            this.resizeTimer = setTimeout(() => this.sendVideoSize(), 500);
+        });
+    }
+
+    // Only offer a choice of displays when there is more than one
+    updateDisplays(message) {
+        this.displaySelect.replaceChildren(
+            ...message.displays.map((display) => {
+                const option = document.createElement("option");
+                option.value = display.id;
+                option.textContent = `${display.name} (${display.width}x${display.height})`;
+                return option;
+            }),
+        );
+        this.displaySelect.value = message.selected;
+        this.displaySelect.hidden = message.displays.length < 2;
+    }
+
     async handleMessage(event) {
-        console.log("Received message", event.data);
         const message = JSON.parse(event.data);
+        if (message.type !== "cursor") {
+            console.log("Received message", event.data);
+        }
 
         switch (message.type) {
             case "offer":
-                const answer = await this.setupPeerConnection(message);
+                if (this.peerConnection) {
+                    this.offerApplied = this.answerOffer(message);
+                    const answer = await this.offerApplied;
+                    console.log("Sending answer", answer);
+                    this.websocket.send(JSON.stringify(answer));
+                    break;
+                }
+                this.offerApplied = this.setupPeerConnection(message);
+                const answer = await this.offerApplied;
                 console.log("Sending answer", answer);
                 this.websocket.send(JSON.stringify(answer));
                 if (answer.type === "answer") {
                     this.captureInput(); // maybe wait until after connection succeeds?
+                    this.trackVideoSize();
                 }
                 break;
+            case "candidate":
+                await this.addCandidate(message.candidate);
+                break;
+            case "displays":
+                this.updateDisplays(message);
+                break;
+            case "cursor":
+                this.updateCursor(message);
+                break;
+            case "cursor_shape":
+                this.updateCursorShape(message);
+                break;
+            case "session":
+                this.resumeToken = message.resumeToken || null;
+                if (message.resumed) {
+                    this.resuming = false;
+                    console.log("Session resumed");
+                }
+                break;
+            case "session_ended":
+                this.endSession(message.reason);
+                break;
             case "auth_failure":
+                if (this.resuming) {
+                    this.resumeFailed();
+                }
                 this.auth.reset();
                 this.login(`<font color="red">${message.error}</font>`);
                 break;
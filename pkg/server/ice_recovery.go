@@ -0,0 +1,120 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	// disconnectedGrace is how long a disconnected connection gets to come
+	// back by itself before ICE is restarted. Brief losses of connectivity
+	// are common, and often recover without help.
+	disconnectedGrace = 3 * time.Second
+	// restartTimeout is how long each ICE restart gets to reconnect.
+	restartTimeout = 15 * time.Second
+	// maxICERestarts is the number of ICE restarts in a row after which the
+	// connection is given up for lost.
+	maxICERestarts = 3
+)
+
+// iceRecovery restarts ICE when a connection is lost, e.g. when the client
+// moves to another network, and gives up if that doesn't bring it back.
+type iceRecovery struct {
+	grace   time.Duration
+	timeout time.Duration
+	restart func()              // sends the client an offer that restarts ICE
+	fail    func(reason string) // called at most once, when recovery is impossible
+
+	mu       sync.Mutex // protects access to the fields below
+	timer    *time.Timer
+	restarts int
+	done     bool
+}
+
+func newICERecovery(restart func(), fail func(reason string)) *iceRecovery {
+	return &iceRecovery{
+		grace:   disconnectedGrace,
+		timeout: restartTimeout,
+		restart: restart,
+		fail:    fail,
+	}
+}
+
+// update handles a change in the state of the peer connection.
+func (r *iceRecovery) update(state webrtc.PeerConnectionState) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.done {
+		return
+	}
+	switch state {
+	case webrtc.PeerConnectionStateConnected:
+		if r.restarts > 0 {
+			log.Printf("Connection recovered after %d ICE restarts", r.restarts)
+		}
+		r.restarts = 0
+		r.stopTimer()
+	case webrtc.PeerConnectionStateDisconnected:
+		if r.timer == nil {
+			log.Printf("Connection lost; restarting ICE in %v unless it recovers", r.grace)
+			r.startTimer(r.grace)
+		}
+	case webrtc.PeerConnectionStateFailed:
+		r.stopTimer()
+		r.restartLocked()
+	case webrtc.PeerConnectionStateClosed:
+		r.stopTimer()
+		r.done = true
+	}
+}
+
+// startTimer restarts ICE if the connection hasn't come back within d.
+// r.mu must be held.
+func (r *iceRecovery) startTimer(d time.Duration) {
+	var timer *time.Timer
+	timer = time.AfterFunc(d, func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if r.done || r.timer != timer {
+			// Stopped or replaced after it fired
+			return
+		}
+		r.timer = nil
+		r.restartLocked()
+	})
+	r.timer = timer
+}
+
+// restartLocked restarts ICE, unless it has been tried too often already.
+// r.mu must be held.
+func (r *iceRecovery) restartLocked() {
+	if r.restarts >= maxICERestarts {
+		r.done = true
+		go r.fail(fmt.Sprintf("connection lost, and %d ICE restarts did not bring it back", r.restarts))
+		return
+	}
+	r.restarts++
+	log.Printf("Restarting ICE (attempt %d of %d)", r.restarts, maxICERestarts)
+	go r.restart()
+	r.startTimer(r.timeout)
+}
+
+func (r *iceRecovery) stopTimer() {
+	if r.timer != nil {
+		r.timer.Stop()
+		r.timer = nil
+	}
+}
+
+// stop cancels any restart that is pending, e.g. because the connection is
+// being closed.
+func (r *iceRecovery) stop() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stopTimer()
+	r.done = true
+}
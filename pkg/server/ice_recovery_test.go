@@ -0,0 +1,68 @@
+package server
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestICERecovery() (*iceRecovery, *atomic.Int32, chan string) {
+	restarts := &atomic.Int32{}
+	failures := make(chan string, 1)
+	r := newICERecovery(func() { restarts.Add(1) }, func(reason string) { failures <- reason })
+	r.grace = 20 * time.Millisecond
+	r.timeout = 50 * time.Millisecond
+	return r, restarts, failures
+}
+
+func TestICERecovery_Disconnected(t *testing.T) {
+	r, restarts, _ := newTestICERecovery()
+	defer r.stop()
+
+	// A connection that comes back by itself is left alone
+	r.update(webrtc.PeerConnectionStateDisconnected)
+	r.update(webrtc.PeerConnectionStateConnected)
+	time.Sleep(40 * time.Millisecond)
+	assert.Zero(t, restarts.Load())
+
+	// One that doesn't gets an ICE restart
+	r.update(webrtc.PeerConnectionStateDisconnected)
+	assert.Eventually(t, func() bool { return restarts.Load() == 1 }, time.Second, 5*time.Millisecond)
+	r.update(webrtc.PeerConnectionStateConnected)
+	time.Sleep(80 * time.Millisecond)
+	assert.Equal(t, int32(1), restarts.Load())
+}
+
+func TestICERecovery_GivesUp(t *testing.T) {
+	r, restarts, failures := newTestICERecovery()
+	defer r.stop()
+
+	// Restarts that don't reconnect in time are retried, up to a limit
+	r.update(webrtc.PeerConnectionStateFailed)
+	select {
+	case reason := <-failures:
+		assert.Contains(t, reason, "3 ICE restarts")
+	case <-time.After(time.Second):
+		t.Fatal("recovery did not give up")
+	}
+	assert.Equal(t, int32(maxICERestarts), restarts.Load())
+
+	// and then it stays given up
+	r.update(webrtc.PeerConnectionStateFailed)
+	time.Sleep(80 * time.Millisecond)
+	assert.Equal(t, int32(maxICERestarts), restarts.Load())
+	assert.Empty(t, failures)
+}
+
+func TestICERecovery_Closed(t *testing.T) {
+	r, restarts, failures := newTestICERecovery()
+	r.update(webrtc.PeerConnectionStateDisconnected)
+	r.update(webrtc.PeerConnectionStateClosed)
+	r.update(webrtc.PeerConnectionStateFailed)
+	time.Sleep(80 * time.Millisecond)
+	assert.Zero(t, restarts.Load())
+	assert.Empty(t, failures)
+}
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// The labels of the data channels that carry input from the client.
+const (
+	pointerChannelLabel = "pointer"
+	inputChannelLabel   = "input"
+)
+
+// WithInputChannels opens two data channels for input from the client: an
+// unordered one without retransmissions for pointer motion, where a lost
+// move is soon made up for by the next one, and a reliable, ordered one for
+// keys, buttons and the wheel. Input on them doesn't queue up behind lost
+// packets, as it does on the websocket.
+func WithInputChannels() func(c *WebRTCConnection) error {
+	return func(c *WebRTCConnection) error {
+		c.inputChannels = true
+		return nil
+	}
+}
+
+// OnInput sets a function to receive the input messages that arrive on the
+// data channels.
+func (c *WebRTCConnection) OnInput(f func(message any)) {
+	c.input = f
+}
+
+func (c *WebRTCConnection) openInputChannels() error {
+	ordered := false
+	maxRetransmits := uint16(0)
+	pointer, err := c.pc.CreateDataChannel(pointerChannelLabel, &webrtc.DataChannelInit{
+		Ordered:        &ordered,
+		MaxRetransmits: &maxRetransmits,
+	})
+	if err != nil {
+		return fmt.Errorf("error creating pointer data channel: %v", err)
+	}
+	input, err := c.pc.CreateDataChannel(inputChannelLabel, nil)
+	if err != nil {
+		return fmt.Errorf("error creating input data channel: %v", err)
+	}
+	for _, channel := range []*webrtc.DataChannel{pointer, input} {
+		label := channel.Label()
+		channel.OnMessage(func(msg webrtc.DataChannelMessage) {
+			c.receiveInput(label, msg.Data)
+		})
+	}
+	return nil
+}
+
+// receiveInput passes on an input message from a data channel. Anything
+// else belongs on the websocket, and is dropped.
+func (c *WebRTCConnection) receiveInput(label string, data []byte) {
+	message, err := MakeMessage(data)
+	if err != nil {
+		log.Printf("could not parse message on %s data channel: %v", label, err)
+		return
+	}
+	switch message.(type) {
+	case *KeyboardMessage, *MouseButtonMessage, *MouseMoveMessage, *MouseWheelMessage:
+	default:
+		log.Printf("unexpected message on %s data channel: %+v", label, message)
+		return
+	}
+	if c.input != nil {
+		c.input(message)
+	}
+}
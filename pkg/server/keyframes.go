@@ -0,0 +1,156 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/adamroach/webrd/pkg/config"
+)
+
+// KeyframePolicy decides when a VideoSender asks its encoder for keyframes.
+// The zero value forces a keyframe for every request from the browser, and
+// none otherwise.
+type KeyframePolicy struct {
+	// MinInterval is the least time between keyframes forced at the
+	// browser's request. Requests that come sooner are held back, and are
+	// all answered by a single keyframe once the time is up, so that a lossy
+	// link doesn't fill up with keyframes.
+	MinInterval time.Duration
+	// Interval is the longest time between keyframes; zero means keyframes
+	// are only sent on request.
+	Interval time.Duration
+	// IntraRefresh ignores picture loss reports while the encoder is
+	// refreshing the picture gradually, since the picture will recover
+	// without a keyframe. Full intra requests are still answered.
+	IntraRefresh bool
+}
+
+// NewKeyframePolicy returns the configured policy.
+func NewKeyframePolicy(video *config.Video) KeyframePolicy {
+	return KeyframePolicy{
+		MinInterval:  time.Duration(video.KeyframeMinIntervalMs) * time.Millisecond,
+		Interval:     time.Duration(video.KeyframeIntervalSeconds) * time.Second,
+		IntraRefresh: video.IntraRefresh,
+	}
+}
+
+// KeyframeStats counts the keyframes that a VideoSender has sent, by what
+// caused them.
+type KeyframeStats struct {
+	Keyframes  uint64 // all keyframes sent
+	PLI        uint64 // forced for picture loss indications
+	FIR        uint64 // forced for full intra requests
+	Periodic   uint64 // forced because KeyframePolicy.Interval was up
+	Suppressed uint64 // requests answered by another keyframe, or left to intra refresh
+}
+
+// Other returns the number of keyframes that the sender didn't ask for,
+// such as the first one, and those sent after a change of size or display.
+func (s KeyframeStats) Other() uint64 {
+	return s.Keyframes - s.PLI - s.FIR - s.Periodic
+}
+
+func (s KeyframeStats) String() string {
+	return fmt.Sprintf("%d keyframes (%d for PLI, %d for FIR, %d periodic, %d other), %d requests suppressed",
+		s.Keyframes, s.PLI, s.FIR, s.Periodic, s.Other(), s.Suppressed)
+}
+
+type keyframeCause int
+
+const (
+	causeNone keyframeCause = iota
+	causePLI
+	causeFIR
+	causePeriodic
+)
+
+// keyframer applies a KeyframePolicy to the requests from the browser and
+// the frames that are sent.
+type keyframer struct {
+	force func() // asks the encoder for a keyframe
+
+	mu           sync.Mutex // protects access to the fields below
+	policy       KeyframePolicy
+	lastKeyFrame time.Time     // when the last keyframe was sent or forced
+	pending      keyframeCause // a request that is being held back
+	forced       keyframeCause // why the keyframe that is on its way was forced
+	stats        KeyframeStats
+}
+
+func newKeyframer(force func()) *keyframer {
+	return &keyframer{force: force}
+}
+
+func (k *keyframer) setPolicy(policy KeyframePolicy) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.policy = policy
+}
+
+// request handles a request for a keyframe from the browser. intraRefresh
+// says whether the encoder is refreshing the picture by itself.
+func (k *keyframer) request(cause keyframeCause, intraRefresh bool, now time.Time) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	switch {
+	case cause == causePLI && intraRefresh && k.policy.IntraRefresh,
+		k.pending != causeNone,
+		k.forced != causeNone && now.Sub(k.lastKeyFrame) < k.policy.MinInterval:
+		k.stats.Suppressed++
+		return
+	}
+	k.pending = cause
+	k.check(now)
+}
+
+// sent records a frame that has been sent, and forces a keyframe if one is
+// due.
+func (k *keyframer) sent(keyFrame bool, now time.Time) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if keyFrame {
+		k.stats.Keyframes++
+		switch k.forced {
+		case causePLI:
+			k.stats.PLI++
+		case causeFIR:
+			k.stats.FIR++
+		case causePeriodic:
+			k.stats.Periodic++
+		}
+		if k.pending != causeNone {
+			// This one answers the request that was held back
+			k.stats.Suppressed++
+		}
+		k.forced = causeNone
+		k.pending = causeNone
+		k.lastKeyFrame = now
+	}
+	k.check(now)
+}
+
+// check forces a keyframe if a request has been held back long enough, or
+// if it is time for a periodic one.
+func (k *keyframer) check(now time.Time) {
+	since := now.Sub(k.lastKeyFrame)
+	cause := causeNone
+	if k.pending != causeNone && since >= k.policy.MinInterval {
+		cause = k.pending
+	} else if k.policy.Interval > 0 && since >= k.policy.Interval && k.forced == causeNone {
+		cause = causePeriodic
+	}
+	if cause == causeNone {
+		return
+	}
+	k.pending = causeNone
+	k.forced = cause
+	k.lastKeyFrame = now
+	k.force()
+}
+
+func (k *keyframer) Stats() KeyframeStats {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.stats
+}
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/adamroach/webrd/pkg/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeyframer_MinInterval(t *testing.T) {
+	forced := 0
+	k := newKeyframer(func() { forced++ })
+	k.setPolicy(KeyframePolicy{MinInterval: time.Second})
+	now := time.Now()
+	k.sent(true, now)
+
+	// A storm of PLIs just after a keyframe is answered by a single one,
+	// once the interval is up
+	for i := range 10 {
+		k.request(causePLI, false, now.Add(time.Duration(i)*10*time.Millisecond))
+	}
+	assert.Equal(t, 0, forced)
+	k.sent(false, now.Add(500*time.Millisecond))
+	assert.Equal(t, 0, forced)
+	k.sent(false, now.Add(time.Second))
+	assert.Equal(t, 1, forced)
+
+	// Requests while that keyframe is on its way are answered by it
+	k.request(causeFIR, false, now.Add(1100*time.Millisecond))
+	k.sent(true, now.Add(1200*time.Millisecond))
+	assert.Equal(t, 1, forced)
+
+	// After a quiet spell, a request is answered at once
+	k.request(causeFIR, false, now.Add(3*time.Second))
+	assert.Equal(t, 2, forced)
+	k.sent(true, now.Add(3100*time.Millisecond))
+
+	assert.Equal(t, KeyframeStats{Keyframes: 3, PLI: 1, FIR: 1, Suppressed: 10}, k.Stats())
+	assert.Equal(t, uint64(1), k.Stats().Other())
+}
+
+func TestKeyframer_Periodic(t *testing.T) {
+	forced := 0
+	k := newKeyframer(func() { forced++ })
+	k.setPolicy(KeyframePolicy{Interval: 2 * time.Second})
+	now := time.Now()
+	k.sent(true, now)
+	k.sent(false, now.Add(time.Second))
+	assert.Equal(t, 0, forced)
+	k.sent(false, now.Add(2*time.Second))
+	assert.Equal(t, 1, forced)
+	// Not again while the keyframe is on its way
+	k.sent(false, now.Add(4100*time.Millisecond))
+	assert.Equal(t, 1, forced)
+	k.sent(true, now.Add(4200*time.Millisecond))
+
+	// A keyframe sent for another reason restarts the interval
+	k.sent(true, now.Add(5*time.Second))
+	k.sent(false, now.Add(6500*time.Millisecond))
+	assert.Equal(t, 1, forced)
+	assert.Equal(t, KeyframeStats{Keyframes: 3, Periodic: 1}, k.Stats())
+}
+
+func TestKeyframer_IntraRefresh(t *testing.T) {
+	forced := 0
+	k := newKeyframer(func() { forced++ })
+	k.setPolicy(KeyframePolicy{IntraRefresh: true})
+	now := time.Now()
+	k.sent(true, now)
+
+	// The encoder recovers from loss by itself
+	k.request(causePLI, true, now.Add(time.Second))
+	assert.Equal(t, 0, forced)
+	// but not one that is still sending keyframes
+	k.request(causePLI, false, now.Add(2*time.Second))
+	assert.Equal(t, 1, forced)
+	k.sent(true, now.Add(2100*time.Millisecond))
+	// and a full intra request is always answered
+	k.request(causeFIR, true, now.Add(3*time.Second))
+	assert.Equal(t, 2, forced)
+	assert.Equal(t, uint64(1), k.Stats().Suppressed)
+}
+
+func TestNewKeyframePolicy(t *testing.T) {
+	video := config.Video{KeyframeMinIntervalMs: 250, KeyframeIntervalSeconds: 10, IntraRefresh: true}
+	assert.Equal(t, KeyframePolicy{
+		MinInterval:  250 * time.Millisecond,
+		Interval:     10 * time.Second,
+		IntraRefresh: true,
+	}, NewKeyframePolicy(&video))
+}
@@ -5,3 +5,8 @@ type MessageChannel interface {
 	Receive() (any, error)
 	Close() error
 }
+
+// messageSender is the sending half of a MessageChannel.
+type messageSender interface {
+	Send(message any) error
+}
@@ -10,15 +10,23 @@ import (
 type MessageType string
 
 const (
-	TypeKeyboard     MessageType = "keyboard"
-	TypeMouseButton  MessageType = "mouse_button"
-	TypeMouseMove    MessageType = "mouse_move"
-	TypeMouseWheel   MessageType = "mouse_wheel"
-	TypeOffer        MessageType = "offer"
-	TypeAnswer       MessageType = "answer"
-	TypeIceCandidate MessageType = "candidate"
-	TypeAuth         MessageType = "auth"
-	TypeAuthFailure  MessageType = "auth_failure"
+	TypeKeyboard      MessageType = "keyboard"
+	TypeMouseButton   MessageType = "mouse_button"
+	TypeMouseMove     MessageType = "mouse_move"
+	TypeMouseWheel    MessageType = "mouse_wheel"
+	TypeOffer         MessageType = "offer"
+	TypeAnswer        MessageType = "answer"
+	TypeIceCandidate  MessageType = "candidate"
+	TypeAuth          MessageType = "auth"
+	TypeAuthFailure   MessageType = "auth_failure"
+	TypeDisplays      MessageType = "displays"
+	TypeSelectDisplay MessageType = "select_display"
+	TypeVideoSize     MessageType = "video_size"
+	TypeCursor        MessageType = "cursor"
+	TypeCursorShape   MessageType = "cursor_shape"
+	TypeSessionEnded  MessageType = "session_ended"
+	TypeSession       MessageType = "session"
+	TypeResume        MessageType = "resume"
 )
 
 ///////////////////////////////////////////////////////////////////////////
@@ -38,10 +46,14 @@ type MouseButtonMessage struct {
 	Down   bool        `json:"down"`
 }
 
+// MouseMoveMessage moves the pointer. Moves sent on the unordered pointer
+// data channel carry a sequence number that counts up from 1, so that one
+// that arrives after a later one can be dropped.
 type MouseMoveMessage struct {
 	Type MessageType `json:"type"`
 	X    float64     `json:"x"`
 	Y    float64     `json:"y"`
+	Seq  uint64      `json:"seq,omitempty"`
 }
 
 type MouseWheelMessage struct {
@@ -55,10 +67,13 @@ type MouseWheelMessage struct {
 // WebRTC messages
 // These messages are sent used to establish a WebRTC connection.
 
+// OfferMessage starts or renegotiates the connection. IceTransportPolicy is
+// "relay" when the client may only connect through the TURN server.
 type OfferMessage struct {
-	Type       MessageType        `json:"type"`
-	SDP        string             `json:"sdp"`
-	IceServers []config.IceServer `json:"iceServers,omitempty"`
+	Type               MessageType        `json:"type"`
+	SDP                string             `json:"sdp"`
+	IceServers         []config.IceServer `json:"iceServers,omitempty"`
+	IceTransportPolicy string             `json:"iceTransportPolicy,omitempty"`
 }
 
 type AnswerMessage struct {
@@ -66,6 +81,10 @@ type AnswerMessage struct {
 	SDP  string      `json:"sdp"`
 }
 
+// IceCandidateMessage carries an ICE candidate in either direction. The
+// server sends its candidates as they are gathered to clients that ask for
+// them in their AuthMessage, followed by one with an empty candidate string
+// to mark the end of candidates.
 type IceCandidateMessage struct {
 	Type      MessageType `json:"type"`
 	Candidate Candidate   `json:"candidate"`
@@ -75,7 +94,7 @@ type Candidate struct {
 	Candidate        string `json:"candidate"`
 	SdpMLineIndex    int    `json:"sdpMLineIndex"`
 	SdpMid           string `json:"sdpMid"`
-	UsernameFragment string `json:"usernameFragment"`
+	UsernameFragment string `json:"usernameFragment,omitempty"` // browsers reject an empty one
 }
 
 ///////////////////////////////////////////////////////////////////////////
@@ -85,6 +104,18 @@ type Candidate struct {
 type AuthMessage struct {
 	Type  MessageType `json:"type"`
 	Token string      `json:"token"`
+	// TrickleICE is set by clients that take the server's ICE candidates
+	// after the offer, in IceCandidateMessages. Other clients get offers
+	// that already hold every candidate, which takes longer.
+	TrickleICE bool `json:"trickleIce,omitempty"`
+}
+
+// ResumeMessage takes the place of an AuthMessage on a new websocket, to
+// pick up a session whose websocket was lost. The token is the one from the
+// session's SessionMessage.
+type ResumeMessage struct {
+	Type  MessageType `json:"type"`
+	Token string      `json:"token"`
 }
 
 type AuthFailureMessage struct {
@@ -92,6 +123,87 @@ type AuthFailureMessage struct {
 	Error string      `json:"error"`
 }
 
+///////////////////////////////////////////////////////////////////////////
+// Display messages
+// The server tells the client which displays are available (and which one
+// is being sent) when the session starts and whenever the selection changes.
+// The client can ask to switch to another display at any time.
+
+type DisplaysMessage struct {
+	Type     MessageType   `json:"type"`
+	Displays []DisplayInfo `json:"displays"`
+	Selected int           `json:"selected"`
+}
+
+type DisplayInfo struct {
+	ID      int     `json:"id"`
+	Name    string  `json:"name"`
+	Primary bool    `json:"primary"`
+	X       int     `json:"x"`
+	Y       int     `json:"y"`
+	Width   int     `json:"width"`
+	Height  int     `json:"height"`
+	Scale   float64 `json:"scale"`
+}
+
+type SelectDisplayMessage struct {
+	Type MessageType `json:"type"`
+	ID   int         `json:"id"`
+}
+
+// VideoSizeMessage asks the server to scale the video down to fit within
+// the given size, in device pixels (typically the size of the client's video
+// element). The server won't go beyond its own configured limit, and never
+// scales up. A dimension of zero means the client has no preference.
+type VideoSizeMessage struct {
+	Type   MessageType `json:"type"`
+	Width  int         `json:"width"`
+	Height int         `json:"height"`
+}
+
+///////////////////////////////////////////////////////////////////////////
+// Cursor messages
+// The server sends the cursor separately from the video, so that the client
+// can draw it without waiting for the video to catch up. The shape is only
+// sent when it changes.
+
+// CursorMessage gives the position of the cursor's hotspot, with each axis
+// expressed as a fraction of the video size (as in mouse messages). The
+// cursor isn't visible when it is on another display.
+type CursorMessage struct {
+	Type    MessageType `json:"type"`
+	Visible bool        `json:"visible"`
+	X       float64     `json:"x"`
+	Y       float64     `json:"y"`
+}
+
+// CursorShapeMessage carries the cursor image as a PNG data URL, along with
+// its hotspot in image pixels.
+type CursorShapeMessage struct {
+	Type     MessageType `json:"type"`
+	Image    string      `json:"image"`
+	HotspotX int         `json:"hotspotX"`
+	HotspotY int         `json:"hotspotY"`
+}
+
+///////////////////////////////////////////////////////////////////////////
+// Session messages
+
+// SessionMessage is sent when a session starts, and again when it is
+// resumed. ResumeToken is empty if sessions can't be resumed.
+type SessionMessage struct {
+	Type        MessageType `json:"type"`
+	ResumeToken string      `json:"resumeToken,omitempty"`
+	Resumed     bool        `json:"resumed"`
+}
+
+// SessionEndedMessage tells the client that the server has ended the
+// session, e.g. because the connection was lost and couldn't be restored.
+type SessionEndedMessage struct {
+	Type   MessageType `json:"type"`
+	Reason string      `json:"reason"`
+}
+
 // /////////////////////////////////////////////////////////////////////////
 func MakeMessage(bytes []byte) (msg any, err error) {
 	var msgMap map[string]any
@@ -119,6 +231,22 @@ func MakeMessage(bytes []byte) (msg any, err error) {
 		msg = &AuthMessage{}
 	case TypeAuthFailure:
 		msg = &AuthFailureMessage{}
+	case TypeDisplays:
+		msg = &DisplaysMessage{}
+	case TypeSelectDisplay:
+		msg = &SelectDisplayMessage{}
+	case TypeVideoSize:
+		msg = &VideoSizeMessage{}
+	case TypeCursor:
+		msg = &CursorMessage{}
+	case TypeCursorShape:
+		msg = &CursorShapeMessage{}
+	case TypeSessionEnded:
+		msg = &SessionEndedMessage{}
+	case TypeSession:
+		msg = &SessionMessage{}
+	case TypeResume:
+		msg = &ResumeMessage{}
 	default:
 		msg = msgMap
 		return
@@ -0,0 +1,66 @@
+package server
+
+import "time"
+
+// rtpClock converts capture times into RTP timestamp increments. Increments
+// are computed from the offset to the first capture time rather than from
+// frame to frame, so rounding errors don't accumulate over time.
+type rtpClock struct {
+	rate    uint32
+	first   time.Time
+	samples int64 // samples elapsed between first and the most recent capture time
+}
+
+func newRTPClock(rate uint32) *rtpClock {
+	return &rtpClock{rate: rate}
+}
+
+// advance returns the number of samples between the previous capture time
+// and this one. Capture times that go backwards yield zero.
+func (c *rtpClock) advance(captureTime time.Time) uint32 {
+	if c.first.IsZero() {
+		c.first = captureTime
+		return 0
+	}
+	// Split into whole seconds and remainder to avoid overflowing on long sessions
+	elapsed := captureTime.Sub(c.first)
+	seconds := int64(elapsed / time.Second)
+	remainder := int64(elapsed % time.Second)
+	samples := seconds*int64(c.rate) + (remainder*int64(c.rate)+int64(time.Second)/2)/int64(time.Second)
+	if samples <= c.samples {
+		return 0
+	}
+	delta := samples - c.samples
+	c.samples = samples
+	return uint32(delta)
+}
+
+// sampleClock stamps audio frames so that timestamps advance by exactly the
+// number of samples in each frame, regardless of scheduling jitter in the
+// capture times. Capture times are only used to notice gaps in capture, where
+// the clock skips ahead so that audio stays in sync with video.
+type sampleClock struct {
+	clock   *rtpClock
+	elapsed int64 // samples between the first capture time and the latest one
+	stamped int64 // samples covered by the timestamps handed out so far
+	maxGap  int64
+}
+
+func newSampleClock(rate uint32) *sampleClock {
+	return &sampleClock{
+		clock:  newRTPClock(rate),
+		maxGap: int64(rate) / 10,
+	}
+}
+
+// skip returns the number of samples to skip before a frame of the given
+// length, captured at the given time.
+func (c *sampleClock) skip(captureTime time.Time, samples uint32) uint32 {
+	c.elapsed += int64(c.clock.advance(captureTime))
+	var skipped int64
+	if gap := c.elapsed - c.stamped; gap > c.maxGap {
+		skipped = gap
+	}
+	c.stamped += skipped + int64(samples)
+	return uint32(skipped)
+}
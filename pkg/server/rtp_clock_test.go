@@ -0,0 +1,61 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRTPClock(t *testing.T) {
+	clock := newRTPClock(90000)
+	start := time.Now()
+
+	assert.Equal(t, uint32(0), clock.advance(start))
+	assert.Equal(t, uint32(3000), clock.advance(start.Add(time.Second/30)))
+	assert.Equal(t, uint32(3000), clock.advance(start.Add(2*time.Second/30)))
+
+	// A late frame is stamped with its capture time, not its arrival time
+	assert.Equal(t, uint32(6000), clock.advance(start.Add(4*time.Second/30)))
+}
+
+func TestRTPClock_NoDrift(t *testing.T) {
+	clock := newRTPClock(90000)
+	start := time.Now()
+	clock.advance(start)
+
+	// 1/60s is 1500 samples, but frame-to-frame durations in nanoseconds
+	// don't divide evenly; make sure the total stays exact
+	var total uint32
+	for i := 1; i <= 600; i++ {
+		total += clock.advance(start.Add(time.Duration(i) * time.Second / 60))
+	}
+	assert.Equal(t, uint32(900000), total)
+}
+
+func TestRTPClock_Backwards(t *testing.T) {
+	clock := newRTPClock(48000)
+	start := time.Now()
+	clock.advance(start)
+
+	assert.Equal(t, uint32(960), clock.advance(start.Add(20*time.Millisecond)))
+	assert.Equal(t, uint32(0), clock.advance(start.Add(10*time.Millisecond)))
+	assert.Equal(t, uint32(960), clock.advance(start.Add(40*time.Millisecond)))
+}
+
+func TestSampleClock(t *testing.T) {
+	clock := newSampleClock(48000)
+	start := time.Now()
+
+	// Jitter in capture times doesn't affect the timestamps
+	assert.Equal(t, uint32(0), clock.skip(start, 960))
+	assert.Equal(t, uint32(0), clock.skip(start.Add(27*time.Millisecond), 960))
+	assert.Equal(t, uint32(0), clock.skip(start.Add(38*time.Millisecond), 960))
+	assert.Equal(t, uint32(0), clock.skip(start.Add(60*time.Millisecond), 960))
+
+	// A gap in capture is skipped over; the frame at 80ms would have been
+	// followed by one at 100ms
+	assert.Equal(t, uint32(0), clock.skip(start.Add(80*time.Millisecond), 960))
+	assert.Equal(t, uint32(9600), clock.skip(start.Add(300*time.Millisecond), 960))
+	assert.Equal(t, uint32(0), clock.skip(start.Add(320*time.Millisecond), 960))
+}
@@ -1,12 +1,14 @@
 package server
 
 import (
+	"crypto/subtle"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"slices"
 	"strings"
 	"sync"
 	"time"
@@ -14,6 +16,7 @@ import (
 	"github.com/adamroach/webrd/pkg/auth"
 	"github.com/adamroach/webrd/pkg/capture"
 	"github.com/adamroach/webrd/pkg/config"
+	"github.com/adamroach/webrd/pkg/encode"
 	"github.com/adamroach/webrd/pkg/hid"
 	"github.com/go-chi/chi"
 	"github.com/go-chi/chi/middleware"
@@ -29,6 +32,9 @@ type Server struct {
 	Authenticator     auth.Authenticator
 	mu                sync.RWMutex // mutex to protect access to sessions
 	sessions          map[uuid.UUID]*Session
+	videoPipelines    *VideoPipelines
+	turnServer        *TurnServer
+	videoCodecs       []encode.VideoCodec
 	serverError       chan (error)
 	config            *config.Config
 }
@@ -36,6 +42,20 @@ type Server struct {
 func (s *Server) Run(config *config.Config) error {
 	s.config = config
 	s.sessions = make(map[uuid.UUID]*Session)
+	if err := checkVideoFormat(&config.Video); err != nil {
+		return err
+	}
+	var err error
+	if s.videoCodecs, err = checkVideoCodecs(&config.Video); err != nil {
+		return err
+	}
+	s.videoPipelines = NewVideoPipelines(s.MakeVideoCapturer, config)
+	if config.Turn.Enabled {
+		if s.turnServer, err = NewTurnServer(&config.Turn); err != nil {
+			return err
+		}
+		defer s.turnServer.Close()
+	}
 	r := chi.NewRouter()
 	r.Use(middleware.Logger)
 	r.Use(httprate.LimitByIP(10, 1*time.Second)) // Prevent password brute-force attacks
@@ -82,75 +102,107 @@ func (s *Server) listenAndServe(address string, r *chi.Mux) {
 	}
 }
 
+// NewSession starts a session for the client on the other end of
+// messageChannel, once it has authenticated. A client that presents the
+// resume token of a session that lost its client is handed that session
+// instead.
 func (s *Server) NewSession(messageChannel MessageChannel) (*Session, error) {
-	var videoCapturer capture.VideoCapturer
-	var audioCapturer capture.AudioCapturer
-	var keyboard hid.Keyboard
-	var mouse hid.Mouse
-	var err error
-
-	err = s.waitForUserAuth(messageChannel)
+	auth, resumed, err := s.waitForUserAuth(messageChannel)
 	if err != nil {
 		return nil, err
 	}
+	if resumed != nil {
+		return resumed, nil
+	}
 
-	if s.MakeVideoCapturer != nil {
-		videoCapturer, err = s.MakeVideoCapturer()
-		if err != nil {
-			return nil, fmt.Errorf("could not create video capturer: %v", err)
+	session := &Session{
+		ID:             uuid.New(),
+		Server:         s,
+		MessageChannel: messageChannel,
+		TrickleICE:     auth.TrickleICE,
+		RelayOnly:      s.turnServer != nil && s.config.Turn.RelayOnly,
+	}
+	// Until the session has started, a failure releases whatever has been
+	// set up for it so far
+	started := false
+	defer func() {
+		if !started {
+			if err := session.Close(); err != nil {
+				log.Printf("could not close session: %v", err)
+			}
 		}
+	}()
+
+	// Sessions viewing the same display share a capture-and-encode pipeline
+	video, err := s.videoPipelines.Subscribe(DefaultDisplay)
+	if err != nil && err != errVideoDisabled {
+		return nil, err
 	}
+	session.Video = video
 
 	if s.MakeAudioCapturer != nil {
-		audioCapturer, err = s.MakeAudioCapturer()
+		audioCapturer, err := s.MakeAudioCapturer()
 		if err != nil {
 			return nil, fmt.Errorf("could not create audio capturer: %v", err)
 		}
+		session.AudioCapturer = audioCapturer
 	}
 
 	if s.MakeKeyboard != nil {
-		keyboard, err = s.MakeKeyboard()
+		keyboard, err := s.MakeKeyboard()
 		if err != nil {
 			return nil, fmt.Errorf("could not create keyboard: %v", err)
 		}
+		session.Keyboard = keyboard
 	}
 
 	if s.MakeMouse != nil {
-		mouse, err = s.MakeMouse()
+		mouse, err := s.MakeMouse()
 		if err != nil {
 			return nil, fmt.Errorf("could not create mouse: %v", err)
 		}
+		session.Mouse = mouse
 	}
 
-	videoEncoder, err := NewVideoEncoder(videoCapturer, s.config.Video.Bitrate, s.config.Video.Framerate)
-	if err != nil {
-		return nil, fmt.Errorf("could not create video encoder: %v", err)
-	}
-	videoSender := NewVideoSender(videoEncoder)
-	webRTCConnection, err := NewWebRTCConnection(
-		WithVideoSender(videoSender),
+	connectionOptions := []func(*WebRTCConnection) error{
 		WithICEServers(s.config.IceServers),
-	)
+		WithCongestionControl(&s.config.Video),
+		WithInputChannels(),
+	}
+	if session.Video != nil {
+		videoSender := NewVideoSender(session.Video, s.videoCodecs)
+		videoSender.SetKeyframePolicy(NewKeyframePolicy(&s.config.Video))
+		connectionOptions = append(connectionOptions, WithVideoSender(videoSender))
+	}
+	if session.AudioCapturer != nil {
+		audioEncoder, err := NewAudioEncoder(session.AudioCapturer, s.config.Audio.Bitrate)
+		if err != nil {
+			return nil, fmt.Errorf("could not create audio encoder: %v", err)
+		}
+		connectionOptions = append(connectionOptions, WithAudioSender(NewAudioSender(audioEncoder)))
+	}
+	session.WebRTCConnection, err = NewWebRTCConnection(connectionOptions...)
 	if err != nil {
 		return nil, fmt.Errorf("could not create WebRTC connection: %v", err)
 	}
 
-	session := &Session{
-		ID:               uuid.New(),
-		Server:           s,
-		WebRTCConnection: webRTCConnection,
-		MessageChannel:   messageChannel,
-		VideoCapturer:    videoCapturer,
-		AudioCapturer:    audioCapturer,
-		Keyboard:         keyboard,
-		Mouse:            mouse,
+	// The TURN credentials belong to the session from here on, so they are
+	// revoked along with it on any failure below
+	session.IceServers, session.TurnUsername, err = s.iceServers()
+	if err != nil {
+		return nil, fmt.Errorf("could not create TURN credentials: %v", err)
 	}
 
-	err = session.Start()
-	if err != nil {
-		return nil, fmt.Errorf("could not start session: %v", err)
+	if s.config.Auth.ResumeGraceSeconds > 0 {
+		session.ResumeToken, err = newResumeToken()
+		if err != nil {
+			log.Printf("could not create resume token: %v", err)
+		}
 	}
 
+	// The session is registered before it starts handling messages, so
+	// that it can't end before it is added, and then be left behind.
+	// Closing it, as happens if it doesn't start, removes it again.
 	s.mu.Lock()
 	if s.sessions == nil {
 		s.sessions = make(map[uuid.UUID]*Session)
@@ -158,20 +210,42 @@ func (s *Server) NewSession(messageChannel MessageChannel) (*Session, error) {
 	s.sessions[session.ID] = session
 	s.mu.Unlock()
 
+	err = session.Start()
+	if err != nil {
+		return nil, fmt.Errorf("could not start session: %v", err)
+	}
+	started = true
 	return session, nil
 }
 
-func (s *Server) waitForUserAuth(messageChannel MessageChannel) error {
+// waitForUserAuth returns the client's AuthMessage once it holds a valid
+// token, or the session that it has resumed.
+func (s *Server) waitForUserAuth(messageChannel MessageChannel) (*AuthMessage, *Session, error) {
 	for {
 		message, err := messageChannel.Receive()
 		if err != nil {
 			if err == io.EOF {
 				err = errors.New("connection closed before authentication")
 				log.Printf("%v\n", err)
-				return err
+				return nil, nil, err
 			}
 			log.Printf("could not receive message: %v\n", err)
-			return err
+			return nil, nil, err
+		}
+		if resume, ok := message.(*ResumeMessage); ok {
+			session := s.resumableSession(resume.Token)
+			if session != nil && session.reattach(messageChannel) == nil {
+				return nil, session, nil
+			}
+			log.Printf("could not resume session\n")
+			err = messageChannel.Send(&AuthFailureMessage{
+				Type:  TypeAuthFailure,
+				Error: "session cannot be resumed",
+			})
+			if err != nil {
+				log.Printf("could not send auth failure message: %v\n", err)
+			}
+			continue
 		}
 		m, ok := message.(*AuthMessage)
 		if !ok {
@@ -194,8 +268,38 @@ func (s *Server) waitForUserAuth(messageChannel MessageChannel) error {
 			continue
 		}
 		log.Printf("user %s authenticated\n", username)
+		return m, nil, nil
+	}
+}
+
+// iceServers returns the ICE servers for a new session's client: the
+// configured ones, and the embedded TURN server with credentials for the
+// session alone.
+func (s *Server) iceServers() ([]config.IceServer, string, error) {
+	if s.turnServer == nil {
+		return s.config.IceServers, "", nil
+	}
+	turnServer, err := s.turnServer.NewCredentials()
+	if err != nil {
+		return nil, "", err
+	}
+	return append(slices.Clone(s.config.IceServers), turnServer), *turnServer.Username, nil
+}
+
+// resumableSession returns the session with the given resume token, or nil
+// if there is none.
+func (s *Server) resumableSession(token string) *Session {
+	if token == "" {
 		return nil
 	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, session := range s.sessions {
+		if subtle.ConstantTimeCompare([]byte(session.ResumeToken), []byte(token)) == 1 {
+			return session
+		}
+	}
+	return nil
 }
 
 func (s *Server) GetSession(id uuid.UUID) (*Session, error) {
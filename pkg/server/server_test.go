@@ -0,0 +1,181 @@
+package server
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/adamroach/webrd/pkg/capture"
+	"github.com/adamroach/webrd/pkg/capture/synthetic"
+	"github.com/adamroach/webrd/pkg/config"
+	"github.com/adamroach/webrd/pkg/hid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// acceptingAuthenticator takes any token
+type acceptingAuthenticator struct{}
+
+func (acceptingAuthenticator) Authenticate(username, password string) (string, error) {
+	return "token", nil
+}
+
+func (acceptingAuthenticator) ValidateToken(token string) (string, error) {
+	return "user", nil
+}
+
+// authChannel is an openChannel whose client authenticates first
+type authChannel struct {
+	*openChannel
+	authenticated atomic.Bool
+}
+
+func (c *authChannel) Receive() (any, error) {
+	if !c.authenticated.Swap(true) {
+		return &AuthMessage{Type: TypeAuth, Token: "token", TrickleICE: true}, nil
+	}
+	return c.openChannel.Receive()
+}
+
+// failingAudioCapturer can't start, and counts how often it is stopped
+type failingAudioCapturer struct {
+	*synthetic.AudioCapturer
+	stops atomic.Int32
+}
+
+func (c *failingAudioCapturer) Start() error {
+	return errors.New("no audio device")
+}
+
+func (c *failingAudioCapturer) Stop() error {
+	c.stops.Add(1)
+	return nil
+}
+
+// closingKeyboard and closingMouse record whether they have been closed
+type closingKeyboard struct {
+	recordingKeyboard
+	closed atomic.Bool
+}
+
+func (k *closingKeyboard) Close() error {
+	k.closed.Store(true)
+	return nil
+}
+
+type closingMouse struct {
+	hid.Mouse
+	closed atomic.Bool
+}
+
+func (m *closingMouse) Close() error {
+	m.closed.Store(true)
+	return nil
+}
+
+// newSessionServer returns a server whose sessions get video, audio that
+// can't start, and a keyboard and mouse
+func newSessionServer(t *testing.T) (*Server, *failingAudioCapturer, *closingKeyboard, *closingMouse) {
+	cfg := &config.Config{
+		Video: config.Video{Bitrate: 1_000_000, Framerate: 30},
+		Audio: config.Audio{Bitrate: 64000},
+	}
+	codecs, err := checkVideoCodecs(&cfg.Video)
+	require.NoError(t, err)
+	synth, err := synthetic.NewAudioCapturer(440)
+	require.NoError(t, err)
+	audio := &failingAudioCapturer{AudioCapturer: synth}
+	keyboard := &closingKeyboard{}
+	mouse := &closingMouse{Mouse: hid.NewSyntheticMouse(hid.NewRecorder(8))}
+	s := &Server{
+		MakeAudioCapturer: func() (capture.AudioCapturer, error) { return audio, nil },
+		MakeKeyboard:      func() (hid.Keyboard, error) { return keyboard, nil },
+		MakeMouse:         func() (hid.Mouse, error) { return mouse, nil },
+		Authenticator:     acceptingAuthenticator{},
+		videoPipelines:    newTestPipelines(320, 240, 1),
+		videoCodecs:       codecs,
+		config:            cfg,
+	}
+	return s, audio, keyboard, mouse
+}
+
+func TestNewSession_StartFails(t *testing.T) {
+	s, audio, keyboard, mouse := newSessionServer(t)
+	channel := &authChannel{openChannel: newOpenChannel()}
+
+	// Everything that was set up for the session is released
+	_, err := s.NewSession(channel)
+	assert.Error(t, err)
+	assert.Equal(t, int32(1), audio.stops.Load())
+	assert.True(t, keyboard.closed.Load())
+	assert.True(t, mouse.closed.Load())
+	assert.Equal(t, 0, s.videoPipelines.count())
+	assert.True(t, channel.isClosed())
+	assert.Empty(t, s.sessions)
+}
+
+func TestNewSession_Registered(t *testing.T) {
+	s, _, _, _ := newSessionServer(t)
+	s.MakeAudioCapturer = nil
+
+	session, err := s.NewSession(&authChannel{openChannel: newOpenChannel()})
+	require.NoError(t, err)
+	defer session.Close()
+	found, err := s.GetSession(session.ID)
+	require.NoError(t, err)
+	assert.Same(t, session, found)
+
+	// A session whose client goes away straight after authenticating isn't
+	// left behind
+	channel := &authChannel{openChannel: newOpenChannel()}
+	require.NoError(t, channel.Close())
+	gone, err := s.NewSession(channel)
+	require.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		_, err := s.GetSession(gone.ID)
+		return err != nil
+	}, 3*time.Second, 10*time.Millisecond)
+	_, err = s.GetSession(session.ID)
+	assert.NoError(t, err)
+}
+
+func TestNewSession_SetupFails(t *testing.T) {
+	s, audio, keyboard, _ := newSessionServer(t)
+	s.MakeMouse = func() (hid.Mouse, error) {
+		return nil, errors.New("no mouse")
+	}
+
+	_, err := s.NewSession(&authChannel{openChannel: newOpenChannel()})
+	assert.ErrorContains(t, err, "no mouse")
+	assert.Equal(t, int32(1), audio.stops.Load())
+	assert.True(t, keyboard.closed.Load())
+	assert.Equal(t, 0, s.videoPipelines.count())
+}
+
+func TestNewSession_RevokesTurnCredentials(t *testing.T) {
+	s, _, _, _ := newSessionServer(t)
+	turnServer, err := NewTurnServer(&config.Turn{PublicIP: "127.0.0.1", Realm: "webrd"})
+	require.NoError(t, err)
+	defer turnServer.Close()
+	s.turnServer = turnServer
+	users := func() int {
+		turnServer.mu.Lock()
+		defer turnServer.mu.Unlock()
+		return len(turnServer.users)
+	}
+
+	// The credentials of a session that fails to start stop working
+	_, err = s.NewSession(&authChannel{openChannel: newOpenChannel()})
+	assert.Error(t, err)
+	assert.Zero(t, users())
+
+	// as do those of one that ends
+	s.MakeAudioCapturer = nil
+	session, err := s.NewSession(&authChannel{openChannel: newOpenChannel()})
+	require.NoError(t, err)
+	assert.NotEmpty(t, session.TurnUsername)
+	assert.Equal(t, 1, users())
+	require.NoError(t, session.Close())
+	assert.Zero(t, users())
+}
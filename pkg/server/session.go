@@ -1,44 +1,89 @@
 package server
 
 import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"sync"
+	"time"
 
 	"github.com/adamroach/webrd/pkg/capture"
+	"github.com/adamroach/webrd/pkg/config"
 	"github.com/adamroach/webrd/pkg/hid"
 	"github.com/google/uuid"
 )
 
+var (
+	errSessionClosed = errors.New("session is closed")
+	errClientAway    = errors.New("client is away")
+)
+
 type Session struct {
 	ID               uuid.UUID
 	Server           *Server
 	WebRTCConnection *WebRTCConnection
-	MessageChannel   MessageChannel
-	VideoCapturer    capture.VideoCapturer
-	AudioCapturer    capture.AudioCapturer
-	Keyboard         hid.Keyboard
-	Mouse            hid.Mouse
+	// MessageChannel reaches the client. It is nil while the client is
+	// away, and replaced when the client resumes the session.
+	MessageChannel MessageChannel
+	Video          *VideoSubscription
+	AudioCapturer  capture.AudioCapturer
+	Keyboard       hid.Keyboard
+	Mouse          hid.Mouse
+	TrickleICE     bool   // the client takes ICE candidates after the offer
+	ResumeToken    string // lets a new websocket take over the session; empty if it can't
+	IceServers     []config.IceServer
+	TurnUsername   string // the session's credentials for the embedded TURN server, if any
+	RelayOnly      bool   // the client may only reach the server through a TURN relay
+	cursor         *cursorTracker
+	held           *heldInput
+	closeOnce      sync.Once
+	closeErr       error
+
+	inputMu     sync.Mutex // input arrives on the websocket and the data channels at once
+	lastMoveSeq uint64     // the latest pointer move handled; protected by inputMu
+
+	mu                 sync.Mutex   // protects access to MessageChannel and the fields below
+	offerSent          bool         // candidates can follow the offer once it has gone
+	candidates         []*Candidate // candidates gathered before the offer was sent
+	closed             bool
+	detachTimer        *time.Timer // ends the session if the client doesn't come back
+	pendingRestart     bool        // an ICE restart is waiting for the client to come back
+	pendingRenegotiate bool        // so is a new offer
 }
 
 func (s *Session) Start() error {
+	s.held = newHeldInput()
+	s.WebRTCConnection.OnNegotiationNeeded(s.renegotiate)
+	s.WebRTCConnection.OnICERestartNeeded(s.restartICE)
+	s.WebRTCConnection.OnFailed(s.End)
+	s.WebRTCConnection.OnInput(s.handleInput)
+	if s.TrickleICE {
+		s.WebRTCConnection.OnICECandidate(s.sendCandidate)
+	}
+	if s.ResumeToken != "" {
+		if err := s.Send(SessionMessage{Type: TypeSession, ResumeToken: s.ResumeToken}); err != nil {
+			log.Printf("could not send resume token: %v", err)
+		}
+	}
 	offer, err := s.WebRTCConnection.GetOffer()
 	if err != nil {
 		log.Printf("could not get offer: %v", err)
 		return err
 	}
-	offerMessage := OfferMessage{Type: TypeOffer, SDP: offer}
-	if len(s.Server.config.IceServers) > 0 {
-		offerMessage.IceServers = s.Server.config.IceServers
-	}
-	err = s.MessageChannel.Send(offerMessage)
-	if err != nil {
+	if err := s.sendOffer(offer); err != nil {
 		log.Printf("could not send offer: %v", err)
 	}
-	if s.VideoCapturer != nil {
-		if err := s.VideoCapturer.Start(); err != nil {
-			log.Printf("could not start video capturer: %v", err)
-			return err
+	if s.Video != nil {
+		if err := s.sendDisplays(); err != nil {
+			log.Printf("could not send displays: %v", err)
+		}
+		// Unless the cursor is drawn into the video, the client draws it
+		if s.Server.config.Video.Cursor != "video" {
+			s.cursor = newCursorTracker(s.Video, s)
+			s.cursor.Start()
 		}
 	}
 	if s.AudioCapturer != nil {
@@ -47,36 +92,216 @@ func (s *Session) Start() error {
 			return err
 		}
 	}
-	go s.handleMessages()
+	go s.handleMessages(s.MessageChannel)
 	return nil
 }
 
-func (s *Session) Close() error {
-	err := s.MessageChannel.Close()
+// Send sends a message to the client. Messages sent while the client is
+// away are dropped.
+func (s *Session) Send(message any) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.MessageChannel == nil {
+		return nil
+	}
+	return s.MessageChannel.Send(message)
+}
+
+// detach is called when the client's message channel closes. The session
+// carries on without it for the configured grace period, in case the client
+// comes back with its resume token, and is closed otherwise.
+func (s *Session) detach(channel MessageChannel) {
+	s.mu.Lock()
+	if s.MessageChannel != channel {
+		// The client has already come back on another channel
+		s.mu.Unlock()
+		return
+	}
+	s.MessageChannel = nil
+	grace := time.Duration(s.Server.config.Auth.ResumeGraceSeconds) * time.Second
+	if s.ResumeToken == "" || grace <= 0 || s.closed {
+		s.mu.Unlock()
+		channel.Close()
+		if err := s.Close(); err != nil {
+			log.Printf("could not close session: %v\n", err)
+		}
+		return
+	}
+	log.Printf("session %s lost its client; waiting %v for it to resume", s.ID, grace)
+	var timer *time.Timer
+	timer = time.AfterFunc(grace, func() {
+		s.mu.Lock()
+		expired := s.detachTimer == timer
+		s.mu.Unlock()
+		if expired {
+			log.Printf("session %s was not resumed in time", s.ID)
+			if err := s.Close(); err != nil {
+				log.Printf("could not close session: %v\n", err)
+			}
+		}
+	})
+	s.detachTimer = timer
+	s.mu.Unlock()
+	channel.Close()
+}
+
+// reattach hands the session to a client that has presented its resume
+// token on a new message channel. Media carries on throughout; the client
+// is only sent what it may have missed.
+func (s *Session) reattach(channel MessageChannel) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return errSessionClosed
+	}
+	previous := s.MessageChannel
+	s.MessageChannel = channel
+	if s.detachTimer != nil {
+		s.detachTimer.Stop()
+		s.detachTimer = nil
+	}
+	restart, renegotiate := s.pendingRestart, s.pendingRenegotiate
+	s.pendingRestart, s.pendingRenegotiate = false, false
+	s.mu.Unlock()
+	if previous != nil {
+		// The old channel hasn't noticed that it is dead yet
+		previous.Close()
+	}
+	log.Printf("session %s resumed", s.ID)
+
+	if err := s.Send(SessionMessage{Type: TypeSession, ResumeToken: s.ResumeToken, Resumed: true}); err != nil {
+		log.Printf("could not send session: %v", err)
+	}
+	if s.Video != nil {
+		if err := s.sendDisplays(); err != nil {
+			log.Printf("could not send displays: %v", err)
+		}
+	}
+	if s.cursor != nil {
+		s.cursor.Resend()
+	}
+	if restart {
+		s.restartICE()
+	} else if renegotiate {
+		s.renegotiate()
+	}
+	go s.handleMessages(channel)
+	return nil
+}
+
+// deferOffer holds back an offer while the client is away, and reports
+// whether it did.
+func (s *Session) deferOffer(restart bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.MessageChannel != nil {
+		return false
+	}
+	if restart {
+		s.pendingRestart = true
+	} else {
+		s.pendingRenegotiate = true
+	}
+	return true
+}
+
+// newResumeToken returns a random token that is hard to guess.
+func newResumeToken() (string, error) {
+	return randomToken(32)
+}
+
+// randomToken returns size random bytes, encoded for use in URLs and JSON.
+func randomToken(size int) (string, error) {
+	token := make([]byte, size)
+	if _, err := rand.Read(token); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(token), nil
+}
+
+// End tells the client why the session is ending, and closes it.
+func (s *Session) End(reason string) {
+	log.Printf("ending session %s: %s", s.ID, reason)
+	err := s.Send(SessionEndedMessage{Type: TypeSessionEnded, Reason: reason})
 	if err != nil {
-		return err
+		log.Printf("could not tell the client that the session ended: %v", err)
+	}
+	if err := s.Close(); err != nil {
+		log.Printf("could not close session: %v", err)
+	}
+}
+
+// Close releases everything that the session holds: the connection, the
+// video and audio, and any keys or buttons that are still held down. It
+// carries on past failures, and returns all of them. Closing a session
+// again does nothing.
+func (s *Session) Close() error {
+	s.closeOnce.Do(func() {
+		s.closeErr = s.close()
+	})
+	return s.closeErr
+}
+
+func (s *Session) close() error {
+	s.mu.Lock()
+	s.closed = true
+	if s.detachTimer != nil {
+		s.detachTimer.Stop()
+		s.detachTimer = nil
 	}
-	if s.VideoCapturer != nil {
-		if err := s.VideoCapturer.Stop(); err != nil {
-			return fmt.Errorf("could not stop video capturer: %v", err)
+	channel := s.MessageChannel
+	s.mu.Unlock()
+
+	var errs []error
+	if s.cursor != nil {
+		s.cursor.Stop()
+	}
+	if s.WebRTCConnection != nil {
+		if err := s.WebRTCConnection.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("could not close connection: %v", err))
+		}
+	}
+	if s.Video != nil {
+		if err := s.Video.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("could not stop video: %v", err))
 		}
 	}
 	if s.AudioCapturer != nil {
 		if err := s.AudioCapturer.Stop(); err != nil {
-			return fmt.Errorf("could not stop audio capturer: %v", err)
+			errs = append(errs, fmt.Errorf("could not stop audio capturer: %v", err))
+		}
+	}
+	if s.held != nil {
+		s.held.release(s.Keyboard, s.Mouse)
+	}
+	if err := hid.Close(s.Keyboard); err != nil {
+		errs = append(errs, fmt.Errorf("could not close keyboard: %v", err))
+	}
+	if err := hid.Close(s.Mouse); err != nil {
+		errs = append(errs, fmt.Errorf("could not close mouse: %v", err))
+	}
+	if channel != nil {
+		if err := channel.Close(); err != nil {
+			errs = append(errs, err)
 		}
 	}
+	if s.TurnUsername != "" && s.Server.turnServer != nil {
+		s.Server.turnServer.Revoke(s.TurnUsername)
+	}
 
 	s.Server.removeSession(s)
-	return nil
+	return errors.Join(errs...)
 }
 
-func (s *Session) handleMessages() {
+// handleMessages handles the messages from the client on one channel,
+// until it closes.
+func (s *Session) handleMessages(channel MessageChannel) {
 	for {
-		message, err := s.MessageChannel.Receive()
+		message, err := channel.Receive()
 		if err != nil {
 			if err == io.EOF {
-				log.Printf("session closed: %v\n", err)
+				log.Printf("message channel closed: %v\n", err)
+				s.detach(channel)
 				return
 			}
 			log.Printf("could not receive message: %v\n", err)
@@ -94,41 +319,21 @@ func (s *Session) handleMessages() {
 			if err != nil {
 				log.Printf("could not add ICE candidate: %v\n", err)
 			}
-		case *KeyboardMessage:
-			if s.Keyboard != nil {
-				err = s.Keyboard.Key(message.Event)
-				if err != nil {
-					log.Printf("could not send keyboard event: %v\n", err)
-				}
-			} else {
-				log.Printf("keyboard not available\n")
-			}
-		case *MouseButtonMessage:
-			if s.Mouse != nil {
-				x, y := s.convertCoordinates(message.X, message.Y)
-				err = s.Mouse.Button(message.Button, x, y, message.Down)
-				if err != nil {
-					log.Printf("could not send mouse button event: %v\n", err)
-				}
-			} else {
-				log.Printf("mouse not available\n")
-			}
-		case *MouseWheelMessage:
-			if s.Mouse != nil {
-				err = s.Mouse.Wheel(message.DeltaX, message.DeltaY, message.DeltaZ)
-				if err != nil {
-					log.Printf("could not send mouse wheel event: %v\n", err)
-				}
+		case *KeyboardMessage, *MouseButtonMessage, *MouseWheelMessage, *MouseMoveMessage:
+			// Clients whose data channels aren't open yet send input here
+			s.handleInput(message)
+		case *SelectDisplayMessage:
+			err = s.selectDisplay(message.ID)
+			if err != nil {
+				log.Printf("could not select display: %v\n", err)
 			}
-		case *MouseMoveMessage:
-			if s.Mouse != nil {
-				x, y := s.convertCoordinates(message.X, message.Y)
-				err = s.Mouse.Move(x, y)
+		case *VideoSizeMessage:
+			if s.Video != nil {
+				err = s.Video.SetMaxSize(message.Width, message.Height)
 				if err != nil {
-					log.Printf("could not send mouse move event: %v\n", err)
+					log.Printf("could not change video size: %v\n", err)
 				}
 			}
-			// we don't log the "else" clause here because it would be too noisy
 
 		default:
 			log.Printf("unexpected message type: %+v\n", message)
@@ -136,10 +341,214 @@ func (s *Session) handleMessages() {
 	}
 }
 
+// handleInput passes input from the client, on either the websocket or a
+// data channel, to the keyboard and mouse.
+func (s *Session) handleInput(message any) {
+	s.inputMu.Lock()
+	defer s.inputMu.Unlock()
+	var err error
+	switch message := message.(type) {
+	case *KeyboardMessage:
+		if s.Keyboard != nil {
+			s.held.key(message.Event)
+			err = s.Keyboard.Key(message.Event)
+			if err != nil {
+				log.Printf("could not send keyboard event: %v\n", err)
+			}
+		} else {
+			log.Printf("keyboard not available\n")
+		}
+	case *MouseButtonMessage:
+		if s.Mouse != nil {
+			x, y := s.convertCoordinates(message.X, message.Y)
+			s.held.button(message.Button, x, y, message.Down)
+			err = s.Mouse.Button(message.Button, x, y, message.Down)
+			if err != nil {
+				log.Printf("could not send mouse button event: %v\n", err)
+			}
+		} else {
+			log.Printf("mouse not available\n")
+		}
+	case *MouseWheelMessage:
+		if s.Mouse != nil {
+			err = s.Mouse.Wheel(message.DeltaX, message.DeltaY, message.DeltaZ)
+			if err != nil {
+				log.Printf("could not send mouse wheel event: %v\n", err)
+			}
+		}
+	case *MouseMoveMessage:
+		if message.Seq != 0 {
+			if message.Seq <= s.lastMoveSeq {
+				// Overtaken by a later move on the unordered channel
+				return
+			}
+			s.lastMoveSeq = message.Seq
+		}
+		if s.Mouse != nil {
+			x, y := s.convertCoordinates(message.X, message.Y)
+			s.held.move(x, y)
+			err = s.Mouse.Move(x, y)
+			if err != nil {
+				log.Printf("could not send mouse move event: %v\n", err)
+			}
+		}
+		// we don't log the "else" clause here because it would be too noisy
+	}
+}
+
+func (s *Session) sendOffer(offer string) error {
+	offerMessage := OfferMessage{Type: TypeOffer, SDP: offer}
+	if len(s.IceServers) > 0 {
+		offerMessage.IceServers = s.IceServers
+	}
+	if s.RelayOnly {
+		offerMessage.IceTransportPolicy = "relay"
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.MessageChannel == nil {
+		return errClientAway
+	}
+	if err := s.MessageChannel.Send(offerMessage); err != nil {
+		return err
+	}
+	if !s.offerSent {
+		s.offerSent = true
+		for _, candidate := range s.candidates {
+			if err := s.MessageChannel.Send(candidateMessage(candidate)); err != nil {
+				log.Printf("could not send ICE candidate: %v", err)
+			}
+		}
+		s.candidates = nil
+	}
+	return nil
+}
+
+// sendCandidate sends a local ICE candidate to the client, or the end of
+// candidates if it is nil. Candidates gathered before the offer has been
+// sent wait for it, since the client can't use them until then.
+func (s *Session) sendCandidate(candidate *Candidate) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.offerSent {
+		s.candidates = append(s.candidates, candidate)
+		return
+	}
+	if s.MessageChannel == nil {
+		// The client will get new candidates with the ICE restart that
+		// follows its return
+		return
+	}
+	if err := s.MessageChannel.Send(candidateMessage(candidate)); err != nil {
+		log.Printf("could not send ICE candidate: %v", err)
+	}
+}
+
+// candidateMessage wraps a candidate for the client. An empty candidate
+// marks the end of candidates.
+func candidateMessage(candidate *Candidate) IceCandidateMessage {
+	message := IceCandidateMessage{Type: TypeIceCandidate}
+	if candidate != nil {
+		message.Candidate = *candidate
+	}
+	return message
+}
+
+// renegotiate sends the client a new offer for the established connection,
+// e.g. when the video needs different codec parameters.
+func (s *Session) renegotiate() {
+	if s.deferOffer(false) {
+		log.Printf("session %s will renegotiate when its client is back", s.ID)
+		return
+	}
+	offer, err := s.WebRTCConnection.CreateOffer()
+	if err != nil {
+		log.Printf("could not create offer: %v", err)
+		return
+	}
+	if err := s.sendOffer(offer); err != nil {
+		log.Printf("could not send offer: %v", err)
+	}
+}
+
+// restartICE sends the client an offer that restarts ICE, after the
+// connection has been lost.
+func (s *Session) restartICE() {
+	if s.deferOffer(true) {
+		log.Printf("session %s will restart ICE when its client is back", s.ID)
+		return
+	}
+	offer, err := s.WebRTCConnection.RestartICE()
+	if err != nil {
+		s.End(fmt.Sprintf("could not restart ICE: %v", err))
+		return
+	}
+	err = s.sendOffer(offer)
+	if errors.Is(err, errClientAway) {
+		// The client went away in the meantime
+		s.deferOffer(true)
+	} else if err != nil {
+		s.End(fmt.Sprintf("could not send ICE restart offer: %v", err))
+	}
+}
+
+// sendDisplays tells the client which displays are available, and which
+// one it is looking at.
+func (s *Session) sendDisplays() error {
+	displays, err := s.Video.Displays()
+	if err != nil {
+		return err
+	}
+	message := DisplaysMessage{
+		Type:     TypeDisplays,
+		Displays: make([]DisplayInfo, len(displays)),
+		Selected: s.Video.CurrentDisplay().ID,
+	}
+	for i, display := range displays {
+		message.Displays[i] = DisplayInfo{
+			ID:      display.ID,
+			Name:    display.Name,
+			Primary: display.Primary,
+			X:       display.Bounds.Min.X,
+			Y:       display.Bounds.Min.Y,
+			Width:   display.Bounds.Dx(),
+			Height:  display.Bounds.Dy(),
+			Scale:   display.Scale,
+		}
+	}
+	return s.Send(message)
+}
+
+// selectDisplay switches the session to another display. The client is
+// sent the resulting selection even if switching fails, so that it can
+// update its state.
+func (s *Session) selectDisplay(id int) error {
+	if s.Video == nil {
+		return fmt.Errorf("video capture not available")
+	}
+	err := s.Video.SelectDisplay(id)
+	if err == nil {
+		log.Printf("session %s switched to display %d", s.ID, id)
+		if s.cursor != nil {
+			s.cursor.Resend()
+		}
+	}
+	if sendErr := s.sendDisplays(); sendErr != nil {
+		log.Printf("could not send displays: %v", sendErr)
+	}
+	return err
+}
+
+// convertCoordinates maps a position on the client's video element, with
+// each axis expressed as a fraction of its size, into the global coordinate
+// space of the display being captured. Since the position is relative, it
+// doesn't matter whether the video has been scaled down.
 func (s *Session) convertCoordinates(xPercent, yPercent float64) (int, int) {
-	// Convert the percentage coordinates to absolute coordinates
-	bounds := s.VideoCapturer.GetBounds()
-	x := int(float64(bounds.Dx()) * xPercent)
-	y := int(float64(bounds.Dy()) * yPercent)
+	if s.Video == nil {
+		return 0, 0
+	}
+	bounds := s.Video.CurrentDisplay().Bounds
+	x := bounds.Min.X + int(float64(bounds.Dx())*xPercent)
+	y := bounds.Min.Y + int(float64(bounds.Dy())*yPercent)
 	return x, y
 }
@@ -0,0 +1,304 @@
+package server
+
+import (
+	"image"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/adamroach/webrd/pkg/config"
+	"github.com/adamroach/webrd/pkg/hid"
+	"github.com/adamroach/webrd/pkg/hid/key"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingChannel is a MessageChannel that keeps everything sent on it
+type recordingChannel struct {
+	sent []any
+}
+
+func (c *recordingChannel) Send(message any) error {
+	c.sent = append(c.sent, message)
+	return nil
+}
+
+func (c *recordingChannel) Receive() (any, error) {
+	return nil, io.EOF
+}
+
+func (c *recordingChannel) Close() error {
+	return nil
+}
+
+// openChannel is a recordingChannel whose Receive waits until it is closed,
+// like a client that is still connected
+type openChannel struct {
+	recordingChannel
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+func newOpenChannel() *openChannel {
+	return &openChannel{done: make(chan struct{})}
+}
+
+func (c *openChannel) Receive() (any, error) {
+	<-c.done
+	return nil, io.EOF
+}
+
+func (c *openChannel) Close() error {
+	c.closeOnce.Do(func() { close(c.done) })
+	return nil
+}
+
+func (c *openChannel) isClosed() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestSession_SelectDisplay(t *testing.T) {
+	video, err := newTestPipelines(800, 600, 2).Subscribe(DefaultDisplay)
+	require.NoError(t, err)
+	defer video.Close()
+
+	messageChannel := &recordingChannel{}
+	session := &Session{MessageChannel: messageChannel, Video: video}
+
+	x, y := session.convertCoordinates(0.5, 0.5)
+	assert.Equal(t, 400, x)
+	assert.Equal(t, 300, y)
+
+	require.NoError(t, session.selectDisplay(1))
+	x, y = session.convertCoordinates(0.5, 0.5)
+	assert.Equal(t, 1200, x)
+	assert.Equal(t, 300, y)
+
+	// A failed switch still tells the client which display it is on
+	assert.Error(t, session.selectDisplay(5))
+
+	require.Len(t, messageChannel.sent, 2)
+	for _, sent := range messageChannel.sent {
+		message, ok := sent.(DisplaysMessage)
+		require.True(t, ok)
+		assert.Equal(t, TypeDisplays, message.Type)
+		assert.Equal(t, 1, message.Selected)
+		require.Len(t, message.Displays, 2)
+		assert.Equal(t, DisplayInfo{
+			ID: 1, Name: "Synthetic 2", X: 800, Y: 0, Width: 800, Height: 600, Scale: 1,
+		}, message.Displays[1])
+	}
+}
+
+func TestSession_ConvertCoordinatesScaled(t *testing.T) {
+	pipelines := newTestPipelines(1600, 1200, 2)
+	pipelines.config.Video.MaxWidth = 400
+	video, err := pipelines.Subscribe(1)
+	require.NoError(t, err)
+	defer video.Close()
+	require.Equal(t, image.Pt(400, 300), video.Size())
+
+	// Positions on the scaled video map back to native pixels
+	session := &Session{Video: video}
+	x, y := session.convertCoordinates(0.25, 0.75)
+	assert.Equal(t, 2000, x)
+	assert.Equal(t, 900, y)
+}
+
+func TestSession_ConvertCoordinatesWithoutCapturer(t *testing.T) {
+	session := &Session{}
+	x, y := session.convertCoordinates(0.5, 0.5)
+	assert.Equal(t, 0, x)
+	assert.Equal(t, 0, y)
+}
+
+func TestSession_TrickleICE(t *testing.T) {
+	messageChannel := &recordingChannel{}
+	session := &Session{Server: &Server{config: &config.Config{}}, MessageChannel: messageChannel}
+
+	// Candidates gathered before the offer has been sent follow it
+	session.sendCandidate(&Candidate{Candidate: "candidate:1", SdpMid: "0"})
+	assert.Empty(t, messageChannel.sent)
+	require.NoError(t, session.sendOffer("v=0"))
+	session.sendCandidate(&Candidate{Candidate: "candidate:2", SdpMid: "0"})
+	session.sendCandidate(nil)
+
+	assert.Equal(t, []any{
+		OfferMessage{Type: TypeOffer, SDP: "v=0"},
+		IceCandidateMessage{Type: TypeIceCandidate, Candidate: Candidate{Candidate: "candidate:1", SdpMid: "0"}},
+		IceCandidateMessage{Type: TypeIceCandidate, Candidate: Candidate{Candidate: "candidate:2", SdpMid: "0"}},
+		IceCandidateMessage{Type: TypeIceCandidate},
+	}, messageChannel.sent)
+}
+
+func TestSession_HandleInputOutOfOrder(t *testing.T) {
+	video, err := newTestPipelines(800, 600, 1).Subscribe(DefaultDisplay)
+	require.NoError(t, err)
+	defer video.Close()
+	recorder := hid.NewRecorder(8)
+	session := &Session{Video: video, Mouse: hid.NewSyntheticMouse(recorder), held: newHeldInput()}
+
+	session.handleInput(&MouseMoveMessage{Type: TypeMouseMove, X: 0.5, Y: 0.5, Seq: 2})
+	// A move that was overtaken on the pointer channel is dropped
+	session.handleInput(&MouseMoveMessage{Type: TypeMouseMove, X: 0.25, Y: 0.25, Seq: 1})
+	state := recorder.State()
+	assert.Equal(t, 400, state.PointerX)
+	assert.Equal(t, 300, state.PointerY)
+	// Moves without a sequence number come over the websocket, in order
+	session.handleInput(&MouseMoveMessage{Type: TypeMouseMove, X: 0.25, Y: 0.25})
+	state = recorder.State()
+	assert.Equal(t, 200, state.PointerX)
+	assert.Equal(t, 150, state.PointerY)
+	assert.Equal(t, uint64(2), state.Events)
+}
+
+func TestSession_SendOfferRelayOnly(t *testing.T) {
+	messageChannel := &recordingChannel{}
+	username, password := "user", "password"
+	turnServer := config.IceServer{Urls: []string{"turn:192.0.2.1:3478?transport=udp"}, Username: &username, Credential: &password}
+	session := &Session{
+		Server:         &Server{config: &config.Config{}},
+		MessageChannel: messageChannel,
+		IceServers:     []config.IceServer{turnServer},
+		RelayOnly:      true,
+	}
+
+	require.NoError(t, session.sendOffer("v=0"))
+	assert.Equal(t, []any{OfferMessage{
+		Type:               TypeOffer,
+		SDP:                "v=0",
+		IceServers:         []config.IceServer{turnServer},
+		IceTransportPolicy: "relay",
+	}}, messageChannel.sent)
+}
+
+// recordingKeyboard is a Keyboard that keeps every event
+type recordingKeyboard struct {
+	events []key.Event
+}
+
+func (k *recordingKeyboard) Key(event key.Event) error {
+	k.events = append(k.events, event)
+	return nil
+}
+
+func TestSession_End(t *testing.T) {
+	video, err := newTestPipelines(320, 240, 1).Subscribe(DefaultDisplay)
+	require.NoError(t, err)
+	messageChannel := &recordingChannel{}
+	keyboard := &recordingKeyboard{}
+	recorder := hid.NewRecorder(8)
+	session := &Session{
+		Server:         &Server{},
+		MessageChannel: messageChannel,
+		Video:          video,
+		Keyboard:       keyboard,
+		Mouse:          hid.NewSyntheticMouse(recorder),
+		held:           newHeldInput(),
+	}
+	shift := key.Event{Key: "Shift", Code: "ShiftLeft", Location: key.LocationLeft, KeyDown: true}
+	session.held.key(shift)
+	session.held.key(key.Event{Key: "a", Code: "KeyA", KeyDown: true})
+	session.held.key(key.Event{Key: "a", Code: "KeyA"})
+	session.held.button(0, 10, 20, true)
+	require.NoError(t, session.Mouse.Button(0, 10, 20, true))
+
+	session.End("connection lost")
+	session.End("connection lost")
+
+	// The client hears why, and nothing is left held down
+	assert.Equal(t, SessionEndedMessage{Type: TypeSessionEnded, Reason: "connection lost"}, messageChannel.sent[0])
+	shift.KeyDown = false
+	assert.Equal(t, []key.Event{shift}, keyboard.events)
+	assert.Zero(t, recorder.State().Buttons)
+	// and the video is released
+	_, err = video.ReadFrame()
+	assert.Equal(t, io.EOF, err)
+}
+
+// newResumableSession returns a session that has lost its client, and may
+// be resumed for graceSeconds.
+func newResumableSession(t *testing.T, graceSeconds int) (*Session, *VideoSubscription) {
+	video, err := newTestPipelines(320, 240, 1).Subscribe(DefaultDisplay)
+	require.NoError(t, err)
+	server := &Server{config: &config.Config{Auth: config.Auth{ResumeGraceSeconds: graceSeconds}}}
+	first := newOpenChannel()
+	session := &Session{
+		Server:         server,
+		MessageChannel: first,
+		Video:          video,
+		ResumeToken:    "token",
+		held:           newHeldInput(),
+	}
+	server.sessions = map[uuid.UUID]*Session{session.ID: session}
+
+	session.detach(first)
+	assert.True(t, first.isClosed())
+	return session, video
+}
+
+func TestSession_Resume(t *testing.T) {
+	session, video := newResumableSession(t, 30)
+	defer session.Close()
+
+	// Nothing is sent while the client is away, and offers wait for it
+	require.NoError(t, session.Send(DisplaysMessage{Type: TypeDisplays}))
+	assert.True(t, session.deferOffer(false))
+	session.mu.Lock()
+	session.pendingRenegotiate = false
+	session.mu.Unlock()
+
+	assert.Nil(t, session.Server.resumableSession("wrong"))
+	assert.Nil(t, session.Server.resumableSession(""))
+	require.Same(t, session, session.Server.resumableSession("token"))
+
+	second := newOpenChannel()
+	require.NoError(t, session.reattach(second))
+	require.Len(t, second.sent, 2)
+	assert.Equal(t, SessionMessage{Type: TypeSession, ResumeToken: "token", Resumed: true}, second.sent[0])
+	assert.IsType(t, DisplaysMessage{}, second.sent[1])
+	// The video carried on throughout
+	_, err := video.ReadFrame()
+	assert.NoError(t, err)
+
+	// The old channel going away late doesn't detach the new one
+	session.detach(newOpenChannel())
+	require.NoError(t, session.Send(DisplaysMessage{Type: TypeDisplays}))
+	assert.Len(t, second.sent, 3)
+}
+
+func TestSession_ResumeExpired(t *testing.T) {
+	session, video := newResumableSession(t, 1)
+
+	// The session is closed once the grace period is up
+	assert.Eventually(t, func() bool {
+		_, err := video.ReadFrame()
+		return err == io.EOF
+	}, 3*time.Second, 50*time.Millisecond)
+	assert.Nil(t, session.Server.resumableSession("token"))
+	assert.ErrorIs(t, session.reattach(newOpenChannel()), errSessionClosed)
+}
+
+func TestSession_DetachWithoutToken(t *testing.T) {
+	video, err := newTestPipelines(320, 240, 1).Subscribe(DefaultDisplay)
+	require.NoError(t, err)
+	channel := newOpenChannel()
+	session := &Session{
+		Server:         &Server{config: &config.Config{Auth: config.Auth{ResumeGraceSeconds: 30}}},
+		MessageChannel: channel,
+		Video:          video,
+	}
+
+	// A session that can't be resumed closes with its channel
+	session.detach(channel)
+	_, err = video.ReadFrame()
+	assert.Equal(t, io.EOF, err)
+	assert.ErrorIs(t, session.reattach(newOpenChannel()), errSessionClosed)
+}
@@ -0,0 +1,157 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+
+	"github.com/adamroach/webrd/pkg/config"
+	"github.com/pion/turn/v4"
+)
+
+// TurnServer relays media for clients that can't reach webrdd directly,
+// such as those behind symmetric NATs. Each session gets credentials of its
+// own, which stop working when it ends.
+type TurnServer struct {
+	server *turn.Server
+	realm  string
+	urls   []string // how clients reach the server, over UDP and TCP
+
+	mu    sync.Mutex        // protects access to users
+	users map[string][]byte // auth keys, by user name
+}
+
+// NewTurnServer starts a TURN server that listens on the configured port,
+// over both UDP and TCP.
+func NewTurnServer(cfg *config.Turn) (*TurnServer, error) {
+	ip, err := turnPublicIP(cfg.PublicIP)
+	if err != nil {
+		return nil, err
+	}
+	address := net.JoinHostPort("", strconv.Itoa(cfg.Port))
+	udp, err := net.ListenPacket("udp", address)
+	if err != nil {
+		return nil, fmt.Errorf("could not listen for TURN over UDP: %v", err)
+	}
+	tcp, err := net.Listen("tcp", address)
+	if err != nil {
+		udp.Close()
+		return nil, fmt.Errorf("could not listen for TURN over TCP: %v", err)
+	}
+
+	t := &TurnServer{
+		realm: cfg.Realm,
+		urls: []string{
+			turnURL(ip, udp.LocalAddr(), "udp"),
+			turnURL(ip, tcp.Addr(), "tcp"),
+		},
+		users: make(map[string][]byte),
+	}
+	t.server, err = turn.NewServer(turn.ServerConfig{
+		Realm:       cfg.Realm,
+		AuthHandler: t.authenticate,
+		PacketConnConfigs: []turn.PacketConnConfig{{
+			PacketConn:            udp,
+			RelayAddressGenerator: relayAddressGenerator(cfg, ip),
+		}},
+		ListenerConfigs: []turn.ListenerConfig{{
+			Listener:              tcp,
+			RelayAddressGenerator: relayAddressGenerator(cfg, ip),
+		}},
+	})
+	if err != nil {
+		udp.Close()
+		tcp.Close()
+		return nil, fmt.Errorf("could not start TURN server: %v", err)
+	}
+	log.Printf("TURN server listening at %v", t.urls)
+	return t, nil
+}
+
+// turnPublicIP returns the address that clients reach the server at: the
+// configured one, or failing that, the first one of this host that isn't a
+// loopback address.
+func turnPublicIP(configured string) (net.IP, error) {
+	if configured != "" {
+		ip := net.ParseIP(configured)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid TURN public IP %q", configured)
+		}
+		return ip, nil
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, fmt.Errorf("could not list network interfaces: %v", err)
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.To4() != nil && !ipNet.IP.IsLoopback() {
+			return ipNet.IP, nil
+		}
+	}
+	return nil, errors.New("no address for the TURN server; set turn.public_ip")
+}
+
+func turnURL(ip net.IP, addr net.Addr, transport string) string {
+	_, port, _ := net.SplitHostPort(addr.String())
+	return fmt.Sprintf("turn:%s?transport=%s", net.JoinHostPort(ip.String(), port), transport)
+}
+
+// relayAddressGenerator allocates relayed addresses from the configured
+// range of ports, if there is one.
+func relayAddressGenerator(cfg *config.Turn, ip net.IP) turn.RelayAddressGenerator {
+	if cfg.RelayMinPort > 0 && cfg.RelayMaxPort >= cfg.RelayMinPort {
+		return &turn.RelayAddressGeneratorPortRange{
+			RelayAddress: ip,
+			Address:      "0.0.0.0",
+			MinPort:      uint16(cfg.RelayMinPort),
+			MaxPort:      uint16(cfg.RelayMaxPort),
+		}
+	}
+	return &turn.RelayAddressGeneratorStatic{
+		RelayAddress: ip,
+		Address:      "0.0.0.0",
+	}
+}
+
+// NewCredentials returns the server's entry for a client's list of ICE
+// servers, with a new user name and password.
+func (t *TurnServer) NewCredentials() (config.IceServer, error) {
+	username, err := randomToken(16)
+	if err != nil {
+		return config.IceServer{}, err
+	}
+	password, err := randomToken(32)
+	if err != nil {
+		return config.IceServer{}, err
+	}
+	t.mu.Lock()
+	t.users[username] = turn.GenerateAuthKey(username, t.realm, password)
+	t.mu.Unlock()
+	return config.IceServer{
+		Urls:       t.urls,
+		Username:   &username,
+		Credential: &password,
+	}, nil
+}
+
+// Revoke stops the credentials for a user name from working. Allocations
+// made with them can't be refreshed, so they expire soon after.
+func (t *TurnServer) Revoke(username string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.users, username)
+}
+
+func (t *TurnServer) authenticate(username, realm string, _ net.Addr) ([]byte, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	key, ok := t.users[username]
+	return key, ok
+}
+
+func (t *TurnServer) Close() error {
+	return t.server.Close()
+}
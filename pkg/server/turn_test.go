@@ -0,0 +1,69 @@
+package server
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/adamroach/webrd/pkg/config"
+	"github.com/pion/turn/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// allocate asks the TURN server at url for a relayed address.
+func allocate(t *testing.T, url, username, password string) error {
+	t.Helper()
+	address, _, _ := strings.Cut(strings.TrimPrefix(url, "turn:"), "?")
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer conn.Close()
+	client, err := turn.NewClient(&turn.ClientConfig{
+		STUNServerAddr: address,
+		TURNServerAddr: address,
+		Conn:           conn,
+		Username:       username,
+		Password:       password,
+		Realm:          "webrd",
+	})
+	require.NoError(t, err)
+	defer client.Close()
+	require.NoError(t, client.Listen())
+	relay, err := client.Allocate()
+	if err != nil {
+		return err
+	}
+	return relay.Close()
+}
+
+func TestTurnServer(t *testing.T) {
+	server, err := NewTurnServer(&config.Turn{PublicIP: "127.0.0.1", Realm: "webrd"})
+	require.NoError(t, err)
+	defer server.Close()
+
+	iceServer, err := server.NewCredentials()
+	require.NoError(t, err)
+	require.Len(t, iceServer.Urls, 2)
+	assert.True(t, strings.HasSuffix(iceServer.Urls[0], "?transport=udp"))
+	assert.True(t, strings.HasSuffix(iceServer.Urls[1], "?transport=tcp"))
+	other, err := server.NewCredentials()
+	require.NoError(t, err)
+	assert.NotEqual(t, *iceServer.Username, *other.Username)
+	assert.NotEqual(t, *iceServer.Credential, *other.Credential)
+
+	username, password := *iceServer.Username, *iceServer.Credential
+	assert.NoError(t, allocate(t, iceServer.Urls[0], username, password))
+	assert.Error(t, allocate(t, iceServer.Urls[0], username, "wrong"))
+
+	// Credentials stop working once they are revoked
+	server.Revoke(username)
+	assert.Error(t, allocate(t, iceServer.Urls[0], username, password))
+}
+
+func TestTurnPublicIP(t *testing.T) {
+	ip, err := turnPublicIP("192.0.2.1")
+	require.NoError(t, err)
+	assert.Equal(t, "192.0.2.1", ip.String())
+	_, err = turnPublicIP("not an address")
+	assert.Error(t, err)
+}
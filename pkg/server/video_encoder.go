@@ -1,77 +1,104 @@
 package server
 
 import (
+	"fmt"
 	"image"
 	"io"
 	"log"
+	"math"
+	"sync/atomic"
+	"time"
 
 	"github.com/adamroach/webrd/pkg/capture"
+	"github.com/adamroach/webrd/pkg/config"
+	"github.com/adamroach/webrd/pkg/encode"
+	"github.com/adamroach/webrd/pkg/imageconvert"
 	"github.com/pion/mediadevices/pkg/codec"
-	"github.com/pion/mediadevices/pkg/codec/openh264"
 	"github.com/pion/mediadevices/pkg/frame"
 	"github.com/pion/mediadevices/pkg/prop"
 )
 
 type VideoReader struct {
 	capturer capture.VideoCapturer
-	image    image.Image
+	frame    *capture.Frame
 }
 
-func (r *VideoReader) waitForImage() {
-	// Wait for an image to be available
-	r.image = <-r.capturer.FrameChannel()
+func (r *VideoReader) waitForFrame() {
+	// Wait for a frame to be available
+	r.frame = <-r.capturer.FrameChannel()
 }
 
 func (r *VideoReader) Read() (img image.Image, release func(), err error) {
 	release = func() {}
-	if r.image == nil {
-		r.waitForImage()
+	if r.frame == nil {
+		r.waitForFrame()
 	}
-	if r.image == nil {
+	if r.frame == nil {
 		err = io.EOF
+		return
 	}
-	img = r.image
-	r.image = nil
+	img = r.frame.Image
+	r.frame = nil
 	return
 }
 
+const (
+	// rebuildThreshold is the relative bitrate change that is worth
+	// rebuilding an encoder for, when it can't change bitrate on the fly.
+	rebuildThreshold = 0.2
+	// rebuildInterval is the least time between such rebuilds, each of which
+	// starts with a keyframe.
+	rebuildInterval = 2 * time.Second
+)
+
 type VideoEncoder struct {
-	reader    *VideoReader
-	encoder   codec.ReadCloser
-	bitrate   int
-	framerate int
-	width     int
-	height    int
+	reader        *VideoReader
+	codec         encode.VideoCodec
+	encoder       codec.ReadCloser
+	bitrate       int
+	framerate     int
+	width         int
+	height        int
+	built         time.Time
+	minInterval   time.Duration // frames are taken no more often than this; zero means as they come
+	nextFrame     time.Time
+	refreshPeriod int // frames over which the picture is refreshed, if the codec can; zero means keyframes only
+	forceKeyFrame atomic.Bool
+	targetBitrate atomic.Int64
 }
 
-func NewVideoEncoder(capturer capture.VideoCapturer, bitrate int, framerate int) (*VideoEncoder, error) {
+func NewVideoEncoder(capturer capture.VideoCapturer, videoCodec encode.VideoCodec, bitrate int, framerate int) (*VideoEncoder, error) {
 	r := &VideoEncoder{
 		reader:    &VideoReader{capturer: capturer},
+		codec:     videoCodec,
 		bitrate:   bitrate,
 		framerate: framerate,
 	}
 	return r, nil
 }
 
-func (e *VideoEncoder) Read() (b []byte, release func(), err error) {
-	release = func() {}
-	e.reader.waitForImage()
-	if e.reader.image == nil {
-		err = io.EOF
-		return
+func (e *VideoEncoder) ReadFrame() (*EncodedFrame, error) {
+	if e.minInterval > 0 {
+		// Frames that arrive in the meantime are replaced by newer ones
+		// before they get here
+		time.Sleep(time.Until(e.nextFrame))
+		e.nextFrame = time.Now().Add(e.minInterval)
 	}
-	if e.encoder == nil || e.width != e.reader.image.Bounds().Dx() || e.height != e.reader.image.Bounds().Dy() {
+	e.reader.waitForFrame()
+	captured := e.reader.frame
+	if captured == nil {
+		return nil, io.EOF
+	}
+	if target := int(e.targetBitrate.Load()); target > 0 && target != e.bitrate && e.encoder != nil {
+		e.changeBitrate(target)
+	}
+	bounds := captured.Image.Bounds()
+	if e.encoder == nil || e.width != bounds.Dx() || e.height != bounds.Dy() {
 		e.Close()
 		e.encoder = nil
-		e.width = e.reader.image.Bounds().Dx()
-		e.height = e.reader.image.Bounds().Dy()
-		log.Printf("Initializing H.264 encoder: %d x %d @ %vfps\n", e.width, e.height, e.framerate)
-		params, _ := openh264.NewParams()
-		params.BitRate = e.bitrate
-		params.EnableFrameSkip = false
-		// Suppress automatic keyframe generation
-		params.IntraPeriod = 0
-
+		e.width = bounds.Dx()
+		e.height = bounds.Dy()
+		log.Printf("Initializing %s encoder: %d x %d @ %vfps\n", e.codec.Name(), e.width, e.height, e.framerate)
 		mediaProperties := prop.Media{
 			Video: prop.Video{
 				Width:       e.width,
@@ -81,12 +108,87 @@ func (e *VideoEncoder) Read() (b []byte, release func(), err error) {
 			},
 		}
 
-		e.encoder, err = params.BuildVideoEncoder(e.reader, mediaProperties)
+		var err error
+		if refresher, ok := e.codec.(encode.IntraRefresher); ok && e.refreshPeriod > 0 {
+			e.encoder, err = refresher.NewIntraRefreshEncoder(e.reader, mediaProperties, e.bitrate, e.refreshPeriod)
+		} else {
+			e.encoder, err = e.codec.NewEncoder(e.reader, mediaProperties, e.bitrate)
+		}
 		if err != nil {
-			return
+			captured.Release()
+			return nil, err
+		}
+		e.built = time.Now()
+	}
+	if e.forceKeyFrame.Swap(false) {
+		if keyFrameController, ok := e.encoder.Controller().(codec.KeyFrameController); ok {
+			keyFrameController.ForceKeyFrame()
+		} else {
+			log.Print("Cannot force key frame: encoder has no KeyFrameController")
 		}
 	}
-	return e.encoder.Read()
+	data, release, err := e.encoder.Read()
+	// Encoding is synchronous, so the image can be reused now. The release
+	// function from VideoReader.Read would be neater, but the encoder's
+	// conversion to I420 doesn't pass it on.
+	captured.Release()
+	if err != nil {
+		return nil, err
+	}
+	signalled, err := e.codec.Describe(data, image.Pt(e.width, e.height), captured.ColorSpace)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	return &EncodedFrame{
+		Data:        signalled,
+		CaptureTime: captured.Time,
+		KeyFrame:    e.codec.IsKeyFrame(signalled),
+		Size:        image.Pt(e.width, e.height),
+		release:     release,
+	}, nil
+}
+
+// ForceKeyFrame makes the next frame a keyframe. Unlike the underlying
+// encoder's controller, it is safe to call while a frame is being encoded.
+func (e *VideoEncoder) ForceKeyFrame() error {
+	e.forceKeyFrame.Store(true)
+	return nil
+}
+
+// IntraRefresh reports whether the encoder recovers from loss by itself,
+// without keyframes.
+func (e *VideoEncoder) IntraRefresh() bool {
+	_, ok := e.codec.(encode.IntraRefresher)
+	return ok && e.refreshPeriod > 0
+}
+
+// SetBitRate changes the bitrate from the next frame on. It is safe to call
+// while a frame is being encoded.
+func (e *VideoEncoder) SetBitRate(bitrate int) error {
+	e.targetBitrate.Store(int64(bitrate))
+	return nil
+}
+
+// changeBitrate passes a new bitrate on to the encoder. Encoders that can't
+// change bitrate on the fly are rebuilt instead, but only for a significant
+// change, and not too often.
+func (e *VideoEncoder) changeBitrate(bitrate int) {
+	if controller, ok := e.encoder.Controller().(codec.BitRateController); ok {
+		if err := controller.SetBitRate(bitrate); err != nil {
+			log.Printf("Could not change %s bitrate: %v", e.codec.Name(), err)
+		}
+		e.bitrate = bitrate
+		return
+	}
+	change := math.Abs(float64(bitrate-e.bitrate)) / float64(e.bitrate)
+	if change < rebuildThreshold || time.Since(e.built) < rebuildInterval {
+		return
+	}
+	log.Printf("Rebuilding %s encoder for %d bits/s", e.codec.Name(), bitrate)
+	e.Close()
+	e.encoder = nil
+	e.bitrate = bitrate
 }
 
 func (e *VideoEncoder) Close() error {
@@ -97,8 +199,49 @@ func (e *VideoEncoder) Close() error {
 }
 
 func (e *VideoEncoder) Controller() codec.EncoderController {
-	if e.encoder == nil {
-		return nil
+	return e
+}
+
+// checkVideoFormat validates the configured colors.
+func checkVideoFormat(video *config.Video) error {
+	if _, err := capture.ParseVideoFormat(*video); err != nil {
+		return fmt.Errorf("invalid video format: %v", err)
+	}
+	return nil
+}
+
+// checkVideoCodecs creates the configured codecs, in order of preference.
+// An empty list means the default codec.
+func checkVideoCodecs(video *config.Video) ([]encode.VideoCodec, error) {
+	if len(video.Codecs) == 0 {
+		video.Codecs = []string{encode.DefaultVideoCodec}
+	}
+	codecs, err := encode.NewVideoCodecs(video)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkColorSpace(codecs, video); err != nil {
+		return nil, err
+	}
+	return codecs, nil
+}
+
+// checkColorSpace refuses codecs that browsers decode with a color space
+// other than the configured one, since the colors would be off.
+func checkColorSpace(codecs []encode.VideoCodec, video *config.Video) error {
+	for _, c := range codecs {
+		fixed, ok := c.(encode.FixedColorSpace)
+		if !ok {
+			continue
+		}
+		colorSpace, err := imageconvert.ParseColorSpace(video.ColorMatrix, video.ColorRange)
+		if err != nil {
+			return fmt.Errorf("invalid video format: %v", err)
+		}
+		if fixed.ColorSpace() != colorSpace {
+			return fmt.Errorf("browsers decode %s as %v, but video is converted as %v; set video.color_matrix and video.color_range to match, or remove %s from video.codecs",
+				c.Name(), fixed.ColorSpace(), colorSpace, c.Name())
+		}
 	}
-	return e.encoder.Controller()
+	return nil
 }
@@ -0,0 +1,246 @@
+package server
+
+import (
+	"image"
+	"testing"
+	"time"
+
+	"github.com/adamroach/webrd/pkg/capture"
+	"github.com/adamroach/webrd/pkg/capture/synthetic"
+	"github.com/adamroach/webrd/pkg/config"
+	"github.com/adamroach/webrd/pkg/encode"
+	"github.com/adamroach/webrd/pkg/h264"
+	"github.com/adamroach/webrd/pkg/imageconvert"
+	"github.com/pion/mediadevices/pkg/codec"
+	"github.com/pion/mediadevices/pkg/io/video"
+	"github.com/pion/mediadevices/pkg/prop"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVideoEncoder_VideoSignal(t *testing.T) {
+	for _, test := range []struct {
+		colorSpace imageconvert.ColorSpace
+		expected   h264.VideoSignal
+	}{
+		{imageconvert.ColorSpace{Matrix: imageconvert.BT709}, h264.VideoSignal{ColorPrimaries: 1, Transfer: 1, Matrix: 1}},
+		{imageconvert.ColorSpace{Matrix: imageconvert.BT601, FullRange: true}, h264.VideoSignal{FullRange: true, ColorPrimaries: 1, Transfer: 1, Matrix: 6}},
+	} {
+		capturer, err := synthetic.NewVideoCapturer(30, 320, 240, synthetic.WithFormat(capture.VideoFormat{
+			ColorSpace: test.colorSpace,
+		}))
+		require.NoError(t, err)
+		require.NoError(t, capturer.Start())
+		encoder, err := NewVideoEncoder(capturer, encode.H264{}, 1_000_000, 30)
+		require.NoError(t, err)
+
+		frame, err := encoder.ReadFrame()
+		require.NoError(t, err)
+		assert.True(t, frame.KeyFrame)
+		signal, ok, err := h264.ReadVideoSignal(frame.Data)
+		require.NoError(t, err)
+		assert.True(t, ok, test.colorSpace.String())
+		assert.Equal(t, test.expected, signal, test.colorSpace.String())
+
+		frame.Release()
+		require.NoError(t, encoder.Close())
+		require.NoError(t, capturer.Stop())
+		for range capturer.FrameChannel() {
+		}
+	}
+}
+
+func TestVideoEncoder_Level(t *testing.T) {
+	// The SPS carries the level advertised in SDP, not the one openh264
+	// picked
+	capturer, err := synthetic.NewVideoCapturer(30, 320, 240)
+	require.NoError(t, err)
+	require.NoError(t, capturer.Start())
+	videoCodec := encode.H264{Framerate: 60, Bitrate: 5_000_000}
+	encoder, err := NewVideoEncoder(capturer, videoCodec, 1_000_000, 30)
+	require.NoError(t, err)
+
+	frame, err := encoder.ReadFrame()
+	require.NoError(t, err)
+	level, ok, err := h264.ReadLevel(frame.Data)
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, h264.Level(30), level)
+	assert.Contains(t, videoCodec.Parameters(image.Pt(320, 240))[0].SDPFmtpLine, "profile-level-id=42e01e")
+
+	frame.Release()
+	require.NoError(t, encoder.Close())
+	require.NoError(t, capturer.Stop())
+	for range capturer.FrameChannel() {
+	}
+}
+
+func TestCheckVideoFormat(t *testing.T) {
+	video := config.Video{ColorMatrix: "bt709", ColorRange: "full"}
+	require.NoError(t, checkVideoFormat(&video))
+
+	video = config.Video{ColorMatrix: "bt709", ColorRange: "studio"}
+	assert.ErrorContains(t, checkVideoFormat(&video), "invalid video format")
+}
+
+func TestCheckVideoCodecs(t *testing.T) {
+	video := config.Video{}
+	codecs, err := checkVideoCodecs(&video)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"h264"}, video.Codecs)
+	require.Len(t, codecs, 1)
+	assert.Equal(t, "h264", codecs[0].Name())
+
+	video = config.Video{Codecs: []string{"h264", "theora"}}
+	_, err = checkVideoCodecs(&video)
+	assert.Error(t, err)
+}
+
+// bt601Codec is a codec that, like VP8, is always decoded as limited range
+// BT.601
+type bt601Codec struct {
+	encode.H264
+}
+
+func (bt601Codec) ColorSpace() imageconvert.ColorSpace {
+	return imageconvert.ColorSpace{Matrix: imageconvert.BT601}
+}
+
+func TestCheckColorSpace(t *testing.T) {
+	codecs := []encode.VideoCodec{encode.H264{}, bt601Codec{}}
+	video := config.Video{ColorMatrix: "bt601", ColorRange: "limited"}
+	assert.NoError(t, checkColorSpace(codecs, &video))
+
+	// Frames converted any other way would be decoded with the wrong colors
+	video = config.Video{ColorMatrix: "bt709", ColorRange: "limited"}
+	assert.ErrorContains(t, checkColorSpace(codecs, &video), "bt601 limited range")
+	video = config.Video{ColorMatrix: "bt601", ColorRange: "full"}
+	assert.Error(t, checkColorSpace(codecs, &video))
+
+	// Codecs that describe their colors take any color space
+	assert.NoError(t, checkColorSpace(codecs[:1], &video))
+}
+
+// channelCapturer is a VideoCapturer whose frames are supplied by the test
+type channelCapturer chan *capture.Frame
+
+func (c channelCapturer) Start() error                        { return nil }
+func (c channelCapturer) Stop() error                         { return nil }
+func (c channelCapturer) GetBounds() image.Rectangle          { return image.Rectangle{} }
+func (c channelCapturer) FrameChannel() <-chan *capture.Frame { return c }
+
+func TestVideoEncoder_ReleasesFrames(t *testing.T) {
+	frames := make(channelCapturer, 1)
+	capturer := frames
+	encoder, err := NewVideoEncoder(capturer, encode.H264{}, 1_000_000, 30)
+	require.NoError(t, err)
+	defer encoder.Close()
+
+	// Once a frame has been encoded, its image goes back to the pool
+	pool := capture.NewFramePool()
+	bounds := image.Rect(0, 0, 320, 240)
+	frame := pool.Get(bounds, image.YCbCrSubsampleRatio420)
+	img := frame.Image
+	frames <- frame
+	encoded, err := encoder.ReadFrame()
+	require.NoError(t, err)
+	encoded.Release()
+	assert.Same(t, img, pool.Get(bounds, image.YCbCrSubsampleRatio420).Image)
+}
+
+func TestVideoEncoder_SetBitRate(t *testing.T) {
+	capturer, err := synthetic.NewVideoCapturer(30, 320, 240)
+	require.NoError(t, err)
+	require.NoError(t, capturer.Start())
+	defer func() {
+		require.NoError(t, capturer.Stop())
+		for range capturer.FrameChannel() {
+		}
+	}()
+	encoder, err := NewVideoEncoder(capturer, encode.H264{}, 1_000_000, 30)
+	require.NoError(t, err)
+	defer encoder.Close()
+	readFrame := func() *EncodedFrame {
+		frame, err := encoder.ReadFrame()
+		require.NoError(t, err)
+		frame.Release()
+		return frame
+	}
+	assert.True(t, readFrame().KeyFrame)
+
+	// openh264 can't change bitrate on the fly, so a big change rebuilds
+	// it, but not straight after it was built
+	require.NoError(t, encoder.SetBitRate(500_000))
+	assert.False(t, readFrame().KeyFrame)
+	assert.Equal(t, 1_000_000, encoder.bitrate)
+	encoder.built = encoder.built.Add(-rebuildInterval)
+	assert.True(t, readFrame().KeyFrame)
+	assert.Equal(t, 500_000, encoder.bitrate)
+
+	// A small change isn't worth a keyframe
+	encoder.built = encoder.built.Add(-rebuildInterval)
+	require.NoError(t, encoder.SetBitRate(550_000))
+	assert.False(t, readFrame().KeyFrame)
+	assert.Equal(t, 500_000, encoder.bitrate)
+}
+
+func TestVideoEncoder_MinInterval(t *testing.T) {
+	capturer, err := synthetic.NewVideoCapturer(60, 64, 64)
+	require.NoError(t, err)
+	require.NoError(t, capturer.Start())
+	defer func() {
+		require.NoError(t, capturer.Stop())
+		for range capturer.FrameChannel() {
+		}
+	}()
+	encoder, err := NewVideoEncoder(capturer, encode.H264{}, 1_000_000, 10)
+	require.NoError(t, err)
+	defer encoder.Close()
+	encoder.minInterval = 100 * time.Millisecond
+
+	start := time.Now()
+	for range 4 {
+		frame, err := encoder.ReadFrame()
+		require.NoError(t, err)
+		frame.Release()
+	}
+	assert.GreaterOrEqual(t, time.Since(start), 300*time.Millisecond)
+}
+
+// refreshingH264 pretends that openh264 can refresh the picture gradually
+type refreshingH264 struct {
+	encode.H264
+	period *int
+}
+
+func (c refreshingH264) NewIntraRefreshEncoder(r video.Reader, media prop.Media, bitrate, period int) (codec.ReadCloser, error) {
+	*c.period = period
+	return c.NewEncoder(r, media, bitrate)
+}
+
+func TestVideoEncoder_IntraRefresh(t *testing.T) {
+	capturer, err := synthetic.NewVideoCapturer(30, 64, 64)
+	require.NoError(t, err)
+	require.NoError(t, capturer.Start())
+	defer func() {
+		require.NoError(t, capturer.Stop())
+		for range capturer.FrameChannel() {
+		}
+	}()
+	period := 0
+	encoder, err := NewVideoEncoder(capturer, refreshingH264{period: &period}, 1_000_000, 30)
+	require.NoError(t, err)
+	defer encoder.Close()
+	assert.False(t, encoder.IntraRefresh())
+
+	encoder.refreshPeriod = 30
+	assert.True(t, encoder.IntraRefresh())
+	frame, err := encoder.ReadFrame()
+	require.NoError(t, err)
+	frame.Release()
+	assert.Equal(t, 30, period)
+
+	// Codecs that can't refresh gradually carry on with keyframes
+	encoder.codec = encode.H264{}
+	assert.False(t, encoder.IntraRefresh())
+}
@@ -0,0 +1,651 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/adamroach/webrd/pkg/capture"
+	"github.com/adamroach/webrd/pkg/config"
+	"github.com/adamroach/webrd/pkg/encode"
+	"github.com/adamroach/webrd/pkg/imageconvert"
+	"github.com/pion/mediadevices/pkg/codec"
+)
+
+// DefaultDisplay subscribes to whichever display a new capturer starts on,
+// which is normally the primary display.
+const DefaultDisplay = -1
+
+// errVideoDisabled is returned when the video capture backend is "null".
+var errVideoDisabled = errors.New("video capture is disabled")
+
+// pipelineKey identifies pipelines that produce identical output, and can
+// therefore be shared.
+type pipelineKey struct {
+	display   int
+	codec     string
+	bitrate   int // the highest bitrate; subscribers may ask for less
+	framerate int
+	maxSize   image.Point // frames are scaled down to fit; zero means no limit
+	scale     float64     // frames are scaled down to this fraction of the display's size
+}
+
+// preferences are what a subscriber asks of its pipeline.
+type preferences struct {
+	maxSize image.Point // the size the subscriber asked for; zero means no preference
+	codec   string
+	quality quality
+}
+
+// VideoPipelines keeps track of the running capture-and-encode pipelines,
+// so that sessions viewing the same display at the same quality and size
+// share a single encoder. Each display is only captured once; pipelines
+// for different qualities, sizes and codecs branch off the shared capturer,
+// and only scale and encode separately. Pipelines are started by the first
+// subscriber, and stopped when their last subscriber goes away. The cursor
+// of each display is polled once for all of the sessions viewing it, in the
+// same way.
+type VideoPipelines struct {
+	makeCapturer   func() (capture.VideoCapturer, error)
+	config         *config.Config
+	mu             sync.Mutex // protects access to pipelines, sources, cursors and defaultDisplay
+	pipelines      map[pipelineKey]*VideoPipeline
+	sources        map[int]*capture.Splitter // the shared capturers, by display
+	cursors        map[int]*cursorPoller     // the shared cursor pollers, by display
+	defaultDisplay *int
+}
+
+func NewVideoPipelines(makeCapturer func() (capture.VideoCapturer, error), config *config.Config) *VideoPipelines {
+	return &VideoPipelines{
+		makeCapturer: makeCapturer,
+		config:       config,
+		pipelines:    make(map[pipelineKey]*VideoPipeline),
+		sources:      make(map[int]*capture.Splitter),
+		cursors:      make(map[int]*cursorPoller),
+	}
+}
+
+// Subscribe returns a subscription to the pipeline for the given display,
+// starting one if necessary. Frames are no larger than the configured
+// maximum size until the subscriber asks for something smaller, and are
+// encoded with the preferred codec until the subscriber picks another.
+func (p *VideoPipelines) Subscribe(display int) (*VideoSubscription, error) {
+	codec := encode.DefaultVideoCodec
+	if len(p.config.Video.Codecs) > 0 {
+		codec = p.config.Video.Codecs[0]
+	}
+	adapter := newAdapter(&p.config.Video)
+	s := &VideoSubscription{
+		pipelines: p,
+		frames:    make(chan *EncodedFrame, 4),
+		done:      make(chan struct{}),
+		adapter:   adapter,
+		prefs:     preferences{codec: codec, quality: adapter.quality()},
+		waiting:   true,
+	}
+	pipeline, err := p.subscribe(display, s.prefs, s)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	s.pipeline = pipeline
+	s.mu.Unlock()
+	return s, nil
+}
+
+// maxSize combines the configured maximum frame size with the size that a
+// subscriber has asked for, taking the smaller limit in each dimension.
+func (p *VideoPipelines) maxSize(requested image.Point) image.Point {
+	limit := func(configured, requested int) int {
+		if configured <= 0 || (requested > 0 && requested < configured) {
+			return max(requested, 0)
+		}
+		return configured
+	}
+	return image.Pt(
+		limit(p.config.Video.MaxWidth, requested.X),
+		limit(p.config.Video.MaxHeight, requested.Y),
+	)
+}
+
+func (p *VideoPipelines) subscribe(display int, prefs preferences, s *VideoSubscription) (*VideoPipeline, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if display == DefaultDisplay && p.defaultDisplay != nil {
+		display = *p.defaultDisplay
+	}
+	key := pipelineKey{
+		display:   display,
+		codec:     prefs.codec,
+		bitrate:   p.config.Video.Bitrate,
+		framerate: prefs.quality.framerate,
+		maxSize:   p.maxSize(prefs.maxSize),
+		scale:     prefs.quality.scale,
+	}
+	if pipeline, ok := p.pipelines[key]; ok {
+		pipeline.addSubscriber(s)
+		return pipeline, nil
+	}
+
+	videoCodec, err := encode.NewVideoCodec(key.codec, &p.config.Video)
+	if err != nil {
+		return nil, err
+	}
+	source, err := p.source(display)
+	if err != nil {
+		return nil, err
+	}
+	var capturer capture.VideoCapturer = source
+	// A branch that doesn't make it into a pipeline is stopped, which stops
+	// the shared capturer too if nobody else is using it
+	started := false
+	defer func() {
+		if !started {
+			if err := capturer.Stop(); err != nil {
+				log.Printf("could not stop video capturer: %v", err)
+			}
+		}
+	}()
+	if key.display == DefaultDisplay {
+		key.display = capture.CurrentDisplay(source).ID
+		if pipeline, ok := p.pipelines[key]; ok {
+			pipeline.addSubscriber(s)
+			return pipeline, nil
+		}
+	}
+	if maxSize := scaledSize(key.maxSize, capturer.GetBounds().Size(), key.scale); maxSize != (image.Point{}) {
+		filter, err := imageconvert.ParseFilter(p.config.Video.Scaler)
+		if err != nil {
+			return nil, err
+		}
+		capturer = capture.NewDownscaler(capturer, maxSize.X, maxSize.Y, filter)
+	}
+	if p.config.Video.DamageTileSize > 0 {
+		capturer = capture.NewDamageTracker(capturer, p.config.Video.DamageTileSize, p.config.Video.IdleFramerate)
+	}
+	// The encoder always gets the newest frame, rather than working through
+	// a backlog while the screen moves on
+	capturer = capture.NewLatestFrames(capturer)
+	encoder, err := NewVideoEncoder(capturer, videoCodec, key.bitrate, key.framerate)
+	if err != nil {
+		return nil, fmt.Errorf("could not create video encoder: %v", err)
+	}
+	if key.framerate < p.config.Video.Framerate {
+		// The capturer still runs at the configured framerate
+		encoder.minInterval = time.Second / time.Duration(key.framerate)
+	}
+	if p.config.Video.IntraRefresh {
+		if _, ok := videoCodec.(encode.IntraRefresher); ok {
+			// The picture is refreshed once a second
+			encoder.refreshPeriod = key.framerate
+		} else {
+			log.Printf("The %s encoder can't refresh gradually; recovering from loss with keyframes", key.codec)
+		}
+	}
+	if err := capturer.Start(); err != nil {
+		return nil, fmt.Errorf("could not start video capturer: %v", err)
+	}
+	started = true
+
+	pipeline := &VideoPipeline{
+		key:         key,
+		capturer:    capturer,
+		encoder:     encoder,
+		subscribers: make(map[*VideoSubscription]struct{}),
+	}
+	pipeline.addSubscriber(s)
+	p.pipelines[key] = pipeline
+	log.Printf("Started %s video pipeline for display %d at %dfps, scaled by %.2f", key.codec, key.display, key.framerate, key.scale)
+	go pipeline.run(p)
+	return pipeline, nil
+}
+
+// source returns a new branch of the capturer for a display, creating the
+// capturer if the display isn't being captured yet. p.mu must be held.
+func (p *VideoPipelines) source(display int) (*capture.Branch, error) {
+	if splitter, ok := p.sources[display]; ok && !splitter.Stopped() {
+		return splitter.Branch(), nil
+	}
+	if p.makeCapturer == nil {
+		return nil, errVideoDisabled
+	}
+	capturer, err := p.makeCapturer()
+	if err != nil {
+		return nil, fmt.Errorf("could not create video capturer: %v", err)
+	}
+	if capturer == nil {
+		return nil, errVideoDisabled
+	}
+	// Capturers hold on to resources such as an X connection from the
+	// start, so one that isn't used is stopped
+	discard := func() {
+		if err := capturer.Stop(); err != nil {
+			log.Printf("could not stop video capturer: %v", err)
+		}
+	}
+	if display == DefaultDisplay {
+		id := capture.CurrentDisplay(capturer).ID
+		p.defaultDisplay = &id
+		display = id
+		if splitter, ok := p.sources[display]; ok && !splitter.Stopped() {
+			discard()
+			return splitter.Branch(), nil
+		}
+	} else if err := capture.SelectDisplay(capturer, display); err != nil {
+		discard()
+		return nil, err
+	}
+	log.Printf("Capturing display %d", display)
+	splitter := capture.NewSplitter(capturer)
+	p.sources[display] = splitter
+	return splitter.Branch(), nil
+}
+
+// scaledSize returns the size to scale frames down to: no more than maxSize,
+// and no more than scale times the display's size. Zero means no scaling.
+func scaledSize(maxSize, displaySize image.Point, scale float64) image.Point {
+	if scale <= 0 || scale >= 1 {
+		return maxSize
+	}
+	limit := func(max, scaled int) int {
+		if max <= 0 || scaled < max {
+			return scaled
+		}
+		return max
+	}
+	return image.Pt(
+		limit(maxSize.X, int(float64(displaySize.X)*scale)),
+		limit(maxSize.Y, int(float64(displaySize.Y)*scale)),
+	)
+}
+
+// unsubscribe removes a subscriber from a pipeline, and stops the pipeline
+// if nobody else is using it.
+func (p *VideoPipelines) unsubscribe(pipeline *VideoPipeline, s *VideoSubscription) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if remaining, removed := pipeline.removeSubscriber(s); !removed || remaining > 0 {
+		return
+	}
+	if p.pipelines[pipeline.key] == pipeline {
+		delete(p.pipelines, pipeline.key)
+	}
+	log.Printf("Stopping video pipeline for display %d (%d stale frames dropped)", pipeline.key.display, capture.DroppedFrames(pipeline.capturer))
+	if err := pipeline.capturer.Stop(); err != nil {
+		log.Printf("could not stop video capturer: %v", err)
+	}
+	p.pruneSources()
+}
+
+// pruneSources forgets about shared capturers that have stopped. p.mu must
+// be held.
+func (p *VideoPipelines) pruneSources() {
+	for display, splitter := range p.sources {
+		if splitter.Stopped() {
+			delete(p.sources, display)
+		}
+	}
+}
+
+// watchCursor moves a tracker from the cursor poller it was watching, if
+// any, to the one for a display, starting that poller if nobody is watching
+// it yet. It returns nil if the display isn't being captured.
+func (p *VideoPipelines) watchCursor(display int, t *cursorTracker, from *cursorPoller) *cursorPoller {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if from != nil {
+		p.removeCursorTracker(from, t)
+	}
+	source, ok := p.sources[display]
+	if !ok {
+		return nil
+	}
+	poller, ok := p.cursors[display]
+	if !ok || poller.source != source {
+		poller = newCursorPoller(display, source)
+		p.cursors[display] = poller
+		go poller.run()
+	}
+	poller.add(t)
+	return poller
+}
+
+// unwatchCursor stops a tracker watching a cursor poller, and stops the
+// poller if nobody else is watching it.
+func (p *VideoPipelines) unwatchCursor(poller *cursorPoller, t *cursorTracker) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.removeCursorTracker(poller, t)
+}
+
+// removeCursorTracker does the work of unwatchCursor. p.mu must be held.
+func (p *VideoPipelines) removeCursorTracker(poller *cursorPoller, t *cursorTracker) {
+	if poller.remove(t) > 0 {
+		return
+	}
+	if p.cursors[poller.display] == poller {
+		delete(p.cursors, poller.display)
+	}
+	poller.Stop()
+}
+
+// remove forgets about a pipeline that has stopped on its own.
+func (p *VideoPipelines) remove(pipeline *VideoPipeline) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.pipelines[pipeline.key] == pipeline {
+		delete(p.pipelines, pipeline.key)
+	}
+	p.pruneSources()
+}
+
+// VideoPipeline captures and encodes a single display, and publishes the
+// encoded frames to all of its subscribers.
+type VideoPipeline struct {
+	key         pipelineKey
+	capturer    capture.VideoCapturer
+	encoder     *VideoEncoder
+	mu          sync.Mutex // protects access to subscribers
+	subscribers map[*VideoSubscription]struct{}
+}
+
+func (p *VideoPipeline) addSubscriber(s *VideoSubscription) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.subscribers[s] = struct{}{}
+	p.updateBitrate()
+}
+
+// removeSubscriber returns the number of remaining subscribers, and whether
+// s was one of them.
+func (p *VideoPipeline) removeSubscriber(s *VideoSubscription) (int, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, ok := p.subscribers[s]
+	delete(p.subscribers, s)
+	p.updateBitrate()
+	return len(p.subscribers), ok
+}
+
+// updateBitrate encodes at the lowest bitrate that any subscriber can take,
+// so that nobody falls behind. p.mu must be held.
+func (p *VideoPipeline) updateBitrate() {
+	bitrate := p.key.bitrate
+	for s := range p.subscribers {
+		if requested := int(s.bitrate.Load()); requested > 0 && requested < bitrate {
+			bitrate = requested
+		}
+	}
+	p.encoder.SetBitRate(bitrate)
+}
+
+// forceKeyFrame makes the next frame a keyframe, and makes sure that there
+// is a next frame even if the screen is idle.
+func (p *VideoPipeline) forceKeyFrame() {
+	p.encoder.ForceKeyFrame()
+	if tracker, ok := p.capturer.(interface{ Refresh() }); ok {
+		tracker.Refresh()
+	}
+}
+
+func (p *VideoPipeline) run(pipelines *VideoPipelines) {
+	defer p.encoder.Close()
+	for {
+		encoded, err := p.encoder.ReadFrame()
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("Error encoding video for display %d: %v", p.key.display, err)
+			}
+			break
+		}
+		// Subscribers consume frames at their own pace, so they get a copy
+		// that doesn't depend on the encoder's buffer
+		frame := &EncodedFrame{
+			Data:        append([]byte(nil), encoded.Data...),
+			CaptureTime: encoded.CaptureTime,
+			KeyFrame:    encoded.KeyFrame,
+			Size:        encoded.Size,
+		}
+		encoded.Release()
+
+		p.mu.Lock()
+		for s := range p.subscribers {
+			s.deliver(p, frame)
+		}
+		p.mu.Unlock()
+	}
+
+	// If the pipeline stopped while it was still in use, the subscribers
+	// won't get any more frames
+	pipelines.remove(p)
+	p.mu.Lock()
+	subscribers := make([]*VideoSubscription, 0, len(p.subscribers))
+	for s := range p.subscribers {
+		subscribers = append(subscribers, s)
+	}
+	p.mu.Unlock()
+	for _, s := range subscribers {
+		s.pipelineStopped(p)
+	}
+}
+
+// VideoSubscription is a session's view of a VideoPipeline. It implements
+// Encoder, so it can be handed to a VideoSender, and can be moved to the
+// pipeline for another display at any time.
+type VideoSubscription struct {
+	pipelines *VideoPipelines
+	frames    chan *EncodedFrame
+	done      chan struct{}
+	doneOnce  sync.Once
+
+	bitrate atomic.Int64 // the bitrate the subscriber can take; zero means no limit
+
+	mu        sync.Mutex // protects access to the fields below
+	pipeline  *VideoPipeline
+	prefs     preferences
+	adapter   *adapter
+	waiting   bool // frames are dropped until the next keyframe
+	requested bool // a keyframe has been requested for this subscriber
+	closed    bool
+}
+
+// deliver queues a frame from the given pipeline. A subscriber that can't
+// keep up has frames dropped; since the frames after a gap can't be decoded,
+// it then waits for a keyframe.
+func (s *VideoSubscription) deliver(pipeline *VideoPipeline, frame *EncodedFrame) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if pipeline != s.pipeline {
+		return
+	}
+	if s.waiting {
+		if !frame.KeyFrame {
+			return
+		}
+		s.waiting = false
+		s.requested = false
+	}
+	select {
+	case s.frames <- frame:
+	default:
+		s.waiting = true
+	}
+}
+
+func (s *VideoSubscription) pipelineStopped(pipeline *VideoPipeline) {
+	s.mu.Lock()
+	current := pipeline == s.pipeline
+	s.mu.Unlock()
+	if current {
+		s.stop()
+	}
+}
+
+// stop makes ReadFrame return io.EOF.
+func (s *VideoSubscription) stop() {
+	s.doneOnce.Do(func() { close(s.done) })
+}
+
+// ReadFrame returns the next frame for this subscriber. A subscriber that
+// has just joined, switched displays or fallen behind only gets frames once
+// a keyframe arrives, so one is requested here. Waiting until the subscriber
+// is actually reading means that a stalled subscriber can't flood everyone
+// else with keyframes.
+func (s *VideoSubscription) ReadFrame() (*EncodedFrame, error) {
+	s.mu.Lock()
+	if s.waiting && !s.requested {
+		s.requested = true
+		s.pipeline.forceKeyFrame()
+	}
+	s.mu.Unlock()
+
+	select {
+	case frame := <-s.frames:
+		return frame, nil
+	case <-s.done:
+		return nil, io.EOF
+	}
+}
+
+// Controller returns the subscription itself; keyframe requests are passed
+// on to the current pipeline.
+func (s *VideoSubscription) Controller() codec.EncoderController {
+	return s
+}
+
+func (s *VideoSubscription) ForceKeyFrame() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pipeline.forceKeyFrame()
+	return nil
+}
+
+// IntraRefresh reports whether the current pipeline's encoder recovers
+// from loss without keyframes.
+func (s *VideoSubscription) IntraRefresh() bool {
+	return s.currentPipeline().encoder.IntraRefresh()
+}
+
+// Close unsubscribes from the current pipeline.
+func (s *VideoSubscription) Close() error {
+	s.mu.Lock()
+	pipeline := s.pipeline
+	closed := s.closed
+	s.closed = true
+	s.mu.Unlock()
+	s.stop()
+	if !closed {
+		s.pipelines.unsubscribe(pipeline, s)
+	}
+	return nil
+}
+
+func (s *VideoSubscription) Displays() ([]capture.Display, error) {
+	return capture.Displays(s.currentPipeline().capturer)
+}
+
+func (s *VideoSubscription) CurrentDisplay() capture.Display {
+	return capture.CurrentDisplay(s.currentPipeline().capturer)
+}
+
+// SelectDisplay moves the subscription to the pipeline for another display.
+func (s *VideoSubscription) SelectDisplay(id int) error {
+	s.mu.Lock()
+	prefs := s.prefs
+	s.mu.Unlock()
+	return s.move(id, prefs)
+}
+
+// SetMaxSize asks for frames no larger than width x height, which are
+// further limited by the configured maximum size. A dimension of zero
+// removes the subscriber's limit for that dimension. If this changes the
+// output size, the subscription moves to a pipeline that produces it.
+func (s *VideoSubscription) SetMaxSize(width, height int) error {
+	s.mu.Lock()
+	prefs := s.prefs
+	s.mu.Unlock()
+	prefs.maxSize = image.Pt(width, height)
+	return s.move(s.currentPipeline().key.display, prefs)
+}
+
+// SetCodec moves the subscription to a pipeline that encodes with the named
+// codec, e.g. once the browser has chosen one.
+func (s *VideoSubscription) SetCodec(codec string) error {
+	s.mu.Lock()
+	prefs := s.prefs
+	s.mu.Unlock()
+	prefs.codec = codec
+	return s.move(s.currentPipeline().key.display, prefs)
+}
+
+// SetBitRate sets the bitrate that the subscriber's connection can take,
+// within the configured limits. The pipeline encodes at the lowest bitrate
+// among its subscribers. When the bitrate is too low for the current
+// framerate and size, the subscription moves to a pipeline with a lower
+// framerate, and then a smaller size, and back when it recovers.
+func (s *VideoSubscription) SetBitRate(bitrate int) error {
+	video := &s.pipelines.config.Video
+	bitrate = min(max(bitrate, video.MinBitrate), video.Bitrate)
+	s.bitrate.Store(int64(bitrate))
+	pipeline := s.currentPipeline()
+	pipeline.mu.Lock()
+	pipeline.updateBitrate()
+	pipeline.mu.Unlock()
+
+	s.mu.Lock()
+	quality, changed := s.adapter.update(bitrate, pipeline.capturer.GetBounds().Size(), time.Now())
+	prefs := s.prefs
+	s.mu.Unlock()
+	if !changed {
+		return nil
+	}
+	log.Printf("Adapting video to %d bits/s: %dfps, scaled by %.2f", bitrate, quality.framerate, quality.scale)
+	prefs.quality = quality
+	return s.move(pipeline.key.display, prefs)
+}
+
+// move switches the subscription to the pipeline for the given display and
+// preferences, if that isn't the one it is already on.
+func (s *VideoSubscription) move(display int, prefs preferences) error {
+	old := s.currentPipeline()
+	pipeline, err := s.pipelines.subscribe(display, prefs, s)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	if s.closed {
+		// The subscription may have been added back to its old pipeline
+		// after Close removed it
+		s.mu.Unlock()
+		s.pipelines.unsubscribe(pipeline, s)
+		return errors.New("subscription is closed")
+	}
+	s.prefs = prefs
+	if pipeline == old {
+		s.mu.Unlock()
+		return nil
+	}
+	s.pipeline = pipeline
+	s.waiting = true
+	s.requested = false
+	s.mu.Unlock()
+	s.pipelines.unsubscribe(old, s)
+	return nil
+}
+
+// Size returns the size of the frames the subscription is currently getting.
+func (s *VideoSubscription) Size() image.Point {
+	return s.currentPipeline().capturer.GetBounds().Size()
+}
+
+func (s *VideoSubscription) currentPipeline() *VideoPipeline {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.pipeline
+}
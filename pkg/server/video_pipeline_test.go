@@ -0,0 +1,294 @@
+package server
+
+import (
+	"image"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/adamroach/webrd/pkg/capture"
+	"github.com/adamroach/webrd/pkg/capture/synthetic"
+	"github.com/adamroach/webrd/pkg/config"
+	"github.com/adamroach/webrd/pkg/encode"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestPipelines(width, height, displays int) *VideoPipelines {
+	return NewVideoPipelines(func() (capture.VideoCapturer, error) {
+		return synthetic.NewVideoCapturer(30, width, height, synthetic.WithDisplays(displays))
+	}, &config.Config{
+		Video: config.Video{Bitrate: 1_000_000, Framerate: 30},
+	})
+}
+
+func readFrame(t *testing.T, s *VideoSubscription) *EncodedFrame {
+	t.Helper()
+	result := make(chan *EncodedFrame, 1)
+	go func() {
+		frame, err := s.ReadFrame()
+		assert.NoError(t, err)
+		result <- frame
+	}()
+	select {
+	case frame := <-result:
+		require.NotNil(t, frame)
+		return frame
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "timed out waiting for frame")
+		return nil
+	}
+}
+
+func (p *VideoPipelines) count() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.pipelines)
+}
+
+func TestVideoPipelines_Shared(t *testing.T) {
+	pipelines := newTestPipelines(320, 240, 1)
+
+	first, err := pipelines.Subscribe(DefaultDisplay)
+	require.NoError(t, err)
+	assert.True(t, readFrame(t, first).KeyFrame)
+	for range 5 {
+		readFrame(t, first)
+	}
+
+	// A late subscriber shares the pipeline, and starts with a keyframe
+	second, err := pipelines.Subscribe(0)
+	require.NoError(t, err)
+	assert.Equal(t, 1, pipelines.count())
+	assert.True(t, readFrame(t, second).KeyFrame)
+
+	require.NoError(t, first.Close())
+	assert.Equal(t, 1, pipelines.count())
+	readFrame(t, second)
+
+	require.NoError(t, second.Close())
+	assert.Equal(t, 0, pipelines.count())
+	_, err = second.ReadFrame()
+	assert.Error(t, err)
+}
+
+func TestVideoPipelines_SelectDisplay(t *testing.T) {
+	pipelines := newTestPipelines(320, 240, 2)
+
+	first, err := pipelines.Subscribe(DefaultDisplay)
+	require.NoError(t, err)
+	defer first.Close()
+	second, err := pipelines.Subscribe(DefaultDisplay)
+	require.NoError(t, err)
+	defer second.Close()
+	readFrame(t, second)
+
+	require.NoError(t, second.SelectDisplay(1))
+	assert.Equal(t, 2, pipelines.count())
+	assert.Equal(t, 1, second.CurrentDisplay().ID)
+	assert.Equal(t, 0, first.CurrentDisplay().ID)
+
+	// Frames from the old pipeline are ignored until the new one produces a
+	// keyframe
+	second.mu.Lock()
+	second.frames = make(chan *EncodedFrame, 4)
+	second.mu.Unlock()
+	assert.True(t, readFrame(t, second).KeyFrame)
+	readFrame(t, first)
+
+	require.NoError(t, second.SelectDisplay(0))
+	assert.Equal(t, 1, pipelines.count())
+	assert.Error(t, second.SelectDisplay(5))
+	assert.Equal(t, 0, second.CurrentDisplay().ID)
+}
+
+// stopCounter is a synthetic capturer that counts how often it is stopped
+type stopCounter struct {
+	*synthetic.VideoCapturer
+	stops *atomic.Int32
+}
+
+func (c stopCounter) Stop() error {
+	c.stops.Add(1)
+	return c.VideoCapturer.Stop()
+}
+
+func TestVideoPipelines_FailedSubscribeStopsCapturer(t *testing.T) {
+	var stops atomic.Int32
+	p := newTestPipelines(320, 240, 2)
+	p.makeCapturer = func() (capture.VideoCapturer, error) {
+		c, err := synthetic.NewVideoCapturer(30, 320, 240, synthetic.WithDisplays(2))
+		return stopCounter{c, &stops}, err
+	}
+
+	// An unknown display
+	_, err := p.Subscribe(5)
+	assert.Error(t, err)
+	assert.Equal(t, int32(1), stops.Load())
+
+	// An unknown scaler
+	p.config.Video.MaxWidth = 100
+	p.config.Video.Scaler = "nearest-ish"
+	_, err = p.Subscribe(DefaultDisplay)
+	assert.Error(t, err)
+	assert.Equal(t, int32(2), stops.Load())
+	assert.Empty(t, p.pipelines)
+}
+
+func TestVideoPipelines_SharedCapturer(t *testing.T) {
+	var made, stops atomic.Int32
+	pipelines := newTestPipelines(320, 240, 1)
+	pipelines.config.Video.MinBitrate = 1_000
+	pipelines.config.Video.MinFramerate = 10
+	pipelines.config.Video.MinScale = 0.5
+	pipelines.makeCapturer = func() (capture.VideoCapturer, error) {
+		made.Add(1)
+		c, err := synthetic.NewVideoCapturer(30, 320, 240)
+		return stopCounter{c, &stops}, err
+	}
+
+	first, err := pipelines.Subscribe(DefaultDisplay)
+	require.NoError(t, err)
+	second, err := pipelines.Subscribe(DefaultDisplay)
+	require.NoError(t, err)
+	third, err := pipelines.Subscribe(0)
+	require.NoError(t, err)
+
+	// Pipelines at other framerates, scales and sizes branch off the same
+	// capturer
+	for range 5 {
+		first.adapter.lastChange = time.Time{}
+		require.NoError(t, first.SetBitRate(2_000))
+	}
+	require.NoError(t, second.SetMaxSize(160, 0))
+	assert.Equal(t, 3, pipelines.count())
+	assert.Equal(t, int32(1), made.Load())
+	assert.True(t, readFrame(t, first).KeyFrame)
+	assert.True(t, readFrame(t, second).KeyFrame)
+	assert.True(t, readFrame(t, third).KeyFrame)
+
+	// The capturer stops along with the last pipeline
+	require.NoError(t, first.Close())
+	require.NoError(t, second.Close())
+	assert.Equal(t, int32(0), stops.Load())
+	readFrame(t, third)
+	require.NoError(t, third.Close())
+	assert.Equal(t, int32(1), stops.Load())
+	assert.Empty(t, pipelines.sources)
+
+	// and a new subscriber starts a new one
+	fourth, err := pipelines.Subscribe(DefaultDisplay)
+	require.NoError(t, err)
+	defer fourth.Close()
+	assert.Equal(t, int32(2), made.Load())
+	assert.True(t, readFrame(t, fourth).KeyFrame)
+}
+
+func TestVideoPipelines_MaxSize(t *testing.T) {
+	pipelines := newTestPipelines(640, 480, 2)
+	pipelines.config.Video.MaxWidth = 320
+	pipelines.config.Video.MaxHeight = 240
+
+	// The configured limit applies to everyone
+	first, err := pipelines.Subscribe(DefaultDisplay)
+	require.NoError(t, err)
+	defer first.Close()
+	assert.Equal(t, image.Pt(320, 240), first.Size())
+	frame := readFrame(t, first)
+	assert.True(t, frame.KeyFrame)
+	assert.Equal(t, image.Pt(320, 240), frame.Size)
+
+	// Asking for something smaller moves a subscriber to its own pipeline
+	second, err := pipelines.Subscribe(DefaultDisplay)
+	require.NoError(t, err)
+	defer second.Close()
+	require.NoError(t, second.SetMaxSize(160, 0))
+	assert.Equal(t, 2, pipelines.count())
+	assert.Equal(t, image.Pt(160, 120), second.Size())
+	assert.True(t, readFrame(t, second).KeyFrame)
+
+	// The requested size sticks when switching displays
+	require.NoError(t, second.SelectDisplay(1))
+	assert.Equal(t, 2, pipelines.count())
+	assert.Equal(t, 1, second.CurrentDisplay().ID)
+	assert.Equal(t, image.Pt(160, 120), second.Size())
+
+	// Asking for something larger can't exceed the configured limit
+	require.NoError(t, second.SelectDisplay(0))
+	require.NoError(t, second.SetMaxSize(1920, 1080))
+	assert.Equal(t, 1, pipelines.count())
+	assert.Equal(t, image.Pt(320, 240), second.Size())
+	assert.True(t, readFrame(t, second).KeyFrame)
+}
+
+func TestVideoPipelines_Disabled(t *testing.T) {
+	pipelines := NewVideoPipelines(func() (capture.VideoCapturer, error) {
+		return nil, nil
+	}, &config.Config{})
+	_, err := pipelines.Subscribe(DefaultDisplay)
+	assert.Equal(t, errVideoDisabled, err)
+}
+
+func TestVideoPipelines_Codec(t *testing.T) {
+	pipelines := newTestPipelines(320, 240, 1)
+
+	s, err := pipelines.Subscribe(DefaultDisplay)
+	require.NoError(t, err)
+	defer s.Close()
+	assert.Equal(t, encode.DefaultVideoCodec, s.currentPipeline().key.codec)
+
+	// Picking the codec that is already in use changes nothing
+	require.NoError(t, s.SetCodec(encode.DefaultVideoCodec))
+	assert.Equal(t, 1, pipelines.count())
+	assert.True(t, readFrame(t, s).KeyFrame)
+
+	// A codec that isn't compiled in leaves the subscription where it was
+	assert.Error(t, s.SetCodec("theora"))
+	assert.Equal(t, encode.DefaultVideoCodec, s.currentPipeline().key.codec)
+	readFrame(t, s)
+}
+
+func TestVideoPipelines_SetBitRate(t *testing.T) {
+	pipelines := newTestPipelines(320, 240, 1)
+	pipelines.config.Video.MinBitrate = 1_000
+	pipelines.config.Video.MinFramerate = 10
+	pipelines.config.Video.MinScale = 0.5
+
+	first, err := pipelines.Subscribe(DefaultDisplay)
+	require.NoError(t, err)
+	defer first.Close()
+	second, err := pipelines.Subscribe(DefaultDisplay)
+	require.NoError(t, err)
+	defer second.Close()
+	pipeline := first.currentPipeline()
+
+	// The pipeline encodes at the lowest bitrate that its subscribers can
+	// take, within the configured limits
+	require.NoError(t, first.SetBitRate(800_000))
+	assert.Equal(t, int64(800_000), pipeline.encoder.targetBitrate.Load())
+	require.NoError(t, second.SetBitRate(20_000_000))
+	assert.Equal(t, int64(800_000), pipeline.encoder.targetBitrate.Load())
+	assert.Equal(t, 1, pipelines.count())
+
+	// A subscriber that can't sustain the framerate moves to a pipeline
+	// with a lower one, and the other gets its bitrate back
+	require.NoError(t, first.SetBitRate(2_000))
+	assert.Equal(t, 2, pipelines.count())
+	assert.Equal(t, 20, first.currentPipeline().key.framerate)
+	assert.Equal(t, int64(2_000), first.currentPipeline().encoder.targetBitrate.Load())
+	assert.Equal(t, int64(1_000_000), pipeline.encoder.targetBitrate.Load())
+	assert.True(t, readFrame(t, first).KeyFrame)
+
+	// and eventually to a smaller size
+	for range 5 {
+		first.adapter.lastChange = time.Time{}
+		require.NoError(t, first.SetBitRate(2_000))
+	}
+	key := first.currentPipeline().key
+	assert.Equal(t, quality{10, 0.5}, quality{key.framerate, key.scale})
+	assert.Equal(t, image.Pt(160, 120), first.Size())
+	// Frames queued before the last move are still the old size
+	for i := 0; readFrame(t, first).Size != image.Pt(160, 120); i++ {
+		require.Less(t, i, 10)
+	}
+}
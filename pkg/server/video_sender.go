@@ -1,81 +1,131 @@
 package server
 
 import (
+	"image"
 	"log"
 	"math/rand/v2"
+	"slices"
 	"time"
 
+	"github.com/adamroach/webrd/pkg/encode"
+	"github.com/pion/interceptor/pkg/cc"
 	"github.com/pion/mediadevices/pkg/codec"
 	"github.com/pion/rtcp"
 	"github.com/pion/rtp"
-	"github.com/pion/rtp/codecs"
 	"github.com/pion/webrtc/v4"
 )
 
 type VideoSender struct {
-	encoder         codec.ReadCloser
-	track           *webrtc.TrackLocalStaticRTP
-	sender          *webrtc.RTPSender
-	packetizer      rtp.Packetizer
-	codecCapability webrtc.RTPCodecCapability
+	encoder           Encoder
+	codecs            []encode.VideoCodec
+	track             *videoTrack
+	sender            *webrtc.RTPSender
+	transceiver       *webrtc.RTPTransceiver
+	packetizer        rtp.Packetizer
+	clockRate         uint32
+	size              image.Point // the size of video that the codec was negotiated for
+	negotiationNeeded func()
+	estimator         cc.BandwidthEstimator
+	twcc              bool // the browser sends transport-wide feedback, rather than REMB
+	keyframes         *keyframer
 }
 
-func NewVideoSender(encoder codec.ReadCloser) *VideoSender {
-	return &VideoSender{
+// NewVideoSender creates a sender that offers the given codecs, in order of
+// preference.
+func NewVideoSender(encoder Encoder, codecs []encode.VideoCodec) *VideoSender {
+	s := &VideoSender{
 		encoder: encoder,
+		codecs:  codecs,
 	}
+	s.keyframes = newKeyframer(s.forceKeyFrame)
+	return s
 }
 
+// SetKeyframePolicy sets when keyframes are sent. By default, one is sent
+// for every request from the browser.
+func (s *VideoSender) SetKeyframePolicy(policy KeyframePolicy) {
+	s.keyframes.setPolicy(policy)
+}
+
+// KeyframeStats returns the number of keyframes sent so far, and why.
+func (s *VideoSender) KeyframeStats() KeyframeStats {
+	return s.keyframes.Stats()
+}
+
+// RegisterCodecs registers the codecs with parameters for the size of video
+// that the encoder is currently producing, if it can tell.
 func (s *VideoSender) RegisterCodecs(me *webrtc.MediaEngine) error {
-	s.codecCapability = webrtc.RTPCodecCapability{
-		MimeType:    webrtc.MimeTypeH264,
-		ClockRate:   90000,
-		Channels:    0,
-		SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f",
-		RTCPFeedback: []webrtc.RTCPFeedback{
-			{Type: "goog-remb", Parameter: ""},
-			{Type: "ccm", Parameter: "fir"},
-			{Type: "nack", Parameter: ""},
-		},
-	}
-	for _, codec := range []webrtc.RTPCodecParameters{
-		{
-			RTPCodecCapability: s.codecCapability,
-			PayloadType:        102,
-		},
-		{
-			RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: "video/rtx", ClockRate: 90000, Channels: 0, SDPFmtpLine: "apt=102", RTCPFeedback: nil},
-			PayloadType:        121,
-		},
-	} {
-		if err := me.RegisterCodec(codec, webrtc.RTPCodecTypeVideo); err != nil {
-			return err
+	if sized, ok := s.encoder.(interface{ Size() image.Point }); ok {
+		s.size = sized.Size()
+	}
+	for _, codec := range s.codecs {
+		for _, parameters := range codec.Parameters(s.size) {
+			if err := me.RegisterCodec(parameters, webrtc.RTPCodecTypeVideo); err != nil {
+				return err
+			}
 		}
 	}
 	return nil
 }
 
+// SetBandwidthEstimator sets the estimator that drives the bitrate when the
+// browser sends transport-wide congestion control feedback.
+func (s *VideoSender) SetBandwidthEstimator(estimator cc.BandwidthEstimator) {
+	s.estimator = estimator
+}
+
+// OnNegotiationNeeded sets a function to call when the codec parameters
+// have changed, and need to be offered to the browser again.
+func (s *VideoSender) OnNegotiationNeeded(f func()) {
+	s.negotiationNeeded = f
+}
+
 func (s *VideoSender) AddTrack(pc *webrtc.PeerConnection) error {
 	var err error
-	s.track, err = webrtc.NewTrackLocalStaticRTP(s.codecCapability, "video", "screen")
-	if err != nil {
-		return err
-	}
+	s.track = newVideoTrack(s.codecs)
 	s.sender, err = pc.AddTrack(s.track)
 	if err != nil {
 		return err
 	}
+	for _, transceiver := range pc.GetTransceivers() {
+		if transceiver.Sender() == s.sender {
+			s.transceiver = transceiver
+		}
+	}
 	return nil
 }
 
 func (s *VideoSender) Start() error {
+	codec := s.track.Codec()
+	if codec == nil {
+		return errNoVideoCodec
+	}
+	log.Printf("Sending %s video", codec.Name())
+	// The encoder may have started with another codec before the browser
+	// picked this one
+	if switcher, ok := s.encoder.(interface{ SetCodec(string) error }); ok {
+		if err := switcher.SetCodec(codec.Name()); err != nil {
+			return err
+		}
+	}
+	capability := s.track.Capability()
+	s.twcc = slices.ContainsFunc(capability.RTCPFeedback, func(feedback webrtc.RTCPFeedback) bool {
+		return feedback.Type == webrtc.TypeRTCPFBTransportCC
+	})
+	if s.twcc && s.estimator != nil {
+		log.Printf("Using transport-wide congestion control")
+		s.estimator.OnTargetBitrateChange(s.setBitrate)
+	} else {
+		log.Printf("Using REMB for congestion control")
+	}
+	s.clockRate = capability.ClockRate
 	s.packetizer = rtp.NewPacketizer(
 		1400,
-		102,
+		0, // Replaced with the negotiated payload type when written to the track
 		rand.Uint32(),
-		&codecs.H264Payloader{},
+		codec.NewPayloader(),
 		rtp.NewRandomSequencer(),
-		s.codecCapability.ClockRate,
+		s.clockRate,
 	)
 
 	go s.handleRtcp()
@@ -84,6 +134,7 @@ func (s *VideoSender) Start() error {
 }
 
 func (s *VideoSender) Close() error {
+	log.Printf("Sent %v", s.keyframes.Stats())
 	if s.encoder != nil {
 		if err := s.encoder.Close(); err != nil {
 			return err
@@ -98,18 +149,20 @@ func (s *VideoSender) Close() error {
 }
 
 func (s *VideoSender) sendMedia() {
-	lastFrameTime := time.Now()
+	// RTP timestamps are derived from capture times, so that encoding time
+	// doesn't introduce jitter into playout
+	clock := newRTPClock(s.clockRate)
 	for {
-		f, release, err := s.encoder.Read()
+		frame, err := s.encoder.ReadFrame()
 		if err != nil {
 			log.Printf("Error reading frame: %v", err)
 			return
 		}
-		delta := time.Since(lastFrameTime)
-		lastFrameTime = time.Now()
-		samples := int(90000 * delta.Seconds())
-
-		rtpPackets := s.packetizer.Packetize(f, uint32(samples))
+		if frame.KeyFrame && frame.Size != (image.Point{}) && frame.Size != s.size {
+			s.resize(frame.Size)
+		}
+		s.packetizer.SkipSamples(clock.advance(frame.CaptureTime))
+		rtpPackets := s.packetizer.Packetize(frame.Data, 0)
 		for _, pkt := range rtpPackets {
 			buffer, err := pkt.Marshal()
 			if err != nil {
@@ -122,7 +175,58 @@ func (s *VideoSender) sendMedia() {
 				return
 			}
 		}
-		release()
+		s.keyframes.sent(frame.KeyFrame, time.Now())
+		frame.Release()
+	}
+}
+
+// resize offers the codec again when the video has grown beyond the level
+// that was negotiated for it. Smaller video, such as that from congestion
+// control scaling down, fits within the negotiated level, so it doesn't
+// need a new offer.
+func (s *VideoSender) resize(size image.Point) {
+	codec, ok := s.track.Codec().(encode.Leveled)
+	if !ok || codec.Level(size) <= codec.Level(s.size) {
+		return
+	}
+	if s.transceiver == nil {
+		return
+	}
+	parameters := codec.Parameters(size)
+	if err := s.transceiver.SetCodecPreferences(parameters); err != nil {
+		log.Printf("Could not update %s parameters: %v", codec.Name(), err)
+		return
+	}
+	s.size = size
+	log.Printf("Renegotiating %s for %d x %d video: %s", codec.Name(), size.X, size.Y, parameters[0].SDPFmtpLine)
+	if s.negotiationNeeded != nil {
+		go s.negotiationNeeded()
+	}
+}
+
+func (s *VideoSender) forceKeyFrame() {
+	if keyFrameController, ok := s.encoder.Controller().(codec.KeyFrameController); ok {
+		if err := keyFrameController.ForceKeyFrame(); err != nil {
+			log.Printf("Could not force key frame: %v", err)
+		}
+	} else {
+		log.Print("Cannot force key frame: encoder has no KeyFrameController")
+	}
+}
+
+// intraRefresh reports whether the encoder recovers from loss without
+// keyframes.
+func (s *VideoSender) intraRefresh() bool {
+	refresher, ok := s.encoder.(interface{ IntraRefresh() bool })
+	return ok && refresher.IntraRefresh()
+}
+
+// setBitrate passes a bandwidth estimate on to the encoder.
+func (s *VideoSender) setBitrate(bitrate int) {
+	if controller, ok := s.encoder.Controller().(codec.BitRateController); ok {
+		if err := controller.SetBitRate(bitrate); err != nil {
+			log.Printf("Could not set bitrate: %v", err)
+		}
 	}
 }
 
@@ -143,19 +247,12 @@ func (s *VideoSender) handleRtcp() {
 		for _, message := range messages {
 			switch msg := message.(type) {
 			case *rtcp.PictureLossIndication:
-				log.Printf("Received PLI: %v", msg)
-				keyFrameController, _ := s.encoder.Controller().(codec.KeyFrameController)
-				if keyFrameController != nil {
-					log.Print("Forcing key frame")
-					keyFrameController.ForceKeyFrame()
-				} else {
-					log.Print("Cannot force key frame: KeyFrameController is nil")
-				}
+				s.keyframes.request(causePLI, s.intraRefresh(), time.Now())
 			case *rtcp.FullIntraRequest:
-				log.Printf("Received FIR: %v", msg)
-				keyFrameController, _ := s.encoder.Controller().(codec.KeyFrameController)
-				if keyFrameController != nil {
-					keyFrameController.ForceKeyFrame()
+				s.keyframes.request(causeFIR, false, time.Now())
+			case *rtcp.ReceiverEstimatedMaximumBitrate:
+				if !s.twcc {
+					s.setBitrate(int(msg.Bitrate))
 				}
 			default:
 				// Handle other RTCP messages if needed
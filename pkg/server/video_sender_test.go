@@ -0,0 +1,91 @@
+package server
+
+import (
+	"image"
+	"io"
+	"testing"
+
+	"github.com/adamroach/webrd/pkg/config"
+	"github.com/adamroach/webrd/pkg/encode"
+	"github.com/pion/mediadevices/pkg/codec"
+	"github.com/pion/webrtc/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// sizedEncoder is an Encoder that produces no frames, but knows how big
+// they would be
+type sizedEncoder image.Point
+
+func (e sizedEncoder) ReadFrame() (*EncodedFrame, error)   { return nil, io.EOF }
+func (e sizedEncoder) Controller() codec.EncoderController { return nil }
+func (e sizedEncoder) Close() error                        { return nil }
+func (e sizedEncoder) Size() image.Point                   { return image.Point(e) }
+
+// connectBrowser answers an offer from c with a peer connection that accepts
+// every default codec.
+func connectBrowser(t *testing.T, c *WebRTCConnection, browser *webrtc.PeerConnection, offer string) {
+	t.Helper()
+	require.NoError(t, browser.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: offer}))
+	answer, err := browser.CreateAnswer(nil)
+	require.NoError(t, err)
+	require.NoError(t, browser.SetLocalDescription(answer))
+	require.NoError(t, c.SetAnswer(answer.SDP))
+}
+
+func TestVideoSender_Renegotiate(t *testing.T) {
+	h264, err := encode.NewH264(&config.Video{Framerate: 30, Bitrate: 1_000_000})
+	require.NoError(t, err)
+	sender := NewVideoSender(sizedEncoder{1280, 720}, []encode.VideoCodec{h264})
+	c, err := NewWebRTCConnection(WithVideoSender(sender))
+	require.NoError(t, err)
+	defer c.Close()
+	browser, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	require.NoError(t, err)
+	defer browser.Close()
+
+	// The level is advertised for the encoder's size
+	offer, err := c.GetOffer()
+	require.NoError(t, err)
+	assert.Contains(t, offer, "profile-level-id=42e01f")
+	connectBrowser(t, c, browser, offer)
+	require.NotNil(t, sender.track.Codec())
+
+	negotiationNeeded := make(chan struct{}, 1)
+	c.OnNegotiationNeeded(func() { negotiationNeeded <- struct{}{} })
+
+	// A size that needs the same level doesn't need a new offer
+	sender.resize(image.Pt(1024, 768))
+	assert.Empty(t, negotiationNeeded)
+
+	sender.resize(image.Pt(2560, 1600))
+	<-negotiationNeeded
+	offer, err = c.CreateOffer()
+	require.NoError(t, err)
+	assert.Contains(t, offer, "profile-level-id=42e032")
+	assert.NotContains(t, offer, "profile-level-id=42e01f")
+	connectBrowser(t, c, browser, offer)
+
+	// Shrinking, and growing back within the negotiated level, don't either
+	sender.resize(image.Pt(1280, 720))
+	sender.resize(image.Pt(2560, 1600))
+	assert.Empty(t, negotiationNeeded)
+}
+
+func TestVideoSender_CongestionControl(t *testing.T) {
+	video := &config.Video{Framerate: 30, Bitrate: 1_000_000, MinBitrate: 300_000}
+	h264, err := encode.NewH264(video)
+	require.NoError(t, err)
+	sender := NewVideoSender(sizedEncoder{1280, 720}, []encode.VideoCodec{h264})
+	c, err := NewWebRTCConnection(WithVideoSender(sender), WithCongestionControl(video))
+	require.NoError(t, err)
+	defer c.Close()
+	require.NotNil(t, sender.estimator)
+	assert.Equal(t, video.Bitrate, sender.estimator.GetTargetBitrate())
+
+	// The browser is asked for transport-wide feedback
+	offer, err := c.GetOffer()
+	require.NoError(t, err)
+	assert.Contains(t, offer, "transport-cc")
+	assert.Contains(t, offer, "transport-wide-cc")
+}
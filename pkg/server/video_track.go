@@ -0,0 +1,111 @@
+package server
+
+import (
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/adamroach/webrd/pkg/encode"
+	"github.com/pion/webrtc/v4"
+)
+
+var errNoVideoCodec = errors.New("browser accepted none of the configured video codecs")
+
+// videoTrack is a video track that can carry any of several codecs. Which
+// one is decided when the track is bound, by taking the first codec in the
+// browser's answer that we can encode.
+type videoTrack struct {
+	codecs []encode.VideoCodec
+
+	mu         sync.RWMutex // protects access to the fields below
+	codec      encode.VideoCodec
+	capability webrtc.RTPCodecCapability
+	track      *webrtc.TrackLocalStaticRTP
+}
+
+func newVideoTrack(codecs []encode.VideoCodec) *videoTrack {
+	return &videoTrack{codecs: codecs}
+}
+
+func (t *videoTrack) Bind(ctx webrtc.TrackLocalContext) (webrtc.RTPCodecParameters, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.track == nil {
+		codec, capability, err := t.negotiate(ctx.CodecParameters())
+		if err != nil {
+			return webrtc.RTPCodecParameters{}, err
+		}
+		track, err := webrtc.NewTrackLocalStaticRTP(capability, t.ID(), t.StreamID())
+		if err != nil {
+			return webrtc.RTPCodecParameters{}, err
+		}
+		t.codec = codec
+		t.capability = capability
+		t.track = track
+	}
+	return t.track.Bind(ctx)
+}
+
+// negotiate returns the first of the negotiated codecs that is one of ours
+func (t *videoTrack) negotiate(negotiated []webrtc.RTPCodecParameters) (encode.VideoCodec, webrtc.RTPCodecCapability, error) {
+	for _, parameters := range negotiated {
+		for _, codec := range t.codecs {
+			if strings.EqualFold(parameters.MimeType, codec.MimeType()) {
+				return codec, parameters.RTPCodecCapability, nil
+			}
+		}
+	}
+	return nil, webrtc.RTPCodecCapability{}, errNoVideoCodec
+}
+
+func (t *videoTrack) Unbind(ctx webrtc.TrackLocalContext) error {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if t.track == nil {
+		return nil
+	}
+	return t.track.Unbind(ctx)
+}
+
+func (t *videoTrack) ID() string {
+	return "video"
+}
+
+func (t *videoTrack) RID() string {
+	return ""
+}
+
+func (t *videoTrack) StreamID() string {
+	return "screen"
+}
+
+func (t *videoTrack) Kind() webrtc.RTPCodecType {
+	return webrtc.RTPCodecTypeVideo
+}
+
+// Codec returns the codec that the track was bound with, or nil if it
+// hasn't been bound yet.
+func (t *videoTrack) Codec() encode.VideoCodec {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.codec
+}
+
+// Capability returns the format that the track was bound with.
+func (t *videoTrack) Capability() webrtc.RTPCodecCapability {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.capability
+}
+
+// Write sends a marshaled RTP packet, whose payload type is replaced with
+// the one negotiated for the codec.
+func (t *videoTrack) Write(b []byte) (int, error) {
+	t.mu.RLock()
+	track := t.track
+	t.mu.RUnlock()
+	if track == nil {
+		return 0, errNoVideoCodec
+	}
+	return track.Write(b)
+}
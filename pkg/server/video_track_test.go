@@ -0,0 +1,29 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/adamroach/webrd/pkg/encode"
+	"github.com/pion/webrtc/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVideoTrack_Negotiate(t *testing.T) {
+	track := newVideoTrack([]encode.VideoCodec{encode.H264{}})
+
+	// The first negotiated codec that we support wins
+	codec, capability, err := track.negotiate([]webrtc.RTPCodecParameters{
+		{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: "video/AV1", ClockRate: 90000}, PayloadType: 45},
+		{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: "video/h264", ClockRate: 90000, SDPFmtpLine: "packetization-mode=1"}, PayloadType: 108},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "h264", codec.Name())
+	assert.Equal(t, "packetization-mode=1", capability.SDPFmtpLine)
+
+	_, _, err = track.negotiate([]webrtc.RTPCodecParameters{
+		{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000}, PayloadType: 96},
+	})
+	assert.Equal(t, errNoVideoCodec, err)
+	assert.Nil(t, track.Codec())
+}
@@ -3,9 +3,12 @@ package server
 import (
 	"fmt"
 	"log"
+	"sync/atomic"
 
 	"github.com/adamroach/webrd/pkg/config"
 	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/cc"
+	"github.com/pion/interceptor/pkg/gcc"
 	"github.com/pion/webrtc/v4"
 )
 
@@ -14,6 +17,16 @@ type WebRTCConnection struct {
 	videoSender Sender
 	audioSender Sender
 	iceServers  []webrtc.ICEServer
+	video       *config.Video // congestion control is off if nil
+	estimator   cc.BandwidthEstimator
+	trickle     bool        // candidates are passed on as they are gathered, rather than put in the offer
+	started     atomic.Bool // the senders are started when the connection first comes up
+	recovery    *iceRecovery
+	iceRestart  func()
+	failed      func(reason string)
+	// inputChannels opens data channels for input from the client
+	inputChannels bool
+	input         func(message any)
 }
 
 func NewWebRTCConnection(opts ...func(*WebRTCConnection) error) (*WebRTCConnection, error) {
@@ -43,6 +56,12 @@ func NewWebRTCConnection(opts ...func(*WebRTCConnection) error) (*WebRTCConnecti
 	if err != nil {
 		return nil, fmt.Errorf("error registering default interceptors: %v", err)
 	}
+	if c.videoSender != nil && c.video != nil {
+		err = c.registerCongestionControl(me, ir)
+		if err != nil {
+			return nil, fmt.Errorf("error registering congestion control: %v", err)
+		}
+	}
 
 	se := webrtc.SettingEngine{}
 	pcConfig := webrtc.Configuration{}
@@ -55,26 +74,87 @@ func NewWebRTCConnection(opts ...func(*WebRTCConnection) error) (*WebRTCConnecti
 	if err != nil {
 		return nil, fmt.Errorf("error creating peer connection: %v", err)
 	}
+	if sender, ok := c.videoSender.(interface{ SetBandwidthEstimator(cc.BandwidthEstimator) }); ok && c.estimator != nil {
+		sender.SetBandwidthEstimator(c.estimator)
+	}
 
+	if c.inputChannels {
+		if err := c.openInputChannels(); err != nil {
+			return nil, err
+		}
+	}
+
+	c.recovery = newICERecovery(c.restartICE, c.fail)
 	c.pc.OnConnectionStateChange(c.HandleConnectionStateChange)
 
 	return c, nil
 }
 
+// registerCongestionControl adds transport-wide sequence numbers to the
+// packets that are sent, and a Google congestion control (GCC) estimator that
+// works out the available bandwidth from the browser's feedback on them. The
+// estimator is created along with the peer connection.
+func (c *WebRTCConnection) registerCongestionControl(me *webrtc.MediaEngine, ir *interceptor.Registry) error {
+	congestionController, err := cc.NewInterceptor(func() (cc.BandwidthEstimator, error) {
+		return gcc.NewSendSideBWE(
+			gcc.SendSideBWEInitialBitrate(c.video.Bitrate),
+			gcc.SendSideBWEMinBitrate(c.video.MinBitrate),
+			gcc.SendSideBWEMaxBitrate(c.video.Bitrate),
+			// Pacing would hold packets back; they go out as soon as a
+			// frame is encoded, and the encoder's bitrate does the rest
+			gcc.SendSideBWEPacer(gcc.NewNoOpPacer()),
+		)
+	})
+	if err != nil {
+		return err
+	}
+	congestionController.OnNewPeerConnection(func(id string, estimator cc.BandwidthEstimator) {
+		c.estimator = estimator
+	})
+	ir.Add(congestionController)
+	return webrtc.ConfigureTWCCHeaderExtensionSender(me, ir)
+}
+
+// HandleConnectionStateChange starts the senders once the connection is
+// first up, and restarts ICE when it is lost.
 func (c *WebRTCConnection) HandleConnectionStateChange(state webrtc.PeerConnectionState) {
-	switch state {
-	case webrtc.PeerConnectionStateConnected:
+	log.Printf("Connection state: %s", state)
+	if state == webrtc.PeerConnectionStateConnected && c.started.CompareAndSwap(false, true) {
 		err := c.start()
 		if err != nil {
 			log.Printf("error starting connection: %v", err)
-			// TODO handle failure
+			c.recovery.stop()
+			// Failing closes the connection, which can't be done from
+			// within its own callback
+			go c.fail(fmt.Sprintf("could not start sending media: %v", err))
+			return
 		}
-	case webrtc.PeerConnectionStateDisconnected:
-		// TODO Handle disconnected state
-	case webrtc.PeerConnectionStateFailed:
-		// TODO Handle failed state
-	case webrtc.PeerConnectionStateClosed:
-		// TODO Handle closed state
+	}
+	c.recovery.update(state)
+}
+
+// OnICERestartNeeded sets a function to call when the connection has been
+// lost, and an offer from RestartICE needs to be sent to the client.
+func (c *WebRTCConnection) OnICERestartNeeded(f func()) {
+	c.iceRestart = f
+}
+
+// OnFailed sets a function to call when the connection is lost for good,
+// or can't be used at all.
+func (c *WebRTCConnection) OnFailed(f func(reason string)) {
+	c.failed = f
+}
+
+func (c *WebRTCConnection) restartICE() {
+	if c.iceRestart != nil {
+		c.iceRestart()
+	}
+}
+
+func (c *WebRTCConnection) fail(reason string) {
+	log.Printf("Connection failed: %s", reason)
+	if c.failed != nil {
+		c.failed(reason)
 	}
 }
 
@@ -85,6 +165,15 @@ func WithVideoSender(sender *VideoSender) func(c *WebRTCConnection) error {
 	}
 }
 
+// WithCongestionControl adapts the video bitrate to the bandwidth that is
+// available, within the configured limits.
+func WithCongestionControl(video *config.Video) func(c *WebRTCConnection) error {
+	return func(c *WebRTCConnection) error {
+		c.video = video
+		return nil
+	}
+}
+
 func WithAudioSender(sender *AudioSender) func(c *WebRTCConnection) error {
 	return func(c *WebRTCConnection) error {
 		c.audioSender = sender
@@ -113,7 +202,7 @@ func WithICEServers(iceServers []config.IceServer) func(c *WebRTCConnection) err
 
 func (c *WebRTCConnection) GetOffer() (string, error) {
 	if c.audioSender != nil {
-		log.Printf("Adding video track")
+		log.Printf("Adding audio track")
 		err := c.audioSender.AddTrack(c.pc)
 		if err != nil {
 			return "", fmt.Errorf("error adding audio track: %v", err)
@@ -126,7 +215,23 @@ func (c *WebRTCConnection) GetOffer() (string, error) {
 			return "", fmt.Errorf("error adding video track: %v", err)
 		}
 	}
-	offer, err := c.pc.CreateOffer(nil)
+	return c.CreateOffer()
+}
+
+// CreateOffer returns a new offer for the connection's current tracks, for
+// the first negotiation or for renegotiating one that is established.
+func (c *WebRTCConnection) CreateOffer() (string, error) {
+	return c.createOffer(nil)
+}
+
+// RestartICE returns an offer that starts ICE over with new credentials,
+// so that the connection can recover after the network changes.
+func (c *WebRTCConnection) RestartICE() (string, error) {
+	return c.createOffer(&webrtc.OfferOptions{ICERestart: true})
+}
+
+func (c *WebRTCConnection) createOffer(options *webrtc.OfferOptions) (string, error) {
+	offer, err := c.pc.CreateOffer(options)
 	if err != nil {
 		return "", fmt.Errorf("error creating offer: %v", err)
 	}
@@ -134,10 +239,46 @@ func (c *WebRTCConnection) GetOffer() (string, error) {
 	if err != nil {
 		return "", fmt.Errorf("error setting local description: %v", err)
 	}
-	<-webrtc.GatheringCompletePromise(c.pc)
+	if !c.trickle {
+		<-webrtc.GatheringCompletePromise(c.pc)
+	}
 	return c.pc.LocalDescription().SDP, nil
 }
 
+// OnICECandidate sets a function to receive local ICE candidates as they
+// are gathered, so that offers can be sent without waiting for all of them.
+// The function is called with nil once gathering is complete. It must be
+// set before the first offer is created.
+func (c *WebRTCConnection) OnICECandidate(f func(candidate *Candidate)) {
+	c.trickle = true
+	c.pc.OnICECandidate(func(candidate *webrtc.ICECandidate) {
+		if candidate == nil {
+			f(nil)
+			return
+		}
+		init := candidate.ToJSON()
+		trickled := &Candidate{Candidate: init.Candidate}
+		if init.SDPMid != nil {
+			trickled.SdpMid = *init.SDPMid
+		}
+		if init.SDPMLineIndex != nil {
+			trickled.SdpMLineIndex = int(*init.SDPMLineIndex)
+		}
+		if init.UsernameFragment != nil {
+			trickled.UsernameFragment = *init.UsernameFragment
+		}
+		f(trickled)
+	})
+}
+
+// OnNegotiationNeeded sets a function to call when the senders need the
+// connection to be renegotiated.
+func (c *WebRTCConnection) OnNegotiationNeeded(f func()) {
+	if sender, ok := c.videoSender.(interface{ OnNegotiationNeeded(func()) }); ok {
+		sender.OnNegotiationNeeded(f)
+	}
+}
+
 func (c *WebRTCConnection) SetAnswer(answer string) error {
 	parsedAnswer := webrtc.SessionDescription{
 		Type: webrtc.SDPTypeAnswer,
@@ -182,6 +323,7 @@ func (c *WebRTCConnection) start() error {
 }
 
 func (c *WebRTCConnection) Close() error {
+	c.recovery.stop()
 	if c.audioSender != nil {
 		err := c.audioSender.Close()
 		if err != nil {
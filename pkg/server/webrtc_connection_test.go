@@ -0,0 +1,162 @@
+package server
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/adamroach/webrd/pkg/config"
+	"github.com/adamroach/webrd/pkg/encode"
+	"github.com/pion/webrtc/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWebRTCConnection_TrickleICE(t *testing.T) {
+	h264, err := encode.NewH264(&config.Video{Framerate: 30, Bitrate: 1_000_000})
+	require.NoError(t, err)
+	c, err := NewWebRTCConnection(WithVideoSender(NewVideoSender(sizedEncoder{640, 480}, []encode.VideoCodec{h264})))
+	require.NoError(t, err)
+	defer c.Close()
+	browser, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	require.NoError(t, err)
+	defer browser.Close()
+
+	candidates := make(chan *Candidate, 100)
+	c.OnICECandidate(func(candidate *Candidate) { candidates <- candidate })
+	offer, err := c.GetOffer()
+	require.NoError(t, err)
+	connectBrowser(t, c, browser, offer)
+
+	connected := make(chan struct{})
+	browser.OnICEConnectionStateChange(func(state webrtc.ICEConnectionState) {
+		if state == webrtc.ICEConnectionStateConnected {
+			close(connected)
+		}
+	})
+	count := 0
+	for candidate := range candidates {
+		if candidate == nil {
+			break
+		}
+		count++
+		index := uint16(candidate.SdpMLineIndex)
+		require.NoError(t, browser.AddICECandidate(webrtc.ICECandidateInit{
+			Candidate:     candidate.Candidate,
+			SDPMid:        &candidate.SdpMid,
+			SDPMLineIndex: &index,
+		}))
+	}
+	assert.Positive(t, count)
+	select {
+	case <-connected:
+	case <-time.After(10 * time.Second):
+		t.Fatal("ICE did not connect")
+	}
+}
+
+func TestWebRTCConnection_RestartICE(t *testing.T) {
+	h264, err := encode.NewH264(&config.Video{Framerate: 30, Bitrate: 1_000_000})
+	require.NoError(t, err)
+	c, err := NewWebRTCConnection(WithVideoSender(NewVideoSender(sizedEncoder{640, 480}, []encode.VideoCodec{h264})))
+	require.NoError(t, err)
+	defer c.Close()
+	browser, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	require.NoError(t, err)
+	defer browser.Close()
+	connected := make(chan struct{}, 2)
+	browser.OnICEConnectionStateChange(func(state webrtc.ICEConnectionState) {
+		if state == webrtc.ICEConnectionStateConnected {
+			connected <- struct{}{}
+		}
+	})
+
+	offer, err := c.GetOffer()
+	require.NoError(t, err)
+	connectBrowser(t, c, browser, offer)
+	waitFor(t, connected)
+	ufrag := iceUfrag(browser.RemoteDescription().SDP)
+	require.NotEmpty(t, ufrag)
+
+	// The restart offer has new credentials, and the connection comes back
+	// with them
+	offer, err = c.RestartICE()
+	require.NoError(t, err)
+	connectBrowser(t, c, browser, offer)
+	assert.NotEqual(t, ufrag, iceUfrag(browser.RemoteDescription().SDP))
+	waitFor(t, connected)
+}
+
+func TestWebRTCConnection_InputChannels(t *testing.T) {
+	c, err := NewWebRTCConnection(WithInputChannels())
+	require.NoError(t, err)
+	defer c.Close()
+	input := make(chan any, 10)
+	c.OnInput(func(message any) { input <- message })
+	browser, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	require.NoError(t, err)
+	defer browser.Close()
+	opened := make(chan *webrtc.DataChannel, 2)
+	browser.OnDataChannel(func(channel *webrtc.DataChannel) {
+		channel.OnOpen(func() { opened <- channel })
+	})
+
+	offer, err := c.GetOffer()
+	require.NoError(t, err)
+	connectBrowser(t, c, browser, offer)
+	channels := map[string]*webrtc.DataChannel{}
+	for range 2 {
+		select {
+		case channel := <-opened:
+			channels[channel.Label()] = channel
+		case <-time.After(10 * time.Second):
+			t.Fatal("data channels did not open")
+		}
+	}
+
+	// Pointer motion may be lost rather than hold up later input
+	pointer := channels[pointerChannelLabel]
+	require.NotNil(t, pointer)
+	assert.False(t, pointer.Ordered())
+	require.NotNil(t, pointer.MaxRetransmits())
+	assert.Zero(t, *pointer.MaxRetransmits())
+	reliable := channels[inputChannelLabel]
+	require.NotNil(t, reliable)
+	assert.True(t, reliable.Ordered())
+
+	// Only input is taken from the data channels
+	require.NoError(t, reliable.SendText(`{"type":"select_display","id":1}`))
+	require.NoError(t, reliable.SendText(`{"type":"mouse_button","button":0,"x":0.5,"y":0.5,"down":true}`))
+	require.NoError(t, pointer.SendText(`{"type":"mouse_move","x":0.25,"y":0.75,"seq":1}`))
+	received := []any{}
+	for range 2 {
+		select {
+		case message := <-input:
+			received = append(received, message)
+		case <-time.After(10 * time.Second):
+			t.Fatal("input did not arrive")
+		}
+	}
+	assert.ElementsMatch(t, []any{
+		&MouseButtonMessage{Type: TypeMouseButton, Button: 0, X: 0.5, Y: 0.5, Down: true},
+		&MouseMoveMessage{Type: TypeMouseMove, X: 0.25, Y: 0.75, Seq: 1},
+	}, received)
+}
+
+func iceUfrag(sdp string) string {
+	for line := range strings.Lines(sdp) {
+		if ufrag, ok := strings.CutPrefix(line, "a=ice-ufrag:"); ok {
+			return strings.TrimSpace(ufrag)
+		}
+	}
+	return ""
+}
+
+func waitFor(t *testing.T, events chan struct{}) {
+	t.Helper()
+	select {
+	case <-events:
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out")
+	}
+}
@@ -2,18 +2,29 @@ package server
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
 )
 
+// writeTimeout is how long a message may take to send before the client is
+// given up on.
+const writeTimeout = 10 * time.Second
+
+var errWebSocketClosed = errors.New("websocket is closed")
+
 type WebSocket struct {
-	conn *websocket.Conn
-	send chan []byte
-	recv chan []byte
+	conn   *websocket.Conn
+	mu     sync.Mutex // protects access to send and closed
+	send   chan []byte
+	closed bool
+	recv   chan []byte
 }
 
 func ServeWs(server *Server, w http.ResponseWriter, r *http.Request) {
@@ -63,6 +74,11 @@ func (ws *WebSocket) Send(message any) error {
 	if err != nil {
 		return fmt.Errorf("failed to marshal message: %w", err)
 	}
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	if ws.closed {
+		return errWebSocketClosed
+	}
 	ws.send <- jsonMessage
 	return nil
 }
@@ -75,11 +91,14 @@ func (ws *WebSocket) Receive() (any, error) {
 	return MakeMessage(msg)
 }
 
+// Close closes the connection once the messages that have already been
+// sent are on their way.
 func (ws *WebSocket) Close() error {
-	close(ws.send)
-	err := ws.conn.Close()
-	if err != nil {
-		return fmt.Errorf("failed to close connection: %w", err)
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	if !ws.closed {
+		ws.closed = true
+		close(ws.send)
 	}
 	return nil
 }
@@ -99,6 +118,7 @@ func (ws *WebSocket) readMessages() {
 
 func (ws *WebSocket) writeMessages() {
 	for msg := range ws.send {
+		ws.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
 		err := ws.conn.WriteMessage(websocket.TextMessage, msg)
 		if err != nil {
 			log.Println("Error writing message:", err)
@@ -106,4 +126,8 @@ func (ws *WebSocket) writeMessages() {
 		}
 	}
 	ws.conn.Close()
+	// Messages sent after a failure go nowhere, rather than filling up the
+	// channel and blocking the sender
+	for range ws.send {
+	}
 }